@@ -1,7 +1,9 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,65 +11,179 @@ import (
 	"yourmail/config"
 	"yourmail/internal/database"
 	"yourmail/internal/federation"
+	"yourmail/internal/htmlmail"
 	"yourmail/internal/httpapi"
+	"yourmail/internal/logging"
 	"yourmail/internal/protocol"
 )
 
 func main() {
-	log.Println("🚀 Starting YourMail Server v2.0.0")
+	slog.Info("starting YourMail Server", "version", "2.0.0")
 
 	// Load configuration
 	cfg := config.Load()
 
+	// Install the structured logger before anything noisy runs
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		slog.Warn("invalid LOG_LEVEL, using info", "err", err)
+	}
+	if err := logging.Setup(level, cfg.LogFormat); err != nil {
+		slog.Warn("invalid LOG_FORMAT, using text", "err", err)
+		logging.Setup(level, "text")
+	}
+	if err := cfg.Validate(); err != nil {
+		slog.Error("refusing to start with invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
 	// Initialize database
-	db, err := database.NewDatabase(cfg.DatabasePath)
+	dbSource := cfg.DatabasePath
+	if cfg.DatabaseDriver == database.DriverPostgres {
+		dbSource = cfg.DatabaseURL
+	}
+	db, err := database.NewDatabase(cfg.DatabaseDriver, dbSource, database.PoolOptions{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		BusyTimeout:     cfg.DBBusyTimeout,
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		slog.Error("failed to initialize database", "err", err)
+		os.Exit(1)
 	}
-	defer db.Close()
+	db.SetBcryptCost(cfg.BcryptCost)
+	db.SetUnreadCacheTTL(cfg.UnreadCacheTTL)
+	db.SetMessageIDHost(cfg.ServerHost)
+	db.SetHTMLSanitizer(htmlmail.Lookup(cfg.HTMLPolicy).Sanitize)
+
+	// Monitor connection pool health
+	stopPoolMonitor := db.StartPoolMonitor(cfg.DBPoolMonitorInterval, cfg.DBPoolWaitWarnThreshold)
 
 	// Seed test users in development
 	if cfg.Environment == "development" {
 		if err := db.SeedTestUsers(); err != nil {
-			log.Printf("Failed to seed test users: %v", err)
+			slog.Error("failed to seed test users", "err", err)
 		}
 	}
 
+	// Grant admin rights to configured users
+	if err := db.GrantAdmin(cfg.AdminUsers); err != nil {
+		slog.Error("failed to grant admin rights", "err", err)
+	}
+
 	// Initialize federation relay
 	relay := federation.NewRelay(cfg.ServerHost, cfg.HTTPPort)
+	relay.SetGoneAfter(cfg.FederationPeerGoneAfter)
+	stopProber := relay.StartProber(cfg.FederationProbeInterval, cfg.FederationProbeTimeout)
 
 	// Initialize HTTP API server
 	httpServer := httpapi.NewServer(cfg, db, relay)
+	stopSnoozeSweeper := httpServer.StartSnoozeSweeper(cfg.SnoozeSweepInterval)
+	stopScheduledSender := httpServer.StartScheduledSender(cfg.ScheduledSendInterval)
+	stopPendingExpirer := httpServer.StartPendingExpirer(cfg.ScheduledSendInterval)
 
 	// Initialize TCP protocol server
 	tcpServer := protocol.NewServer(cfg, db)
 
+	// Initialize SMTP server for mail clients
+	var smtpServer *protocol.Server
+	if cfg.SMTPPort != "0" {
+		smtpServer = protocol.NewSMTPServer(cfg, db, relay)
+	}
+
+	// Bind every port before reporting ready, so that a port in use stops
+	// startup instead of leaving a ready server that can't be reached
+	tcpListener := listen("TCP", cfg.TCPPort)
+	var smtpListener net.Listener
+	if smtpServer != nil {
+		smtpListener = listen("SMTP", cfg.SMTPPort)
+	}
+	httpListener := listen("HTTP", cfg.HTTPPort)
+
 	// Start servers in goroutines
 	go func() {
-		log.Printf("Starting TCP server on :%s", cfg.TCPPort)
-		if err := tcpServer.Start(); err != nil {
-			log.Fatalf("TCP server failed: %v", err)
+		if err := tcpServer.Serve(tcpListener); err != nil {
+			slog.Error("TCP server failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
+	if smtpServer != nil {
+		go func() {
+			if err := smtpServer.Serve(smtpListener); err != nil {
+				slog.Error("SMTP server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	go func() {
-		log.Printf("Starting HTTP server on :%s", cfg.HTTPPort)
-		if err := httpServer.Start(); err != nil {
-			log.Fatalf("HTTP server failed: %v", err)
+		if err := httpServer.Serve(httpListener); err != nil {
+			slog.Error("HTTP server failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
+	// The database is migrated and every listener is bound, so traffic can
+	// be routed here
+	httpServer.SetReady(true)
+
 	// Wait for interrupt signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	log.Println("✅ YourMail Server is running")
-	log.Println("📧 TCP Protocol: localhost:" + cfg.TCPPort)
-	log.Println("🌐 HTTP API: http://localhost:" + cfg.HTTPPort)
-	log.Println("💾 Database: " + cfg.DatabasePath)
-	log.Println("Press Ctrl+C to stop")
+	slog.Info("YourMail Server is running",
+		"tcp", "localhost:"+cfg.TCPPort,
+		"http", "http://localhost:"+cfg.HTTPPort,
+		"database", cfg.DatabasePath)
 
 	// Block until signal received
 	<-c
-	log.Println("🛑 Shutting down YourMail Server...")
-} 
\ No newline at end of file
+	slog.Info("shutting down YourMail Server")
+	httpServer.SetReady(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+
+	// Stop taking new work and let in-flight requests finish before the
+	// database is closed
+	exitCode := 0
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("failed to shut down HTTP server", "err", err)
+		exitCode = 1
+	}
+	if err := tcpServer.Shutdown(ctx); err != nil {
+		slog.Error("failed to shut down TCP server", "err", err)
+		exitCode = 1
+	}
+	if smtpServer != nil {
+		if err := smtpServer.Shutdown(ctx); err != nil {
+			slog.Error("failed to shut down SMTP server", "err", err)
+			exitCode = 1
+		}
+	}
+	cancel()
+
+	stopScheduledSender()
+	stopPendingExpirer()
+	stopSnoozeSweeper()
+	stopProber()
+	stopPoolMonitor()
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close database", "err", err)
+		exitCode = 1
+	}
+
+	slog.Info("YourMail Server stopped")
+	os.Exit(exitCode)
+}
+
+// listen binds a server's port, exiting if it can't
+func listen(name, port string) net.Listener {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		slog.Error("failed to listen", "server", name, "port", port, "err", err)
+		os.Exit(1)
+	}
+	return listener
+}
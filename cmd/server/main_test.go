@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestRefusesDefaultJWTSecret starts the server outside development without
+// a JWT_SECRET and checks that it exits with status 1 before opening the
+// database, saying why
+func TestRefusesDefaultJWTSecret(t *testing.T) {
+	if os.Getenv("YOURMAIL_TEST_MAIN") == "1" {
+		main()
+		return
+	}
+
+	dbPath := t.TempDir() + "/db.sqlite"
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRefusesDefaultJWTSecret$")
+	cmd.Dir = t.TempDir() // No .env to pick up
+	cmd.Env = append(os.Environ(),
+		"YOURMAIL_TEST_MAIN=1",
+		"ENVIRONMENT=production",
+		"JWT_SECRET=",
+		"DATABASE_PATH="+dbPath,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Fatalf("server exited with %v, want status 1; output:\n%s", err, output.String())
+	}
+	for _, want := range []string{"refusing to start with invalid configuration", "JWT_SECRET must be set when ENVIRONMENT is not development"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("output does not say %q:\n%s", want, output.String())
+		}
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("database was created before the configuration was checked")
+	}
+}
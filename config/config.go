@@ -1,14 +1,36 @@
+// Package config loads the server's settings from the environment. It is
+// the one configuration shared by the HTTP API, the TCP and SMTP servers and
+// federation; add new settings here.
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// minJWTSecretLength is the shortest JWT_SECRET accepted outside development
+const minJWTSecretLength = 32
+
+// defaultJWTSecret is used when JWT_SECRET is unset, which is only allowed in
+// development
+const defaultJWTSecret = "your-super-secret-jwt-key-change-this-in-production"
+
+// knownJWTSecrets are placeholder secrets shipped with the repository. Anyone
+// can forge tokens signed with them.
+var knownJWTSecrets = []string{
+	defaultJWTSecret,
+	"your-random-secret-key-change-in-production", // setup.sh fallback
+	"your-secret-key", // Old README example
+}
+
 // Config holds all configuration for the application
 type Config struct {
 	// Server settings
@@ -17,18 +39,123 @@ type Config struct {
 	Host       string
 	ServerHost string
 
+	// How long shutdown waits for in-flight requests
+	ShutdownTimeout time.Duration
+
 	// Database settings
-	DatabasePath string
+	DatabaseDriver          string // "sqlite3" or "postgres"
+	DatabasePath            string // SQLite database file
+	DatabaseURL             string // PostgreSQL connection string
+	DBMaxOpenConns          int           // 0 means unlimited
+	DBMaxIdleConns          int
+	DBConnMaxLifetime       time.Duration // 0 means unlimited
+	DBBusyTimeout           time.Duration
+	DBPoolMonitorInterval   time.Duration
+	DBPoolWaitWarnThreshold int64
+	UnreadCacheTTL          time.Duration // 0 disables the unread count cache
+
+	// Mailbox limits
+	MaxInboxMessages int   // 0 means unlimited
+	MailboxQuota     int64 // Bytes per user, 0 means unlimited
+	MaxImportBytes   int64 // Largest mbox file accepted by the import
+
+	// Spam filtering; mail scoring above the threshold goes to the Spam
+	// folder. 0 disables it.
+	SpamThreshold int
+
+	// How often messages whose snooze has ended are returned to the inbox,
+	// and scheduled messages that are due are sent
+	SnoozeSweepInterval   time.Duration
+	ScheduledSendInterval time.Duration
+
+	// Attachment settings
+	MaxAttachmentBytes     int64
+	AllowedAttachmentTypes []string // Empty allows every type not blocked
+	BlockedAttachmentTypes []string
+
+	// Attachment virus scanning with clamd
+	AttachmentScanAddress  string        // Unix socket path or host:port; empty disables scanning
+	AttachmentScanTimeout  time.Duration // For scanning one file
+	AttachmentScanFailOpen bool          // Keep files that could not be scanned instead of rejecting them
 
 	// JWT settings
 	JWTSecret     string
 	JWTExpiration time.Duration
 
+	// Password hashing
+	BcryptCost int
+
 	// Environment
 	Environment string
+
+	// Minimum log level: debug, info, warn or error
+	LogLevel string
+	// Log output format: text for development, json for production
+	LogFormat string
+
+	// Usernames granted admin rights at startup
+	AdminUsers []string
 	
-	// CORS settings
+	// CORS settings. Origins may start with a wildcard subdomain, as in
+	// https://*.example.com.
 	AllowedOrigins []string
+	AllowAnyOrigin bool // Reflect every origin; development only
+
+	// Rendering settings
+	LinkifyPlaintext bool
+	HTMLPolicy       string // "relaxed" or "strict"; what HTML bodies may contain
+
+	// JSON responses at least this long are gzipped for clients that accept
+	// it; 0 disables compression
+	GzipMinBytes int
+
+	// Bearer token Prometheus must send to scrape /metrics; without one
+	// only admins may read it
+	MetricsToken string
+
+	// SSE settings
+	SSEClientBuffer int
+	SSEDropPolicy   string
+
+	// TCP protocol settings
+	TCPBanner          string
+	TCPMaxLineLength   int
+	TCPMaxMessageBytes int64         // Largest body accepted by BODY
+	TCPMaxConnections  int           // Open connections allowed per listener, TCP and SMTP alike
+	TCPIdleTimeout     time.Duration // How long a client may take to send its next command
+
+	// Federation settings
+	FederationProbeInterval         time.Duration // How often known peers are checked, 0 disables
+	FederationProbeTimeout          time.Duration
+	FederationMaxMessageBytes       int64         // Largest relay request accepted from a peer
+	FederationInlineAttachmentBytes int64         // Larger attachments are relayed as signed download links
+	FederationPendingMaxAge         time.Duration // Mail held for an unreachable server longer than this bounces
+	FederationPeerGoneAfter         time.Duration // A server down this long is given up on, 0 never gives up
+
+	// SMTP settings
+	SMTPPort            string // "0" disables the SMTP listener
+	SMTPMaxMessageBytes int64
+
+	// How long responses to requests with an Idempotency-Key are kept
+	IdempotencyTTL time.Duration
+
+	// Webhook settings
+	WebhookMaxAttempts  int           // Attempts per delivery, including the first
+	WebhookTimeout      time.Duration // Timeout of each attempt
+	WebhookFailureLimit int           // Failed deliveries in a row before a webhook is disabled
+	WebhookAllowPrivate bool          // Let webhooks reach loopback and private addresses
+
+	// System mail settings
+	ServerName            string // Name used in system mail
+	SystemMailSender      string // Local part of the system mail from address
+	SystemMailTemplateDir string // Directory of <kind>.tmpl overrides
+	WelcomeMail           bool   // Send new users a welcome message
+
+	// Email verification settings
+	PublicURL                string        // Base URL of the HTTP API as users reach it, for links
+	EmailVerificationTTL     time.Duration // How long a verification link works
+	RequireEmailVerification bool          // Refuse to send mail for unverified users
+	VerificationHookURL      string        // Receives verification tokens to email out
 }
 
 // Load loads configuration from environment variables
@@ -44,33 +171,340 @@ func Load() *Config {
 		Host:       getEnv("HOST", "localhost"),
 		ServerHost: getEnv("SERVER_HOST", "localhost"),
 
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", "30s"),
+
 		// Database
-		DatabasePath: getEnv("DATABASE_PATH", "./data/yourmail.db"),
+		DatabaseDriver:          getEnv("DATABASE_DRIVER", "sqlite3"),
+		DatabasePath:            getEnv("DATABASE_PATH", "./data/yourmail.db"),
+		DatabaseURL:             getEnv("DATABASE_URL", ""),
+		DBMaxOpenConns:          getEnvInt("DB_MAX_OPEN_CONNS", 10),
+		DBMaxIdleConns:          getEnvInt("DB_MAX_IDLE_CONNS", 5),
+		DBConnMaxLifetime:       getEnvDuration("DB_CONN_MAX_LIFETIME", "1h"),
+		DBBusyTimeout:           getEnvDuration("DB_BUSY_TIMEOUT", "5s"),
+		DBPoolMonitorInterval:   getEnvDuration("DB_POOL_MONITOR_INTERVAL", "1m"),
+		DBPoolWaitWarnThreshold: int64(getEnvInt("DB_POOL_WAIT_WARN_THRESHOLD", 10)),
+		UnreadCacheTTL:          getEnvDuration("UNREAD_CACHE_TTL", "1m"),
+
+		// Mailbox limits
+		MaxInboxMessages: getEnvInt("MAX_INBOX_MESSAGES", 0),
+		MailboxQuota:     int64(getEnvInt("MAILBOX_QUOTA", 0)),
+		MaxImportBytes:   int64(getEnvInt("MAX_IMPORT_BYTES", 100<<20)),
+
+		SpamThreshold: getEnvInt("SPAM_THRESHOLD", 4),
+
+		SnoozeSweepInterval:   getEnvDuration("SNOOZE_SWEEP_INTERVAL", "30s"),
+		ScheduledSendInterval: getEnvDuration("SCHEDULED_SEND_INTERVAL", "30s"),
+
+		// Attachments
+		MaxAttachmentBytes:     int64(getEnvInt("MAX_ATTACHMENT_BYTES", 50<<20)),
+		AllowedAttachmentTypes: getEnvList("ALLOWED_ATTACHMENT_TYPES"),
+		BlockedAttachmentTypes: getEnvList("BLOCKED_ATTACHMENT_TYPES"),
+
+		// Attachment virus scanning
+		AttachmentScanAddress:  getEnv("ATTACHMENT_SCAN_ADDRESS", ""),
+		AttachmentScanTimeout:  getEnvDuration("ATTACHMENT_SCAN_TIMEOUT", "30s"),
+		AttachmentScanFailOpen: getEnvBool("ATTACHMENT_SCAN_FAIL_OPEN", false),
 
 		// JWT
-		JWTSecret:     getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this-in-production"),
+		JWTSecret:     getEnv("JWT_SECRET", defaultJWTSecret),
 		JWTExpiration: getEnvDuration("JWT_EXPIRATION", "24h"),
 
+		// Password hashing
+		BcryptCost: getEnvInt("BCRYPT_COST", bcrypt.DefaultCost),
+
 		// Environment
 		Environment: getEnv("ENVIRONMENT", "development"),
 
+		// Logging
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", "text"),
+
+		// Admin
+		AdminUsers: getEnvList("ADMIN_USERS"),
+
 		// CORS
-		AllowedOrigins: []string{
+		AllowedOrigins: append([]string{
 			getEnv("FRONTEND_URL", "http://localhost:3000"),
 			"http://localhost:3001", // Alternative frontend port
-		},
+		}, getEnvList("CORS_ALLOWED_ORIGINS")...),
+		AllowAnyOrigin: getEnvBool("CORS_ALLOW_ANY_ORIGIN", false),
+
+		// Rendering
+		LinkifyPlaintext: getEnvBool("LINKIFY_PLAINTEXT", false),
+		HTMLPolicy:       getEnv("HTML_SANITIZE_POLICY", "relaxed"),
+
+		GzipMinBytes: getEnvInt("GZIP_MIN_BYTES", 1024),
+
+		MetricsToken: getEnv("METRICS_TOKEN", ""),
+
+		// SSE
+		SSEClientBuffer: getEnvInt("SSE_CLIENT_BUFFER", 64),
+		SSEDropPolicy:   getEnv("SSE_DROP_POLICY", "drop-oldest"),
+
+		// TCP protocol
+		TCPBanner:          getEnv("TCP_BANNER", "YourMail Server ready"),
+		TCPMaxLineLength:   getEnvInt("TCP_MAX_LINE_LENGTH", 1<<20),
+		TCPMaxMessageBytes: int64(getEnvInt("TCP_MAX_MESSAGE_BYTES", 25<<20)),
+		TCPMaxConnections:  getEnvInt("TCP_MAX_CONNECTIONS", 1000),
+		TCPIdleTimeout:     getEnvDuration("TCP_IDLE_TIMEOUT", "5m"),
+
+		// Federation
+		FederationProbeInterval:         getEnvDuration("FEDERATION_PROBE_INTERVAL", "1m"),
+		FederationProbeTimeout:          getEnvDuration("FEDERATION_PROBE_TIMEOUT", "5s"),
+		FederationMaxMessageBytes:       int64(getEnvInt("FEDERATION_MAX_MESSAGE_BYTES", 25<<20)),
+		FederationInlineAttachmentBytes: int64(getEnvInt("FEDERATION_INLINE_ATTACHMENT_BYTES", 1<<20)),
+		FederationPendingMaxAge:         getEnvDuration("FEDERATION_PENDING_MAX_AGE", "72h"),
+		FederationPeerGoneAfter:         getEnvDuration("FEDERATION_PEER_GONE_AFTER", "24h"),
+
+		// SMTP
+		SMTPPort:            getEnv("SMTP_PORT", "2525"),
+		SMTPMaxMessageBytes: int64(getEnvInt("SMTP_MAX_MESSAGE_BYTES", 25<<20)),
+
+		IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", "24h"),
+
+		// Webhooks
+		WebhookMaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 3),
+		WebhookTimeout:      getEnvDuration("WEBHOOK_TIMEOUT", "10s"),
+		WebhookFailureLimit: getEnvInt("WEBHOOK_FAILURE_LIMIT", 5),
+		WebhookAllowPrivate: getEnvBool("WEBHOOK_ALLOW_PRIVATE", false),
+
+		// System mail
+		ServerName:            getEnv("SERVER_NAME", "YourMail"),
+		SystemMailSender:      getEnv("SYSTEM_MAIL_SENDER", "postmaster"),
+		SystemMailTemplateDir: getEnv("SYSTEM_MAIL_TEMPLATE_DIR", ""),
+		WelcomeMail:           getEnvBool("WELCOME_MAIL", false),
+
+		// Email verification
+		EmailVerificationTTL:     getEnvDuration("EMAIL_VERIFICATION_TTL", "48h"),
+		RequireEmailVerification: getEnvBool("REQUIRE_EMAIL_VERIFICATION", false),
+		VerificationHookURL:      getEnv("VERIFICATION_HOOK_URL", ""),
+	}
+	config.PublicURL = strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:"+config.HTTPPort), "/")
+
+	if config.SSEClientBuffer < 1 {
+		log.Printf("Invalid SSE_CLIENT_BUFFER %d, using default: 64", config.SSEClientBuffer)
+		config.SSEClientBuffer = 64
+	}
+	if config.SSEDropPolicy != "drop-oldest" && config.SSEDropPolicy != "disconnect" {
+		log.Printf("Invalid SSE_DROP_POLICY %q, using default: drop-oldest", config.SSEDropPolicy)
+		config.SSEDropPolicy = "drop-oldest"
+	}
+	if config.JWTExpiration <= 0 {
+		log.Printf("Invalid JWT_EXPIRATION %s, using default: 24h", config.JWTExpiration)
+		config.JWTExpiration = 24 * time.Hour
+	}
+	if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+		log.Printf("Invalid BCRYPT_COST %d, using default: %d", config.BcryptCost, bcrypt.DefaultCost)
+		config.BcryptCost = bcrypt.DefaultCost
+	}
+	if config.SpamThreshold < 0 {
+		log.Printf("Invalid SPAM_THRESHOLD %d, using default: 4", config.SpamThreshold)
+		config.SpamThreshold = 4
+	}
+	// Credentials are allowed, so browsers would reject a literal "*"
+	origins := config.AllowedOrigins[:0]
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			log.Printf("Ignoring \"*\" in CORS_ALLOWED_ORIGINS; use CORS_ALLOW_ANY_ORIGIN in development")
+			continue
+		}
+		origins = append(origins, strings.TrimSuffix(origin, "/"))
+	}
+	config.AllowedOrigins = origins
+	if config.AllowAnyOrigin && config.Environment != "development" {
+		log.Printf("CORS_ALLOW_ANY_ORIGIN is only honored in development, ignoring it")
+		config.AllowAnyOrigin = false
+	}
+	if config.HTMLPolicy != "relaxed" && config.HTMLPolicy != "strict" {
+		log.Printf("Invalid HTML_SANITIZE_POLICY %q, using default: relaxed", config.HTMLPolicy)
+		config.HTMLPolicy = "relaxed"
+	}
+	if config.GzipMinBytes < 0 {
+		log.Printf("Invalid GZIP_MIN_BYTES %d, using default: 1024", config.GzipMinBytes)
+		config.GzipMinBytes = 1024
+	}
+	if config.SnoozeSweepInterval <= 0 {
+		// Snoozed mail would never come back
+		log.Printf("Invalid SNOOZE_SWEEP_INTERVAL %s, using default: 30s", config.SnoozeSweepInterval)
+		config.SnoozeSweepInterval = 30 * time.Second
+	}
+	if config.ScheduledSendInterval <= 0 {
+		// Scheduled mail would never be sent
+		log.Printf("Invalid SCHEDULED_SEND_INTERVAL %s, using default: 30s", config.ScheduledSendInterval)
+		config.ScheduledSendInterval = 30 * time.Second
+	}
+	if config.MaxAttachmentBytes < 1 {
+		log.Printf("Invalid MAX_ATTACHMENT_BYTES %d, using default: %d", config.MaxAttachmentBytes, 50<<20)
+		config.MaxAttachmentBytes = 50 << 20
+	}
+	if config.MaxImportBytes < 1 {
+		log.Printf("Invalid MAX_IMPORT_BYTES %d, using default: %d", config.MaxImportBytes, 100<<20)
+		config.MaxImportBytes = 100 << 20
+	}
+	if config.AttachmentScanTimeout <= 0 {
+		log.Printf("Invalid ATTACHMENT_SCAN_TIMEOUT %s, using default: 30s", config.AttachmentScanTimeout)
+		config.AttachmentScanTimeout = 30 * time.Second
+	}
+	if config.TCPMaxLineLength < 512 {
+		log.Printf("Invalid TCP_MAX_LINE_LENGTH %d, using minimum: 512", config.TCPMaxLineLength)
+		config.TCPMaxLineLength = 512
+	}
+	if config.TCPMaxMessageBytes < 1 {
+		log.Printf("Invalid TCP_MAX_MESSAGE_BYTES %d, using default: %d", config.TCPMaxMessageBytes, 25<<20)
+		config.TCPMaxMessageBytes = 25 << 20
+	}
+	if config.TCPMaxConnections < 1 {
+		log.Printf("Invalid TCP_MAX_CONNECTIONS %d, using default: 1000", config.TCPMaxConnections)
+		config.TCPMaxConnections = 1000
+	}
+	if config.TCPIdleTimeout < time.Second {
+		log.Printf("Invalid TCP_IDLE_TIMEOUT %s, using default: 5m", config.TCPIdleTimeout)
+		config.TCPIdleTimeout = 5 * time.Minute
+	}
+	if config.SMTPMaxMessageBytes < 1 {
+		log.Printf("Invalid SMTP_MAX_MESSAGE_BYTES %d, using default: %d", config.SMTPMaxMessageBytes, 25<<20)
+		config.SMTPMaxMessageBytes = 25 << 20
+	}
+	if config.EmailVerificationTTL <= 0 {
+		log.Printf("Invalid EMAIL_VERIFICATION_TTL %s, using default: 48h", config.EmailVerificationTTL)
+		config.EmailVerificationTTL = 48 * time.Hour
+	}
+	if config.IdempotencyTTL <= 0 {
+		log.Printf("Invalid IDEMPOTENCY_TTL %s, using default: 24h", config.IdempotencyTTL)
+		config.IdempotencyTTL = 24 * time.Hour
+	}
+	if config.DatabaseDriver != "sqlite3" && config.DatabaseDriver != "postgres" {
+		log.Printf("Invalid DATABASE_DRIVER %q, using default: sqlite3", config.DatabaseDriver)
+		config.DatabaseDriver = "sqlite3"
+	}
+	if config.DBMaxOpenConns < 0 {
+		log.Printf("Invalid DB_MAX_OPEN_CONNS %d, using default: 10", config.DBMaxOpenConns)
+		config.DBMaxOpenConns = 10
+	}
+	if config.DBMaxIdleConns < 0 {
+		log.Printf("Invalid DB_MAX_IDLE_CONNS %d, using default: 5", config.DBMaxIdleConns)
+		config.DBMaxIdleConns = 5
+	}
+	if config.DBConnMaxLifetime < 0 {
+		log.Printf("Invalid DB_CONN_MAX_LIFETIME %s, using default: 1h", config.DBConnMaxLifetime)
+		config.DBConnMaxLifetime = time.Hour
+	}
+	if config.DBBusyTimeout < 0 {
+		log.Printf("Invalid DB_BUSY_TIMEOUT %s, using default: 5s", config.DBBusyTimeout)
+		config.DBBusyTimeout = 5 * time.Second
+	}
+	if config.UnreadCacheTTL < 0 {
+		log.Printf("Invalid UNREAD_CACHE_TTL %s, using default: 1m", config.UnreadCacheTTL)
+		config.UnreadCacheTTL = time.Minute
+	}
+	if config.WebhookMaxAttempts < 1 {
+		log.Printf("Invalid WEBHOOK_MAX_ATTEMPTS %d, using default: 3", config.WebhookMaxAttempts)
+		config.WebhookMaxAttempts = 3
+	}
+	if config.WebhookFailureLimit < 1 {
+		log.Printf("Invalid WEBHOOK_FAILURE_LIMIT %d, using default: 5", config.WebhookFailureLimit)
+		config.WebhookFailureLimit = 5
+	}
+	if config.FederationProbeTimeout <= 0 {
+		log.Printf("Invalid FEDERATION_PROBE_TIMEOUT %s, using default: 5s", config.FederationProbeTimeout)
+		config.FederationProbeTimeout = 5 * time.Second
+	}
+	if config.FederationMaxMessageBytes < 1 {
+		log.Printf("Invalid FEDERATION_MAX_MESSAGE_BYTES %d, using default: %d", config.FederationMaxMessageBytes, 25<<20)
+		config.FederationMaxMessageBytes = 25 << 20
+	}
+	if config.FederationInlineAttachmentBytes < 0 {
+		log.Printf("Invalid FEDERATION_INLINE_ATTACHMENT_BYTES %d, using default: %d", config.FederationInlineAttachmentBytes, 1<<20)
+		config.FederationInlineAttachmentBytes = 1 << 20
+	}
+	if config.FederationPendingMaxAge <= 0 {
+		log.Printf("Invalid FEDERATION_PENDING_MAX_AGE %s, using default: 72h", config.FederationPendingMaxAge)
+		config.FederationPendingMaxAge = 72 * time.Hour
+	}
+	if config.FederationPeerGoneAfter < 0 {
+		log.Printf("Invalid FEDERATION_PEER_GONE_AFTER %s, using default: 24h", config.FederationPeerGoneAfter)
+		config.FederationPeerGoneAfter = 24 * time.Hour
 	}
 
 	log.Printf("✅ Configuration loaded:")
 	log.Printf("   TCP Port: %s", config.TCPPort)
 	log.Printf("   HTTP Port: %s", config.HTTPPort)
-	log.Printf("   Database: %s", config.DatabasePath)
+	if config.SMTPPort != "0" {
+		log.Printf("   SMTP Port: %s", config.SMTPPort)
+	}
+	if config.DatabaseDriver == "postgres" {
+		log.Printf("   Database: PostgreSQL")
+	} else {
+		log.Printf("   Database: %s", config.DatabasePath)
+	}
 	log.Printf("   Environment: %s", config.Environment)
+	log.Printf("   Log Level: %s", config.LogLevel)
+	log.Printf("   Log Format: %s", config.LogFormat)
 	log.Printf("   JWT Expiration: %s", config.JWTExpiration)
 
 	return config
 }
 
+// Validate reports settings the server can't start with, such as a port
+// that isn't a number, and ones that are unsafe to run with outside
+// development, such as a JWT secret anyone could look up
+func (c *Config) Validate() error {
+	if err := c.validatePorts(); err != nil {
+		return err
+	}
+
+	if c.Environment == "development" {
+		return nil
+	}
+
+	if c.JWTSecret == defaultJWTSecret || c.JWTSecret == "" {
+		return errors.New("JWT_SECRET must be set when ENVIRONMENT is not development")
+	}
+	for _, known := range knownJWTSecrets {
+		if c.JWTSecret == known {
+			return errors.New("JWT_SECRET is a published example value; generate a random one, e.g. with: openssl rand -base64 32")
+		}
+	}
+	if len(c.JWTSecret) < minJWTSecretLength {
+		return fmt.Errorf("JWT_SECRET must be at least %d characters long", minJWTSecretLength)
+	}
+	return nil
+}
+
+// validatePorts checks that every listener has a port number of its own.
+// Without it a value like TCP_PORT=abc only fails once the listener starts,
+// with an error that doesn't name the setting.
+func (c *Config) validatePorts() error {
+	ports := []struct {
+		name      string
+		value     string
+		allowZero bool // 0 turns the listener off
+	}{
+		{"HTTP_PORT", c.HTTPPort, false},
+		{"TCP_PORT", c.TCPPort, false},
+		{"SMTP_PORT", c.SMTPPort, true},
+	}
+
+	used := make(map[int]string)
+	for _, p := range ports {
+		port, err := strconv.Atoi(p.value)
+		if err != nil || port < 0 || port > 65535 || (port == 0 && !p.allowZero) {
+			if p.allowZero {
+				return fmt.Errorf("%s must be a port number from 1 to 65535, or 0 to disable, got %q", p.name, p.value)
+			}
+			return fmt.Errorf("%s must be a port number from 1 to 65535, got %q", p.name, p.value)
+		}
+		if port == 0 {
+			continue
+		}
+		if other, ok := used[port]; ok {
+			return fmt.Errorf("%s and %s are both set to %d; each listener needs its own port", other, p.name, port)
+		}
+		used[port] = p.name
+	}
+	return nil
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -79,6 +513,18 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvList gets a comma-separated environment variable as a list,
+// ignoring empty entries
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 // getEnvDuration gets an environment variable as duration or returns default
 func getEnvDuration(key, defaultValue string) time.Duration {
 	value := getEnv(key, defaultValue)
@@ -104,4 +550,20 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	
 	return intValue
-} 
\ No newline at end of file
+} 
+
+// getEnvBool gets an environment variable as bool or returns default
+func getEnvBool(key string, defaultValue bool) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean format for %s: %s, using default: %t", key, value, defaultValue)
+		return defaultValue
+	}
+
+	return boolValue
+}
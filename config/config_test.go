@@ -0,0 +1,70 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTExpiration(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", 24 * time.Hour},
+		{"15m", 15 * time.Minute},
+		{"720h", 720 * time.Hour},
+		{"0s", 24 * time.Hour},
+		{"-1h", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Setenv("JWT_EXPIRATION", tt.env)
+		if got := Load().JWTExpiration; got != tt.want {
+			t.Errorf("JWT_EXPIRATION=%q gives %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRefusesWeakJWTSecret(t *testing.T) {
+	strong := "k3V9q2Lr8xZpT6mW1nB4cY7dF0gH5jSa"
+	tests := []struct {
+		name        string
+		environment string
+		secret      string
+		wantErr     string // "" if the config is accepted
+	}{
+		{"default secret in development", "development", defaultJWTSecret, ""},
+		{"short secret in development", "development", "dev", ""},
+		{"default secret in production", "production", defaultJWTSecret, "JWT_SECRET must be set when ENVIRONMENT is not development"},
+		{"empty secret in production", "production", "", "JWT_SECRET must be set when ENVIRONMENT is not development"},
+		{"setup.sh secret in production", "production", "your-random-secret-key-change-in-production", "JWT_SECRET is a published example value"},
+		{"README secret in staging", "staging", "your-secret-key", "JWT_SECRET is a published example value"},
+		{"short secret in production", "production", "too-short-a-secret", "JWT_SECRET must be at least 32 characters long"},
+		{"strong secret in production", "production", strong, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Load()
+			cfg.Environment = tt.environment
+			cfg.JWTSecret = tt.secret
+
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Without JWT_SECRET the default is loaded, and refused
+	t.Setenv("ENVIRONMENT", "production")
+	t.Setenv("JWT_SECRET", "")
+	if err := Load().Validate(); err == nil {
+		t.Errorf("production config without JWT_SECRET accepted")
+	}
+}
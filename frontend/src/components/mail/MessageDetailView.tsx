@@ -135,7 +135,7 @@ export function MessageDetailView({
                   onMessageSent={onMessageSent}
                   replyTo={{
                     id: msg.id,
-                    from: msg.from,
+                    from: msg.reply_to || msg.from,
                     subject: msg.subject,
                     threadId: msg.thread_id,
                   }}
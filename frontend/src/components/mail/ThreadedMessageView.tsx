@@ -18,6 +18,7 @@ import {
   Paperclip,
   Download,
   Clock,
+  AlertTriangle,
 } from "lucide-react";
 import { formatDistanceToNow } from "date-fns";
 
@@ -143,7 +144,7 @@ export function ThreadedMessageView({
             onMessageSent={onMessageSent}
             replyTo={{
               id: currentMessage.id,
-              from: currentMessage.from,
+              from: currentMessage.reply_to || currentMessage.from,
               subject: currentMessage.subject,
               threadId: currentMessage.thread_id,
             }}
@@ -193,6 +194,22 @@ export function ThreadedMessageView({
                           {msg.attachments && msg.attachments.length > 0 && (
                             <Paperclip className="h-3 w-3 lg:h-4 lg:w-4 text-muted-foreground" />
                           )}
+                          {(msg.delivery_status === "failed" ||
+                            msg.delivery_status === "pending") && (
+                            <span
+                              className={`flex items-center gap-1 text-xs ${
+                                msg.delivery_status === "failed"
+                                  ? "text-destructive"
+                                  : "text-muted-foreground"
+                              }`}
+                              title={msg.delivery_error}
+                            >
+                              <AlertTriangle className="h-3 w-3 lg:h-4 lg:w-4" />
+                              {msg.delivery_status === "failed"
+                                ? "Not delivered"
+                                : "Delivery pending"}
+                            </span>
+                          )}
                         </div>
                         <div className="flex items-center gap-2 text-xs lg:text-sm text-muted-foreground">
                           <Clock className="h-3 w-3 flex-shrink-0" />
@@ -221,7 +238,7 @@ export function ThreadedMessageView({
                           onMessageSent={onMessageSent}
                           replyTo={{
                             id: msg.id,
-                            from: msg.from,
+                            from: msg.reply_to || msg.from,
                             subject: msg.subject,
                             threadId: msg.thread_id,
                           }}
@@ -1,4 +1,4 @@
-import { Message, Attachment } from "@/types/mail";
+import { Message, MessagePage, Attachment } from "@/types/mail";
 
 export interface User {
   id: number;
@@ -161,9 +161,12 @@ export class YourMailAPI {
       throw new Error("Not authenticated. Please login first.");
     }
 
+    // The inbox is shown with each message's body, which listings leave out
+    // unless asked for
     const params = new URLSearchParams({
       limit: limit.toString(),
       offset: offset.toString(),
+      body: "true",
     });
 
     const response = await fetch(`${this.baseUrl}/api/messages?${params}`, {
@@ -178,7 +181,8 @@ export class YourMailAPI {
       throw new Error(`Failed to fetch messages: ${response.status}`);
     }
 
-    return await response.json();
+    const page: MessagePage = await response.json();
+    return page.messages;
   }
 
   // Get user's sent messages
@@ -210,7 +214,8 @@ export class YourMailAPI {
       throw new Error(`Failed to fetch sent messages: ${response.status}`);
     }
 
-    return await response.json();
+    const page: MessagePage = await response.json();
+    return page.messages;
   }
 
   // Get unread message count
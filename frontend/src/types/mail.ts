@@ -14,14 +14,18 @@ export interface Message {
   to_user_id?: number;
   from: string;
   to: string;
+  reply_to?: string;
   subject: string;
   body: string;
+  preview?: string;
   is_html?: boolean;
   thread_id?: string;
   parent_id?: number;
   read: boolean;
   timestamp: string;
   created_at?: string;
+  delivery_status?: "local" | "delivered" | "failed" | "pending";
+  delivery_error?: string;
 
   // Optional virtual fields populated by backend
   from_user?: {
@@ -41,6 +45,15 @@ export interface Message {
   attachments?: Attachment[];
 }
 
+// Paginated message listing returned by /api/messages and /api/messages/sent
+export interface MessagePage {
+  messages: Message[];
+  total: number;
+  limit: number;
+  offset: number;
+  has_more: boolean;
+}
+
 export interface User {
   username: string;
   serverHost: string;
@@ -0,0 +1,98 @@
+// Package antivirus checks uploaded attachments for malware before they
+// are stored. Scanning is pluggable through the Scanner interface; ClamAV
+// talks to a clamd daemon, and Noop accepts everything.
+package antivirus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Scanner checks a file for malware. It returns the name of the threat
+// found, or "" if the file is clean. An error means the file could not be
+// scanned.
+type Scanner interface {
+	Scan(ctx context.Context, data []byte) (threat string, err error)
+}
+
+// Noop is a Scanner that finds every file clean. It is used when no
+// scanner is configured.
+type Noop struct{}
+
+// Scan implements Scanner
+func (Noop) Scan(ctx context.Context, data []byte) (string, error) {
+	return "", nil
+}
+
+// chunkSize is how much of a file is sent to clamd at a time
+const chunkSize = 64 << 10
+
+// ClamAV scans files with a clamd daemon, streaming them with its INSTREAM
+// command. Files larger than clamd's StreamMaxLength fail to scan.
+type ClamAV struct {
+	Address string        // Unix socket path, or host:port for TCP
+	Timeout time.Duration // For a whole scan; 0 leaves it to ctx
+}
+
+// Scan implements Scanner
+func (c ClamAV) Scan(ctx context.Context, data []byte) (string, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(c.Address, "/") {
+		network = "unix"
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Each chunk is preceded by its length; an empty chunk ends the stream
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send file to clamd: %w", err)
+	}
+
+	// The reply is "stream: OK", "stream: <threat> FOUND" or
+	// "<problem> ERROR"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd could not scan the file: %q", reply)
+}
@@ -9,6 +9,11 @@ type AuthUser struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	IsAdmin  bool   `json:"is_admin"`
+	// APIKeyID is the key the request was made with, or 0 for a token.
+	// Scopes limit what the key or token may do; nil allows everything.
+	APIKeyID int      `json:"api_key_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
 }
 
 // contextKey is a custom type for context keys to avoid collisions
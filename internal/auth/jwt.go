@@ -16,35 +16,95 @@ type JWTClaims struct {
 	UserID   int    `json:"user_id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	IsAdmin  bool   `json:"is_admin,omitempty"`
+	// Scopes limit what the token may do; tokens without them may do
+	// anything the account can
+	Scopes []string `json:"scopes,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// user returns the user the claims identify
+func (c *JWTClaims) user() *AuthUser {
+	return &AuthUser{
+		ID:       c.UserID,
+		Username: c.Username,
+		Email:    c.Email,
+		IsAdmin:  c.IsAdmin,
+		Scopes:   c.Scopes,
+	}
+}
+
+// AccountChecker reports whether a user's account may still be used by a
+// token issued to username. It lets the middleware reject tokens of
+// suspended, deleted or renamed accounts before they expire.
+type AccountChecker func(userID int, username string) (active bool, err error)
+
 // JWTService handles JWT operations
 type JWTService struct {
-	secretKey []byte
-	issuer    string
+	secretKey      []byte
+	issuer         string
+	expiration     time.Duration // Lifetime of generated tokens
+	accountCheck   AccountChecker
+	apiKeyResolver APIKeyResolver
 }
 
-// NewJWTService creates a new JWT service
-func NewJWTService(secretKey, issuer string) *JWTService {
+// NewJWTService creates a new JWT service whose tokens expire after
+// expiration
+func NewJWTService(secretKey, issuer string, expiration time.Duration) *JWTService {
 	return &JWTService{
-		secretKey: []byte(secretKey),
-		issuer:    issuer,
+		secretKey:  []byte(secretKey),
+		issuer:     issuer,
+		expiration: expiration,
+	}
+}
+
+// SetAccountChecker installs a check run on every authenticated request
+func (j *JWTService) SetAccountChecker(check AccountChecker) {
+	j.accountCheck = check
+}
+
+// requireActive returns an error unless the user's account is active
+func (j *JWTService) requireActive(userID int, username string) error {
+	active, err := j.checkAccount(userID, username)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return errors.New("account disabled")
 	}
+	return nil
 }
 
-// GenerateToken generates a JWT token for a user
-func (j *JWTService) GenerateToken(userID int, username, email string) (string, error) {
+// checkAccount runs the account checker, if any
+func (j *JWTService) checkAccount(userID int, username string) (bool, error) {
+	if j.accountCheck == nil {
+		return true, nil
+	}
+	return j.accountCheck(userID, username)
+}
+
+// GenerateToken generates a JWT token for a user. A nil scopes gives full
+// access, as logging in does; otherwise the token is limited to scopes.
+func (j *JWTService) GenerateToken(userID int, username, email string, isAdmin bool, scopes []string) (string, error) {
+	// An empty list would be dropped from the claims and read back as full
+	// access
+	if scopes != nil && len(scopes) == 0 {
+		return "", errors.New("a scoped token needs at least one scope")
+	}
+
+	now := time.Now()
 	claims := JWTClaims{
 		UserID:   userID,
 		Username: username,
 		Email:    email,
+		IsAdmin:  isAdmin,
+		Scopes:   scopes,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    j.issuer,
 			Subject:   strconv.Itoa(userID),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // 24 hours
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(now.Add(j.expiration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
@@ -99,6 +159,11 @@ func (j *JWTService) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(tokenString, APIKeyPrefix) {
+			j.serveWithAPIKey(w, r, tokenString, next)
+			return
+		}
+
 		// Validate token
 		claims, err := j.ValidateToken(tokenString)
 		if err != nil {
@@ -106,37 +171,86 @@ func (j *JWTService) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// Reject tokens of accounts suspended or renamed since the token was
+		// issued
+		active, err := j.checkAccount(claims.UserID, claims.Username)
+		if err != nil {
+			http.Error(w, "Failed to check account status", http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			http.Error(w, "Account disabled or renamed", http.StatusForbidden)
+			return
+		}
+
+		user := claims.user()
+		if reason := checkMethodScope(user, r.Method); reason != "" {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+
 		// Add user info to request context
-		ctx := r.Context()
-		ctx = SetUserInContext(ctx, &AuthUser{
-			ID:       claims.UserID,
-			Username: claims.Username,
-			Email:    claims.Email,
-		})
-		r = r.WithContext(ctx)
+		r = r.WithContext(SetUserInContext(r.Context(), user))
 
 		// Call next handler
 		next.ServeHTTP(w, r)
 	}
 }
 
+// serveWithAPIKey authenticates a request made with an API key. Keys are
+// checked against the database on every request, so a revoked key stops
+// working at once. Scopes are checked as for tokens.
+func (j *JWTService) serveWithAPIKey(w http.ResponseWriter, r *http.Request, key string, next http.HandlerFunc) {
+	user, err := j.resolveAPIKey(key)
+	if err != nil {
+		http.Error(w, "Failed to check API key", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if reason := checkMethodScope(user, r.Method); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(SetUserInContext(r.Context(), user)))
+}
+
+// AdminMiddleware creates a middleware that requires JWT authentication with
+// the admin claim. The claim is trusted without a database lookup, so admin
+// rights granted or revoked take effect when the user next logs in.
+func (j *JWTService) AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return j.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := GetUserFromContext(r.Context())
+		if !ok || !user.IsAdmin {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // OptionalAuthMiddleware creates a middleware that extracts user info if present but doesn't require auth
 func (j *JWTService) OptionalAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Try to extract token from header
 		tokenString, err := j.ExtractTokenFromHeader(r)
-		if err == nil {
+		if err == nil && strings.HasPrefix(tokenString, APIKeyPrefix) {
+			if user, err := j.resolveAPIKey(tokenString); err == nil && user != nil && checkMethodScope(user, r.Method) == "" {
+				r = r.WithContext(SetUserInContext(r.Context(), user))
+			}
+		} else if err == nil {
 			// Validate token if present
 			claims, err := j.ValidateToken(tokenString)
 			if err == nil {
+				err = j.requireActive(claims.UserID, claims.Username)
+			}
+			if err == nil && checkMethodScope(claims.user(), r.Method) == "" {
 				// Add user info to request context
-				ctx := r.Context()
-				ctx = SetUserInContext(ctx, &AuthUser{
-					ID:       claims.UserID,
-					Username: claims.Username,
-					Email:    claims.Email,
-				})
-				r = r.WithContext(ctx)
+				r = r.WithContext(SetUserInContext(r.Context(), claims.user()))
 			}
 		}
 
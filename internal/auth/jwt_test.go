@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGenerateTokenUsesConfiguredExpiration(t *testing.T) {
+	for _, expiration := range []time.Duration{15 * time.Minute, 24 * time.Hour, 30 * 24 * time.Hour} {
+		j := NewJWTService("test-secret", "yourmail", expiration)
+		before := time.Now().Truncate(time.Second)
+		token, err := j.GenerateToken(1, "alice", "alice@example.com", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now()
+
+		claims, err := j.ValidateToken(token)
+		if err != nil {
+			t.Fatalf("fresh token rejected: %v", err)
+		}
+		expires := claims.ExpiresAt.Time
+		if expires.Before(before.Add(expiration)) || expires.After(after.Add(expiration)) {
+			t.Errorf("token expires at %v, want %v after it was issued at %v", expires, expiration, claims.IssuedAt.Time)
+		}
+	}
+}
+
+func TestExpiredTokenRejected(t *testing.T) {
+	const secret = "test-secret"
+	j := NewJWTService(secret, "yourmail", time.Hour)
+
+	// tokenExpiring signs a token for alice like GenerateToken, but with
+	// the given expiry
+	tokenExpiring := func(expires time.Time) string {
+		t.Helper()
+		issued := expires.Add(-time.Hour)
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			UserID:   1,
+			Username: "alice",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "yourmail",
+				Subject:   strconv.Itoa(1),
+				ExpiresAt: jwt.NewNumericDate(expires),
+				IssuedAt:  jwt.NewNumericDate(issued),
+				NotBefore: jwt.NewNumericDate(issued),
+			},
+		}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	reached := false
+	handler := j.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	call := func(token string) int {
+		reached = false
+		r := httptest.NewRequest("GET", "/api/messages", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	valid := tokenExpiring(time.Now().Add(time.Minute))
+	if _, err := j.ValidateToken(valid); err != nil {
+		t.Errorf("token before expiry rejected: %v", err)
+	}
+	if code := call(valid); code != http.StatusOK || !reached {
+		t.Errorf("request before expiry returned %d", code)
+	}
+
+	expired := tokenExpiring(time.Now().Add(-time.Second))
+	if _, err := j.ValidateToken(expired); err == nil {
+		t.Errorf("expired token accepted")
+	}
+	if code := call(expired); code != http.StatusUnauthorized || reached {
+		t.Errorf("request after expiry returned %d, want 401", code)
+	}
+}
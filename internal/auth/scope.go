@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Scopes a token or API key can be limited to. Logging in gives a token
+// without scopes, which may do anything the account can.
+const (
+	ScopeRead   = "messages:read"   // Read mail and settings
+	ScopeSend   = "messages:send"   // Send mail
+	ScopeDelete = "messages:delete" // Delete mail
+)
+
+// Scopes lists every scope, in the order they are documented
+var Scopes = []string{ScopeRead, ScopeSend, ScopeDelete}
+
+// ValidScope reports whether scope is one a token can be granted
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the user may act within scope. Users whose
+// credentials carry no scopes have every scope.
+func (u *AuthUser) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnly reports whether the user's scopes only allow reading
+func (u *AuthUser) readOnly() bool {
+	if u.Scopes == nil {
+		return false
+	}
+	for _, s := range u.Scopes {
+		if s != ScopeRead {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMethodScope returns why the user may not make a request with the
+// given method, or "" if they may. Requests that only read need ScopeRead;
+// anything else is refused to read-only credentials. Sending and deleting
+// are checked further by RequireScope on their routes.
+func checkMethodScope(user *AuthUser, method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if !user.HasScope(ScopeRead) {
+			return missingScope(ScopeRead)
+		}
+	default:
+		if user.readOnly() {
+			return "Token is read-only"
+		}
+	}
+	return ""
+}
+
+// missingScope is the error message for a request lacking scope
+func missingScope(scope string) string {
+	return fmt.Sprintf("Token lacks the %s scope", scope)
+}
+
+// RequireScope wraps an authenticated handler so that it is only reached by
+// users with scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := GetUserFromContext(r.Context()); ok && !user.HasScope(scope) {
+			http.Error(w, missingScope(scope), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// LoginOnly wraps an authenticated handler so that it refuses API keys and
+// scoped tokens. It guards managing credentials and the account itself, so
+// a leaked key or token can't be used to take over the account or mint
+// more.
+func LoginOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := GetUserFromContext(r.Context()); ok && user.Scopes != nil {
+			http.Error(w, "This action requires logging in; API keys and scoped tokens are not accepted", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
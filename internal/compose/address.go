@@ -0,0 +1,141 @@
+package compose
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on address lengths, in bytes, from RFC 5321
+const (
+	maxAddressLength   = 254
+	maxLocalPartLength = 64
+	maxDomainLength    = 253
+	maxLabelLength     = 63
+)
+
+// ErrInvalidAddress is returned for addresses that are not well formed
+var ErrInvalidAddress = errors.New("invalid email address")
+
+// NormalizeAddress validates an email address and returns it with
+// surrounding whitespace trimmed and the domain lowercased. The local part
+// is kept as written, since its case may matter to the receiving server.
+//
+// The local part is either a dot-atom (letters, digits, the RFC 5322 atext
+// symbols and non-ASCII characters, with no leading, trailing or doubled
+// dots) or a quoted string, which may hold spaces and backslash escapes.
+// The domain is one or more labels of letters, digits and hyphens; a single
+// label such as "localhost" is accepted for development setups.
+func NormalizeAddress(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if len(addr) > maxAddressLength || !utf8.ValidString(addr) {
+		return "", ErrInvalidAddress
+	}
+
+	// The domain cannot contain an @, so the last one separates the parts;
+	// any other @ must be inside a quoted local part
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return "", ErrInvalidAddress
+	}
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+
+	if !validLocalPart(local) || !validDomain(domain) {
+		return "", ErrInvalidAddress
+	}
+	return local + "@" + domain, nil
+}
+
+// ValidAddress reports whether addr is a well-formed email address
+func ValidAddress(addr string) bool {
+	_, err := NormalizeAddress(addr)
+	return err == nil
+}
+
+// AddressDomain returns the lowercased domain of an address, or "" if it
+// has none
+func AddressDomain(addr string) string {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[at+1:])
+}
+
+func validLocalPart(local string) bool {
+	if local == "" || len(local) > maxLocalPartLength {
+		return false
+	}
+	if local[0] == '"' {
+		return validQuotedString(local)
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if !isAtext(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validQuotedString checks a quoted local part such as "john doe". Inside
+// the quotes any printable character is allowed; quotes and backslashes
+// must be escaped with a backslash.
+func validQuotedString(s string) bool {
+	if len(s) < 3 || s[len(s)-1] != '"' {
+		return false
+	}
+
+	escaped := false
+	for _, r := range s[1 : len(s)-1] {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			return false
+		case r != ' ' && !unicode.IsPrint(r):
+			return false
+		}
+	}
+	return !escaped
+}
+
+// isAtext reports whether r may appear unquoted in a local part
+func isAtext(r rune) bool {
+	if r >= utf8.RuneSelf {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+	}
+	if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > maxDomainLength {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package compose
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string // "" if the address is invalid
+	}{
+		// Valid
+		{"alice@example.com", "alice@example.com"},
+		{"  alice@example.com\n", "alice@example.com"},
+		{"Alice@EXAMPLE.com", "Alice@example.com"},
+		{"first.last+tag@mail.example.org", "first.last+tag@mail.example.org"},
+		{"o'brien@example.ie", "o'brien@example.ie"},
+		{"!#$%&'*+-/=?^_`{|}~@example.com", "!#$%&'*+-/=?^_`{|}~@example.com"},
+		{"bob@localhost", "bob@localhost"},
+		{"bob@my-host-1", "bob@my-host-1"},
+
+		// Internationalized
+		{"josé@example.com", "josé@example.com"},
+		{"用户@例子.广告", "用户@例子.广告"},
+		{"user@BÜCHER.de", "user@bücher.de"},
+		{"user@xn--bcher-kva.de", "user@xn--bcher-kva.de"},
+
+		// Quoted local parts
+		{`"john doe"@example.com`, `"john doe"@example.com`},
+		{`"john@home"@example.com`, `"john@home"@example.com`},
+		{`"say \"hi\""@example.com`, `"say \"hi\""@example.com`},
+		{`"back\\slash"@example.com`, `"back\\slash"@example.com`},
+
+		// Invalid
+		{"", ""},
+		{"alice", ""},
+		{"alice@", ""},
+		{"@example.com", ""},
+		{"alice@@example.com", ""},
+		{"alice@bob@example.com", ""},
+		{"al ice@example.com", ""},
+		{"alice@exa mple.com", ""},
+		{".alice@example.com", ""},
+		{"alice.@example.com", ""},
+		{"al..ice@example.com", ""},
+		{"alice@example..com", ""},
+		{"alice@.example.com", ""},
+		{"alice@example.com.", ""},
+		{"alice@-example.com", ""},
+		{"alice@example-.com", ""},
+		{"alice@exam_ple.com", ""},
+		{"alice(comment)@example.com", ""},
+		{"<alice@example.com>", ""},
+		{"alice@[127.0.0.1]", ""},
+		{`"unterminated@example.com`, ""},
+		{`""@example.com`, ""},
+		{`"a"b"@example.com`, ""},
+		{`"trailing\"@example.com`, ""},
+		{"\"tab\there\"@example.com", ""},
+		{"alice\x00@example.com", ""},
+		{"alice@example.com\xff", ""},
+		{strings.Repeat("a", 65) + "@example.com", ""},
+		{"alice@" + strings.Repeat("a", 64) + ".com", ""},
+		{"alice@" + strings.Repeat(strings.Repeat("a", 60)+".", 5) + "com", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeAddress(tt.addr)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("NormalizeAddress(%q) = %q, want an error", tt.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NormalizeAddress(%q) failed: %v", tt.addr, err)
+		} else if got != tt.want {
+			t.Errorf("NormalizeAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+		if !ValidAddress(tt.addr) {
+			t.Errorf("ValidAddress(%q) = false", tt.addr)
+		}
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"alice@Example.COM", "example.com"},
+		{`"a@b"@host`, "host"},
+		{"no-domain", ""},
+	}
+	for _, tt := range tests {
+		if got := AddressDomain(tt.addr); got != tt.want {
+			t.Errorf("AddressDomain(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package compose
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// AttachmentPolicy holds the configured attachment type lists. Entries are
+// exact media types or "type/*" wildcards; an empty allowlist allows every
+// type that is not blocked.
+type AttachmentPolicy struct {
+	Allowed []string
+	Blocked []string
+}
+
+// Check verifies a file against the policy. Both the content type that
+// would be stored for it (see AttachmentContentType) and the type sniffed
+// from its first bytes must be permitted, so a renamed executable is caught
+// even when the client labels it as something harmless. Sniffed types that
+// only mean "unrecognized" are let through when a permitted type is
+// declared, but a file sent without one is stored under its sniffed type,
+// which an allowlist then has to permit.
+func (p AttachmentPolicy) Check(declared string, data []byte) error {
+	if stored := AttachmentContentType(declared, data); !p.permits(stored) {
+		return fmt.Errorf("file type %s is not allowed", mediaType(stored))
+	}
+
+	sniffed := mediaType(http.DetectContentType(data))
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" && !p.permits(sniffed) {
+		return fmt.Errorf("file content looks like %s, which is not allowed", sniffed)
+	}
+
+	return nil
+}
+
+// permits reports whether a content type passes the blocklist and, when one
+// is configured, the allowlist
+func (p AttachmentPolicy) permits(contentType string) bool {
+	t := mediaType(contentType)
+	if matchesMediaType(t, p.Blocked) {
+		return false
+	}
+	return len(p.Allowed) == 0 || matchesMediaType(t, p.Allowed)
+}
+
+// AttachmentContentType decides the content type to store for an attachment.
+// Clients often send no type or a generic one, which makes PDFs and images
+// download as opaque binaries, so those are replaced by the type sniffed from
+// the data. Any other declared type is kept, since it is usually more
+// specific than the sniff (application/json sniffs as text/plain).
+func AttachmentContentType(declared string, data []byte) string {
+	switch mediaType(declared) {
+	case "", "application/octet-stream", "binary/octet-stream", "application/unknown":
+		return http.DetectContentType(data)
+	}
+	return declared
+}
+
+// matchesMediaType reports whether a media type matches any of the patterns
+func matchesMediaType(t string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == t {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(t, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the lowercase media type of a Content-Type value without
+// its parameters
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
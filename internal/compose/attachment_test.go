@@ -0,0 +1,48 @@
+package compose
+
+import "testing"
+
+func TestAttachmentPolicyCheck(t *testing.T) {
+	var (
+		png        = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+		pdf        = []byte("%PDF-1.7\n")
+		elf        = []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+		pe         = []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff\x00\x00")
+		script     = []byte("#!/bin/sh\nrm -rf ~\n")
+		html       = []byte("<html><script>alert(1)</script></html>")
+		imagesOnly = AttachmentPolicy{Allowed: []string{"image/*"}}
+		noHTML     = AttachmentPolicy{Blocked: []string{"text/html"}}
+	)
+
+	tests := []struct {
+		name     string
+		policy   AttachmentPolicy
+		declared string
+		data     []byte
+		wantErr  bool
+	}{
+		{name: "allowed image", policy: imagesOnly, declared: "image/png", data: png},
+		{name: "allowed image without a type", policy: imagesOnly, data: png},
+		{name: "allowed image declared as a generic type", policy: imagesOnly, declared: "application/octet-stream", data: png},
+		{name: "declared type not allowed", policy: imagesOnly, declared: "application/pdf", data: pdf, wantErr: true},
+		{name: "content not allowed", policy: imagesOnly, declared: "image/png", data: pdf, wantErr: true},
+		{name: "ELF binary without a type", policy: imagesOnly, data: elf, wantErr: true},
+		{name: "PE binary without a type", policy: imagesOnly, data: pe, wantErr: true},
+		{name: "shell script without a type", policy: imagesOnly, data: script, wantErr: true},
+		{name: "ELF binary declared as a generic type", policy: imagesOnly, declared: "application/octet-stream", data: elf, wantErr: true},
+		{name: "unrecognized content declared as an allowed type", policy: imagesOnly, declared: "image/x-icon", data: elf},
+		{name: "binary without a type and no allowlist", policy: noHTML, data: elf},
+		{name: "blocked content without a type", policy: noHTML, data: html, wantErr: true},
+		{name: "blocked content declared as text", policy: noHTML, declared: "text/plain", data: html, wantErr: true},
+		{name: "blocked declared type", policy: noHTML, declared: "text/html; charset=utf-8", data: []byte("hello"), wantErr: true},
+		{name: "no policy", data: elf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.declared, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%q) error = %v, want error %v", tt.declared, err, tt.wantErr)
+			}
+		})
+	}
+}
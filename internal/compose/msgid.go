@@ -0,0 +1,52 @@
+package compose
+
+import "strings"
+
+// maxMessageIDLength bounds a single Message-ID, in bytes. RFC 5322 sets no
+// limit, but anything longer than a header line is not a real one.
+const maxMessageIDLength = 998
+
+// ParseMessageIDs returns the message IDs, such as "<abc@example.com>", in
+// the value of a Message-ID, In-Reply-To or References header, in order.
+// Comments and anything else outside angle brackets are dropped, as are IDs
+// without an @ or containing whitespace.
+func ParseMessageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return ids
+		}
+		id := value[start : start+end+1]
+		value = value[start+end+1:]
+
+		if len(id) <= maxMessageIDLength && strings.Contains(id, "@") && !strings.ContainsAny(id[1:len(id)-1], " \t\r\n<") {
+			ids = append(ids, id)
+		}
+	}
+}
+
+// ParseMessageID returns the first message ID in a header value, or "" if
+// there is none
+func ParseMessageID(value string) string {
+	if ids := ParseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// ContentID returns the bare content ID, as a cid: URL refers to it, from a
+// Content-ID header value such as "<logo@example.com>". Angle brackets are
+// optional. Values that can't be a content ID give "".
+func ContentID(value string) string {
+	id := strings.TrimSpace(value)
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	if len(id) > maxMessageIDLength || strings.ContainsAny(id, " \t\r\n<>\"'") {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,30 @@
+package compose
+
+import "strings"
+
+// SplitRecipients splits a list of addresses separated by commas and/or
+// whitespace. Empty entries are dropped, as are repeats of an address
+// already listed (compared case-insensitively).
+func SplitRecipients(list string) []string {
+	fields := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	return UniqueRecipients(fields)
+}
+
+// UniqueRecipients trims each address and drops empty entries and repeats,
+// keeping the first occurrence of each address
+func UniqueRecipients(addresses []string) []string {
+	seen := make(map[string]bool, len(addresses))
+	var out []string
+	for _, addr := range addresses {
+		addr = strings.TrimSpace(addr)
+		key := strings.ToLower(addr)
+		if addr == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, addr)
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package compose
+
+import (
+	"html"
+	"strings"
+	"time"
+)
+
+// forwardSeparator introduces the original message in a forwarded body
+const forwardSeparator = "---------- Forwarded message ----------"
+
+// quoteDateLayout formats the original message's date in forwarded headers
+const quoteDateLayout = "Mon, 2 Jan 2006 at 15:04"
+
+// Original describes the message being replied to or forwarded
+type Original struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	IsHTML  bool
+	Date    time.Time
+}
+
+// ReplySubject prefixes a subject with "Re: " unless it already is a reply
+func ReplySubject(subject string) string {
+	return prefixSubject(subject, "Re: ", "re:")
+}
+
+// ForwardSubject prefixes a subject with "Fwd: " unless it already is a
+// forward
+func ForwardSubject(subject string) string {
+	return prefixSubject(subject, "Fwd: ", "fwd:", "fw:")
+}
+
+// prefixSubject adds prefix to subject unless it starts with one of the
+// given lowercase markers
+func prefixSubject(subject, prefix string, markers ...string) string {
+	subject = strings.TrimSpace(subject)
+	lower := strings.ToLower(subject)
+	for _, marker := range markers {
+		if strings.HasPrefix(lower, marker) {
+			return subject
+		}
+	}
+	return prefix + subject
+}
+
+// ForwardBody returns the body of a message forwarding orig: a header block
+// describing the original followed by its quoted body. The rendering follows
+// the original's body type.
+func ForwardBody(orig Original) string {
+	headers := [][2]string{
+		{"From", orig.From},
+		{"Date", orig.Date.Format(quoteDateLayout)},
+		{"Subject", orig.Subject},
+		{"To", orig.To},
+	}
+
+	if orig.IsHTML {
+		var b strings.Builder
+		b.WriteString(`<div class="` + quoteClass + `">`)
+		b.WriteString(html.EscapeString(forwardSeparator) + "<br>")
+		for _, h := range headers {
+			b.WriteString(h[0] + ": " + html.EscapeString(h[1]) + "<br>")
+		}
+		b.WriteString("<br><blockquote>" + orig.Body + "</blockquote></div>")
+		return b.String()
+	}
+
+	var b strings.Builder
+	b.WriteString("\n\n" + forwardSeparator + "\n")
+	for _, h := range headers {
+		b.WriteString(h[0] + ": " + h[1] + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(QuoteText(orig.Body))
+	return b.String()
+}
+
+// QuoteText prefixes every line of a plaintext body with "> "
+func QuoteText(body string) string {
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	for i, line := range lines {
+		if line == "" || strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
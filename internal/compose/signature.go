@@ -0,0 +1,149 @@
+package compose
+
+import (
+	"html"
+	"strings"
+)
+
+// signatureDelimiter is the conventional "dash dash space" line that
+// separates a plaintext signature from the message body
+const signatureDelimiter = "-- \n"
+
+// signatureClass marks the element wrapping an HTML signature so it can be
+// recognised again later (e.g. to avoid signing twice)
+const signatureClass = "yourmail-signature"
+
+// quoteClass marks the element wrapping quoted text in HTML replies
+const quoteClass = "yourmail-quote"
+
+// Signature holds a user's configured signature
+type Signature struct {
+	Text string // Plaintext signature
+	HTML string // Optional HTML signature, derived from Text when empty
+}
+
+// IsEmpty reports whether no signature is configured
+func (s Signature) IsEmpty() bool {
+	return strings.TrimSpace(s.Text) == "" && strings.TrimSpace(s.HTML) == ""
+}
+
+// text returns the plaintext rendering of the signature
+func (s Signature) text() string {
+	if strings.TrimSpace(s.Text) != "" {
+		return strings.TrimSpace(s.Text)
+	}
+	return strings.TrimSpace(StripTags(s.HTML))
+}
+
+// html returns the HTML rendering of the signature
+func (s Signature) html() string {
+	if strings.TrimSpace(s.HTML) != "" {
+		return strings.TrimSpace(s.HTML)
+	}
+	escaped := html.EscapeString(strings.TrimSpace(s.Text))
+	return strings.ReplaceAll(escaped, "\n", "<br>")
+}
+
+// ApplySignature inserts the signature into a message body. New messages get
+// the signature appended at the end; replies get it placed above the quoted
+// text. The rendering (HTML or plaintext) follows the body type. If the
+// author's own text already contains the signature it is left untouched.
+func ApplySignature(body string, isHTML, isReply bool, sig Signature) string {
+	if sig.IsEmpty() {
+		return body
+	}
+
+	// Only look at the author's own text when deciding where to sign, so a
+	// signature inside the quoted original doesn't suppress ours
+	split := len(body)
+	if isReply {
+		if isHTML {
+			split = htmlQuoteStart(body)
+		} else {
+			split = textQuoteStart(body)
+		}
+	}
+	own, quoted := body[:split], body[split:]
+
+	if isHTML {
+		if strings.Contains(own, signatureClass) || strings.HasSuffix(strings.TrimSpace(own), sig.html()) {
+			return body
+		}
+		block := `<div class="` + signatureClass + `">-- <br>` + sig.html() + `</div>`
+		return own + block + quoted
+	}
+
+	if strings.Contains(own, signatureDelimiter+sig.text()) || strings.HasSuffix(strings.TrimSpace(own), sig.text()) {
+		return body
+	}
+	own = strings.TrimRight(own, "\n")
+	block := signatureDelimiter + sig.text()
+	if own != "" {
+		block = "\n\n" + block
+	}
+	if quoted != "" {
+		return own + block + "\n\n" + quoted
+	}
+	return own + block + "\n"
+}
+
+// textQuoteStart returns the offset of the quoted section of a plaintext
+// reply: the first "> " line, or the "On ... wrote:" attribution line right
+// before it. It returns len(body) if there is no quoted text.
+func textQuoteStart(body string) int {
+	lines := strings.SplitAfter(body, "\n")
+	offset := 0
+	prevOffset, prevLine := -1, ""
+	for _, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			if prevOffset >= 0 && strings.HasSuffix(strings.TrimSpace(prevLine), "wrote:") {
+				return prevOffset
+			}
+			return offset
+		}
+		if strings.TrimSpace(line) != "" {
+			prevOffset, prevLine = offset, line
+		}
+		offset += len(line)
+	}
+	return len(body)
+}
+
+// htmlQuoteStart returns the offset of the quoted section of an HTML reply,
+// or len(body) if there is none
+func htmlQuoteStart(body string) int {
+	lower := strings.ToLower(body)
+	if i := strings.Index(lower, `<div class="`+quoteClass+`"`); i >= 0 {
+		return i
+	}
+	if i := strings.Index(lower, "<blockquote"); i >= 0 {
+		return i
+	}
+	return len(body)
+}
+
+// StripTags removes HTML tags and unescapes entities, leaving plain text
+func StripTags(s string) string {
+	var b strings.Builder
+	inTag := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '<':
+			inTag = true
+			// Preserve line structure for common block-level breaks
+			end := i + 5
+			if end > len(s) {
+				end = len(s)
+			}
+			rest := strings.ToLower(s[i:end])
+			if strings.HasPrefix(rest, "<br") || strings.HasPrefix(rest, "</p") || strings.HasPrefix(rest, "</div") {
+				b.WriteByte('\n')
+			}
+		case c == '>' && inTag:
+			inTag = false
+		case !inTag:
+			b.WriteByte(c)
+		}
+	}
+	return html.UnescapeString(b.String())
+}
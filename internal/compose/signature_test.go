@@ -0,0 +1,109 @@
+package compose
+
+import "testing"
+
+func TestApplySignature(t *testing.T) {
+	sig := Signature{Text: "Alice\nExample Corp"}
+	htmlSig := Signature{Text: "Alice", HTML: "<b>Alice</b>"}
+	htmlBlock := `<div class="yourmail-signature">-- <br>`
+
+	tests := []struct {
+		name    string
+		body    string
+		isHTML  bool
+		isReply bool
+		sig     Signature
+		want    string
+	}{
+		{
+			name: "new plaintext message",
+			body: "Hello Bob\n",
+			sig:  sig,
+			want: "Hello Bob\n\n-- \nAlice\nExample Corp\n",
+		},
+		{
+			name: "new plaintext message without body",
+			body: "",
+			sig:  sig,
+			want: "-- \nAlice\nExample Corp\n",
+		},
+		{
+			name:    "plaintext reply signs above the quote",
+			body:    "Sounds good\n\nOn Mon, Bob wrote:\n> Lunch?\n",
+			isReply: true,
+			sig:     sig,
+			want:    "Sounds good\n\n-- \nAlice\nExample Corp\n\nOn Mon, Bob wrote:\n> Lunch?\n",
+		},
+		{
+			name:    "plaintext reply without attribution",
+			body:    "Yes\n> Lunch?\n",
+			isReply: true,
+			sig:     sig,
+			want:    "Yes\n\n-- \nAlice\nExample Corp\n\n> Lunch?\n",
+		},
+		{
+			name:    "plaintext reply whose quote is already signed",
+			body:    "Sure\n\n> Lunch?\n> -- \n> Alice\n> Example Corp\n",
+			isReply: true,
+			sig:     sig,
+			want:    "Sure\n\n-- \nAlice\nExample Corp\n\n> Lunch?\n> -- \n> Alice\n> Example Corp\n",
+		},
+		{
+			name: "plaintext message already signed",
+			body: "Hello\n\n-- \nAlice\nExample Corp\n",
+			sig:  sig,
+			want: "Hello\n\n-- \nAlice\nExample Corp\n",
+		},
+		{
+			name:   "new HTML message",
+			body:   "<p>Hello Bob</p>",
+			isHTML: true,
+			sig:    htmlSig,
+			want:   "<p>Hello Bob</p>" + htmlBlock + "<b>Alice</b></div>",
+		},
+		{
+			name:   "HTML signature derived from text",
+			body:   "<p>Hi</p>",
+			isHTML: true,
+			sig:    Signature{Text: "Alice & Co\nLondon"},
+			want:   "<p>Hi</p>" + htmlBlock + "Alice &amp; Co<br>London</div>",
+		},
+		{
+			name:    "HTML reply signs above the quote",
+			body:    `<p>Sounds good</p><div class="yourmail-quote"><p>Lunch?</p></div>`,
+			isHTML:  true,
+			isReply: true,
+			sig:     htmlSig,
+			want:    `<p>Sounds good</p>` + htmlBlock + `<b>Alice</b></div><div class="yourmail-quote"><p>Lunch?</p></div>`,
+		},
+		{
+			name:    "HTML reply quoting with blockquote",
+			body:    `<p>Yes</p><blockquote><p>Lunch?</p></blockquote>`,
+			isHTML:  true,
+			isReply: true,
+			sig:     htmlSig,
+			want:    `<p>Yes</p>` + htmlBlock + `<b>Alice</b></div><blockquote><p>Lunch?</p></blockquote>`,
+		},
+		{
+			name:   "HTML message already signed",
+			body:   "<p>Hello</p>" + htmlBlock + "<b>Alice</b></div>",
+			isHTML: true,
+			sig:    htmlSig,
+			want:   "<p>Hello</p>" + htmlBlock + "<b>Alice</b></div>",
+		},
+		{
+			name: "no signature",
+			body: "Hello\n",
+			sig:  Signature{Text: "  "},
+			want: "Hello\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ApplySignature(tt.body, tt.isHTML, tt.isReply, tt.sig)
+			if got != tt.want {
+				t.Errorf("ApplySignature() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// apiKeyUseInterval is how stale a key's last_used_at may get before a use
+// updates it, so busy keys don't write on every request
+const apiKeyUseInterval = time.Minute
+
+// APIKeyRepository handles API key database operations
+type APIKeyRepository struct {
+	db *DB
+}
+
+// NewAPIKeyRepository creates a new API key repository
+func NewAPIKeyRepository(db *DB) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+// apiKeyColumns is the column list read by scanAPIKey
+const apiKeyColumns = `id, user_id, name, scopes, last_used_at, created_at`
+
+// scanAPIKey scans a row selected with apiKeyColumns into an APIKey
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	var scopes string
+	var lastUsed sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &scopes, &lastUsed, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	return key, nil
+}
+
+// Create stores a new key for a user. Only its hash is kept.
+func (r *APIKeyRepository) Create(userID int, name, key string, scopes []string) (*APIKey, error) {
+	query := `
+		INSERT INTO api_keys (user_id, name, key_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	id, err := r.db.insert(query, userID, name, hashToken(key), strings.Join(scopes, ","), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves an API key by ID
+func (r *APIKeyRepository) GetByID(id int) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = ?`
+	key, err := scanAPIKey(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return key, nil
+}
+
+// List returns all of a user's API keys, oldest first
+func (r *APIKeyRepository) List(userID int) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = ? ORDER BY id ASC`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Count returns how many API keys a user has
+func (r *APIKeyRepository) Count(userID int) (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE user_id = ?`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count API keys: %w", err)
+	}
+	return count, nil
+}
+
+// Delete revokes an API key
+func (r *APIKeyRepository) Delete(id int) error {
+	_, err := r.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	return nil
+}
+
+// Authenticate returns the stored key matching key and records that it was
+// used. It returns nil if there is no such key.
+func (r *APIKeyRepository) Authenticate(key string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?`
+	stored, err := scanAPIKey(r.db.QueryRow(query, hashToken(key)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+
+	now := time.Now()
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) >= apiKeyUseInterval {
+		if _, err := r.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now, stored.ID); err != nil {
+			return nil, fmt.Errorf("failed to record API key use: %w", err)
+		}
+		stored.LastUsedAt = &now
+	}
+	return stored, nil
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
@@ -15,30 +16,26 @@ func NewAttachmentRepository(db *DB) *AttachmentRepository {
 	return &AttachmentRepository{db: db}
 }
 
-// Create creates a new attachment
-func (r *AttachmentRepository) Create(messageID int, filename, originalName, contentType string, fileSize int64, filePath *string, fileData []byte) (*Attachment, error) {
+// Create creates a new attachment. contentID is empty unless an HTML body
+// shows the attachment inline.
+func (r *AttachmentRepository) Create(messageID int, filename, originalName, contentType, contentID string, fileSize int64, filePath *string, fileData []byte) (*Attachment, error) {
 	query := `
-		INSERT INTO attachments (message_id, filename, original_name, content_type, file_size, file_path, file_data)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO attachments (message_id, filename, original_name, content_type, content_id, file_size, file_path, file_data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
-	result, err := r.db.Exec(query, messageID, filename, originalName, contentType, fileSize, filePath, fileData)
+	id, err := r.db.insert(query, messageID, filename, originalName, contentType, contentID, fileSize, filePath, fileData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create attachment: %w", err)
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get attachment ID: %w", err)
-	}
-
 	return r.GetByID(int(id))
 }
 
 // GetByID retrieves an attachment by ID
 func (r *AttachmentRepository) GetByID(id int) (*Attachment, error) {
 	query := `
-		SELECT id, message_id, filename, original_name, content_type, file_size, file_path, file_data, created_at
+		SELECT id, message_id, filename, original_name, content_type, content_id, file_size, file_path, file_data, created_at
 		FROM attachments 
 		WHERE id = ?
 	`
@@ -50,6 +47,7 @@ func (r *AttachmentRepository) GetByID(id int) (*Attachment, error) {
 		&attachment.FileName,
 		&attachment.OriginalName,
 		&attachment.ContentType,
+		&attachment.ContentID,
 		&attachment.FileSize,
 		&attachment.FilePath,
 		&attachment.FileData,
@@ -69,7 +67,7 @@ func (r *AttachmentRepository) GetByID(id int) (*Attachment, error) {
 // GetByMessageID retrieves all attachments for a message
 func (r *AttachmentRepository) GetByMessageID(messageID int) ([]*Attachment, error) {
 	query := `
-		SELECT id, message_id, filename, original_name, content_type, file_size, file_path, created_at
+		SELECT id, message_id, filename, original_name, content_type, content_id, file_size, file_path, created_at
 		FROM attachments 
 		WHERE message_id = ?
 		ORDER BY created_at ASC
@@ -90,6 +88,7 @@ func (r *AttachmentRepository) GetByMessageID(messageID int) ([]*Attachment, err
 			&attachment.FileName,
 			&attachment.OriginalName,
 			&attachment.ContentType,
+			&attachment.ContentID,
 			&attachment.FileSize,
 			&attachment.FilePath,
 			&attachment.CreatedAt,
@@ -103,6 +102,61 @@ func (r *AttachmentRepository) GetByMessageID(messageID int) ([]*Attachment, err
 	return attachments, nil
 }
 
+// GetByMessageIDs retrieves the attachments of several messages in one
+// query, keyed by message ID
+func (r *AttachmentRepository) GetByMessageIDs(messageIDs []int) (map[int][]*Attachment, error) {
+	return r.getByMessageIDs(context.Background(), r.db, messageIDs)
+}
+
+// GetByMessageIDsContext is like GetByMessageIDs but aborts when ctx is done
+func (r *AttachmentRepository) GetByMessageIDsContext(ctx context.Context, messageIDs []int) (map[int][]*Attachment, error) {
+	return r.getByMessageIDs(ctx, r.db, messageIDs)
+}
+
+// getByMessageIDs is GetByMessageIDs reading through q, so callers holding
+// a transaction don't wait on a second connection from the pool
+func (r *AttachmentRepository) getByMessageIDs(ctx context.Context, q queryer, messageIDs []int) (map[int][]*Attachment, error) {
+	attachments := make(map[int][]*Attachment)
+	if len(messageIDs) == 0 {
+		return attachments, nil
+	}
+
+	in, args := inClause(messageIDs)
+	query := `
+		SELECT id, message_id, filename, original_name, content_type, content_id, file_size, file_path, created_at
+		FROM attachments
+		WHERE message_id IN (` + in + `)
+		ORDER BY created_at ASC
+	`
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment := &Attachment{}
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.MessageID,
+			&attachment.FileName,
+			&attachment.OriginalName,
+			&attachment.ContentType,
+			&attachment.ContentID,
+			&attachment.FileSize,
+			&attachment.FilePath,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments[attachment.MessageID] = append(attachments[attachment.MessageID], attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
 // GetFileData retrieves the file data for an attachment (for database storage)
 func (r *AttachmentRepository) GetFileData(id int) ([]byte, error) {
 	query := `SELECT file_data FROM attachments WHERE id = ?`
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// BlockRepository handles the senders users have blocked
+type BlockRepository struct {
+	db *DB
+}
+
+// NewBlockRepository creates a new block repository
+func NewBlockRepository(db *DB) *BlockRepository {
+	return &BlockRepository{db: db}
+}
+
+// blockColumns is the column list read by scanBlock
+const blockColumns = `id, user_id, address, created_at`
+
+// scanBlock scans a row selected with blockColumns into a BlockedSender
+func scanBlock(row rowScanner) (*BlockedSender, error) {
+	block := &BlockedSender{}
+	err := row.Scan(&block.ID, &block.UserID, &block.Address, &block.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Create blocks mail from address to a user
+func (r *BlockRepository) Create(userID int, address string) (*BlockedSender, error) {
+	query := `INSERT INTO blocked_senders (user_id, address, created_at) VALUES (?, ?, ?)`
+	id, err := r.db.insert(query, userID, address, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to block sender: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves a block by ID
+func (r *BlockRepository) GetByID(id int) (*BlockedSender, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocked_senders WHERE id = ?`
+	block, err := scanBlock(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get blocked sender: %w", err)
+	}
+	return block, nil
+}
+
+// GetByAddress retrieves a user's block of address, ignoring case
+func (r *BlockRepository) GetByAddress(userID int, address string) (*BlockedSender, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocked_senders WHERE user_id = ? AND LOWER(address) = LOWER(?)`
+	block, err := scanBlock(r.db.QueryRow(query, userID, address))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get blocked sender: %w", err)
+	}
+	return block, nil
+}
+
+// IsBlocked reports whether a user has blocked mail from senderAddress
+func (r *BlockRepository) IsBlocked(recipientID int, senderAddress string) (bool, error) {
+	block, err := r.GetByAddress(recipientID, senderAddress)
+	if err != nil {
+		return false, err
+	}
+	return block != nil, nil
+}
+
+// List returns all of a user's blocked senders ordered by address
+func (r *BlockRepository) List(userID int) ([]*BlockedSender, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocked_senders WHERE user_id = ? ORDER BY LOWER(address)`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocked senders: %w", err)
+	}
+	defer rows.Close()
+
+	var blocks []*BlockedSender
+	for rows.Next() {
+		block, err := scanBlock(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan blocked sender: %w", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+// Delete unblocks a sender
+func (r *BlockRepository) Delete(id int) error {
+	query := `DELETE FROM blocked_senders WHERE id = ?`
+	_, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to unblock sender: %w", err)
+	}
+	return nil
+}
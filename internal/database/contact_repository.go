@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ContactRepository handles address book database operations
+type ContactRepository struct {
+	db *DB
+}
+
+// NewContactRepository creates a new contact repository
+func NewContactRepository(db *DB) *ContactRepository {
+	return &ContactRepository{db: db}
+}
+
+// contactColumns is the column list read by scanContact
+const contactColumns = `id, user_id, name, address, created_at`
+
+// scanContact scans a row selected with contactColumns into a Contact
+func scanContact(row rowScanner) (*Contact, error) {
+	contact := &Contact{}
+	err := row.Scan(&contact.ID, &contact.UserID, &contact.Name, &contact.Address, &contact.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// Create adds a contact to a user's address book
+func (r *ContactRepository) Create(userID int, name, address string) (*Contact, error) {
+	query := `INSERT INTO contacts (user_id, name, address, created_at) VALUES (?, ?, ?, ?)`
+	id, err := r.db.insert(query, userID, name, address, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create contact: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves a contact by ID
+func (r *ContactRepository) GetByID(id int) (*Contact, error) {
+	query := `SELECT ` + contactColumns + ` FROM contacts WHERE id = ?`
+	contact, err := scanContact(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get contact: %w", err)
+	}
+	return contact, nil
+}
+
+// GetByAddress retrieves a user's contact by address, ignoring case
+func (r *ContactRepository) GetByAddress(userID int, address string) (*Contact, error) {
+	query := `SELECT ` + contactColumns + ` FROM contacts WHERE user_id = ? AND LOWER(address) = LOWER(?)`
+	contact, err := scanContact(r.db.QueryRow(query, userID, address))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get contact: %w", err)
+	}
+	return contact, nil
+}
+
+// List returns all of a user's contacts ordered by name
+func (r *ContactRepository) List(userID int) ([]*Contact, error) {
+	query := `SELECT ` + contactColumns + ` FROM contacts WHERE user_id = ? ORDER BY LOWER(name), address`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list contacts: %w", err)
+	}
+	defer rows.Close()
+
+	return scanContacts(rows)
+}
+
+// Update changes a contact's name and address
+func (r *ContactRepository) Update(id int, name, address string) error {
+	query := `UPDATE contacts SET name = ?, address = ? WHERE id = ?`
+	_, err := r.db.Exec(query, name, address, id)
+	if err != nil {
+		return fmt.Errorf("failed to update contact: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a contact
+func (r *ContactRepository) Delete(id int) error {
+	query := `DELETE FROM contacts WHERE id = ?`
+	_, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete contact: %w", err)
+	}
+	return nil
+}
+
+// Suggest returns up to limit of the user's contacts whose name or address
+// starts with prefix
+func (r *ContactRepository) Suggest(userID int, prefix string, limit int) ([]*Contact, error) {
+	pattern := escapeLike(prefix) + "%"
+	query := `
+		SELECT ` + contactColumns + ` FROM contacts
+		WHERE user_id = ? AND (name ` + r.db.like() + ` ? ESCAPE '\' OR address ` + r.db.like() + ` ? ESCAPE '\')
+		ORDER BY LOWER(name), address
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, userID, pattern, pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest contacts: %w", err)
+	}
+	defer rows.Close()
+
+	return scanContacts(rows)
+}
+
+// SuggestCorrespondents returns up to limit addresses starting with prefix
+// that the user has exchanged mail with but not saved as contacts, most
+// recently used first. The returned contacts have no ID or name.
+func (r *ContactRepository) SuggestCorrespondents(userID int, prefix string, limit int) ([]*Contact, error) {
+	pattern := escapeLike(prefix) + "%"
+	query := `
+		SELECT MIN(h.address), MAX(h.created_at) AS last_used FROM (
+			SELECT to_address AS address, created_at FROM messages WHERE from_user_id = ? AND is_draft = FALSE
+			UNION ALL
+			SELECT from_address AS address, created_at FROM messages WHERE to_user_id = ?
+		) h
+		WHERE h.address ` + r.db.like() + ` ? ESCAPE '\'
+		  AND NOT EXISTS (SELECT 1 FROM contacts c WHERE c.user_id = ? AND LOWER(c.address) = LOWER(h.address))
+		GROUP BY LOWER(h.address)
+		ORDER BY last_used DESC
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, userID, userID, pattern, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest correspondents: %w", err)
+	}
+	defer rows.Close()
+
+	var contacts []*Contact
+	for rows.Next() {
+		contact := &Contact{UserID: userID}
+		var lastUsed interface{}
+		if err := rows.Scan(&contact.Address, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan correspondent: %w", err)
+		}
+		contacts = append(contacts, contact)
+	}
+
+	return contacts, rows.Err()
+}
+
+// scanContacts scans all rows selected with contactColumns
+func scanContacts(rows *sql.Rows) ([]*Contact, error) {
+	var contacts []*Contact
+	for rows.Next() {
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan contact: %w", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
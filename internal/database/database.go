@@ -1,52 +1,169 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // DB represents the database connection
 type DB struct {
 	*sql.DB
+
+	// writer runs write transactions; see Begin
+	writer *sql.DB
+	driver string // DriverSQLite or DriverPostgres
+
+	ftsEnabled bool         // Set when the FTS5 search index is available
+	bcryptCost int          // Cost used when hashing passwords
+	unread     *unreadCache // Unread message counts by user
+	msgIDHost  string       // Domain of generated Message-IDs
+
+	// sanitizeHTML cleans HTML bodies before they are stored; nil stores
+	// them as given
+	sanitizeHTML func(string) string
+}
+
+// PoolOptions configures the connection pool
+type PoolOptions struct {
+	MaxOpenConns    int           // 0 means unlimited
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration // 0 means connections are reused forever
+
+	// BusyTimeout is how long a SQLite connection waits for another one's
+	// write lock before failing with "database is locked"
+	BusyTimeout time.Duration
+
+	// SQLiteDriver is the database/sql driver SQLite is opened with,
+	// "sqlite3" if empty. A driver registered under another name can wrap
+	// it, to trace or count queries.
+	SQLiteDriver string
+}
+
+// NewDatabase opens a database connection and migrates the schema. For
+// SQLite source is the path of the database file; for PostgreSQL it is a
+// connection string.
+func NewDatabase(driver, source string, pool PoolOptions) (*DB, error) {
+	var sqlDB, writer *sql.DB
+	var err error
+	switch driver {
+	case DriverSQLite:
+		sqlDB, writer, err = openSQLite(source, pool)
+	case DriverPostgres:
+		// PostgreSQL has row-level locking, so write transactions can share
+		// the pool
+		sqlDB, err = openPostgres(source, pool)
+		writer = sqlDB
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{DB: sqlDB, writer: writer, driver: driver, bcryptCost: bcrypt.DefaultCost, unread: newUnreadCache(), msgIDHost: "localhost"}
+	db.registerPoolMetrics()
+
+	// Run migrations
+	if err := db.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if err := db.setupFullTextSearch(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if err := db.backfillPreviews(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if driver == DriverSQLite {
+		slog.Info("database connected and migrated", "driver", driver, "path", source)
+	} else {
+		slog.Info("database connected and migrated", "driver", driver)
+	}
+	return db, nil
 }
 
-// NewDatabase creates a new database connection
-func NewDatabase(dbPath string) (*DB, error) {
+// openSQLite opens the SQLite database at dbPath, returning the main pool
+// and the connection write transactions use
+func openSQLite(dbPath string, pool PoolOptions) (*sql.DB, *sql.DB, error) {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create database directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	// Open database connection
-	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=1&_journal_mode=WAL")
+	// Open database connection. SQLite allows one writer at a time, so
+	// connections wait up to the busy timeout for the lock rather than
+	// failing straight away.
+	dsn := fmt.Sprintf("%s?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=%d",
+		dbPath, pool.BusyTimeout.Milliseconds())
+	driverName := pool.SQLiteDriver
+	if driverName == "" {
+		driverName = "sqlite3"
+	}
+	sqlDB, err := sql.Open(driverName, dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
 	// Test connection
 	if err := sqlDB.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+		sqlDB.Close()
+		return nil, nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	db := &DB{sqlDB}
+	// Write transactions get a connection of their own that takes the
+	// write lock when they begin. A transaction that reads first and only
+	// asks for the lock at its first write fails at once, whatever the
+	// busy timeout, if another connection wrote in between.
+	writer, err := sql.Open(driverName, dsn+"&_txlock=immediate")
+	if err != nil {
+		sqlDB.Close()
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	writer.SetMaxOpenConns(1)
+	writer.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
-	// Run migrations
-	if err := db.migrate(); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	return sqlDB, writer, nil
+}
+
+// openPostgres connects to the PostgreSQL database at dsn
+func openPostgres(dsn string, pool PoolOptions) (*sql.DB, error) {
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
-	log.Printf("✅ Database connected and migrated: %s", dbPath)
-	return db, nil
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return sqlDB, nil
 }
 
 // migrate runs database migrations
 func (db *DB) migrate() error {
+	if db.driver == DriverPostgres {
+		return db.runMigrations(postgresMigrations)
+	}
+
 	migrations := []string{
 		// Users table
 		`CREATE TABLE IF NOT EXISTS users (
@@ -54,6 +171,13 @@ func (db *DB) migrate() error {
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
 			password_hash TEXT NOT NULL,
+			signature TEXT NOT NULL DEFAULT '',
+			signature_html TEXT NOT NULL DEFAULT '',
+			reply_to TEXT NOT NULL DEFAULT '',
+			is_admin BOOLEAN DEFAULT FALSE,
+			disabled BOOLEAN DEFAULT FALSE,
+			send_read_receipts BOOLEAN DEFAULT TRUE,
+			email_verified BOOLEAN DEFAULT TRUE,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
@@ -65,12 +189,22 @@ func (db *DB) migrate() error {
 			to_user_id INTEGER,
 			from_address TEXT NOT NULL,
 			to_address TEXT NOT NULL,
+			reply_to TEXT NOT NULL DEFAULT '',
 			subject TEXT NOT NULL,
 			body TEXT NOT NULL,
 			is_html BOOLEAN DEFAULT FALSE,
 			thread_id TEXT,
 			parent_id INTEGER,
 			read_status BOOLEAN DEFAULT FALSE,
+			flagged BOOLEAN DEFAULT FALSE,
+			is_draft BOOLEAN DEFAULT FALSE,
+			delivery_status TEXT NOT NULL DEFAULT '',
+			delivery_error TEXT NOT NULL DEFAULT '',
+			request_receipt BOOLEAN DEFAULT FALSE,
+			read_at DATETIME,
+			message_id TEXT NOT NULL DEFAULT '',
+			in_reply_to TEXT NOT NULL DEFAULT '',
+			reference_ids TEXT NOT NULL DEFAULT '',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (from_user_id) REFERENCES users(id) ON DELETE SET NULL,
 			FOREIGN KEY (to_user_id) REFERENCES users(id) ON DELETE SET NULL,
@@ -95,6 +229,32 @@ func (db *DB) migrate() error {
 		`ALTER TABLE messages ADD COLUMN is_html BOOLEAN DEFAULT FALSE`,
 		`ALTER TABLE messages ADD COLUMN thread_id TEXT`,
 		`ALTER TABLE messages ADD COLUMN parent_id INTEGER REFERENCES messages(id) ON DELETE SET NULL`,
+		`ALTER TABLE users ADD COLUMN signature TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN signature_html TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN flagged BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN is_draft BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN reply_to TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN reply_to TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN delivery_status TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN delivery_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN is_admin BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN disabled BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN request_receipt BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE messages ADD COLUMN read_at DATETIME`,
+		`ALTER TABLE users ADD COLUMN send_read_receipts BOOLEAN DEFAULT TRUE`,
+		`ALTER TABLE messages ADD COLUMN message_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN in_reply_to TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN reference_ids TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN email_verified BOOLEAN DEFAULT TRUE`,
+		`ALTER TABLE messages ADD COLUMN snoozed_until DATETIME`,
+		`ALTER TABLE messages ADD COLUMN scheduled_for DATETIME`,
+		`ALTER TABLE attachments ADD COLUMN content_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN preview TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN last_login_at DATETIME`,
+		`ALTER TABLE messages ADD COLUMN send_id TEXT NOT NULL DEFAULT ''`,
+		// Sent messages stored before delivery statuses existed were all local
+		`UPDATE messages SET delivery_status = 'local'
+			WHERE delivery_status = '' AND from_user_id IS NOT NULL AND to_user_id IS NOT NULL AND is_draft = FALSE`,
 
 		// Indexes for performance
 		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)`,
@@ -105,6 +265,7 @@ func (db *DB) migrate() error {
 		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_thread_id ON messages(thread_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages(parent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_send_id ON messages(send_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id)`,
 
 		// Trigger to update updated_at timestamp
@@ -113,27 +274,247 @@ func (db *DB) migrate() error {
 		 BEGIN 
 			UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
 		 END`,
+
+		// Folders for organizing mail; messages not filed in any folder are in the inbox
+		`CREATE TABLE IF NOT EXISTS folders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, name),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_folders (
+			message_id INTEGER NOT NULL,
+			folder_id INTEGER NOT NULL,
+			PRIMARY KEY (message_id, folder_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_folders_user_id ON folders(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_folders_folder_id ON message_folders(folder_id)`,
+
+		// Address book; addresses are unique per user, ignoring case
+		`CREATE TABLE IF NOT EXISTS contacts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			address TEXT NOT NULL COLLATE NOCASE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, address),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// Reusable message templates; names are unique per user
+		`CREATE TABLE IF NOT EXISTS templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			subject TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL DEFAULT '',
+			is_html BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, name),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// Webhook subscriptions; events is a comma-separated list
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			failure_count INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks(user_id)`,
+
+		// Responses to requests made with an Idempotency-Key, kept for
+		// replay; a status code of 0 marks a request still in progress
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id INTEGER NOT NULL,
+			key TEXT NOT NULL,
+			path TEXT NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response BLOB,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, key),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)`,
+
+		// Federated replies find their parent by Message-ID
+		`CREATE INDEX IF NOT EXISTS idx_messages_message_id ON messages(message_id)`,
+
+		// Pending email verifications, one per user. Only a hash of the
+		// token is kept.
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+			user_id INTEGER PRIMARY KEY,
+			token_hash TEXT UNIQUE NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// Senders whose mail a user drops; addresses are unique per user,
+		// ignoring case
+		`CREATE TABLE IF NOT EXISTS blocked_senders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			address TEXT NOT NULL COLLATE NOCASE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, address),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// How often each user rescued a sender's mail from the Spam folder;
+		// addresses are stored lowercased
+		`CREATE TABLE IF NOT EXISTS spam_feedback (
+			user_id INTEGER NOT NULL,
+			address TEXT NOT NULL,
+			not_spam INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, address),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// Threads a user has muted; their mail stays readable but does not
+		// count as unread or notify
+		`CREATE TABLE IF NOT EXISTS muted_threads (
+			user_id INTEGER NOT NULL,
+			thread_id TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, thread_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// Let the snooze sweeper and scheduled sender find due messages without
+		// a table scan
+		`CREATE INDEX IF NOT EXISTS idx_messages_snoozed_until ON messages(snoozed_until)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_scheduled_for ON messages(scheduled_for)`,
+
+		// Long-lived keys for scripts and integrations. Only a hash of each
+		// key is kept; scopes is a comma-separated list.
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id)`,
+
+		// Logins to existing accounts, successful or not; protocol is
+		// http, tcp or smtp
+		`CREATE TABLE IF NOT EXISTS login_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			protocol TEXT NOT NULL,
+			success BOOLEAN NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_events_user_created ON login_events(user_id, created_at)`,
 	}
 
+	return db.runMigrations(migrations)
+}
+
+// runMigrations applies each migration in turn. They must be safe to run
+// again on an up-to-date schema.
+func (db *DB) runMigrations(migrations []string) error {
 	for i, migration := range migrations {
 		if _, err := db.Exec(migration); err != nil {
 			// Ignore column already exists errors for ALTER TABLE statements
-			if i >= 3 && i <= 5 { // ALTER TABLE statements
+			if isDuplicateColumnError(migration, err) {
 				continue
 			}
 			return fmt.Errorf("migration %d failed: %w", i+1, err)
 		}
 	}
 
-	log.Println("✅ Database migrations completed")
+	slog.Info("database migrations completed")
 	return nil
 }
 
+// isDuplicateColumnError reports whether an ALTER TABLE migration failed only
+// because the column already exists (fresh databases get it from CREATE TABLE)
+func isDuplicateColumnError(migration string, err error) bool {
+	return strings.HasPrefix(strings.TrimSpace(migration), "ALTER TABLE") &&
+		strings.Contains(err.Error(), "duplicate column name")
+}
+
+// SetBcryptCost sets the cost used to hash new and upgraded passwords
+func (db *DB) SetBcryptCost(cost int) {
+	db.bcryptCost = cost
+}
+
+// SetUnreadCacheTTL sets how long unread counts are cached before they are
+// read from the database again. Zero disables the cache.
+func (db *DB) SetUnreadCacheTTL(ttl time.Duration) {
+	db.unread.setTTL(ttl)
+}
+
+// SetMessageIDHost sets the domain of the Message-IDs given to new messages,
+// which should be the server's host name so they are unique across servers
+func (db *DB) SetMessageIDHost(host string) {
+	db.msgIDHost = host
+}
+
+// SetHTMLSanitizer sets the function HTML message bodies are passed through
+// before they are stored, whichever way the message arrived
+func (db *DB) SetHTMLSanitizer(sanitize func(string) string) {
+	db.sanitizeHTML = sanitize
+}
+
+// storedBody returns a message body as it should be stored
+func (db *DB) storedBody(body string, isHTML bool) string {
+	if isHTML && db.sanitizeHTML != nil {
+		return db.sanitizeHTML(body)
+	}
+	return body
+}
+
 // Close closes the database connection
 func (db *DB) Close() error {
+	if db.writer != db.DB {
+		if err := db.writer.Close(); err != nil {
+			db.DB.Close()
+			return err
+		}
+	}
 	return db.DB.Close()
 }
 
+// CheckHealth verifies that the database answers a trivial query
+func (db *DB) CheckHealth(ctx context.Context) error {
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("database did not answer: %w", err)
+	}
+	return nil
+}
+
+// Begin starts a write transaction. On SQLite write transactions run one
+// at a time on a dedicated connection and hold the write lock from the
+// start, so they wait for other writers instead of failing with "database
+// is locked". Read-only transactions should use BeginTx.
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
 // SeedTestUsers creates test users for development
 func (db *DB) SeedTestUsers() error {
 	testUsers := []struct {
@@ -158,11 +539,26 @@ func (db *DB) SeedTestUsers() error {
 		// Create user
 		_, err := userRepo.Create(user.username, user.email, user.password)
 		if err != nil {
-			log.Printf("Failed to create test user %s: %v", user.username, err)
+			slog.Error("failed to create test user", "username", user.username, "err", err)
 		} else {
-			log.Printf("✅ Created test user: %s", user.username)
+			slog.Info("created test user", "username", user.username)
 		}
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
+
+// GrantAdmin marks the named users as administrators. Unknown usernames are
+// logged and skipped.
+func (db *DB) GrantAdmin(usernames []string) error {
+	for _, username := range usernames {
+		result, err := db.Exec(`UPDATE users SET is_admin = TRUE WHERE username = ?`, username)
+		if err != nil {
+			return fmt.Errorf("failed to grant admin to %s: %w", username, err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			slog.Warn("admin user does not exist", "username", username)
+		}
+	}
+	return nil
+}
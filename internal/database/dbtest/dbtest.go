@@ -0,0 +1,144 @@
+// Package dbtest opens throwaway SQLite databases for tests, and counts the
+// queries run against them so tests can check how many a code path makes.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yourmail/internal/database"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// driverName is the SQLite driver wrapped to count queries
+const driverName = "sqlite3-counting"
+
+var (
+	registerOnce sync.Once
+
+	// counters holds the Counter of each open database, by file path
+	countersMu sync.Mutex
+	counters   = make(map[string]*Counter)
+)
+
+// Open returns a migrated SQLite database in a temporary directory, closed
+// when the test ends, with the Counter of the queries run against it.
+// Passwords are hashed at the lowest bcrypt cost to keep tests fast.
+func Open(t testing.TB) (*database.DB, *Counter) {
+	t.Helper()
+	registerOnce.Do(func() {
+		sql.Register(driverName, &countingDriver{})
+	})
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	counter := &Counter{}
+	countersMu.Lock()
+	counters[path] = counter
+	countersMu.Unlock()
+
+	db, err := database.NewDatabase(database.DriverSQLite, path, database.PoolOptions{
+		BusyTimeout:  5 * time.Second,
+		SQLiteDriver: driverName,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.SetBcryptCost(bcrypt.MinCost)
+	t.Cleanup(func() {
+		db.Close()
+		countersMu.Lock()
+		delete(counters, path)
+		countersMu.Unlock()
+	})
+	counter.Reset()
+	return db, counter
+}
+
+// Counter records the statements run against a database
+type Counter struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+// Reset forgets the statements recorded so far
+func (c *Counter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = nil
+}
+
+// Count returns how many statements containing substr were run since the
+// last Reset. An empty substr counts every statement.
+func (c *Counter) Count(substr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, query := range c.queries {
+		if strings.Contains(query, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// Queries returns the statements run since the last Reset, in order
+func (c *Counter) Queries() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+func (c *Counter) record(query string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, strings.Join(strings.Fields(query), " "))
+}
+
+// countingDriver opens SQLite connections that report their statements to
+// the Counter of their database
+type countingDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *countingDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	path, _, _ := strings.Cut(dsn, "?")
+	countersMu.Lock()
+	counter := counters[path]
+	countersMu.Unlock()
+	return &countingConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), counter: counter}, nil
+}
+
+type countingConn struct {
+	*sqlite3.SQLiteConn
+	counter *Counter
+}
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.counter.record(query)
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.counter.record(query)
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c *countingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.counter.record(query)
+	return c.SQLiteConn.PrepareContext(ctx, query)
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Database drivers NewDatabase supports
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// Repositories write their queries for SQLite, with ? placeholders. DB and
+// Tx rewrite them for the driver in use, and the helpers below supply the
+// few expressions that differ between the two.
+
+// rebind rewrites the ? placeholders in query to the driver's style.
+// Question marks inside string literals are left alone.
+func (db *DB) rebind(query string) string {
+	if db.driver != DriverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// like returns the operator for case-insensitive pattern matching. SQLite's
+// LIKE already ignores ASCII case; PostgreSQL's does not.
+func (db *DB) like() string {
+	if db.driver == DriverPostgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// byteLength returns an expression for the size of text in bytes
+func (db *DB) byteLength(expr string) string {
+	if db.driver == DriverPostgres {
+		return "OCTET_LENGTH(" + expr + ")"
+	}
+	return "LENGTH(CAST(" + expr + " AS BLOB))"
+}
+
+// sortableTime returns expr as a timestamp that sorts correctly. SQLite
+// stores timestamps as text in whatever format they were written in.
+func (db *DB) sortableTime(expr string) string {
+	if db.driver == DriverPostgres {
+		return expr
+	}
+	return "DATETIME(" + expr + ")"
+}
+
+// insert runs an INSERT statement and returns the ID of the new row
+func (db *DB) insert(query string, args ...interface{}) (int64, error) {
+	if db.driver == DriverPostgres {
+		var id int64
+		err := db.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Exec executes a query without returning any rows
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), args...)
+}
+
+// ExecContext is like Exec but aborts when ctx is done
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.rebind(query), args...)
+}
+
+// Query executes a query that returns rows
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), args...)
+}
+
+// QueryContext is like Query but aborts when ctx is done
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.rebind(query), args...)
+}
+
+// QueryRow executes a query that returns at most one row
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), args...)
+}
+
+// QueryRowContext is like QueryRow but aborts when ctx is done
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.rebind(query), args...)
+}
+
+// BeginTx starts a transaction on the main pool, for reads. Write
+// transactions should use Begin.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// Tx is a transaction whose queries are rewritten for the driver like DB's
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+// Exec executes a query without returning any rows
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.rebind(query), args...)
+}
+
+// ExecContext is like Exec but aborts when ctx is done
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.db.rebind(query), args...)
+}
+
+// Query executes a query that returns rows
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.rebind(query), args...)
+}
+
+// QueryContext is like Query but aborts when ctx is done
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.db.rebind(query), args...)
+}
+
+// QueryRow executes a query that returns at most one row
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.rebind(query), args...)
+}
+
+// QueryRowContext is like QueryRow but aborts when ctx is done
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.db.rebind(query), args...)
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// FolderRepository handles folder database operations
+type FolderRepository struct {
+	db *DB
+}
+
+// NewFolderRepository creates a new folder repository
+func NewFolderRepository(db *DB) *FolderRepository {
+	return &FolderRepository{db: db}
+}
+
+// CreateFolder creates a new folder for a user
+func (r *FolderRepository) CreateFolder(userID int, name string) (*Folder, error) {
+	query := `INSERT INTO folders (user_id, name, created_at) VALUES (?, ?, ?)`
+	id, err := r.db.insert(query, userID, name, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves a folder by ID
+func (r *FolderRepository) GetByID(id int) (*Folder, error) {
+	folder := &Folder{}
+	query := `SELECT id, user_id, name, created_at FROM folders WHERE id = ?`
+	err := r.db.QueryRow(query, id).Scan(&folder.ID, &folder.UserID, &folder.Name, &folder.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get folder: %w", err)
+	}
+	return folder, nil
+}
+
+// GetByName retrieves a user's folder by name
+func (r *FolderRepository) GetByName(userID int, name string) (*Folder, error) {
+	folder := &Folder{}
+	query := `SELECT id, user_id, name, created_at FROM folders WHERE user_id = ? AND name = ?`
+	err := r.db.QueryRow(query, userID, name).Scan(&folder.ID, &folder.UserID, &folder.Name, &folder.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get folder: %w", err)
+	}
+	return folder, nil
+}
+
+// ListFolders returns all folders belonging to a user
+func (r *FolderRepository) ListFolders(userID int) ([]*Folder, error) {
+	query := `SELECT id, user_id, name, created_at FROM folders WHERE user_id = ? ORDER BY name ASC`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folders: %w", err)
+	}
+	defer rows.Close()
+
+	var folders []*Folder
+	for rows.Next() {
+		folder := &Folder{}
+		if err := rows.Scan(&folder.ID, &folder.UserID, &folder.Name, &folder.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan folder: %w", err)
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, nil
+}
+
+// DeleteFolder deletes a folder. Its message assignments are removed by the
+// cascading foreign key, which puts the messages back in the inbox.
+func (r *FolderRepository) DeleteFolder(id int) error {
+	query := `DELETE FROM folders WHERE id = ?`
+	_, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete folder: %w", err)
+	}
+	return nil
+}
+
+// MoveMessageToFolder files a message into one of the user's folders,
+// replacing any previous assignment by that user. A nil folderID moves the
+// message back to the inbox.
+func (r *FolderRepository) MoveMessageToFolder(messageID, userID int, folderID *int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM message_folders
+		WHERE message_id = ? AND folder_id IN (SELECT id FROM folders WHERE user_id = ?)
+	`, messageID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to clear message folder: %w", err)
+	}
+
+	if folderID != nil {
+		_, err = tx.Exec(`INSERT INTO message_folders (message_id, folder_id) VALUES (?, ?)`, messageID, *folderID)
+		if err != nil {
+			return fmt.Errorf("failed to move message to folder: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit folder move: %w", err)
+	}
+	return nil
+}
+
+// Contains reports whether a message is filed in a folder
+func (r *FolderRepository) Contains(folderID, messageID int) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM message_folders WHERE folder_id = ? AND message_id = ?)`
+	if err := r.db.QueryRow(query, folderID, messageID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check folder: %w", err)
+	}
+	return exists, nil
+}
+
+// GetMessagesInFolder retrieves the messages filed in a folder, newest first
+func (r *FolderRepository) GetMessagesInFolder(folderID int, limit, offset int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		JOIN message_folders mf ON mf.message_id = m.id
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE mf.folder_id = ? AND ` + deliveredFilter + `
+		ORDER BY m.created_at DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := r.db.Query(query, folderID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder messages: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMessagesWithSender(rows)
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ErrFullTextSearchUnavailable is returned by FullTextSearch when SQLite was
+// built without FTS5 (build with -tags sqlite_fts5 to enable it)
+var ErrFullTextSearchUnavailable = errors.New("full-text search is not available")
+
+// ftsMigrations create the messages_fts index over subject and body. It is an
+// external content table, so triggers keep it in sync with messages.
+var ftsMigrations = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		subject, body, content='messages', content_rowid='id'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, subject, body) VALUES (new.id, new.subject, new.body);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, subject, body) VALUES ('delete', old.id, old.subject, old.body);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF subject, body ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, subject, body) VALUES ('delete', old.id, old.subject, old.body);
+		INSERT INTO messages_fts(rowid, subject, body) VALUES (new.id, new.subject, new.body);
+	END`,
+}
+
+// setupFullTextSearch creates the FTS5 index and its triggers, backfilling
+// the index when it is first created. If SQLite lacks FTS5 support, search
+// falls back to LIKE queries and this is only logged. The index is SQLite
+// specific, so other drivers always use the fallback.
+func (db *DB) setupFullTextSearch() error {
+	if db.driver != DriverSQLite {
+		slog.Info("ranked search not supported by database driver, using LIKE search", "driver", db.driver)
+		return nil
+	}
+
+	var existing int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`).Scan(&existing)
+	if err != nil {
+		return fmt.Errorf("failed to check full-text index: %w", err)
+	}
+
+	for _, migration := range ftsMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				slog.Warn("SQLite FTS5 not available, ranked search disabled (build with -tags sqlite_fts5)")
+				return nil
+			}
+			return fmt.Errorf("failed to set up full-text index: %w", err)
+		}
+	}
+
+	if existing == 0 {
+		slog.Info("building full-text index for existing messages")
+		if _, err := db.Exec(`INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')`); err != nil {
+			return fmt.Errorf("failed to build full-text index: %w", err)
+		}
+	}
+
+	db.ftsEnabled = true
+	return nil
+}
+
+// FullTextSearchEnabled reports whether the FTS5 index is available
+func (db *DB) FullTextSearchEnabled() bool {
+	return db.ftsEnabled
+}
+
+// ftsQuery turns free text into an FTS5 query matching all of its words.
+// Each word is quoted so FTS5 operators and punctuation in user input are
+// treated as plain text.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
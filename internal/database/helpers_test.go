@@ -0,0 +1,47 @@
+package database_test
+
+import (
+	"testing"
+
+	"yourmail/internal/database"
+	"yourmail/internal/database/dbtest"
+)
+
+// testStore is a fresh database with its repositories
+type testStore struct {
+	db       *database.DB
+	queries  *dbtest.Counter
+	users    *database.UserRepository
+	messages *database.MessageRepository
+}
+
+func newTestStore(t testing.TB) *testStore {
+	t.Helper()
+	db, queries := dbtest.Open(t)
+	return &testStore{
+		db:       db,
+		queries:  queries,
+		users:    database.NewUserRepository(db),
+		messages: database.NewMessageRepository(db, database.NewAttachmentRepository(db)),
+	}
+}
+
+// createUser adds a user with the password "password123"
+func (s *testStore) createUser(t testing.TB, username string) *database.User {
+	t.Helper()
+	user, err := s.users.Create(username, username+"@example.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+	return user
+}
+
+// send stores a message from one local user to another
+func (s *testStore) send(t testing.TB, from, to *database.User, subject string, threadID *string, parentID *int) *database.Message {
+	t.Helper()
+	message, err := s.messages.CreateWithThreading(&from.ID, &to.ID, from.Username+"@localhost", to.Username+"@localhost", "", subject, "body of "+subject, false, threadID, parentID)
+	if err != nil {
+		t.Fatalf("failed to store message %q: %v", subject, err)
+	}
+	return message
+}
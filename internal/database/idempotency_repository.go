@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// IdempotencyRepository stores the responses to requests made with an
+// idempotency key, so retries of the same request can be answered without
+// repeating it
+type IdempotencyRepository struct {
+	db *DB
+}
+
+// NewIdempotencyRepository creates a new idempotency repository
+func NewIdempotencyRepository(db *DB) *IdempotencyRepository {
+	return &IdempotencyRepository{db: db}
+}
+
+// Reserve claims a user's key for a request to path. If the key is free, or
+// its previous use is older than ttl, it is claimed and nil is returned.
+// Otherwise the existing record is returned, which may still be in
+// progress.
+func (r *IdempotencyRepository) Reserve(userID int, key, path string, ttl time.Duration) (*IdempotencyRecord, error) {
+	now := time.Now()
+	if _, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-ttl)); err != nil {
+		return nil, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+
+	result, err := r.db.Exec(`
+		INSERT INTO idempotency_keys (user_id, key, path, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, userID, key, path, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	record := &IdempotencyRecord{}
+	var response []byte
+	err = r.db.QueryRow(`
+		SELECT user_id, key, path, status_code, response, created_at
+		FROM idempotency_keys WHERE user_id = ? AND key = ?
+	`, userID, key).Scan(&record.UserID, &record.Key, &record.Path, &record.StatusCode, &response, &record.CreatedAt)
+	if err == sql.ErrNoRows {
+		// Purged between the insert and the select; let the caller retry
+		return nil, fmt.Errorf("idempotency key %q vanished while reserving it", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	record.Response = response
+	return record, nil
+}
+
+// Complete stores the response to the request holding a reserved key
+func (r *IdempotencyRepository) Complete(userID int, key string, statusCode int, response []byte) error {
+	_, err := r.db.Exec(`UPDATE idempotency_keys SET status_code = ?, response = ? WHERE user_id = ? AND key = ?`,
+		statusCode, response, userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
+
+// Release frees a reserved key without storing a response, so the request
+// can be retried with it
+func (r *IdempotencyRepository) Release(userID int, key string) error {
+	_, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`, userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package database_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+// fillInbox gives bob the given number of threads with alice, each a
+// message and two replies
+func fillInbox(t testing.TB, s *testStore, alice, bob *database.User, threads int) {
+	t.Helper()
+	for i := 0; i < threads; i++ {
+		root := s.send(t, alice, bob, fmt.Sprintf("Thread %d", i), nil, nil)
+		reply := s.send(t, bob, alice, fmt.Sprintf("Re: Thread %d", i), root.ThreadID, &root.ID)
+		s.send(t, alice, bob, fmt.Sprintf("Re: Thread %d", i), root.ThreadID, &reply.ID)
+	}
+}
+
+func TestGetInboxForUserQueryCountIsConstant(t *testing.T) {
+	// The page is read in a transaction, which a pool of one connection
+	// leaves no room to step outside of
+	paths := []struct {
+		name     string
+		maxConns int
+		get      func(s *testStore, userID int) ([]*database.Message, error)
+	}{
+		{
+			name: "GetInboxForUser",
+			get: func(s *testStore, userID int) ([]*database.Message, error) {
+				return s.messages.GetInboxForUser(userID, database.InboxOptions{Limit: 50})
+			},
+		},
+		{
+			name:     "GetInboxPageForUserContext",
+			maxConns: 1,
+			get: func(s *testStore, userID int) ([]*database.Message, error) {
+				inbox, _, err := s.messages.GetInboxPageForUserContext(context.Background(), userID, database.InboxOptions{Limit: 50})
+				return inbox, err
+			},
+		},
+	}
+	for _, path := range paths {
+		t.Run(path.name, func(t *testing.T) {
+			counts := make(map[int]int)
+			for _, threads := range []int{1, 5, 20} {
+				s := newTestStore(t)
+				alice := s.createUser(t, "alice")
+				bob := s.createUser(t, "bob")
+				fillInbox(t, s, alice, bob, threads)
+				if path.maxConns > 0 {
+					s.db.SetMaxOpenConns(path.maxConns)
+				}
+
+				s.queries.Reset()
+				inbox, err := path.get(s, bob.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(inbox) != threads {
+					t.Fatalf("got %d threads, want %d", len(inbox), threads)
+				}
+				for _, root := range inbox {
+					if len(root.Replies) != 2 {
+						t.Errorf("thread %q has %d replies, want 2", root.Subject, len(root.Replies))
+					}
+				}
+				counts[threads] = s.queries.Count("")
+			}
+
+			if counts[1] != counts[5] || counts[1] != counts[20] {
+				t.Errorf("queries by number of threads = %v, want the same for each", counts)
+			}
+		})
+	}
+}
+
+func BenchmarkGetInboxForUser(b *testing.B) {
+	for _, threads := range []int{10, 50} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			s := newTestStore(b)
+			alice := s.createUser(b, "alice")
+			bob := s.createUser(b, "bob")
+			fillInbox(b, s, alice, bob, threads)
+
+			s.queries.Reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.messages.GetInboxForUser(bob.ID, database.InboxOptions{Limit: threads}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(s.queries.Count(""))/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// TestGetInboxForUserMixedParticipation covers a thread bob started and
+// replied to as well as received in, with a private aside between the
+// others: bob's listing counts what he sent and received, roots the thread
+// at his first message, and leaves the aside out.
+func TestGetInboxForUserMixedParticipation(t *testing.T) {
+	s := newTestStore(t)
+	alice := s.createUser(t, "alice")
+	bob := s.createUser(t, "bob")
+	carol := s.createUser(t, "carol")
+
+	root := s.send(t, bob, alice, "Plans", nil, nil)
+	reply := s.send(t, alice, bob, "Re: Plans", root.ThreadID, &root.ID)
+	aside := s.send(t, alice, carol, "Fwd: Plans", root.ThreadID, &reply.ID)
+	followUp := s.send(t, bob, alice, "Re: Plans", root.ThreadID, &reply.ID)
+	last := s.send(t, alice, bob, "Re: Plans", root.ThreadID, &followUp.ID)
+
+	inbox, err := s.messages.GetInboxForUser(bob.ID, database.InboxOptions{Limit: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 1 {
+		t.Fatalf("got %d threads, want 1", len(inbox))
+	}
+	got := inbox[0]
+	if got.ID != root.ID {
+		t.Errorf("thread rooted at message %d, want bob's first message %d", got.ID, root.ID)
+	}
+
+	var replyIDs []int
+	for _, message := range got.Replies {
+		if message.ID == aside.ID {
+			t.Errorf("bob's listing includes message %d between alice and carol", aside.ID)
+		}
+		replyIDs = append(replyIDs, message.ID)
+	}
+	if want := []int{reply.ID, followUp.ID, last.ID}; !slices.Equal(replyIDs, want) {
+		t.Errorf("replies = %v, want %v", replyIDs, want)
+	}
+}
+
+// TestGetInboxPageForUserWithOneConnection reads an inbox page, whose
+// transaction holds a connection throughout, from a pool of one. Every
+// query, attachments included, has to go through the transaction.
+func TestGetInboxPageForUserWithOneConnection(t *testing.T) {
+	s := newTestStore(t)
+	alice := s.createUser(t, "alice")
+	bob := s.createUser(t, "bob")
+	fillInbox(t, s, alice, bob, 3)
+	root := s.send(t, alice, bob, "Photos", nil, nil)
+	attachments := database.NewAttachmentRepository(s.db)
+	if _, err := attachments.Create(root.ID, "a1.png", "beach.png", "image/png", "", 4, nil, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	s.db.SetMaxOpenConns(1)
+
+	type page struct {
+		inbox []*database.Message
+		total int
+		err   error
+	}
+	done := make(chan page, 1)
+	go func() {
+		inbox, total, err := s.messages.GetInboxPageForUserContext(context.Background(), bob.ID, database.InboxOptions{Limit: 50})
+		done <- page{inbox, total, err}
+	}()
+
+	var got page
+	select {
+	case got = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("inbox page still waiting for a connection")
+	}
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	if got.total != 4 || len(got.inbox) != 4 {
+		t.Fatalf("got %d of %d threads, want 4 of 4", len(got.inbox), got.total)
+	}
+	for _, message := range got.inbox {
+		if message.ID == root.ID && message.AttachmentCount != 1 {
+			t.Errorf("message with an attachment lists %d", message.AttachmentCount)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// LoginEventRepository handles login audit log database operations
+type LoginEventRepository struct {
+	db *DB
+}
+
+// NewLoginEventRepository creates a new login event repository
+func NewLoginEventRepository(db *DB) *LoginEventRepository {
+	return &LoginEventRepository{db: db}
+}
+
+// Record stores a login attempt and, if it succeeded, the user's last login
+// time. An attempt without a user ID, such as one with a wrong password, is
+// matched to an account by username; attempts on usernames that don't
+// exist are not stored. The IP may be given with a port, which is dropped.
+func (r *LoginEventRepository) Record(username string, event LoginEvent) error {
+	if event.UserID == 0 {
+		err := r.db.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&event.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up user: %w", err)
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(event.IP); err == nil {
+		event.IP = host
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO login_events (user_id, ip, user_agent, protocol, success, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	if _, err := tx.Exec(query, event.UserID, event.IP, event.UserAgent, event.Protocol, event.Success, event.CreatedAt); err != nil {
+		return fmt.Errorf("failed to record login: %w", err)
+	}
+	if event.Success {
+		if _, err := tx.Exec(`UPDATE users SET last_login_at = ? WHERE id = ?`, event.CreatedAt, event.UserID); err != nil {
+			return fmt.Errorf("failed to update last login: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRecent returns a user's latest login attempts, newest first
+func (r *LoginEventRepository) ListRecent(userID, limit int) ([]*LoginEvent, error) {
+	query := `
+		SELECT id, user_id, ip, user_agent, protocol, success, created_at
+		FROM login_events
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logins: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*LoginEvent
+	for rows.Next() {
+		event := &LoginEvent{}
+		err := rows.Scan(&event.ID, &event.UserID, &event.IP, &event.UserAgent, &event.Protocol, &event.Success, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan login: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
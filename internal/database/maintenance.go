@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrBackupUnsupported is returned by Backup for databases other than SQLite,
+// which have their own tools for it (pg_dump for PostgreSQL)
+var ErrBackupUnsupported = errors.New("online backup is only supported for SQLite")
+
+// Backup writes a consistent snapshot of the database to a new file at path,
+// which must not exist yet. It uses VACUUM INTO, so the copy is compacted and
+// writes carry on while it is taken.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	if db.driver != DriverSQLite {
+		return ErrBackupUnsupported
+	}
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return nil
+}
+
+// Vacuum rebuilds the database to return the space left by deleted rows.
+// On SQLite it runs on the writer connection, so writes wait until it is done.
+func (db *DB) Vacuum(ctx context.Context) error {
+	if _, err := db.writer.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// Size returns the number of bytes the database takes up
+func (db *DB) Size(ctx context.Context) (int64, error) {
+	query := `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	if db.driver == DriverPostgres {
+		query = `SELECT pg_database_size(current_database())`
+	}
+
+	var size int64
+	if err := db.QueryRowContext(ctx, query).Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to get database size: %w", err)
+	}
+	return size, nil
+}
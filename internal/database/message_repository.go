@@ -1,11 +1,16 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,51 +28,177 @@ func NewMessageRepository(db *DB, attachmentRepo *AttachmentRepository) *Message
 	}
 }
 
+// messageColumns is the column list read by scanMessage. Queries must alias
+// the messages table as m. The attachment count is a correlated subquery on
+// the indexed message_id, so listings get it without a query per message.
+const messageColumns = `m.id, m.from_user_id, m.to_user_id, m.from_address, m.to_address, m.reply_to,
+		       m.subject, m.body, m.preview, m.is_html, m.thread_id, m.parent_id, m.read_status, m.flagged, m.is_draft, m.created_at,
+		       m.delivery_status, m.delivery_error, m.request_receipt, m.read_at, m.snoozed_until, m.scheduled_for,
+		       m.message_id, m.in_reply_to, m.reference_ids,
+		       (SELECT COUNT(*) FROM attachments a WHERE a.message_id = m.id)`
+
+// deliveredFilter restricts message m to delivered messages, excluding drafts
+const deliveredFilter = `m.is_draft = FALSE`
+
+// countedFilter excludes messages m that do not count as unread even when
+// unread: snoozed ones, and those in threads their recipient has muted
+const countedFilter = `(m.snoozed_until IS NULL AND NOT EXISTS (
+		SELECT 1 FROM muted_threads mt WHERE mt.user_id = m.to_user_id AND mt.thread_id = m.thread_id
+	))`
+
+// queryer is implemented by both *DB and *Tx, so listings can run either
+// on their own or inside a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// scanMessage scans a row selected with messageColumns into a Message. Any
+// extra destinations are scanned from the columns following messageColumns.
+func scanMessage(row rowScanner, extra ...interface{}) (*Message, error) {
+	message := &Message{}
+	var fromUserID, toUserID, parentID sql.NullInt64
+	var threadID sql.NullString
+	var readAt, snoozedUntil, scheduledFor sql.NullTime
+
+	dest := []interface{}{
+		&message.ID, &fromUserID, &toUserID,
+		&message.FromAddress, &message.ToAddress, &message.ReplyTo, &message.Subject,
+		&message.Body, &message.Preview, &message.IsHTML, &threadID, &parentID,
+		&message.ReadStatus, &message.Flagged, &message.IsDraft, &message.CreatedAt,
+		&message.DeliveryStatus, &message.DeliveryError, &message.RequestReceipt, &readAt, &snoozedUntil, &scheduledFor,
+		&message.MessageID, &message.InReplyTo, &message.References,
+		&message.AttachmentCount,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	// Convert nullable IDs
+	if fromUserID.Valid {
+		id := int(fromUserID.Int64)
+		message.FromUserID = &id
+	}
+	if toUserID.Valid {
+		id := int(toUserID.Int64)
+		message.ToUserID = &id
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		message.ParentID = &id
+	}
+	if threadID.Valid {
+		message.ThreadID = &threadID.String
+	}
+	if readAt.Valid {
+		message.ReadAt = &readAt.Time
+	}
+	if snoozedUntil.Valid {
+		message.SnoozedUntil = &snoozedUntil.Time
+	}
+	if scheduledFor.Valid {
+		message.ScheduledFor = &scheduledFor.Time
+	}
+
+	return message, nil
+}
+
 // CreateWithThreading creates a new message with threading support
-func (r *MessageRepository) CreateWithThreading(fromUserID, toUserID *int, fromAddress, toAddress, subject, body string, isHTML bool, threadID *string, parentID *int) (*Message, error) {
-	log.Printf("DEBUG: CreateWithThreading called - threadID: %v, parentID: %v", threadID, parentID)
-	
+func (r *MessageRepository) CreateWithThreading(fromUserID, toUserID *int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, threadID *string, parentID *int) (*Message, error) {
+	return r.createMessage(fromUserID, toUserID, fromAddress, toAddress, replyTo, subject, body, isHTML, threadID, parentID, false, MessageHeaders{})
+}
+
+// CreateReceived stores a message that arrived from another server. It joins
+// the thread of the message it replies to, found by the In-Reply-To and
+// References headers among the user's mail, and keeps its Message-ID.
+func (r *MessageRepository) CreateReceived(toUserID int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, headers MessageHeaders) (*Message, error) {
+	var threadID *string
+	var parentID *int
+	parent, err := r.findParent(toUserID, headers)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		threadID, parentID = parent.ThreadID, &parent.ID
+	}
+	return r.createMessage(nil, &toUserID, fromAddress, toAddress, replyTo, subject, body, isHTML, threadID, parentID, false, headers)
+}
+
+// CreateSent stores a copy of a message a local user sent from a mail
+// client, keeping the client's headers. It joins the thread of the message
+// it replies to, found among the sender's mail, or else threadID if set.
+func (r *MessageRepository) CreateSent(fromUserID int, toUserID *int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, threadID *string, headers MessageHeaders) (*Message, error) {
+	var parentID *int
+	parent, err := r.findParent(fromUserID, headers)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		threadID, parentID = parent.ThreadID, &parent.ID
+	}
+	return r.createMessage(&fromUserID, toUserID, fromAddress, toAddress, replyTo, subject, body, isHTML, threadID, parentID, false, headers)
+}
+
+// CreateDraft stores an unsent message. Drafts have no recipient user until
+// they are sent, so they never show up in anyone's inbox.
+func (r *MessageRepository) CreateDraft(fromUserID int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, threadID *string, parentID *int) (*Message, error) {
+	return r.createMessage(&fromUserID, nil, fromAddress, toAddress, replyTo, subject, body, isHTML, threadID, parentID, true, MessageHeaders{})
+}
+
+// createMessage inserts a message, inheriting or generating its thread ID.
+// Headers left empty are filled in: a new Message-ID, and for replies the
+// In-Reply-To and References pointing at the parent.
+func (r *MessageRepository) createMessage(fromUserID, toUserID *int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, threadID *string, parentID *int, isDraft bool, headers MessageHeaders) (*Message, error) {
 	// If this is a reply (has parentID), inherit thread_id from parent
-	if parentID != nil && threadID == nil {
-		log.Printf("DEBUG: This is a reply (parentID: %d), looking up parent message for thread_id", *parentID)
+	if parentID != nil {
 		parentMessage, err := r.GetByID(*parentID)
 		if err != nil {
-			log.Printf("ERROR: Failed to get parent message %d: %v", *parentID, err)
 			return nil, fmt.Errorf("failed to get parent message: %w", err)
 		}
-		if parentMessage != nil && parentMessage.ThreadID != nil {
+		if parentMessage != nil && parentMessage.ThreadID != nil && threadID == nil {
 			threadID = parentMessage.ThreadID
-			log.Printf("DEBUG: Inherited thread_id from parent: %s", *threadID)
+			slog.Debug("reply inherits parent thread", "parent_id", *parentID, "thread_id", *threadID)
+		}
+		if parentMessage != nil && headers.InReplyTo == "" && parentMessage.MessageID != "" {
+			headers.InReplyTo = parentMessage.MessageID
+			headers.References = strings.TrimSpace(parentMessage.References + " " + parentMessage.MessageID)
+		}
+	}
+
+	if headers.MessageID == "" {
+		id, err := r.generateMessageID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Message-ID: %w", err)
 		}
+		headers.MessageID = id
 	}
 	
 	// Generate thread ID if not provided and this is not a reply
 	if threadID == nil && parentID == nil {
-		log.Printf("DEBUG: Generating new thread_id for root message")
 		id, err := generateThreadID()
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate thread ID: %w", err)
 		}
 		threadID = &id
-		log.Printf("DEBUG: Generated new thread_id: %s", *threadID)
+		slog.Debug("generated thread ID for new thread", "thread_id", id)
 	}
 
-	log.Printf("DEBUG: Final parameters - threadID: %v, parentID: %v", threadID, parentID)
-
 	query := `
-		INSERT INTO messages (from_user_id, to_user_id, from_address, to_address, subject, body, is_html, thread_id, parent_id, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (from_user_id, to_user_id, from_address, to_address, reply_to, subject, body, preview, is_html, thread_id, parent_id, is_draft,
+		                      message_id, in_reply_to, reference_ids, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
+	body = r.db.storedBody(body, isHTML)
+	done := r.db.unread.begin()
 	now := time.Now()
-	result, err := r.db.Exec(query, fromUserID, toUserID, fromAddress, toAddress, subject, body, isHTML, threadID, parentID, now)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create message: %w", err)
+	id, err := r.db.insert(query, fromUserID, toUserID, fromAddress, toAddress, replyTo, subject, body, messagePreview(body, isHTML), isHTML, threadID, parentID, isDraft,
+		headers.MessageID, headers.InReplyTo, headers.References, now)
+	if err == nil && !isDraft && toUserID != nil {
+		r.adjustUnlessMuted(*toUserID, threadID, 1)
 	}
-
-	// Get the created message ID
-	id, err := result.LastInsertId()
+	done()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get message ID: %w", err)
+		return nil, fmt.Errorf("failed to create message: %w", err)
 	}
 
 	createdMessage, err := r.GetByID(int(id))
@@ -75,391 +206,2051 @@ func (r *MessageRepository) CreateWithThreading(fromUserID, toUserID *int, fromA
 		return nil, err
 	}
 	
-	log.Printf("DEBUG: Created message with ID %d, thread_id: %v, parent_id: %v", createdMessage.ID, createdMessage.ThreadID, createdMessage.ParentID)
+	slog.Debug("created message", "id", createdMessage.ID, "draft", isDraft)
 	return createdMessage, nil
 }
 
+// Import stores a message brought in from another mail system as received
+// by the user, keeping its original date and read and flagged state. It
+// joins the thread of an earlier message it replies to, like CreateReceived.
+func (r *MessageRepository) Import(toUserID int, fromAddress, toAddress, replyTo, subject, body string, isHTML bool, createdAt time.Time, read, flagged bool, headers MessageHeaders) (*Message, error) {
+	var threadID string
+	var parentID *int
+	parent, err := r.findParent(toUserID, headers)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil && parent.ThreadID != nil {
+		threadID, parentID = *parent.ThreadID, &parent.ID
+	} else if threadID, err = generateThreadID(); err != nil {
+		return nil, fmt.Errorf("failed to generate thread ID: %w", err)
+	}
+
+	if headers.MessageID == "" {
+		if headers.MessageID, err = r.generateMessageID(); err != nil {
+			return nil, fmt.Errorf("failed to generate Message-ID: %w", err)
+		}
+	}
+
+	query := `
+		INSERT INTO messages (to_user_id, from_address, to_address, reply_to, subject, body, preview, is_html, thread_id, parent_id, read_status, flagged,
+		                      message_id, in_reply_to, reference_ids, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	body = r.db.storedBody(body, isHTML)
+	done := r.db.unread.begin()
+	id, err := r.db.insert(query, toUserID, fromAddress, toAddress, replyTo, subject, body, messagePreview(body, isHTML), isHTML, threadID, parentID, read, flagged,
+		headers.MessageID, headers.InReplyTo, headers.References, createdAt)
+	if err == nil && !read {
+		r.adjustUnlessMuted(toUserID, &threadID, 1)
+	}
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("failed to import message: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
 // Create creates a new message (backward compatibility)
 func (r *MessageRepository) Create(fromUserID, toUserID *int, fromAddress, toAddress, subject, body string) (*Message, error) {
-	return r.CreateWithThreading(fromUserID, toUserID, fromAddress, toAddress, subject, body, false, nil, nil)
+	return r.CreateWithThreading(fromUserID, toUserID, fromAddress, toAddress, "", subject, body, false, nil, nil)
 }
 
-// generateThreadID generates a unique thread ID
-func generateThreadID() (string, error) {
-	bytes := make([]byte, 16)
-	_, err := rand.Read(bytes)
+// generateMessageID returns a new globally unique Message-ID
+func (r *MessageRepository) generateMessageID() (string, error) {
+	id, err := generateThreadID()
 	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(bytes), nil
+	return "<" + id + "@" + r.db.msgIDHost + ">", nil
 }
 
-// GetByID retrieves a message by ID with threading support
-func (r *MessageRepository) GetByID(id int) (*Message, error) {
-	message := &Message{}
-	var fromUserID, toUserID, parentID sql.NullInt64
-	var threadID sql.NullString
+// findParent returns the message a new message of the user's replies to:
+// the one named by In-Reply-To or, failing that, the latest one in
+// References that the user has. It returns nil if there is none.
+func (r *MessageRepository) findParent(userID int, headers MessageHeaders) (*Message, error) {
+	var candidates []string
+	if headers.InReplyTo != "" {
+		candidates = append(candidates, headers.InReplyTo)
+	}
+	refs := strings.Fields(headers.References)
+	for i := len(refs) - 1; i >= 0; i-- {
+		candidates = append(candidates, refs[i])
+	}
+
 	query := `
-		SELECT id, from_user_id, to_user_id, from_address, to_address, 
-		       subject, body, is_html, thread_id, parent_id, read_status, created_at
-		FROM messages WHERE id = ?
+		SELECT ` + messageColumns + ` FROM messages m
+		WHERE m.message_id = ? AND (m.to_user_id = ? OR m.from_user_id = ?)
+		ORDER BY m.id
+		LIMIT 1
 	`
-	err := r.db.QueryRow(query, id).Scan(
-		&message.ID, &fromUserID, &toUserID,
-		&message.FromAddress, &message.ToAddress, &message.Subject,
-		&message.Body, &message.IsHTML, &threadID, &parentID, 
-		&message.ReadStatus, &message.CreatedAt,
-	)
-	if err != nil {
+	for _, messageID := range candidates {
+		message, err := scanMessage(r.db.QueryRow(query, messageID, userID, userID))
 		if err == sql.ErrNoRows {
-			return nil, nil
+			continue
 		}
-		return nil, fmt.Errorf("failed to get message: %w", err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find parent message: %w", err)
+		}
+		return message, nil
 	}
-	
-	// Convert nullable IDs
-	if fromUserID.Valid {
-		id := int(fromUserID.Int64)
-		message.FromUserID = &id
+	return nil, nil
+}
+
+// HasReceived reports whether a user already has the message with the given
+// Message-ID, so a relay that is retried is not stored twice
+func (r *MessageRepository) HasReceived(userID int, messageID string) (bool, error) {
+	query := `SELECT COUNT(*) FROM messages m WHERE m.message_id = ? AND m.to_user_id = ? AND ` + deliveredFilter
+	var count int
+	if err := r.db.QueryRow(query, messageID, userID).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check for duplicate message: %w", err)
 	}
-	if toUserID.Valid {
-		id := int(toUserID.Int64)
-		message.ToUserID = &id
+	return count > 0, nil
+}
+
+// MuteThread mutes a thread for a user: its mail no longer counts as unread
+// for them. Muting a muted thread is not an error.
+func (r *MessageRepository) MuteThread(userID int, threadID string) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `INSERT INTO muted_threads (user_id, thread_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+	_, err := r.db.Exec(query, userID, threadID, time.Now())
+	r.db.unread.invalidate(userID)
+	if err != nil {
+		return fmt.Errorf("failed to mute thread: %w", err)
 	}
-	if parentID.Valid {
-		id := int(parentID.Int64)
-		message.ParentID = &id
+	return nil
+}
+
+// UnmuteThread undoes MuteThread
+func (r *MessageRepository) UnmuteThread(userID int, threadID string) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `DELETE FROM muted_threads WHERE user_id = ? AND thread_id = ?`
+	_, err := r.db.Exec(query, userID, threadID)
+	r.db.unread.invalidate(userID)
+	if err != nil {
+		return fmt.Errorf("failed to unmute thread: %w", err)
 	}
-	if threadID.Valid {
-		message.ThreadID = &threadID.String
+	return nil
+}
+
+// IsThreadMuted reports whether a user has muted a thread
+func (r *MessageRepository) IsThreadMuted(userID int, threadID string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM muted_threads WHERE user_id = ? AND thread_id = ?)`
+	var muted bool
+	if err := r.db.QueryRow(query, userID, threadID).Scan(&muted); err != nil {
+		return false, fmt.Errorf("failed to check thread mute: %w", err)
 	}
-	
-	return message, nil
+	return muted, nil
 }
 
-// GetThreadByID retrieves all messages in a thread
-func (r *MessageRepository) GetThreadByID(threadID string) ([]*Message, error) {
+// Snooze keeps a message a user received out of their inbox and unread
+// count until the given time. Snoozing a snoozed message moves its time.
+func (r *MessageRepository) Snooze(messageID, userID int, until time.Time) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `UPDATE messages SET snoozed_until = ? WHERE id = ? AND to_user_id = ?`
+	_, err := r.db.Exec(query, until.UTC(), messageID, userID)
+	r.db.unread.invalidate(userID)
+	if err != nil {
+		return fmt.Errorf("failed to snooze message: %w", err)
+	}
+	return nil
+}
+
+// Unsnooze returns a snoozed message to the user's inbox straight away. It
+// reports false if the message was not snoozed.
+func (r *MessageRepository) Unsnooze(messageID, userID int) (bool, error) {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `UPDATE messages SET snoozed_until = NULL WHERE id = ? AND to_user_id = ? AND snoozed_until IS NOT NULL`
+	result, err := r.db.Exec(query, messageID, userID)
+	r.db.unread.invalidate(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to unsnooze message: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to unsnooze message: %w", err)
+	}
+	return n > 0, nil
+}
+
+// GetSnoozedForUser retrieves the messages a user has snoozed, due soonest
+// first
+func (r *MessageRepository) GetSnoozedForUser(userID int, limit, offset int) ([]*Message, error) {
 	query := `
-		SELECT m.id, m.from_user_id, m.to_user_id, m.from_address, m.to_address,
-		       m.subject, m.body, m.is_html, m.thread_id, m.parent_id, m.read_status, m.created_at,
+		SELECT ` + messageColumns + `,
 		       fu.id, fu.username, fu.email
 		FROM messages m
 		LEFT JOIN users fu ON m.from_user_id = fu.id
-		WHERE m.thread_id = ?
-		ORDER BY m.created_at ASC
+		WHERE m.to_user_id = ? AND m.snoozed_until IS NOT NULL
+		ORDER BY m.snoozed_until, m.id
+		LIMIT ? OFFSET ?
 	`
-	rows, err := r.db.Query(query, threadID)
+	rows, err := r.db.Query(query, userID, limit, offset)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get thread: %w", err)
+		return nil, fmt.Errorf("failed to get snoozed messages: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []*Message
-	for rows.Next() {
-		message := &Message{}
-		var fromUser User
-		var msgFromUserID, msgToUserID, msgParentID sql.NullInt64
-		var msgThreadID sql.NullString
-		var fromUserIdDB sql.NullInt64
-		var fromUsername, fromEmail sql.NullString
-
-		err := rows.Scan(
-			&message.ID, &msgFromUserID, &msgToUserID,
-			&message.FromAddress, &message.ToAddress, &message.Subject,
-			&message.Body, &message.IsHTML, &msgThreadID, &msgParentID,
-			&message.ReadStatus, &message.CreatedAt,
-			&fromUserIdDB, &fromUsername, &fromEmail,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan message: %w", err)
-		}
-
-		// Convert nullable message IDs
-		if msgFromUserID.Valid {
-			id := int(msgFromUserID.Int64)
-			message.FromUserID = &id
-		}
-		if msgToUserID.Valid {
-			id := int(msgToUserID.Int64)
-			message.ToUserID = &id
-		}
-		if msgParentID.Valid {
-			id := int(msgParentID.Int64)
-			message.ParentID = &id
-		}
-		if msgThreadID.Valid {
-			message.ThreadID = &msgThreadID.String
-		}
-
-		// Set FromUser if exists
-		if fromUserIdDB.Valid {
-			fromUser.ID = int(fromUserIdDB.Int64)
-			fromUser.Username = fromUsername.String
-			fromUser.Email = fromEmail.String
-			message.FromUser = &fromUser
-		}
-
-		messages = append(messages, message)
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
 	}
 
-	// Load attachments for all messages
-	for _, msg := range messages {
-		attachments, err := r.attachmentRepo.GetByMessageID(msg.ID)
-		if err != nil {
-			log.Printf("Failed to load attachments for message %d: %v", msg.ID, err)
-			// Don't fail the whole request, just log the error
-		} else {
-			msg.Attachments = attachments
-		}
-	}
+	r.loadAttachments(context.Background(), r.db, messages)
 
 	return messages, nil
 }
 
-// GetInboxForUser retrieves all messages for a user's inbox (threaded)
-func (r *MessageRepository) GetInboxForUser(userID int, limit, offset int) ([]*Message, error) {
-	// Get thread roots first (messages with no parent)
+// WakeSnoozed returns up to limit messages, across all users, whose snooze
+// ended by now, and clears their snooze so they are back in the inbox. Due
+// messages are found through the snoozed_until index and woken in one
+// update, so callers loop until fewer than limit come back.
+func (r *MessageRepository) WakeSnoozed(now time.Time, limit int) ([]*Message, error) {
+	done := r.db.unread.begin()
+	defer done()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
-		SELECT DISTINCT m.thread_id, m.id, m.from_user_id, m.to_user_id, m.from_address, m.to_address,
-		       m.subject, m.body, m.is_html, m.parent_id, m.read_status, m.created_at,
-		       fu.id, fu.username, fu.email,
-		       (SELECT COUNT(*) FROM messages WHERE thread_id = m.thread_id AND to_user_id = ?) as reply_count,
-		       DATETIME((SELECT MAX(created_at) FROM messages WHERE thread_id = m.thread_id AND to_user_id = ?)) as last_message_time
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
 		FROM messages m
 		LEFT JOIN users fu ON m.from_user_id = fu.id
-		WHERE m.to_user_id = ? AND (m.parent_id IS NULL OR m.id = (
-			SELECT MIN(id) FROM messages WHERE thread_id = m.thread_id AND to_user_id = ?
-		))
-		GROUP BY m.thread_id
-		ORDER BY last_message_time DESC
-		LIMIT ? OFFSET ?
+		WHERE m.snoozed_until IS NOT NULL AND m.snoozed_until <= ?
+		ORDER BY m.snoozed_until, m.id
+		LIMIT ?
 	`
-	
-	log.Printf("DEBUG: Executing GetInboxForUser query for userID: %d", userID)
-	rows, err := r.db.Query(query, userID, userID, userID, userID, limit, offset)
+	rows, err := tx.Query(query, now.UTC(), limit)
 	if err != nil {
-		log.Printf("DEBUG: Query failed: %v", err)
-		return nil, fmt.Errorf("failed to get inbox: %w", err)
+		return nil, fmt.Errorf("failed to get due snoozed messages: %w", err)
+	}
+	messages, err := scanMessagesWithSender(rows)
+	rows.Close()
+	if err != nil || len(messages) == 0 {
+		return nil, err
 	}
-	defer rows.Close()
-
-	var messages []*Message
-	for rows.Next() {
-		message := &Message{}
-		var fromUser User
-		var msgFromUserID, msgToUserID, msgParentID sql.NullInt64
-		var msgThreadID sql.NullString
-		var fromUserIdDB sql.NullInt64
-		var fromUsername, fromEmail sql.NullString
-		var replyCount int
-		var lastMessageTimeStr sql.NullString
 
-		log.Printf("DEBUG: About to scan row...")
-		err := rows.Scan(
-			&msgThreadID, &message.ID, &msgFromUserID, &msgToUserID,
-			&message.FromAddress, &message.ToAddress, &message.Subject,
-			&message.Body, &message.IsHTML, &msgParentID,
-			&message.ReadStatus, &message.CreatedAt,
-			&fromUserIdDB, &fromUsername, &fromEmail,
-			&replyCount, &lastMessageTimeStr,
-		)
-		if err != nil {
-			log.Printf("DEBUG: Scan failed with error: %v", err)
-			log.Printf("DEBUG: lastMessageTimeStr value: %+v, valid: %t", lastMessageTimeStr.String, lastMessageTimeStr.Valid)
-			return nil, fmt.Errorf("failed to scan message: %w", err)
-		}
-		
-		log.Printf("DEBUG: Successfully scanned row. lastMessageTimeStr: %+v, valid: %t", lastMessageTimeStr.String, lastMessageTimeStr.Valid)
+	ids := make([]int, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+	in, args := inClause(ids)
+	if _, err := tx.Exec(`UPDATE messages SET snoozed_until = NULL WHERE id IN (`+in+`)`, args...); err != nil {
+		return nil, fmt.Errorf("failed to wake snoozed messages: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit woken messages: %w", err)
+	}
 
-		// Convert nullable message IDs
-		if msgFromUserID.Valid {
-			id := int(msgFromUserID.Int64)
-			message.FromUserID = &id
-		}
-		if msgToUserID.Valid {
-			id := int(msgToUserID.Int64)
-			message.ToUserID = &id
-		}
-		if msgParentID.Valid {
-			id := int(msgParentID.Int64)
-			message.ParentID = &id
-		}
-		if msgThreadID.Valid {
-			message.ThreadID = &msgThreadID.String
+	for _, message := range messages {
+		message.SnoozedUntil = nil
+		if message.ToUserID != nil {
+			r.db.unread.invalidate(*message.ToUserID)
 		}
+	}
+	r.loadAttachments(context.Background(), r.db, messages)
 
-		// Set FromUser if exists
-		if fromUserIdDB.Valid {
-			fromUser.ID = int(fromUserIdDB.Int64)
-			fromUser.Username = fromUsername.String
-			fromUser.Email = fromEmail.String
-			message.FromUser = &fromUser
-		}
-
-		// Load replies if this is a thread
-		if msgThreadID.Valid && replyCount > 1 {
-			log.Printf("DEBUG: Loading replies for thread %s (reply count: %d)", msgThreadID.String, replyCount)
-			replies, err := r.GetThreadByID(msgThreadID.String)
-			if err == nil && len(replies) > 1 {
-				// Remove the first message (original) and set the rest as replies
-				message.Replies = replies[1:]
-				log.Printf("DEBUG: Loaded %d replies for message %d", len(message.Replies), message.ID)
-			} else {
-				log.Printf("DEBUG: Failed to load replies for thread %s: err=%v, replies=%d", msgThreadID.String, err, len(replies))
-			}
-		} else {
-			log.Printf("DEBUG: No replies to load for message %d (threadID valid: %t, reply count: %d)", message.ID, msgThreadID.Valid, replyCount)
-		}
+	return messages, nil
+}
 
-		messages = append(messages, message)
+// Schedule sets the time a draft is to be sent at, which also moves it out
+// of the drafts listing. It returns false if the message is no longer a
+// draft.
+func (r *MessageRepository) Schedule(messageID int, at time.Time) (bool, error) {
+	query := `UPDATE messages SET scheduled_for = ? WHERE id = ? AND is_draft = TRUE`
+	result, err := r.db.Exec(query, at.UTC(), messageID)
+	if err != nil {
+		return false, fmt.Errorf("failed to schedule message: %w", err)
 	}
-
-	// Load attachments for all messages
-	for _, msg := range messages {
-		attachments, err := r.attachmentRepo.GetByMessageID(msg.ID)
-		if err != nil {
-			log.Printf("Failed to load attachments for message %d: %v", msg.ID, err)
-			// Don't fail the whole request, just log the error
-		} else {
-			msg.Attachments = attachments
-		}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to schedule message: %w", err)
 	}
+	return n > 0, nil
+}
 
-	return messages, nil
+// DeleteScheduled deletes a scheduled send, with its attachments, unless it
+// has been sent. It reports whether it was deleted.
+func (r *MessageRepository) DeleteScheduled(messageID int) (bool, error) {
+	query := `DELETE FROM messages WHERE id = ? AND is_draft = TRUE AND scheduled_for IS NOT NULL`
+	result, err := r.db.Exec(query, messageID)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel scheduled message: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel scheduled message: %w", err)
+	}
+	return n > 0, nil
 }
 
-// GetInboxForAddress retrieves messages for a specific address (for external messages)
-func (r *MessageRepository) GetInboxForAddress(address string, limit, offset int) ([]*Message, error) {
+// GetScheduledForUser retrieves the messages a user has scheduled to be
+// sent, due soonest first
+func (r *MessageRepository) GetScheduledForUser(userID int, limit, offset int) ([]*Message, error) {
 	query := `
-		SELECT m.id, m.from_user_id, m.to_user_id, m.from_address, m.to_address,
-		       m.subject, m.body, m.read_status, m.created_at
+		SELECT ` + messageColumns + `
 		FROM messages m
-		WHERE m.to_address = ?
-		ORDER BY m.created_at DESC
+		WHERE m.from_user_id = ? AND m.is_draft = TRUE AND m.scheduled_for IS NOT NULL
+		ORDER BY m.scheduled_for, m.id
 		LIMIT ? OFFSET ?
 	`
-	rows, err := r.db.Query(query, address, limit, offset)
+	return r.getScheduled(query, userID, limit, offset)
+}
+
+// GetDueScheduled retrieves up to limit scheduled messages, across all
+// users, that are due to be sent by now, with their attachment metadata
+func (r *MessageRepository) GetDueScheduled(now time.Time, limit int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		WHERE m.is_draft = TRUE AND m.scheduled_for IS NOT NULL AND m.scheduled_for <= ?
+		ORDER BY m.scheduled_for, m.id
+		LIMIT ?
+	`
+	return r.getScheduled(query, now.UTC(), limit)
+}
+
+func (r *MessageRepository) getScheduled(query string, args ...interface{}) ([]*Message, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get inbox for address: %w", err)
+		return nil, fmt.Errorf("failed to get scheduled messages: %w", err)
 	}
 	defer rows.Close()
 
 	var messages []*Message
 	for rows.Next() {
-		message := &Message{}
-		var msgFromUserID, msgToUserID sql.NullInt64
-		err := rows.Scan(
-			&message.ID, &msgFromUserID, &msgToUserID,
-			&message.FromAddress, &message.ToAddress, &message.Subject,
-			&message.Body, &message.ReadStatus, &message.CreatedAt,
-		)
+		message, err := scanMessage(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan message: %w", err)
-		}
-		
-		// Convert nullable message IDs
-		if msgFromUserID.Valid {
-			id := int(msgFromUserID.Int64)
-			message.FromUserID = &id
+			return nil, fmt.Errorf("failed to scan scheduled message: %w", err)
 		}
-		if msgToUserID.Valid {
-			id := int(msgToUserID.Int64)
-			message.ToUserID = &id
-		}
-		
 		messages = append(messages, message)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	r.loadAttachments(context.Background(), r.db, messages)
 
 	return messages, nil
 }
 
-// GetSentForUser retrieves all sent messages for a user
-func (r *MessageRepository) GetSentForUser(userID int, limit, offset int) ([]*Message, error) {
-	query := `
-		SELECT m.id, m.from_user_id, m.to_user_id, m.from_address, m.to_address,
-		       m.subject, m.body, m.read_status, m.created_at,
-		       tu.id, tu.username, tu.email
-		FROM messages m
-		LEFT JOIN users tu ON m.to_user_id = tu.id
-		WHERE m.from_user_id = ?
+// generateThreadID generates a unique thread ID
+func generateThreadID() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// GetByID retrieves a message by ID with threading support
+func (r *MessageRepository) GetByID(id int) (*Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages m WHERE m.id = ?`
+	message, err := scanMessage(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	
+	return message, nil
+}
+
+// GetByIDWithAttachments retrieves a message by ID along with its
+// attachment metadata
+func (r *MessageRepository) GetByIDWithAttachments(id int) (*Message, error) {
+	message, err := r.GetByID(id)
+	if err != nil || message == nil {
+		return message, err
+	}
+
+	r.loadAttachments(context.Background(), r.db, []*Message{message})
+	return message, nil
+}
+
+// GetThreadForUser retrieves the messages in a thread that userID sent or
+// received, oldest first. Messages between other participants are never
+// read.
+func (r *MessageRepository) GetThreadForUser(threadID string, userID int) ([]*Message, error) {
+	return r.GetThreadForUserContext(context.Background(), threadID, userID)
+}
+
+// GetThreadForUserContext is like GetThreadForUser but aborts when ctx is
+// done
+func (r *MessageRepository) GetThreadForUserContext(ctx context.Context, threadID string, userID int) ([]*Message, error) {
+	threads, err := getThreads(ctx, r.db, userID, []string{threadID})
+	if err != nil {
+		return nil, err
+	}
+	messages := threads[threadID]
+	r.loadAttachments(ctx, r.db, messages)
+	return messages, nil
+}
+
+// GetThreadByID retrieves all messages in a thread, whoever they are
+// between. Listings for a user should use GetThreadForUser.
+func (r *MessageRepository) GetThreadByID(threadID string) ([]*Message, error) {
+	return r.GetThreadByIDContext(context.Background(), threadID)
+}
+
+// GetThreadByIDContext is like GetThreadByID but aborts when ctx is done
+func (r *MessageRepository) GetThreadByIDContext(ctx context.Context, threadID string) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE m.thread_id = ? AND ` + deliveredFilter + `
+		ORDER BY m.created_at ASC
+	`
+	rows, err := r.db.QueryContext(ctx, query, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load attachments for all messages
+	r.loadAttachments(ctx, r.db, messages)
+
+	return messages, nil
+}
+
+// scanMessagesWithSender scans rows selected with messageColumns followed by
+// the sender's id, username and email (from a LEFT JOIN on users)
+func scanMessagesWithSender(rows *sql.Rows) ([]*Message, error) {
+	var messages []*Message
+	for rows.Next() {
+		var fromUserIdDB sql.NullInt64
+		var fromUsername, fromEmail sql.NullString
+
+		message, err := scanMessage(rows, &fromUserIdDB, &fromUsername, &fromEmail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		// Set FromUser if exists
+		if fromUserIdDB.Valid {
+			message.FromUser = &User{
+				ID:       int(fromUserIdDB.Int64),
+				Username: fromUsername.String,
+				Email:    fromEmail.String,
+			}
+		}
+
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// loadAttachments loads attachment metadata for each message, reading
+// through q. Failures are logged rather than failing the whole request.
+func (r *MessageRepository) loadAttachments(ctx context.Context, q queryer, messages []*Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	ids := make([]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	attachments, err := r.attachmentRepo.getByMessageIDs(ctx, q, ids)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load attachments", "messages", len(ids), "err", err)
+		// Don't fail the whole request, just log the error
+		return
+	}
+
+	for _, msg := range messages {
+		msg.Attachments = attachments[msg.ID]
+		msg.AttachmentCount = len(msg.Attachments)
+	}
+}
+
+// InboxOptions controls which threads GetInboxForUser returns
+type InboxOptions struct {
+	Limit  int
+	Offset int
+
+	// FolderID restricts the listing to threads filed in this folder. When
+	// nil only unfiled threads (the inbox proper) are returned.
+	FolderID *int
+
+	// Sort is one of the InboxSort* keys; empty sorts by date. Order is
+	// "asc" or "desc"; empty uses the key's natural order, which is
+	// descending for date and unread and ascending otherwise.
+	Sort  string
+	Order string
+
+	// Before, if set, lists the threads that come after the cursor in the
+	// newest-first date order, and Offset is ignored. Only the default sort
+	// supports it.
+	Before *InboxCursor
+}
+
+// InboxCursor marks the last thread of a page of the inbox, so the next page
+// can start after it however much mail has arrived since. Threads are
+// ordered by their latest message, then by the ID of their first.
+type InboxCursor struct {
+	LastMessageTime string
+	ID              int
+}
+
+// Encode returns the cursor as an opaque token for clients to send back
+func (c InboxCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.LastMessageTime + "|" + strconv.Itoa(c.ID)))
+}
+
+// ParseInboxCursor decodes a token made by InboxCursor.Encode
+func ParseInboxCursor(token string) (*InboxCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	at, id, ok := strings.Cut(string(raw), "|")
+	if !ok || at == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	cursor := &InboxCursor{LastMessageTime: at}
+	if cursor.ID, err = strconv.Atoi(id); err != nil || cursor.ID < 1 {
+		return nil, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// Keys the inbox can be sorted by
+const (
+	InboxSortDate    = "date"    // Latest message in the thread
+	InboxSortSubject = "subject" // Subject of the thread's first message
+	InboxSortSender  = "sender"  // Sender of the thread's first message
+	InboxSortUnread  = "unread"  // Threads with unread mail first
+)
+
+// inboxSortKey is the ORDER BY expression of a sort key and whether it sorts
+// descending by default
+type inboxSortKey struct {
+	expr       string
+	descending bool
+}
+
+// inboxSortKeys maps the allowed sort keys to their SQL. Only these
+// expressions ever reach ORDER BY, so the sort cannot inject SQL. The
+// unread expression takes the user ID as its argument.
+var inboxSortKeys = map[string]inboxSortKey{
+	InboxSortDate:    {expr: `last_message_time`, descending: true},
+	InboxSortSubject: {expr: `LOWER(m.subject)`},
+	InboxSortSender:  {expr: `LOWER(m.from_address)`},
+	InboxSortUnread: {expr: `CASE WHEN EXISTS (
+			SELECT 1 FROM messages WHERE thread_id = m.thread_id AND to_user_id = ? AND read_status = FALSE
+		) THEN 1 ELSE 0 END`, descending: true},
+}
+
+// ValidInboxSort reports whether sort is a key the inbox can be sorted by
+func ValidInboxSort(sort string) bool {
+	_, ok := inboxSortKeys[sort]
+	return ok
+}
+
+// orderBy returns the ORDER BY clause (and its arguments) for the sort in
+// opts. Ties are broken newest thread first, so paging is stable.
+func (opts InboxOptions) orderBy(userID int) (string, []interface{}) {
+	sort := opts.Sort
+	if sort == "" {
+		sort = InboxSortDate
+	}
+	key := inboxSortKeys[sort]
+
+	direction := "ASC"
+	if opts.Order == "desc" || (opts.Order == "" && key.descending) {
+		direction = "DESC"
+	}
+
+	// Times are compared to the second, so threads started in the same
+	// second fall back to their IDs
+	if sort == InboxSortDate {
+		return key.expr + ` ` + direction + `, m.id ` + direction, nil
+	}
+
+	var args []interface{}
+	if sort == InboxSortUnread {
+		args = append(args, userID)
+	}
+	return key.expr + ` ` + direction + `, last_message_time DESC, m.id DESC`, args
+}
+
+// folderFilter returns the SQL condition (and its arguments) restricting
+// message m to the folder selected in opts
+func (opts InboxOptions) folderFilter(userID int) (string, []interface{}) {
+	if opts.FolderID != nil {
+		return `EXISTS (
+			SELECT 1 FROM message_folders mf JOIN folders f ON f.id = mf.folder_id
+			WHERE mf.message_id = m.id AND f.id = ? AND f.user_id = ?
+		)`, []interface{}{*opts.FolderID, userID}
+	}
+	return `NOT EXISTS (
+			SELECT 1 FROM message_folders mf JOIN folders f ON f.id = mf.folder_id
+			WHERE mf.message_id = m.id AND f.user_id = ?
+		)`, []interface{}{userID}
+}
+
+// inboxRootsFilter returns the SQL condition (and its arguments) selecting
+// the thread roots of a user's inbox listing. Callers pick one row per
+// m.thread_id. Snoozed messages are left out, so a thread is listed only if
+// some of its mail is not snoozed.
+func (opts InboxOptions) inboxRootsFilter(userID int) (string, []interface{}) {
+	folderCond, folderArgs := opts.folderFilter(userID)
+	cond := `m.to_user_id = ? AND m.snoozed_until IS NULL AND (m.parent_id IS NULL OR m.id = (
+			SELECT MIN(id) FROM messages WHERE thread_id = m.thread_id AND to_user_id = ? AND snoozed_until IS NULL
+		)) AND ` + folderCond
+	return cond, append([]interface{}{userID, userID}, folderArgs...)
+}
+
+// GetInboxForUser retrieves all messages for a user's inbox (threaded)
+func (r *MessageRepository) GetInboxForUser(userID int, opts InboxOptions) ([]*Message, error) {
+	return r.GetInboxForUserContext(context.Background(), userID, opts)
+}
+
+// GetInboxForUserContext is like GetInboxForUser but aborts when ctx is done
+func (r *MessageRepository) GetInboxForUserContext(ctx context.Context, userID int, opts InboxOptions) ([]*Message, error) {
+	messages, _, err := r.getInboxForUser(ctx, r.db, userID, opts)
+	return messages, err
+}
+
+// GetInboxCursorPageForUserContext retrieves the page of a user's inbox
+// after opts.Before, or the first page if it is nil, without counting the
+// threads. It also returns the cursor of the next page, or nil if this is
+// the last.
+func (r *MessageRepository) GetInboxCursorPageForUserContext(ctx context.Context, userID int, opts InboxOptions) ([]*Message, *InboxCursor, error) {
+	// One more thread than asked for tells whether there is another page
+	limit := opts.Limit
+	opts.Limit++
+	opts.Offset = 0
+
+	messages, cursors, err := r.getInboxForUser(ctx, r.db, userID, opts)
+	if err != nil || len(messages) <= limit {
+		return messages, nil, err
+	}
+	return messages[:limit], &cursors[limit-1], nil
+}
+
+// CountInboxForUser returns the number of threads in a user's inbox listing,
+// ignoring the limit and offset in opts
+func (r *MessageRepository) CountInboxForUser(userID int, opts InboxOptions) (int, error) {
+	return r.countInboxForUser(context.Background(), r.db, userID, opts)
+}
+
+// GetInboxPageForUser retrieves a page of a user's inbox together with the
+// total number of threads, read in one transaction so they agree
+func (r *MessageRepository) GetInboxPageForUser(userID int, opts InboxOptions) ([]*Message, int, error) {
+	return r.GetInboxPageForUserContext(context.Background(), userID, opts)
+}
+
+// GetInboxPageForUserContext is like GetInboxPageForUser but aborts when ctx
+// is done
+func (r *MessageRepository) GetInboxPageForUserContext(ctx context.Context, userID int, opts InboxOptions) ([]*Message, int, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	total, err := r.countInboxForUser(ctx, tx, userID, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, _, err := r.getInboxForUser(ctx, tx, userID, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, total, nil
+}
+
+func (r *MessageRepository) countInboxForUser(ctx context.Context, q queryer, userID int, opts InboxOptions) (int, error) {
+	rootsCond, args := opts.inboxRootsFilter(userID)
+	query := `SELECT COUNT(*) FROM (SELECT m.thread_id FROM messages m WHERE ` + rootsCond + ` GROUP BY m.thread_id) AS roots`
+
+	var count int
+	if err := q.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count inbox: %w", err)
+	}
+	return count, nil
+}
+
+// getInboxForUser returns a page of the inbox and, for each thread root in
+// it, the cursor marking its place in the date order
+func (r *MessageRepository) getInboxForUser(ctx context.Context, q queryer, userID int, opts InboxOptions) ([]*Message, []InboxCursor, error) {
+	rootsCond, rootsArgs := opts.inboxRootsFilter(userID)
+	orderBy, orderArgs := opts.orderBy(userID)
+	lastMessageTime := r.db.sortableTime("(SELECT MAX(created_at) FROM messages WHERE thread_id = m.thread_id AND to_user_id = ?)")
+
+	// Keyset paging picks up after the cursor's thread, where the date
+	// order would
+	var cursorCond string
+	var cursorArgs []interface{}
+	if opts.Before != nil {
+		cursorCond = ` AND (` + lastMessageTime + ` < ? OR (` + lastMessageTime + ` = ? AND m.id < ?))`
+		cursorArgs = []interface{}{userID, opts.Before.LastMessageTime, userID, opts.Before.LastMessageTime, opts.Before.ID}
+		opts.Offset = 0
+	}
+
+	// Get thread roots first. The threads are those with received mail in
+	// the listing, but a thread's root is the earliest message in it the
+	// user sent or received, which may be one they sent. Messages count
+	// either way.
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email,
+		       (SELECT COUNT(*) FROM messages
+		        WHERE thread_id = m.thread_id AND (to_user_id = ? OR from_user_id = ?) AND is_draft = FALSE) as reply_count,
+		       ` + lastMessageTime + ` as last_message_time
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE m.id IN (
+			SELECT MIN(t.id) FROM messages t
+			WHERE t.thread_id IN (SELECT m.thread_id FROM messages m WHERE ` + rootsCond + `)
+			  AND (t.from_user_id = ? OR (t.to_user_id = ? AND t.snoozed_until IS NULL)) AND t.is_draft = FALSE
+			GROUP BY t.thread_id
+		)` + cursorCond + `
+		ORDER BY ` + orderBy + `
+		LIMIT ? OFFSET ?
+	`
+	
+	args := []interface{}{userID, userID, userID}
+	args = append(args, rootsArgs...)
+	args = append(args, userID, userID)
+	args = append(args, cursorArgs...)
+	args = append(args, orderArgs...)
+	args = append(args, opts.Limit, opts.Offset)
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get inbox: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	var cursors []InboxCursor
+	var threadIDs []string
+	for rows.Next() {
+		var fromUserIdDB sql.NullInt64
+		var fromUsername, fromEmail sql.NullString
+		var replyCount int
+		var lastMessageTimeStr sql.NullString
+
+		message, err := scanMessage(rows,
+			&fromUserIdDB, &fromUsername, &fromEmail,
+			&replyCount, &lastMessageTimeStr,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		cursors = append(cursors, InboxCursor{LastMessageTime: lastMessageTimeStr.String, ID: message.ID})
+
+		// Set FromUser if exists
+		if fromUserIdDB.Valid {
+			message.FromUser = &User{
+				ID:       int(fromUserIdDB.Int64),
+				Username: fromUsername.String,
+				Email:    fromEmail.String,
+			}
+		}
+
+		// Threads with replies get them loaded below
+		if message.ThreadID != nil && replyCount > 1 {
+			threadIDs = append(threadIDs, *message.ThreadID)
+		}
+
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to get inbox: %w", err)
+	}
+	rows.Close()
+
+	threads, err := getThreads(ctx, q, userID, threadIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every other message of a thread is a reply to its root
+	all := messages
+	for _, message := range messages {
+		if message.ThreadID == nil {
+			continue
+		}
+		for _, reply := range threads[*message.ThreadID] {
+			if reply.ID != message.ID {
+				message.Replies = append(message.Replies, reply)
+			}
+		}
+		all = append(all, message.Replies...)
+	}
+
+	// Load attachments for all messages
+	r.loadAttachments(ctx, q, all)
+
+	return messages, cursors, nil
+}
+
+// getThreads retrieves the messages userID sent or received in several
+// threads in one query, keyed by thread ID and ordered oldest first like
+// GetThreadByID
+func getThreads(ctx context.Context, q queryer, userID int, threadIDs []string) (map[string][]*Message, error) {
+	threads := make(map[string][]*Message, len(threadIDs))
+	if len(threadIDs) == 0 {
+		return threads, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(threadIDs)), ",")
+	args := []interface{}{userID, userID}
+	for _, id := range threadIDs {
+		args = append(args, id)
+	}
+
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE (m.to_user_id = ? OR m.from_user_id = ?) AND m.thread_id IN (` + placeholders + `) AND ` + deliveredFilter + `
+		ORDER BY m.created_at ASC, m.id ASC
+	`
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get threads: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		threads[*message.ThreadID] = append(threads[*message.ThreadID], message)
+	}
+	return threads, nil
+}
+
+// ListThreadsForUser returns a page of the threads a user sent or received
+// delivered mail in, most recently active first, with the total number of
+// such threads
+func (r *MessageRepository) ListThreadsForUser(userID, limit, offset int) ([]*ThreadSummary, int, error) {
+	return r.ListThreadsForUserContext(context.Background(), userID, limit, offset)
+}
+
+// ListThreadsForUserContext is like ListThreadsForUser but aborts when ctx
+// is done
+func (r *MessageRepository) ListThreadsForUserContext(ctx context.Context, userID, limit, offset int) ([]*ThreadSummary, int, error) {
+	const visible = `(m.to_user_id = ? OR m.from_user_id = ?) AND m.thread_id IS NOT NULL AND ` + deliveredFilter
+
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var total int
+	countQuery := `SELECT COUNT(DISTINCT m.thread_id) FROM messages m WHERE ` + visible
+	if err := tx.QueryRowContext(ctx, countQuery, userID, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count threads: %w", err)
+	}
+
+	query := `
+		SELECT m.thread_id, COUNT(*),
+		       SUM(CASE WHEN m.to_user_id = ? AND m.read_status = FALSE THEN 1 ELSE 0 END)
+		FROM messages m
+		WHERE ` + visible + `
+		GROUP BY m.thread_id
+		ORDER BY ` + r.db.sortableTime("MAX(m.created_at)") + ` DESC, MAX(m.id) DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := tx.QueryContext(ctx, query, userID, userID, userID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list threads: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []*ThreadSummary
+	byID := make(map[string]*ThreadSummary)
+	for rows.Next() {
+		t := &ThreadSummary{Participants: []string{}}
+		if err := rows.Scan(&t.ThreadID, &t.MessageCount, &t.UnreadCount); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan thread: %w", err)
+		}
+		threads = append(threads, t)
+		byID[t.ThreadID] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to list threads: %w", err)
+	}
+	rows.Close()
+	if len(threads) == 0 {
+		return threads, total, nil
+	}
+
+	// The subject, participants and last activity come from the messages
+	// themselves, read oldest first so the last one seen is the latest
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(threads)), ",")
+	args := []interface{}{userID, userID}
+	for _, t := range threads {
+		args = append(args, t.ThreadID)
+	}
+	detailQuery := `
+		SELECT m.thread_id, m.subject, m.from_address, m.to_address, m.created_at
+		FROM messages m
+		WHERE ` + visible + ` AND m.thread_id IN (` + placeholders + `)
+		ORDER BY m.created_at ASC, m.id ASC
+	`
+	rows, err = tx.QueryContext(ctx, detailQuery, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list threads: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]map[string]bool)
+	for rows.Next() {
+		var threadID, subject, from, to string
+		var createdAt time.Time
+		if err := rows.Scan(&threadID, &subject, &from, &to, &createdAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan thread message: %w", err)
+		}
+		t := byID[threadID]
+		t.Subject, t.LastActivity = subject, createdAt
+
+		if seen[threadID] == nil {
+			seen[threadID] = make(map[string]bool)
+		}
+		for _, address := range []string{from, to} {
+			if address != "" && !seen[threadID][address] {
+				seen[threadID][address] = true
+				t.Participants = append(t.Participants, address)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to list threads: %w", err)
+	}
+
+	return threads, total, nil
+}
+
+// GetInboxForAddress retrieves messages for a specific address (for external messages)
+func (r *MessageRepository) GetInboxForAddress(address string, limit, offset int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		WHERE m.to_address = ? AND ` + deliveredFilter + `
+		ORDER BY m.created_at DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := r.db.Query(query, address, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbox for address: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// GetSentForUser retrieves all sent messages for a user
+func (r *MessageRepository) GetSentForUser(userID int, limit, offset int) ([]*Message, error) {
+	return r.getSentForUser(context.Background(), r.db, userID, limit, offset)
+}
+
+// CountSentForUser returns the number of messages a user has sent
+func (r *MessageRepository) CountSentForUser(userID int) (int, error) {
+	return r.countSentForUser(context.Background(), r.db, userID)
+}
+
+// GetSentPageForUser retrieves a page of a user's sent messages together
+// with the total number sent, read in one transaction so they agree
+func (r *MessageRepository) GetSentPageForUser(userID int, limit, offset int) ([]*Message, int, error) {
+	return r.GetSentPageForUserContext(context.Background(), userID, limit, offset)
+}
+
+// GetSentPageForUserContext is like GetSentPageForUser but aborts when ctx is
+// done
+func (r *MessageRepository) GetSentPageForUserContext(ctx context.Context, userID int, limit, offset int) ([]*Message, int, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	total, err := r.countSentForUser(ctx, tx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := r.getSentForUser(ctx, tx, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, total, nil
+}
+
+func (r *MessageRepository) countSentForUser(ctx context.Context, q queryer, userID int) (int, error) {
+	query := `SELECT COUNT(*) FROM messages m WHERE m.from_user_id = ? AND ` + deliveredFilter
+
+	var count int
+	if err := q.QueryRowContext(ctx, query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count sent messages: %w", err)
+	}
+	return count, nil
+}
+
+func (r *MessageRepository) getSentForUser(ctx context.Context, q queryer, userID int, limit, offset int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       tu.id, tu.username, tu.email
+		FROM messages m
+		LEFT JOIN users tu ON m.to_user_id = tu.id
+		WHERE m.from_user_id = ? AND ` + deliveredFilter + `
+		ORDER BY m.created_at DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := q.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sent messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		var toUserIdDB sql.NullInt64
+		var toUsername, toEmail sql.NullString
+
+		message, err := scanMessage(rows, &toUserIdDB, &toUsername, &toEmail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		// Set ToUser if exists
+		if toUserIdDB.Valid {
+			message.ToUser = &User{
+				ID:       int(toUserIdDB.Int64),
+				Username: toUsername.String,
+				Email:    toEmail.String,
+			}
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// GetFlaggedForUser retrieves the messages a user has flagged, newest first
+func (r *MessageRepository) GetFlaggedForUser(userID int, limit, offset int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE m.to_user_id = ? AND m.flagged = TRUE
 		ORDER BY m.created_at DESC
 		LIMIT ? OFFSET ?
 	`
-	rows, err := r.db.Query(query, userID, limit, offset)
+	rows, err := r.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get flagged messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load attachments for all messages
+	r.loadAttachments(context.Background(), r.db, messages)
+
+	return messages, nil
+}
+
+// MarkAsRead marks a message as read
+func (r *MessageRepository) MarkAsRead(messageID int) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `UPDATE messages SET read_status = TRUE WHERE id = ? AND read_status = FALSE`
+	result, err := r.db.Exec(query, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to mark message as read: %w", err)
+	}
+	r.adjustRecipientUnread(result, messageID, -1)
+	return nil
+}
+
+// RecordReadReceipt sets the time a message was read if its sender asked for
+// a read receipt and the recipient allows receipts to be sent. Only the first
+// read is recorded; it reports whether this call recorded it.
+func (r *MessageRepository) RecordReadReceipt(messageID int) (bool, error) {
+	query := `
+		UPDATE messages SET read_at = ?
+		WHERE id = ? AND request_receipt = TRUE AND read_at IS NULL
+		  AND EXISTS (SELECT 1 FROM users u WHERE u.id = messages.to_user_id AND u.send_read_receipts = TRUE)
+	`
+	result, err := r.db.Exec(query, time.Now(), messageID)
+	if err != nil {
+		return false, fmt.Errorf("failed to record read receipt: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record read receipt: %w", err)
+	}
+	return n > 0, nil
+}
+
+// MarkAsUnread marks a message as unread
+func (r *MessageRepository) MarkAsUnread(messageID int) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	query := `UPDATE messages SET read_status = FALSE WHERE id = ? AND read_status = TRUE`
+	result, err := r.db.Exec(query, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to mark message as unread: %w", err)
+	}
+	r.adjustRecipientUnread(result, messageID, 1)
+	return nil
+}
+
+// adjustRecipientUnread applies delta to the cached unread count of the
+// recipient of messageID if result changed the message
+func (r *MessageRepository) adjustRecipientUnread(result sql.Result, messageID, delta int) {
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return
+	}
+
+	var toUserID sql.NullInt64
+	var uncounted bool
+	err := r.db.QueryRow(`SELECT m.to_user_id, NOT `+countedFilter+` FROM messages m WHERE m.id = ?`, messageID).Scan(&toUserID, &uncounted)
+	if err != nil {
+		// We cannot tell whose count changed
+		r.db.unread.clear()
+		return
+	}
+	if toUserID.Valid && !uncounted {
+		r.db.unread.adjust(int(toUserID.Int64), delta)
+	}
+}
+
+// adjustUnlessMuted applies delta to a user's cached unread count for a
+// message in threadID, unless the user has muted the thread
+func (r *MessageRepository) adjustUnlessMuted(userID int, threadID *string, delta int) {
+	if threadID != nil {
+		muted, err := r.IsThreadMuted(userID, *threadID)
+		if err != nil {
+			r.db.unread.invalidate(userID)
+			return
+		}
+		if muted {
+			return
+		}
+	}
+	r.db.unread.adjust(userID, delta)
+}
+
+// GetDraftsForUser retrieves a user's unsent drafts, most recently saved
+// first. Scheduled sends are left out; see GetScheduledForUser.
+func (r *MessageRepository) GetDraftsForUser(userID int, limit, offset int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		WHERE m.from_user_id = ? AND m.is_draft = TRUE AND m.scheduled_for IS NULL
+		ORDER BY m.created_at DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := r.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drafts: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan draft: %w", err)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// UpdateDraft replaces the contents of a draft. The saved time is bumped so
+// recently edited drafts sort first.
+func (r *MessageRepository) UpdateDraft(messageID int, toAddress, replyTo, subject, body string, isHTML bool) error {
+	query := `
+		UPDATE messages SET to_address = ?, reply_to = ?, subject = ?, body = ?, preview = ?, is_html = ?, created_at = ?
+		WHERE id = ? AND is_draft = TRUE
+	`
+	body = r.db.storedBody(body, isHTML)
+	_, err := r.db.Exec(query, toAddress, replyTo, subject, body, messagePreview(body, isHTML), isHTML, time.Now(), messageID)
+	if err != nil {
+		return fmt.Errorf("failed to update draft: %w", err)
+	}
+	return nil
+}
+
+// UpdateDraftSender changes the From address of all of a user's drafts, so
+// drafts saved before a rename are sent from the new address
+func (r *MessageRepository) UpdateDraftSender(userID int, fromAddress string) error {
+	query := `UPDATE messages SET from_address = ? WHERE from_user_id = ? AND is_draft = TRUE`
+	_, err := r.db.Exec(query, fromAddress, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update draft sender: %w", err)
+	}
+	return nil
+}
+
+// MarkDraftSent turns a draft into a delivered message addressed to
+// toAddress (and toUserID for local recipients), stamping it with the
+// delivery time. It returns false if the message is no longer a draft, or
+// is scheduled to be sent later. isHTML is the draft's body format.
+func (r *MessageRepository) MarkDraftSent(messageID int, toUserID *int, toAddress, replyTo, body string, isHTML bool) (bool, error) {
+	query := `
+		UPDATE messages SET is_draft = FALSE, scheduled_for = NULL, to_user_id = ?, to_address = ?, reply_to = ?, body = ?, preview = ?, created_at = ?
+		WHERE id = ? AND is_draft = TRUE AND (scheduled_for IS NULL OR scheduled_for <= ?)
+	`
+	done := r.db.unread.begin()
+	defer done()
+
+	now := time.Now()
+	result, err := r.db.Exec(query, toUserID, toAddress, replyTo, body, messagePreview(body, isHTML), now, messageID, now.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to send draft: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		if toUserID != nil {
+			r.db.unread.invalidate(*toUserID)
+		}
+		return false, fmt.Errorf("failed to send draft: %w", err)
+	}
+	if affected > 0 && toUserID != nil {
+		var threadID sql.NullString
+		if err := r.db.QueryRow(`SELECT thread_id FROM messages WHERE id = ?`, messageID).Scan(&threadID); err != nil {
+			r.db.unread.invalidate(*toUserID)
+		} else {
+			r.adjustUnlessMuted(*toUserID, &threadID.String, 1)
+		}
+	}
+	return affected > 0, nil
+}
+
+// SearchMessages finds messages the user sent or received whose subject or
+// body contains query, newest first
+func (r *MessageRepository) SearchMessages(userID int, query string, limit, offset int) ([]*Message, error) {
+	return r.SearchMessagesContext(context.Background(), userID, query, limit, offset)
+}
+
+// SearchMessagesContext is like SearchMessages but aborts when ctx is done
+func (r *MessageRepository) SearchMessagesContext(ctx context.Context, userID int, query string, limit, offset int) ([]*Message, error) {
+	pattern := "%" + escapeLike(query) + "%"
+	sqlQuery := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE (m.to_user_id = ? OR m.from_user_id = ?) AND ` + deliveredFilter + `
+		  AND (m.subject ` + r.db.like() + ` ? ESCAPE '\' OR m.body ` + r.db.like() + ` ? ESCAPE '\')
+		ORDER BY m.created_at DESC
+		LIMIT ? OFFSET ?
+	`
+	rows, err := r.db.QueryContext(ctx, sqlQuery, userID, userID, pattern, pattern, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMessagesWithSender(rows)
+}
+
+// SearchCriteria selects messages a user received. Empty strings and nil
+// flags match everything; text matches are case-insensitive substrings.
+type SearchCriteria struct {
+	From    string
+	Subject string
+	Text    string // Subject or body
+	Read    *bool
+	Flagged *bool
+}
+
+// SearchReceivedIDs returns the IDs of up to limit messages the user
+// received that match every criterion, newest first
+func (r *MessageRepository) SearchReceivedIDs(userID int, criteria SearchCriteria, limit int) ([]int, error) {
+	conds := []string{`m.to_user_id = ?`}
+	args := []interface{}{userID}
+	match := func(column, value string) {
+		conds = append(conds, column+` `+r.db.like()+` ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(value)+"%")
+	}
+	if criteria.From != "" {
+		match("m.from_address", criteria.From)
+	}
+	if criteria.Subject != "" {
+		match("m.subject", criteria.Subject)
+	}
+	if criteria.Text != "" {
+		pattern := "%" + escapeLike(criteria.Text) + "%"
+		conds = append(conds, `(m.subject `+r.db.like()+` ? ESCAPE '\' OR m.body `+r.db.like()+` ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	if criteria.Read != nil {
+		conds = append(conds, `m.read_status = ?`)
+		args = append(args, *criteria.Read)
+	}
+	if criteria.Flagged != nil {
+		conds = append(conds, `m.flagged = ?`)
+		args = append(args, *criteria.Flagged)
+	}
+
+	query := `SELECT m.id FROM messages m WHERE ` + strings.Join(conds, " AND ") + ` ORDER BY m.id DESC LIMIT ?`
+	rows, err := r.db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan message ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	return ids, nil
+}
+
+// FullTextSearch finds messages the user sent or received matching all words
+// of query using the FTS5 index, most relevant first. It returns
+// ErrFullTextSearchUnavailable when the index doesn't exist.
+func (r *MessageRepository) FullTextSearch(userID int, query string, limit, offset int) ([]*Message, error) {
+	return r.FullTextSearchContext(context.Background(), userID, query, limit, offset)
+}
+
+// FullTextSearchContext is like FullTextSearch but aborts when ctx is done
+func (r *MessageRepository) FullTextSearchContext(ctx context.Context, userID int, query string, limit, offset int) ([]*Message, error) {
+	if !r.db.FullTextSearchEnabled() {
+		return nil, ErrFullTextSearchUnavailable
+	}
+
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+
+	sqlQuery := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages_fts
+		JOIN messages m ON m.id = messages_fts.rowid
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE messages_fts MATCH ?
+		  AND (m.to_user_id = ? OR m.from_user_id = ?) AND ` + deliveredFilter + `
+		ORDER BY bm25(messages_fts)
+		LIMIT ? OFFSET ?
+	`
+	rows, err := r.db.QueryContext(ctx, sqlQuery, match, userID, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMessagesWithSender(rows)
+}
+
+// escapeLike escapes the LIKE wildcards in s using backslash
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SetFlag sets or clears the flag on a message. The flag belongs to the
+// recipient's copy of the message.
+func (r *MessageRepository) SetFlag(messageID int, flagged bool) error {
+	query := `UPDATE messages SET flagged = ? WHERE id = ?`
+	_, err := r.db.Exec(query, flagged, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to set message flag: %w", err)
+	}
+	return nil
+}
+
+// SetRequestReceipt marks a sent message as asking for a read receipt
+func (r *MessageRepository) SetRequestReceipt(messageID int) error {
+	query := `UPDATE messages SET request_receipt = TRUE WHERE id = ?`
+	_, err := r.db.Exec(query, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to request read receipt: %w", err)
+	}
+	return nil
+}
+
+// SetDeliveryStatus records the delivery outcome of a sent message.
+// deliveryError explains a failed delivery and is empty otherwise.
+func (r *MessageRepository) SetDeliveryStatus(messageID int, status, deliveryError string) error {
+	query := `UPDATE messages SET delivery_status = ?, delivery_error = ? WHERE id = ?`
+	_, err := r.db.Exec(query, status, deliveryError, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to set delivery status: %w", err)
+	}
+	return nil
+}
+
+// GroupSend marks the copies of a message sent to several recipients as
+// one send, so that GetSendRecipients can find them all
+func (r *MessageRepository) GroupSend(messageIDs []int) error {
+	if len(messageIDs) < 2 {
+		return nil
+	}
+	sendID, err := generateThreadID()
+	if err != nil {
+		return fmt.Errorf("failed to generate send ID: %w", err)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	args := []interface{}{sendID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	query := `UPDATE messages SET send_id = ? WHERE id IN (` + placeholders + `)`
+	if _, err := r.db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to group send: %w", err)
+	}
+	return nil
+}
+
+// GetSendRecipients retrieves the delivery outcome of every copy sent along
+// with the given message, including the message itself, in the order they
+// were stored
+func (r *MessageRepository) GetSendRecipients(messageID, fromUserID int) ([]*RecipientDelivery, error) {
+	query := `
+		SELECT id, to_address, delivery_status, delivery_error, read_at
+		FROM messages
+		WHERE from_user_id = ? AND (id = ? OR (send_id <> '' AND send_id = (SELECT send_id FROM messages WHERE id = ?)))
+		ORDER BY id
+	`
+	rows, err := r.db.Query(query, fromUserID, messageID, messageID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sent messages: %w", err)
+		return nil, fmt.Errorf("failed to get send recipients: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []*Message
+	var recipients []*RecipientDelivery
 	for rows.Next() {
-		message := &Message{}
-		var toUser User
-		var msgFromUserID, msgToUserID sql.NullInt64
-		var toUserIdDB sql.NullInt64
-		var toUsername, toEmail sql.NullString
+		rcpt := &RecipientDelivery{}
+		var readAt sql.NullTime
+		if err := rows.Scan(&rcpt.MessageID, &rcpt.To, &rcpt.DeliveryStatus, &rcpt.DeliveryError, &readAt); err != nil {
+			return nil, fmt.Errorf("failed to scan send recipient: %w", err)
+		}
+		if readAt.Valid {
+			rcpt.ReadAt = &readAt.Time
+		}
+		recipients = append(recipients, rcpt)
+	}
+	return recipients, rows.Err()
+}
 
-		err := rows.Scan(
-			&message.ID, &msgFromUserID, &msgToUserID,
-			&message.FromAddress, &message.ToAddress, &message.Subject,
-			&message.Body, &message.ReadStatus, &message.CreatedAt,
-			&toUserIdDB, &toUsername, &toEmail,
-		)
+// GetPendingForHost retrieves the messages waiting for host's server to
+// come back, oldest first
+func (r *MessageRepository) GetPendingForHost(host string) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		WHERE m.delivery_status = ? AND m.to_user_id IS NULL AND LOWER(m.to_address) LIKE ? ESCAPE '\'
+		ORDER BY m.created_at, m.id
+	`
+	rows, err := r.db.Query(query, DeliveryPending, "%@"+escapeLike(strings.ToLower(host)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
 
-		// Convert nullable message IDs
-		if msgFromUserID.Valid {
-			id := int(msgFromUserID.Int64)
-			message.FromUserID = &id
-		}
-		if msgToUserID.Valid {
-			id := int(msgToUserID.Int64)
-			message.ToUserID = &id
-		}
+// GetPendingSince retrieves up to limit messages that have been waiting for
+// their recipient's server since before cutoff, oldest first
+func (r *MessageRepository) GetPendingSince(cutoff time.Time, limit int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		WHERE m.delivery_status = ? AND m.to_user_id IS NULL AND m.created_at < ?
+		ORDER BY m.created_at, m.id
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, DeliveryPending, cutoff, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired pending messages: %w", err)
+	}
+	defer rows.Close()
 
-		// Set ToUser if exists
-		if toUserIdDB.Valid {
-			toUser.ID = int(toUserIdDB.Int64)
-			toUser.Username = toUsername.String
-			toUser.Email = toEmail.String
-			message.ToUser = &toUser
+	var messages []*Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
-
 		messages = append(messages, message)
 	}
-
-	return messages, nil
+	return messages, rows.Err()
 }
 
-// MarkAsRead marks a message as read
-func (r *MessageRepository) MarkAsRead(messageID int) error {
-	query := `UPDATE messages SET read_status = TRUE WHERE id = ?`
-	_, err := r.db.Exec(query, messageID)
+// FailPending marks a pending message as failed. It reports false if the
+// message was no longer pending, such as when a retry delivered it first.
+func (r *MessageRepository) FailPending(messageID int, deliveryError string) (bool, error) {
+	query := `UPDATE messages SET delivery_status = ?, delivery_error = ? WHERE id = ? AND delivery_status = ?`
+	result, err := r.db.Exec(query, DeliveryFailed, deliveryError, messageID, DeliveryPending)
 	if err != nil {
-		return fmt.Errorf("failed to mark message as read: %w", err)
+		return false, fmt.Errorf("failed to fail pending message: %w", err)
 	}
-	return nil
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to fail pending message: %w", err)
+	}
+	return n > 0, nil
 }
 
 // Delete deletes a message
 func (r *MessageRepository) Delete(messageID int) error {
+	done := r.db.unread.begin()
+	defer done()
+
+	// Note whose unread count the message is part of, if anyone's
+	var toUserID sql.NullInt64
+	var readStatus, uncounted bool
+	err := r.db.QueryRow(`SELECT m.to_user_id, m.read_status, NOT `+countedFilter+` FROM messages m WHERE m.id = ?`, messageID).Scan(&toUserID, &readStatus, &uncounted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+
 	query := `DELETE FROM messages WHERE id = ?`
-	_, err := r.db.Exec(query, messageID)
+	result, err := r.db.Exec(query, messageID)
 	if err != nil {
 		return fmt.Errorf("failed to delete message: %w", err)
 	}
+	if n, err := result.RowsAffected(); toUserID.Valid && !readStatus && !uncounted && (err != nil || n > 0) {
+		r.db.unread.adjust(int(toUserID.Int64), -1)
+	}
 	return nil
 }
 
-// GetUnreadCount returns the count of unread messages for a user
+// Outcomes of a bulk operation for an individual message
+const (
+	BulkApplied      = "ok"
+	BulkNotFound     = "not_found"
+	BulkAccessDenied = "access_denied"
+)
+
+// MarkManyAsRead marks the given messages received by userID as read in a
+// single transaction. It returns the outcome for each ID; messages the user
+// did not receive are left untouched.
+func (r *MessageRepository) MarkManyAsRead(userID int, ids []int) (map[int]string, error) {
+	return r.setReadStatusMany(userID, ids, true)
+}
+
+// MarkManyAsUnread marks the given messages received by userID as unread in
+// a single transaction, like MarkManyAsRead
+func (r *MessageRepository) MarkManyAsUnread(userID int, ids []int) (map[int]string, error) {
+	return r.setReadStatusMany(userID, ids, false)
+}
+
+func (r *MessageRepository) setReadStatusMany(userID int, ids []int, read bool) (map[int]string, error) {
+	done := r.db.unread.begin()
+	defer done()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	owners, err := messageOwners(tx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[int]string, len(ids))
+	var allowed []int
+	for _, id := range ids {
+		owner, ok := owners[id]
+		switch {
+		case !ok:
+			results[id] = BulkNotFound
+		case !owner.isRecipient(userID):
+			results[id] = BulkAccessDenied
+		default:
+			results[id] = BulkApplied
+			allowed = append(allowed, id)
+		}
+	}
+
+	var changed int64
+	if len(allowed) > 0 {
+		in, args := inClause(allowed)
+		// Only changes to mail that counts as unread move the unread count
+		err := tx.QueryRow(`SELECT COUNT(*) FROM messages m WHERE m.id IN (`+in+`) AND m.read_status = ? AND `+countedFilter,
+			append(args, !read)...).Scan(&changed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update read status: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE messages SET read_status = ? WHERE id IN (`+in+`) AND read_status = ?`, append(append([]interface{}{read}, args...), !read)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update read status: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit read status: %w", err)
+	}
+	if read {
+		changed = -changed
+	}
+	r.db.unread.adjust(userID, int(changed))
+	return results, nil
+}
+
+// DeleteMany removes the given messages from userID's mailbox in a single
+// transaction, returning the outcome for each ID. A message is shared by its
+// sender and recipient, so the user's side is detached and the row is only
+// deleted once neither side references a local user any more.
+func (r *MessageRepository) DeleteMany(userID int, ids []int) (map[int]string, error) {
+	done := r.db.unread.begin()
+	defer done()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	owners, err := messageOwners(tx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[int]string, len(ids))
+	var received, sent []int
+	for _, id := range ids {
+		owner, ok := owners[id]
+		if !ok {
+			results[id] = BulkNotFound
+			continue
+		}
+		isRecipient, isSender := owner.isRecipient(userID), owner.isSender(userID)
+		if !isRecipient && !isSender {
+			results[id] = BulkAccessDenied
+			continue
+		}
+		results[id] = BulkApplied
+		if isRecipient {
+			received = append(received, id)
+		}
+		if isSender {
+			sent = append(sent, id)
+		}
+	}
+
+	if len(received) > 0 {
+		in, args := inClause(received)
+		_, err = tx.Exec(`
+			DELETE FROM message_folders
+			WHERE message_id IN (`+in+`) AND folder_id IN (SELECT id FROM folders WHERE user_id = ?)
+		`, append(args, userID)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove messages from folders: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE messages SET to_user_id = NULL, flagged = FALSE WHERE id IN (`+in+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detach received messages: %w", err)
+		}
+	}
+
+	if len(sent) > 0 {
+		in, args := inClause(sent)
+		_, err = tx.Exec(`UPDATE messages SET from_user_id = NULL WHERE id IN (`+in+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detach sent messages: %w", err)
+		}
+	}
+
+	if deleted := append(received, sent...); len(deleted) > 0 {
+		in, args := inClause(deleted)
+		_, err = tx.Exec(`
+			DELETE FROM messages
+			WHERE id IN (`+in+`) AND from_user_id IS NULL AND to_user_id IS NULL
+		`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete messages: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	if len(received) > 0 {
+		r.db.unread.invalidate(userID)
+	}
+	return results, nil
+}
+
+// messageOwner holds the local users a message belongs to
+type messageOwner struct {
+	fromUserID sql.NullInt64
+	toUserID   sql.NullInt64
+}
+
+func (o messageOwner) isRecipient(userID int) bool {
+	return o.toUserID.Valid && int(o.toUserID.Int64) == userID
+}
+
+func (o messageOwner) isSender(userID int) bool {
+	return o.fromUserID.Valid && int(o.fromUserID.Int64) == userID
+}
+
+// messageOwners looks up the sender and recipient of each delivered message
+// in ids. Drafts and IDs that do not exist are absent from the result.
+func messageOwners(tx *Tx, ids []int) (map[int]messageOwner, error) {
+	owners := make(map[int]messageOwner, len(ids))
+	if len(ids) == 0 {
+		return owners, nil
+	}
+
+	in, args := inClause(ids)
+	rows, err := tx.Query(`
+		SELECT id, from_user_id, to_user_id FROM messages
+		WHERE id IN (`+in+`) AND is_draft = FALSE
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var owner messageOwner
+		if err := rows.Scan(&id, &owner.fromUserID, &owner.toUserID); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		owners[id] = owner
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to look up messages: %w", err)
+	}
+	return owners, nil
+}
+
+// inClause returns the placeholder list and arguments for an IN (...) clause
+// matching ids
+func inClause(ids []int) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ","), args
+}
+
+// GetReceivedAfter returns up to limit messages the user received with an ID
+// greater than afterID, oldest first, so clients can catch up on messages
+// they missed
+func (r *MessageRepository) GetReceivedAfter(userID, afterID, limit int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE m.to_user_id = ? AND m.id > ? AND ` + deliveredFilter + `
+		ORDER BY m.id
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, userID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get received messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	r.loadAttachments(context.Background(), r.db, messages)
+
+	return messages, nil
+}
+
+// GetMailboxAfter returns up to limit of the messages a user sent or
+// received with an ID greater than afterID, oldest first, with their
+// attachment metadata. Drafts are left out. Callers page through a whole
+// mailbox by passing the last ID they got back.
+func (r *MessageRepository) GetMailboxAfter(ctx context.Context, userID, afterID, limit int) ([]*Message, error) {
+	query := `
+		SELECT ` + messageColumns + `,
+		       fu.id, fu.username, fu.email
+		FROM messages m
+		LEFT JOIN users fu ON m.from_user_id = fu.id
+		WHERE (m.to_user_id = ? OR m.from_user_id = ?) AND m.id > ? AND ` + deliveredFilter + `
+		ORDER BY m.id
+		LIMIT ?
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID, userID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessagesWithSender(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	r.loadAttachments(ctx, r.db, messages)
+
+	return messages, nil
+}
+
+// GetLatestReceivedID returns the ID of the newest message the user received,
+// or 0 if there is none
+func (r *MessageRepository) GetLatestReceivedID(userID int) (int, error) {
+	var id int
+	query := `SELECT COALESCE(MAX(id), 0) FROM messages WHERE to_user_id = ? AND is_draft = FALSE`
+	err := r.db.QueryRow(query, userID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get latest message ID: %w", err)
+	}
+	return id, nil
+}
+
+// GetUnreadCount returns the count of unread messages for a user, leaving
+// out snoozed messages and muted threads. Counts are served from memory once loaded; see
+// unreadCache.
 func (r *MessageRepository) GetUnreadCount(userID int) (int, error) {
-	var count int
-	query := `SELECT COUNT(*) FROM messages WHERE to_user_id = ? AND read_status = FALSE`
+	count, generation, ok := r.db.unread.get(userID)
+	if ok {
+		return count, nil
+	}
+
+	query := `SELECT COUNT(*) FROM messages m WHERE m.to_user_id = ? AND m.read_status = FALSE AND ` + countedFilter
 	err := r.db.QueryRow(query, userID).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get unread count: %w", err)
 	}
+	r.db.unread.store(userID, count, generation)
 	return count, nil
-} 
\ No newline at end of file
+} 
+
+// InboxName is the key of the inbox in GetUnreadCountsByFolder. Folders
+// cannot be given this name.
+const InboxName = "Inbox"
+
+// GetUnreadCountsByFolder returns the number of unread messages a user has
+// received in each of their folders, keyed by folder name, and in the inbox,
+// keyed by InboxName. Folders without unread mail are included with 0. Like
+// GetUnreadCount it leaves out snoozed messages and muted threads.
+func (r *MessageRepository) GetUnreadCountsByFolder(userID int) (map[string]int, error) {
+	query := `
+		SELECT f.name, COUNT(m.id)
+		FROM folders f
+		LEFT JOIN message_folders mf ON mf.folder_id = f.id
+		LEFT JOIN messages m ON m.id = mf.message_id AND m.to_user_id = ? AND m.read_status = FALSE AND `+countedFilter+`
+		WHERE f.user_id = ?
+		GROUP BY f.id, f.name
+		UNION ALL
+		SELECT ?, COUNT(*)
+		FROM messages m
+		WHERE m.to_user_id = ? AND m.read_status = FALSE AND `+countedFilter+`
+		  AND NOT EXISTS (
+			SELECT 1 FROM message_folders mf
+			JOIN folders f ON f.id = mf.folder_id
+			WHERE mf.message_id = m.id AND f.user_id = ?
+		  )
+	`
+	rows, err := r.db.Query(query, userID, userID, InboxName, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unread counts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan unread count: %w", err)
+		}
+		counts[name] += count
+	}
+	return counts, rows.Err()
+}
+
+// MailboxStatus counts the messages a user has received
+type MailboxStatus struct {
+	Messages int
+	Unread   int
+	Flagged  int
+	LatestID int // ID of the newest message, 0 if there is none
+}
+
+// GetMailboxStatus returns the counts of the messages a user has received
+func (r *MessageRepository) GetMailboxStatus(userID int) (*MailboxStatus, error) {
+	query := `
+		SELECT COUNT(*),
+		       COALESCE(SUM(CASE WHEN read_status = FALSE THEN 1 ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN flagged = TRUE THEN 1 ELSE 0 END), 0),
+		       COALESCE(MAX(id), 0)
+		FROM messages WHERE to_user_id = ?
+	`
+	var status MailboxStatus
+	err := r.db.QueryRow(query, userID).Scan(&status.Messages, &status.Unread, &status.Flagged, &status.LatestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox status: %w", err)
+	}
+	return &status, nil
+}
+
+// GetUserStorageUsage returns the number of bytes a user's mailbox takes up:
+// the bodies of every message they sent or received, including drafts, plus
+// the size of their attachments
+func (r *MessageRepository) GetUserStorageUsage(userID int) (int64, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(SUM(` + r.db.byteLength("body") + `), 0) FROM messages
+			 WHERE from_user_id = ? OR to_user_id = ?)
+			+
+			(SELECT COALESCE(SUM(a.file_size), 0) FROM attachments a
+			 JOIN messages m ON m.id = a.message_id
+			 WHERE m.from_user_id = ? OR m.to_user_id = ?)
+	`
+	var usage int64
+	err := r.db.QueryRow(query, userID, userID, userID, userID).Scan(&usage)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get storage usage: %w", err)
+	}
+	return usage, nil
+}
+
+// EnforceInboxLimit evicts the oldest unflagged messages from a user's
+// mailbox until at most maxMessages remain, returning how many were evicted.
+// Flagged messages still count towards the limit but are never evicted.
+// Messages sent by another local user are detached from the recipient rather
+// than deleted, so the sender keeps their copy in Sent.
+func (r *MessageRepository) EnforceInboxLimit(userID, maxMessages int) (int, error) {
+	done := r.db.unread.begin()
+	defer done()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM messages WHERE to_user_id = ? AND is_draft = FALSE`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	if count <= maxMessages {
+		return 0, nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, from_user_id FROM messages
+		WHERE to_user_id = ? AND is_draft = FALSE AND flagged = FALSE
+		ORDER BY created_at ASC, id ASC
+		LIMIT ?
+	`, userID, count-maxMessages)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find messages to evict: %w", err)
+	}
+
+	type candidate struct {
+		id         int
+		fromUserID sql.NullInt64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.fromUserID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan message: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to find messages to evict: %w", err)
+	}
+
+	for _, c := range candidates {
+		if !c.fromUserID.Valid || int(c.fromUserID.Int64) == userID {
+			_, err = tx.Exec(`DELETE FROM messages WHERE id = ?`, c.id)
+		} else {
+			_, err = tx.Exec(`
+				DELETE FROM message_folders
+				WHERE message_id = ? AND folder_id IN (SELECT id FROM folders WHERE user_id = ?)
+			`, c.id, userID)
+			if err == nil {
+				_, err = tx.Exec(`UPDATE messages SET to_user_id = NULL, flagged = FALSE WHERE id = ?`, c.id)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to evict message %d: %w", c.id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit eviction: %w", err)
+	}
+	if len(candidates) > 0 {
+		r.db.unread.invalidate(userID)
+	}
+	return len(candidates), nil
+}
@@ -0,0 +1,70 @@
+package database_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEnforceInboxLimitEvictsOldest(t *testing.T) {
+	s := newTestStore(t)
+	alice := s.createUser(t, "alice")
+	bob := s.createUser(t, "bob")
+
+	const limit, over = 5, 3
+	var ids []int
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < limit+over; i++ {
+		message := s.send(t, alice, bob, fmt.Sprintf("Message %d", i), nil, nil)
+		if _, err := s.db.Exec(`UPDATE messages SET created_at = ? WHERE id = ?`, start.Add(time.Duration(i)*time.Minute), message.ID); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+	// The oldest message is flagged, so the next oldest go instead
+	if err := s.messages.SetFlag(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+
+	evicted, err := s.messages.EnforceInboxLimit(bob.ID, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != over {
+		t.Errorf("evicted %d messages, want %d", evicted, over)
+	}
+
+	inbox := make(map[int]bool)
+	rows, err := s.db.Query(`SELECT id FROM messages WHERE to_user_id = ?`, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		inbox[id] = true
+	}
+	rows.Close()
+
+	if len(inbox) > limit {
+		t.Errorf("%d messages left, want at most %d", len(inbox), limit)
+	}
+	for i, id := range ids {
+		want := i == 0 || i > over
+		if inbox[id] != want {
+			t.Errorf("message %d kept = %v, want %v", i, inbox[id], want)
+		}
+	}
+
+	// Alice keeps her copies of the evicted messages in Sent
+	var sent int
+	s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE from_user_id = ?`, alice.ID).Scan(&sent)
+	if sent != limit+over {
+		t.Errorf("alice has %d sent messages, want %d", sent, limit+over)
+	}
+
+	// Under the limit nothing more goes
+	if evicted, err := s.messages.EnforceInboxLimit(bob.ID, limit); err != nil || evicted != 0 {
+		t.Errorf("second pass evicted %d (err %v), want 0", evicted, err)
+	}
+}
@@ -0,0 +1,210 @@
+package database
+
+// postgresMigrations creates the same schema as the SQLite migrations in
+// migrate. PostgreSQL support is newer than any of the columns added there
+// with ALTER TABLE, so every table is created complete; columns added from
+// now on need an ALTER TABLE ... ADD COLUMN IF NOT EXISTS here as well.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username TEXT UNIQUE NOT NULL,
+		email TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		signature TEXT NOT NULL DEFAULT '',
+		signature_html TEXT NOT NULL DEFAULT '',
+		reply_to TEXT NOT NULL DEFAULT '',
+		is_admin BOOLEAN DEFAULT FALSE,
+		disabled BOOLEAN DEFAULT FALSE,
+		send_read_receipts BOOLEAN DEFAULT TRUE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS messages (
+		id SERIAL PRIMARY KEY,
+		from_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		to_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		from_address TEXT NOT NULL,
+		to_address TEXT NOT NULL,
+		reply_to TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		is_html BOOLEAN DEFAULT FALSE,
+		thread_id TEXT,
+		parent_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+		read_status BOOLEAN DEFAULT FALSE,
+		flagged BOOLEAN DEFAULT FALSE,
+		is_draft BOOLEAN DEFAULT FALSE,
+		delivery_status TEXT NOT NULL DEFAULT '',
+		delivery_error TEXT NOT NULL DEFAULT '',
+		request_receipt BOOLEAN DEFAULT FALSE,
+		read_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id SERIAL PRIMARY KEY,
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		original_name TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		file_size BIGINT NOT NULL,
+		file_path TEXT,
+		file_data BYTEA,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)`,
+	`CREATE INDEX IF NOT EXISTS idx_users_email ON users(email)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_from_user ON messages(from_user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_to_user ON messages(to_user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_to_address ON messages(to_address)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_thread_id ON messages(thread_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages(parent_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id)`,
+
+	// Keep users.updated_at current
+	`CREATE OR REPLACE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.updated_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS update_users_updated_at ON users`,
+	`CREATE TRIGGER update_users_updated_at
+	 BEFORE UPDATE ON users
+	 FOR EACH ROW EXECUTE FUNCTION set_updated_at()`,
+
+	`CREATE TABLE IF NOT EXISTS folders (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS message_folders (
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		folder_id INTEGER NOT NULL REFERENCES folders(id) ON DELETE CASCADE,
+		PRIMARY KEY (message_id, folder_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_folders_user_id ON folders(user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_message_folders_folder_id ON message_folders(folder_id)`,
+
+	// Addresses are unique per user ignoring case, which SQLite gets from
+	// COLLATE NOCASE
+	`CREATE TABLE IF NOT EXISTS contacts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL DEFAULT '',
+		address TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_contacts_user_address ON contacts(user_id, LOWER(address))`,
+
+	`CREATE TABLE IF NOT EXISTS templates (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		subject TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		is_html BOOLEAN DEFAULT FALSE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, name)
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks(user_id)`,
+
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		path TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		response BYTEA,
+		created_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (user_id, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)`,
+
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS message_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS in_reply_to TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS reference_ids TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_message_id ON messages(message_id)`,
+
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN DEFAULT TRUE`,
+	`CREATE TABLE IF NOT EXISTS email_verifications (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT UNIQUE NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS blocked_senders (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		address TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_blocked_senders_user_address ON blocked_senders(user_id, LOWER(address))`,
+
+	`CREATE TABLE IF NOT EXISTS spam_feedback (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		address TEXT NOT NULL,
+		not_spam INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, address)
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS muted_threads (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		thread_id TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, thread_id)
+	)`,
+
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS snoozed_until TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_snoozed_until ON messages(snoozed_until)`,
+
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS scheduled_for TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_scheduled_for ON messages(scheduled_for)`,
+
+	`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS content_id TEXT NOT NULL DEFAULT ''`,
+
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS preview TEXT NOT NULL DEFAULT ''`,
+
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		key_hash TEXT UNIQUE NOT NULL,
+		scopes TEXT NOT NULL,
+		last_used_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id)`,
+
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS login_events (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		protocol TEXT NOT NULL,
+		success BOOLEAN NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_login_events_user_created ON login_events(user_id, created_at)`,
+
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS send_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_messages_send_id ON messages(send_id)`,
+}
@@ -6,12 +6,20 @@ import (
 
 // User represents a user in the database
 type User struct {
-	ID           int       `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password_hash"` // Never include in JSON
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID               int       `json:"id" db:"id"`
+	Username         string    `json:"username" db:"username"`
+	Email            string    `json:"email" db:"email"`
+	PasswordHash     string    `json:"-" db:"password_hash"` // Never include in JSON
+	Signature        string    `json:"signature" db:"signature"`
+	SignatureHTML    string    `json:"signature_html" db:"signature_html"`
+	ReplyTo          string    `json:"reply_to" db:"reply_to"`
+	IsAdmin          bool      `json:"is_admin" db:"is_admin"`
+	Disabled         bool      `json:"disabled" db:"disabled"`
+	SendReadReceipts bool      `json:"send_read_receipts" db:"send_read_receipts"`
+	EmailVerified    bool       `json:"email_verified" db:"email_verified"`
+	LastLoginAt      *time.Time `json:"last_login_at" db:"last_login_at"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // Message represents a message in the database
@@ -21,13 +29,44 @@ type Message struct {
 	ToUserID    *int      `json:"to_user_id" db:"to_user_id"`
 	FromAddress string    `json:"from" db:"from_address"`
 	ToAddress   string    `json:"to" db:"to_address"`
+	ReplyTo     string    `json:"reply_to,omitempty" db:"reply_to"`
 	Subject     string    `json:"subject" db:"subject"`
 	Body        string    `json:"body" db:"body"`
+	Preview     string    `json:"preview" db:"preview"` // The start of the body's text, for listings
 	IsHTML      bool      `json:"is_html" db:"is_html"`
 	ThreadID    *string   `json:"thread_id" db:"thread_id"`
 	ParentID    *int      `json:"parent_id" db:"parent_id"`
 	ReadStatus  bool      `json:"read" db:"read_status"`
+	Flagged     bool      `json:"flagged" db:"flagged"`
+	IsDraft     bool      `json:"is_draft" db:"is_draft"`
 	CreatedAt   time.Time `json:"timestamp" db:"created_at"`
+
+	// Delivery outcome of a sent message; see the Delivery* constants
+	DeliveryStatus string `json:"delivery_status,omitempty" db:"delivery_status"`
+	DeliveryError  string `json:"delivery_error,omitempty" db:"delivery_error"`
+
+	// Read receipt requested by the sender, and when the recipient read the
+	// message if they allowed a receipt to be sent
+	RequestReceipt bool       `json:"request_receipt" db:"request_receipt"`
+	ReadAt         *time.Time `json:"read_at,omitempty" db:"read_at"`
+
+	// Until this time a received message is kept out of the inbox and the
+	// unread count
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty" db:"snoozed_until"`
+	// When an unsent message is due to be sent; it is kept as a draft until
+	// then
+	ScheduledFor *time.Time `json:"scheduled_for,omitempty" db:"scheduled_for"`
+
+	// Headers that thread the message across servers
+	MessageHeaders
+	
+	// RenderedBody is the HTML to display: an HTML body with its inline
+	// images resolved and remote content held back, or an optional rendering
+	// of a plaintext body
+	RenderedBody string `json:"rendered_body,omitempty"`
+	// RemoteContentBlocked is set when remote content was left out of
+	// RenderedBody
+	RemoteContentBlocked bool `json:"remote_content_blocked,omitempty"`
 	
 	// Virtual fields populated by joins
 	FromUser *User `json:"from_user,omitempty"`
@@ -37,6 +76,56 @@ type Message struct {
 	Replies []*Message `json:"replies,omitempty"`
 	AttachmentCount int `json:"attachment_count,omitempty"`
 	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// Delivery outcome for each recipient the message was sent to; only
+	// shown to the sender
+	Recipients []*RecipientDelivery `json:"recipients,omitempty"`
+}
+
+// RecipientDelivery is the delivery outcome of one recipient's copy of a
+// sent message
+type RecipientDelivery struct {
+	MessageID      int        `json:"id"`
+	To             string     `json:"to"`
+	DeliveryStatus string     `json:"delivery_status"`
+	DeliveryError  string     `json:"delivery_error,omitempty"`
+	ReadAt         *time.Time `json:"read_at,omitempty"`
+}
+
+// MessageHeaders are the RFC 5322 headers that link a message to the one it
+// replies to. Message IDs include their angle brackets.
+type MessageHeaders struct {
+	MessageID  string `json:"message_id,omitempty" db:"message_id"`
+	InReplyTo  string `json:"in_reply_to,omitempty" db:"in_reply_to"`
+	References string `json:"references,omitempty" db:"reference_ids"` // Space-separated, oldest first
+}
+
+// Delivery statuses recorded on sent messages. Messages received from other
+// servers and drafts have no delivery status.
+const (
+	DeliveryLocal     = "local"     // Stored in a local user's mailbox
+	DeliveryDelivered = "delivered" // Accepted by the recipient's server
+	DeliveryFailed    = "failed"    // Federation to the recipient's server failed
+	DeliveryPending   = "pending"   // Waiting for the recipient's server to come back
+)
+
+// ReplyAddress returns the address replies to this message should go to
+func (m *Message) ReplyAddress() string {
+	if m.ReplyTo != "" {
+		return m.ReplyTo
+	}
+	return m.FromAddress
+}
+
+// ThreadSummary describes a thread as a whole, counting only the messages
+// the listing user sent or received
+type ThreadSummary struct {
+	ThreadID     string    `json:"thread_id"`
+	Subject      string    `json:"subject"`      // Subject of the latest message
+	Participants []string  `json:"participants"` // Senders and recipients, in order of appearance
+	MessageCount int       `json:"message_count"`
+	UnreadCount  int       `json:"unread_count"`
+	LastActivity time.Time `json:"last_activity"`
 }
 
 // Attachment represents a file attachment
@@ -46,12 +135,108 @@ type Attachment struct {
 	FileName    string    `json:"filename" db:"filename"`
 	OriginalName string   `json:"original_name" db:"original_name"`
 	ContentType string    `json:"content_type" db:"content_type"`
+	ContentID   string    `json:"content_id,omitempty" db:"content_id"` // Referenced as cid: from an HTML body
 	FileSize    int64     `json:"file_size" db:"file_size"`
 	FilePath    *string   `json:"file_path" db:"file_path"` // For file system storage
 	FileData    []byte    `json:"-" db:"file_data"` // For database storage (small files)
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
+// Folder represents a user-defined mail folder
+type Folder struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Contact represents an address book entry. Suggestions derived from past
+// correspondence have no ID.
+type Contact struct {
+	ID        int       `json:"id,omitempty" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	Address   string    `json:"address" db:"address"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// BlockedSender is an address a user does not want mail from
+type BlockedSender struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Address   string    `json:"address" db:"address"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Template represents a reusable message a user can compose from
+type Template struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	Subject   string    `json:"subject" db:"subject"`
+	Body      string    `json:"body" db:"body"`
+	IsHTML    bool      `json:"is_html" db:"is_html"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Webhook is a URL that is called when events happen in a user's mailbox.
+// The secret signs each delivery and is only shown when the webhook is
+// created.
+type Webhook struct {
+	ID           int       `json:"id" db:"id"`
+	UserID       int       `json:"user_id" db:"user_id"`
+	URL          string    `json:"url" db:"url"`
+	Secret       string    `json:"-" db:"secret"`
+	Events       []string  `json:"events" db:"events"`
+	Active       bool      `json:"active" db:"active"`
+	FailureCount int       `json:"failure_count" db:"failure_count"` // Consecutive failed deliveries
+	LastError    string    `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// APIKey is a long-lived credential for scripts and integrations. Only a
+// hash of the key is stored; the key itself is shown once, when it is
+// created.
+type APIKey struct {
+	ID         int        `json:"id" db:"id"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// LoginEvent records an attempt to log in to an account, over HTTP, TCP or
+// SMTP
+type LoginEvent struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"-" db:"user_id"`
+	IP        string    `json:"ip" db:"ip"`
+	UserAgent string    `json:"user_agent,omitempty" db:"user_agent"`
+	Protocol  string    `json:"protocol" db:"protocol"`
+	Success   bool      `json:"success" db:"success"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Protocols a login can be made over
+const (
+	LoginHTTP = "http"
+	LoginTCP  = "tcp"
+	LoginSMTP = "smtp"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// idempotency key. A StatusCode of 0 means the request is still running.
+type IdempotencyRecord struct {
+	UserID     int       `db:"user_id"`
+	Key        string    `db:"key"`
+	Path       string    `db:"path"`
+	StatusCode int       `db:"status_code"`
+	Response   []byte    `db:"response"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
 // CreateUserRequest represents a user registration request
 type CreateUserRequest struct {
 	Username string `json:"username" validate:"required,min=3,max=20"`
@@ -71,4 +256,8 @@ type LoginResponse struct {
 	Message string `json:"message"`
 	Token   string `json:"token,omitempty"`
 	User    *User  `json:"user,omitempty"`
+
+	// Set on registration and email changes in development, where there is
+	// no way to email it
+	VerificationToken string `json:"verification_token,omitempty"`
 } 
\ No newline at end of file
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"log/slog"
+	"time"
+
+	"yourmail/internal/metrics"
+)
+
+// registerPoolMetrics exposes the connection pool statistics as metrics.
+// Values are read from db.Stats() at scrape time.
+func (db *DB) registerPoolMetrics() {
+	metrics.NewGaugeFunc("yourmail_db_open_connections", "Number of established database connections",
+		func() float64 { return float64(db.Stats().OpenConnections) })
+	metrics.NewGaugeFunc("yourmail_db_in_use_connections", "Number of database connections currently in use",
+		func() float64 { return float64(db.Stats().InUse) })
+	metrics.NewGaugeFunc("yourmail_db_idle_connections", "Number of idle database connections",
+		func() float64 { return float64(db.Stats().Idle) })
+	metrics.NewCounterFunc("yourmail_db_wait_count_total", "Total number of connections waited for",
+		func() float64 { return float64(db.Stats().WaitCount) })
+	metrics.NewCounterFunc("yourmail_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection",
+		func() float64 { return db.Stats().WaitDuration.Seconds() })
+}
+
+// StartPoolMonitor periodically logs connection pool statistics and warns
+// when the number of connection waits during an interval reaches
+// waitWarnThreshold (0 disables the warning). It returns a function that
+// stops the monitor. A non-positive interval disables monitoring.
+func (db *DB) StartPoolMonitor(interval time.Duration, waitWarnThreshold int64) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := db.Stats()
+		for {
+			select {
+			case <-ticker.C:
+				stats := db.Stats()
+				waits := stats.WaitCount - last.WaitCount
+				waited := stats.WaitDuration - last.WaitDuration
+
+				slog.Info("db pool stats",
+					"open", stats.OpenConnections, "in_use", stats.InUse, "idle", stats.Idle,
+					"waits", waits, "waited", waited)
+				if waitWarnThreshold > 0 && waits >= waitWarnThreshold {
+					slog.Warn("db pool saturated", "waits", waits, "waited", waited, "interval", interval)
+				}
+
+				last = stats
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"yourmail/internal/htmlmail"
+)
+
+// previewLength is the number of characters of a body kept as its preview
+const previewLength = 140
+
+// messagePreview returns the start of a body's text as one line, for
+// listings that show messages without their bodies
+func messagePreview(body string, isHTML bool) string {
+	if isHTML {
+		body = htmlmail.Text(body)
+	}
+	text := strings.Join(strings.Fields(body), " ")
+	if utf8.RuneCountInString(text) <= previewLength {
+		return text
+	}
+
+	runes := []rune(text)[:previewLength]
+	return strings.TrimRight(string(runes), " ") + "…"
+}
+
+// backfillPreviews computes the previews of messages stored before previews
+// existed. It works through them in batches so a large mailbox doesn't hold
+// the write lock for long.
+func (db *DB) backfillPreviews() error {
+	const batchSize = 500
+
+	type pending struct {
+		id     int
+		body   string
+		isHTML bool
+	}
+
+	total, lastID := 0, 0
+	for {
+		rows, err := db.Query(`
+			SELECT id, body, is_html FROM messages
+			WHERE id > ? AND preview = '' AND body <> ''
+			ORDER BY id LIMIT ?
+		`, lastID, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to find messages without a preview: %w", err)
+		}
+
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.body, &p.isHTML); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan message: %w", err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to find messages without a preview: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, p := range batch {
+			if _, err := db.Exec(`UPDATE messages SET preview = ? WHERE id = ?`, messagePreview(p.body, p.isHTML), p.id); err != nil {
+				return fmt.Errorf("failed to store message preview: %w", err)
+			}
+			lastID = p.id
+		}
+		total += len(batch)
+	}
+
+	if total > 0 {
+		slog.Info("stored previews for existing messages", "count", total)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SpamRepository holds what spam scoring needs to know about a recipient's
+// history with a sender
+type SpamRepository struct {
+	db *DB
+}
+
+// NewSpamRepository creates a new spam repository
+func NewSpamRepository(db *DB) *SpamRepository {
+	return &SpamRepository{db: db}
+}
+
+// KnownSender reports whether a user has sent mail to address or saved it as
+// a contact, ignoring case
+func (r *SpamRepository) KnownSender(userID int, address string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM messages m
+			WHERE m.from_user_id = ? AND LOWER(m.to_address) = LOWER(?) AND ` + deliveredFilter + `
+		) OR EXISTS (
+			SELECT 1 FROM contacts WHERE user_id = ? AND LOWER(address) = LOWER(?)
+		)
+	`
+	var known bool
+	if err := r.db.QueryRow(query, userID, address, userID, address).Scan(&known); err != nil {
+		return false, fmt.Errorf("failed to check sender history: %w", err)
+	}
+	return known, nil
+}
+
+// NotSpamMarks returns how many of the sender's messages a user has marked as
+// not spam
+func (r *SpamRepository) NotSpamMarks(userID int, address string) (int, error) {
+	var marks int
+	query := `SELECT not_spam FROM spam_feedback WHERE user_id = ? AND address = ?`
+	err := r.db.QueryRow(query, userID, strings.ToLower(address)).Scan(&marks)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get spam feedback: %w", err)
+	}
+	return marks, nil
+}
+
+// RecordNotSpam notes that a user marked a message from address as not spam
+func (r *SpamRepository) RecordNotSpam(userID int, address string) error {
+	query := `
+		INSERT INTO spam_feedback (user_id, address, not_spam) VALUES (?, ?, 1)
+		ON CONFLICT (user_id, address) DO UPDATE SET not_spam = spam_feedback.not_spam + 1
+	`
+	if _, err := r.db.Exec(query, userID, strings.ToLower(address)); err != nil {
+		return fmt.Errorf("failed to record spam feedback: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TemplateRepository handles message template database operations
+type TemplateRepository struct {
+	db *DB
+}
+
+// NewTemplateRepository creates a new template repository
+func NewTemplateRepository(db *DB) *TemplateRepository {
+	return &TemplateRepository{db: db}
+}
+
+// templateColumns is the column list read by scanTemplate
+const templateColumns = `id, user_id, name, subject, body, is_html, created_at, updated_at`
+
+// scanTemplate scans a row selected with templateColumns into a Template
+func scanTemplate(row rowScanner) (*Template, error) {
+	template := &Template{}
+	err := row.Scan(&template.ID, &template.UserID, &template.Name, &template.Subject,
+		&template.Body, &template.IsHTML, &template.CreatedAt, &template.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// Create saves a new template for a user
+func (r *TemplateRepository) Create(userID int, name, subject, body string, isHTML bool) (*Template, error) {
+	now := time.Now()
+	query := `
+		INSERT INTO templates (user_id, name, subject, body, is_html, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	id, err := r.db.insert(query, userID, name, subject, body, isHTML, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves a template by ID
+func (r *TemplateRepository) GetByID(id int) (*Template, error) {
+	query := `SELECT ` + templateColumns + ` FROM templates WHERE id = ?`
+	template, err := scanTemplate(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get template: %w", err)
+	}
+	return template, nil
+}
+
+// GetByName retrieves a user's template by name
+func (r *TemplateRepository) GetByName(userID int, name string) (*Template, error) {
+	query := `SELECT ` + templateColumns + ` FROM templates WHERE user_id = ? AND name = ?`
+	template, err := scanTemplate(r.db.QueryRow(query, userID, name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get template: %w", err)
+	}
+	return template, nil
+}
+
+// List returns all of a user's templates ordered by name
+func (r *TemplateRepository) List(userID int) ([]*Template, error) {
+	query := `SELECT ` + templateColumns + ` FROM templates WHERE user_id = ? ORDER BY name ASC`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []*Template
+	for rows.Next() {
+		template, err := scanTemplate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan template: %w", err)
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+// Update replaces a template's name and content
+func (r *TemplateRepository) Update(id int, name, subject, body string, isHTML bool) (*Template, error) {
+	query := `UPDATE templates SET name = ?, subject = ?, body = ?, is_html = ?, updated_at = ? WHERE id = ?`
+	_, err := r.db.Exec(query, name, subject, body, isHTML, time.Now(), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update template: %w", err)
+	}
+	return r.GetByID(id)
+}
+
+// Delete removes a template
+func (r *TemplateRepository) Delete(id int) error {
+	query := `DELETE FROM templates WHERE id = ?`
+	_, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// unreadCache keeps each user's unread message count in memory so polling
+// the count does not run a COUNT(*) every time. MessageRepository keeps it
+// up to date as it writes, which assumes this process is the only writer;
+// entries expire after ttl so counts changed by another process are picked
+// up from the database within that time.
+//
+// Loads race with writes: a count read from the database while a write is
+// in flight may or may not include it. Writes are bracketed by begin and
+// the function it returns, and a loaded count is only stored if no write
+// started or finished while it was being read.
+type unreadCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration // 0 disables the cache
+	entries    map[int]unreadEntry
+	generation uint64 // Bumped whenever a write starts or finishes
+	writing    int    // Writes in flight
+}
+
+type unreadEntry struct {
+	count    int
+	loadedAt time.Time
+}
+
+func newUnreadCache() *unreadCache {
+	return &unreadCache{entries: make(map[int]unreadEntry)}
+}
+
+// setTTL sets how long a count read from the database is trusted
+func (c *unreadCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	c.entries = make(map[int]unreadEntry)
+}
+
+// get returns a user's cached count. On a miss it returns the generation
+// to pass to store once the count has been loaded.
+func (c *unreadCache) get(userID int) (count int, generation uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if ok && time.Since(entry.loadedAt) < c.ttl {
+		return entry.count, 0, true
+	}
+	delete(c.entries, userID)
+	return 0, c.generation, false
+}
+
+// store caches a count loaded from the database, unless a write overlapped
+// the load
+func (c *unreadCache) store(userID, count int, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 || c.writing > 0 || c.generation != generation {
+		return
+	}
+	c.entries[userID] = unreadEntry{count: count, loadedAt: time.Now()}
+}
+
+// begin marks the start of a write that may change unread counts. The
+// returned function must be called once the write is done.
+func (c *unreadCache) begin() func() {
+	c.mu.Lock()
+	c.writing++
+	c.generation++
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		c.writing--
+		c.generation++
+		c.mu.Unlock()
+	}
+}
+
+// adjust applies a change a write made to a user's unread count
+func (c *unreadCache) adjust(userID, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok {
+		return
+	}
+	entry.count += delta
+	if entry.count < 0 {
+		// Out of step with the database; reload it
+		delete(c.entries, userID)
+		return
+	}
+	c.entries[userID] = entry
+}
+
+// invalidate drops a user's cached count, for writes whose effect on it is
+// not known
+func (c *unreadCache) invalidate(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// clear drops every cached count
+func (c *unreadCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[int]unreadEntry)
+}
@@ -1,14 +1,49 @@
 package database
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrAccountDisabled is returned by Authenticate when the credentials are
+// valid but the account has been suspended
+var ErrAccountDisabled = errors.New("account disabled")
+
+// userColumns is the column list read by scanUser
+const userColumns = `id, username, email, password_hash, signature, signature_html, reply_to, is_admin, disabled, send_read_receipts, email_verified, last_login_at, created_at, updated_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans a row selected with userColumns into a User
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var lastLogin sql.NullTime
+	err := row.Scan(
+		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
+		&user.Signature, &user.SignatureHTML, &user.ReplyTo,
+		&user.IsAdmin, &user.Disabled, &user.SendReadReceipts, &user.EmailVerified,
+		&lastLogin, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if lastLogin.Valid {
+		user.LastLoginAt = &lastLogin.Time
+	}
+	return user, nil
+}
+
 // UserRepository handles user database operations
 type UserRepository struct {
 	db *DB
@@ -22,7 +57,7 @@ func NewUserRepository(db *DB) *UserRepository {
 // Create creates a new user with hashed password
 func (r *UserRepository) Create(username, email, password string) (*User, error) {
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), r.db.bcryptCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
@@ -33,32 +68,19 @@ func (r *UserRepository) Create(username, email, password string) (*User, error)
 		VALUES (?, ?, ?, ?, ?)
 	`
 	now := time.Now()
-	result, err := r.db.Exec(query, username, email, string(hashedPassword), now, now)
+	id, err := r.db.insert(query, username, email, string(hashedPassword), now, now)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Get the created user ID
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user ID: %w", err)
-	}
-
 	// Return the created user
 	return r.GetByID(int(id))
 }
 
 // GetByID retrieves a user by ID
 func (r *UserRepository) GetByID(id int) (*User, error) {
-	user := &User{}
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at
-		FROM users WHERE id = ?
-	`
-	err := r.db.QueryRow(query, id).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.CreatedAt, &user.UpdatedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	user, err := scanUser(r.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -70,15 +92,8 @@ func (r *UserRepository) GetByID(id int) (*User, error) {
 
 // GetByUsername retrieves a user by username
 func (r *UserRepository) GetByUsername(username string) (*User, error) {
-	user := &User{}
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at
-		FROM users WHERE username = ?
-	`
-	err := r.db.QueryRow(query, username).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.CreatedAt, &user.UpdatedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
+	user, err := scanUser(r.db.QueryRow(query, username))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -90,15 +105,8 @@ func (r *UserRepository) GetByUsername(username string) (*User, error) {
 
 // GetByEmail retrieves a user by email
 func (r *UserRepository) GetByEmail(email string) (*User, error) {
-	user := &User{}
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at
-		FROM users WHERE email = ?
-	`
-	err := r.db.QueryRow(query, email).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.CreatedAt, &user.UpdatedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = ?`
+	user, err := scanUser(r.db.QueryRow(query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -124,9 +132,39 @@ func (r *UserRepository) Authenticate(username, password string) (*User, error)
 		return nil, nil // Invalid password
 	}
 
+	// Only reveal the suspension to someone who knows the password
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	// Upgrade hashes made with a lower cost while we have the plaintext
+	if cost, err := bcrypt.Cost([]byte(user.PasswordHash)); err == nil && cost < r.db.bcryptCost {
+		if err := r.rehashPassword(user, password); err != nil {
+			slog.Error("failed to rehash password", "user_id", user.ID, "err", err)
+		}
+	}
+
 	return user, nil
 }
 
+// rehashPassword replaces a user's password hash with one at the current
+// cost. The hash is only replaced if it has not changed in the meantime.
+func (r *UserRepository) rehashPassword(user *User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), r.db.bcryptCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	query := `UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`
+	_, err = r.db.Exec(query, string(hashedPassword), user.ID, user.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+
+	user.PasswordHash = string(hashedPassword)
+	return nil
+}
+
 // Update updates user information
 func (r *UserRepository) Update(id int, username, email string) (*User, error) {
 	query := `
@@ -144,7 +182,7 @@ func (r *UserRepository) Update(id int, username, email string) (*User, error) {
 
 // UpdatePassword updates user password
 func (r *UserRepository) UpdatePassword(id int, newPassword string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), r.db.bcryptCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
@@ -162,6 +200,21 @@ func (r *UserRepository) UpdatePassword(id int, newPassword string) error {
 	return nil
 }
 
+// UpdateSignature updates the user's plaintext and HTML signatures
+func (r *UserRepository) UpdateSignature(id int, signature, signatureHTML string) error {
+	query := `
+		UPDATE users 
+		SET signature = ?, signature_html = ?, updated_at = ?
+		WHERE id = ?
+	`
+	_, err := r.db.Exec(query, signature, signatureHTML, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update signature: %w", err)
+	}
+
+	return nil
+}
+
 // Delete deletes a user
 func (r *UserRepository) Delete(id int) error {
 	query := `DELETE FROM users WHERE id = ?`
@@ -172,10 +225,53 @@ func (r *UserRepository) Delete(id int) error {
 	return nil
 }
 
+// DisableUser suspends a user's account without deleting it
+func (r *UserRepository) DisableUser(id int) error {
+	query := `UPDATE users SET disabled = TRUE, updated_at = ? WHERE id = ?`
+	_, err := r.db.Exec(query, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to disable user: %w", err)
+	}
+	return nil
+}
+
+// EnableUser lifts a suspension placed by DisableUser
+func (r *UserRepository) EnableUser(id int) error {
+	query := `UPDATE users SET disabled = FALSE, updated_at = ? WHERE id = ?`
+	_, err := r.db.Exec(query, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to enable user: %w", err)
+	}
+	return nil
+}
+
+// IsActive reports whether a user exists under username and is not disabled.
+// Tokens name the user they were issued to, so a rename makes them stale.
+func (r *UserRepository) IsActive(id int, username string) (bool, error) {
+	var disabled bool
+	err := r.db.QueryRow(`SELECT disabled FROM users WHERE id = ? AND username = ?`, id, username).Scan(&disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check user status: %w", err)
+	}
+	return !disabled, nil
+}
+
+// Count returns the total number of users
+func (r *UserRepository) Count() (int, error) {
+	var count int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
 // List returns all users (for admin purposes)
 func (r *UserRepository) List(limit, offset int) ([]*User, error) {
 	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at
+		SELECT ` + userColumns + `
 		FROM users 
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
@@ -188,11 +284,7 @@ func (r *UserRepository) List(limit, offset int) ([]*User, error) {
 
 	var users []*User
 	for rows.Next() {
-		user := &User{}
-		err := rows.Scan(
-			&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-			&user.CreatedAt, &user.UpdatedAt,
-		)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
 		}
@@ -200,4 +292,103 @@ func (r *UserRepository) List(limit, offset int) ([]*User, error) {
 	}
 
 	return users, nil
-} 
\ No newline at end of file
+} 
+
+// UpdateReplyTo updates the user's default Reply-To address. An empty
+// address clears the default.
+func (r *UserRepository) UpdateReplyTo(id int, replyTo string) error {
+	query := `UPDATE users SET reply_to = ?, updated_at = ? WHERE id = ?`
+	_, err := r.db.Exec(query, replyTo, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update reply-to address: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateSendReadReceipts sets whether senders who ask for a read receipt are
+// told when the user reads their messages
+func (r *UserRepository) UpdateSendReadReceipts(id int, send bool) error {
+	query := `UPDATE users SET send_read_receipts = ?, updated_at = ? WHERE id = ?`
+	_, err := r.db.Exec(query, send, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update read receipt setting: %w", err)
+	}
+
+	return nil
+}
+
+// StartEmailVerification marks the user's email address unverified and
+// returns a new verification token, valid for ttl, replacing any earlier
+// one. Only a hash of the token is stored.
+func (r *UserRepository) StartEmailVerification(userID int, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET email_verified = FALSE WHERE id = ?`, userID); err != nil {
+		return "", fmt.Errorf("failed to mark email unverified: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID); err != nil {
+		return "", fmt.Errorf("failed to replace verification token: %w", err)
+	}
+	query := `INSERT INTO email_verifications (user_id, token_hash, expires_at) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, userID, hashToken(token), time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to store verification token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit verification token: %w", err)
+	}
+	return token, nil
+}
+
+// VerifyEmail marks the email address of the user a verification token was
+// issued to as verified and uses up the token. It returns nil if the token
+// is unknown or has expired.
+func (r *UserRepository) VerifyEmail(token string) (*User, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiresAt time.Time
+	query := `SELECT user_id, expires_at FROM email_verifications WHERE token_hash = ?`
+	err = tx.QueryRow(query, hashToken(token)).Scan(&userID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up verification token: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return nil, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET email_verified = TRUE WHERE id = ?`, userID); err != nil {
+		return nil, fmt.Errorf("failed to mark email verified: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete verification token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit email verification: %w", err)
+	}
+
+	return r.GetByID(userID)
+}
+
+// hashToken returns the hex SHA-256 of a token, the form tokens are stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,51 @@
+package database_test
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticateUpgradesPasswordCost(t *testing.T) {
+	s := newTestStore(t)
+	s.createUser(t, "alice") // Hashed at bcrypt.MinCost
+
+	storedCost := func() int {
+		t.Helper()
+		user, err := s.users.GetByUsername("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cost, err := bcrypt.Cost([]byte(user.PasswordHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cost
+	}
+	if cost := storedCost(); cost != bcrypt.MinCost {
+		t.Fatalf("new hash has cost %d, want %d", cost, bcrypt.MinCost)
+	}
+
+	const configured = bcrypt.MinCost + 2
+	s.db.SetBcryptCost(configured)
+
+	// A failed login leaves the hash alone
+	if user, err := s.users.Authenticate("alice", "wrong password"); user != nil || err != nil {
+		t.Fatalf("wrong password authenticated: %v, %v", user, err)
+	}
+	if cost := storedCost(); cost != bcrypt.MinCost {
+		t.Errorf("hash cost after failed login = %d, want %d", cost, bcrypt.MinCost)
+	}
+
+	if user, err := s.users.Authenticate("alice", "password123"); user == nil || err != nil {
+		t.Fatalf("login failed: %v, %v", user, err)
+	}
+	if cost := storedCost(); cost != configured {
+		t.Errorf("hash cost after login = %d, want %d", cost, configured)
+	}
+
+	// The upgraded hash still accepts the password
+	if user, err := s.users.Authenticate("alice", "password123"); user == nil || err != nil {
+		t.Fatalf("login with upgraded hash failed: %v, %v", user, err)
+	}
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WebhookRepository handles webhook subscription database operations
+type WebhookRepository struct {
+	db *DB
+}
+
+// NewWebhookRepository creates a new webhook repository
+func NewWebhookRepository(db *DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+// webhookColumns is the column list read by scanWebhook
+const webhookColumns = `id, user_id, url, secret, events, active, failure_count, last_error, created_at`
+
+// scanWebhook scans a row selected with webhookColumns into a Webhook
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	webhook := &Webhook{}
+	var events string
+	err := row.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &webhook.Secret, &events,
+		&webhook.Active, &webhook.FailureCount, &webhook.LastError, &webhook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Events = strings.Split(events, ",")
+	return webhook, nil
+}
+
+// Create registers a webhook for a user
+func (r *WebhookRepository) Create(userID int, url, secret string, events []string) (*Webhook, error) {
+	query := `
+		INSERT INTO webhooks (user_id, url, secret, events, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	id, err := r.db.insert(query, userID, url, secret, strings.Join(events, ","), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	return r.GetByID(int(id))
+}
+
+// GetByID retrieves a webhook by ID
+func (r *WebhookRepository) GetByID(id int) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	webhook, err := scanWebhook(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// List returns all of a user's webhooks, oldest first
+func (r *WebhookRepository) List(userID int) ([]*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE user_id = ? ORDER BY id ASC`
+	return r.query(query, userID)
+}
+
+// ListActiveForEvent returns a user's active webhooks subscribed to event
+func (r *WebhookRepository) ListActiveForEvent(userID int, event string) ([]*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE user_id = ? AND active = TRUE ORDER BY id ASC`
+	webhooks, err := r.query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscribed []*Webhook
+	for _, webhook := range webhooks {
+		for _, e := range webhook.Events {
+			if e == event {
+				subscribed = append(subscribed, webhook)
+				break
+			}
+		}
+	}
+	return subscribed, nil
+}
+
+// Count returns how many webhooks a user has registered
+func (r *WebhookRepository) Count(userID int) (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM webhooks WHERE user_id = ?`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count webhooks: %w", err)
+	}
+	return count, nil
+}
+
+// Delete removes a webhook
+func (r *WebhookRepository) Delete(id int) error {
+	_, err := r.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return nil
+}
+
+// RecordSuccess clears a webhook's failure count after a delivery succeeds
+func (r *WebhookRepository) RecordSuccess(id int) error {
+	_, err := r.db.Exec(`UPDATE webhooks SET failure_count = 0, last_error = '' WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	return nil
+}
+
+// RecordFailure counts a failed delivery and disables the webhook once
+// failureLimit deliveries in a row have failed. It reports whether the
+// webhook was disabled.
+func (r *WebhookRepository) RecordFailure(id int, deliveryError string, failureLimit int) (bool, error) {
+	query := `
+		UPDATE webhooks
+		SET failure_count = failure_count + 1,
+			last_error = ?,
+			active = CASE WHEN failure_count + 1 >= ? THEN FALSE ELSE active END
+		WHERE id = ?
+	`
+	if _, err := r.db.Exec(query, deliveryError, failureLimit, id); err != nil {
+		return false, fmt.Errorf("failed to update webhook: %w", err)
+	}
+
+	webhook, err := r.GetByID(id)
+	if err != nil || webhook == nil {
+		return false, err
+	}
+	return !webhook.Active, nil
+}
+
+// Enable reactivates a webhook and clears its failure count
+func (r *WebhookRepository) Enable(id int) error {
+	_, err := r.db.Exec(`UPDATE webhooks SET active = TRUE, failure_count = 0, last_error = '' WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to enable webhook: %w", err)
+	}
+	return nil
+}
+
+// query runs a query selecting webhookColumns and scans every row
+func (r *WebhookRepository) query(query string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
@@ -0,0 +1,94 @@
+package federation
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAttachmentTooLarge is returned by FetchAttachment when the file is
+// bigger than the limit it was given
+var ErrAttachmentTooLarge = errors.New("attachment is too large")
+
+// Attachment is a file relayed with a message. Small files travel inline in
+// Data, base64-encoded in JSON. Larger ones are sent by reference: URL is a
+// signed link on the sending server that the receiving server downloads the
+// file from while it handles the relay.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"` // For images shown inline by an HTML body
+	Size        int64  `json:"size"`
+	Data        []byte `json:"data,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+// SignAttachment returns the signature of a download link for attachment
+// id that is valid until expires
+func SignAttachment(secret string, id int, expires time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "attachment:%d:%d", id, expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAttachment reports whether sig, as made by SignAttachment, is valid
+// for attachment id and the expires query value, and has not expired
+func VerifyAttachment(secret string, id int, expires, sig string) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return false
+	}
+	at := time.Unix(unix, 0)
+	if time.Now().After(at) {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(SignAttachment(secret, id, at)))
+}
+
+// FetchAttachment downloads an attachment sent by reference from the server
+// of fromHost. The link must point at that server, so a peer can't make this
+// one fetch from anywhere else, and the file must be at most maxBytes long.
+func (r *Relay) FetchAttachment(ctx context.Context, a Attachment, fromHost string, maxBytes int64) ([]byte, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid attachment URL %q", a.URL)
+	}
+	if !strings.EqualFold(u.Hostname(), fromHost) {
+		return nil, fmt.Errorf("attachment URL host %q is not the sending server", u.Hostname())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attachment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attachment download responded with status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrAttachmentTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,246 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPeerUnreachable is returned by Deliver when the last probe of the
+// target server failed, instead of waiting for another connection attempt
+// to time out
+var ErrPeerUnreachable = errors.New("peer server is unreachable")
+
+// ErrPeerGone is returned by Deliver when the target server has been
+// unreachable for longer than the relay's gone-after limit. Unlike
+// ErrPeerUnreachable it is permanent: the message should bounce rather than
+// wait for the server.
+var ErrPeerGone = errors.New("peer server has been unreachable too long")
+
+// PeerStatus is what is known about a server this one has exchanged mail
+// with
+type PeerStatus struct {
+	Host        string     `json:"host"`
+	Reachable   bool       `json:"reachable"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`    // Last successful contact
+	LastChecked *time.Time `json:"last_checked,omitempty"` // Last contact attempt
+	LatencyMS   int64      `json:"latency_ms"`             // Of the last successful contact
+	LastError   string     `json:"last_error,omitempty"`
+	DownSince   *time.Time `json:"down_since,omitempty"` // First failed contact since it was last reachable
+	Gone        bool       `json:"gone"`                 // Down for longer than the gone-after limit
+}
+
+// peerTable tracks the reachability of known peers. It is safe for
+// concurrent use.
+type peerTable struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStatus // Keyed by lowercase host
+
+	// probing is set while the prober runs; without it a peer that went down
+	// would never be seen coming back, so Deliver doesn't fast-fail
+	probing bool
+	// onRecover is called when a peer that was down answers again
+	onRecover func(host string)
+	// goneAfter is how long a peer may be down before mail for it fails
+	// for good; 0 means never
+	goneAfter time.Duration
+}
+
+// peer returns the entry for host, adding it if it is new. Callers hold mu.
+func (t *peerTable) peer(host string) *PeerStatus {
+	key := strings.ToLower(host)
+	p, ok := t.peers[key]
+	if !ok {
+		p = &PeerStatus{Host: key, Reachable: true}
+		t.peers[key] = p
+	}
+	return p
+}
+
+// down reports whether host is known to be unreachable
+func (t *peerTable) down(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.peers[strings.ToLower(host)]
+	return t.probing && ok && !p.Reachable
+}
+
+// gone reports whether host is known to have been unreachable for longer
+// than goneAfter
+func (t *peerTable) gone(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.peers[strings.ToLower(host)]
+	return ok && t.goneLocked(p)
+}
+
+// goneLocked reports whether p has been down for longer than goneAfter.
+// Callers hold mu.
+func (t *peerTable) goneLocked(p *PeerStatus) bool {
+	return t.probing && t.goneAfter > 0 && !p.Reachable && p.DownSince != nil && time.Since(*p.DownSince) > t.goneAfter
+}
+
+// record notes the outcome of a contact attempt with host that took latency.
+// A nil err means the peer answered.
+func (t *peerTable) record(host string, latency time.Duration, err error) {
+	t.mu.Lock()
+	p := t.peer(host)
+	now := time.Now()
+	p.LastChecked = &now
+	recovered := false
+	if err != nil {
+		p.Reachable = false
+		p.LastError = err.Error()
+		if p.DownSince == nil {
+			p.DownSince = &now
+		}
+	} else {
+		recovered = !p.Reachable
+		p.Reachable = true
+		p.LastSeen = &now
+		p.LatencyMS = latency.Milliseconds()
+		p.LastError = ""
+		p.DownSince = nil
+	}
+	onRecover := t.onRecover
+	t.mu.Unlock()
+
+	if recovered {
+		slog.Info("federation peer is reachable again", "host", host)
+		if onRecover != nil {
+			onRecover(p.Host)
+		}
+	}
+}
+
+// NotePeer records a server that relayed mail to this one. The relay shows
+// it is up, so it is marked reachable.
+func (r *Relay) NotePeer(host string) {
+	if host == "" || strings.EqualFold(host, r.serverHost) {
+		return
+	}
+	r.peers.record(host, 0, nil)
+}
+
+// Peers returns the status of every known peer, ordered by host
+func (r *Relay) Peers() []PeerStatus {
+	r.peers.mu.Lock()
+	defer r.peers.mu.Unlock()
+
+	peers := make([]PeerStatus, 0, len(r.peers.peers))
+	for _, p := range r.peers.peers {
+		status := *p
+		status.Gone = r.peers.goneLocked(p)
+		peers = append(peers, status)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Host < peers[j].Host })
+	return peers
+}
+
+// SetGoneAfter sets how long a peer may stay unreachable before mail for it
+// fails with ErrPeerGone instead of waiting. A non-positive limit means
+// peers are never given up on. Like fast-failing, it only applies while the
+// prober runs, since nothing else would notice the peer coming back.
+func (r *Relay) SetGoneAfter(limit time.Duration) {
+	r.peers.mu.Lock()
+	defer r.peers.mu.Unlock()
+	r.peers.goneAfter = limit
+}
+
+// OnPeerRecovered sets a function called when a peer that was unreachable
+// answers again. It is used to retry mail queued for the peer, and must not
+// block.
+func (r *Relay) OnPeerRecovered(fn func(host string)) {
+	r.peers.mu.Lock()
+	defer r.peers.mu.Unlock()
+	r.peers.onRecover = fn
+}
+
+// StartProber checks every known peer's /api/health each interval, giving
+// each check timeout to answer. It returns a function that stops the prober.
+// A non-positive interval disables probing, and with it fast-failing to
+// unreachable peers.
+func (r *Relay) StartProber(interval, timeout time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	r.peers.mu.Lock()
+	r.peers.probing = true
+	r.peers.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, p := range r.Peers() {
+					r.probe(ctx, p.Host, timeout)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		r.peers.mu.Lock()
+		r.peers.probing = false
+		r.peers.mu.Unlock()
+	}
+}
+
+// ProbePeers checks every known peer now, all at once, giving each check
+// timeout to answer, and returns their updated status
+func (r *Relay) ProbePeers(ctx context.Context, timeout time.Duration) []PeerStatus {
+	var wg sync.WaitGroup
+	for _, p := range r.Peers() {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			r.probe(ctx, host, timeout)
+		}(p.Host)
+	}
+	wg.Wait()
+	return r.Peers()
+}
+
+// probe checks that host's HTTP API answers and records the result
+func (r *Relay) probe(ctx context.Context, host string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:8080/api/health", host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		r.peers.record(host, 0, err)
+		return
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("health check responded with status %d", resp.StatusCode)
+		}
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// Stopped while the check was running
+		return
+	}
+	if err != nil {
+		slog.Debug("federation peer probe failed", "host", host, "err", err)
+	}
+	r.peers.record(host, time.Since(start), err)
+}
@@ -0,0 +1,36 @@
+package federation
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeliverToGonePeer(t *testing.T) {
+	r := NewRelay("localhost", "8080")
+	r.peers.probing = true
+	r.SetGoneAfter(time.Hour)
+
+	r.peers.record("down.example", 0, errors.New("connection refused"))
+	err := r.Deliver(Message{To: "bob@down.example"}, "down.example")
+	if !errors.Is(err, ErrPeerUnreachable) {
+		t.Fatalf("Deliver to a peer just gone down = %v, want ErrPeerUnreachable", err)
+	}
+
+	// Down for longer than the limit
+	since := time.Now().Add(-2 * time.Hour)
+	r.peers.peers["down.example"].DownSince = &since
+	err = r.Deliver(Message{To: "bob@down.example"}, "down.example")
+	if !errors.Is(err, ErrPeerGone) {
+		t.Fatalf("Deliver to a gone peer = %v, want ErrPeerGone", err)
+	}
+	if peers := r.Peers(); len(peers) != 1 || !peers[0].Gone {
+		t.Fatalf("Peers() = %+v, want one gone peer", peers)
+	}
+
+	// Answering again brings it back
+	r.peers.record("down.example", time.Millisecond, nil)
+	if peers := r.Peers(); peers[0].Gone || peers[0].DownSince != nil {
+		t.Fatalf("Peers() after recovery = %+v, want a reachable peer", peers)
+	}
+}
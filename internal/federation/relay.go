@@ -2,26 +2,39 @@ package federation
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
+
+	"yourmail/internal/logging"
 )
 
 // Message represents a federated message
 type Message struct {
 	From      string    `json:"from"`
 	To        string    `json:"to"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
 	Subject   string    `json:"subject"`
 	Body      string    `json:"body"`
+	IsHTML    bool      `json:"is_html,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// Threading headers, so replies join the right thread on both servers
+	MessageID  string   `json:"message_id,omitempty"`
+	InReplyTo  string   `json:"in_reply_to,omitempty"`
+	References []string `json:"references,omitempty"` // Oldest first
+
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
 // Relay handles federation with other mail servers
 type Relay struct {
 	serverHost string
 	httpPort   string
+	peers      peerTable
 }
 
 // NewRelay creates a new federation relay
@@ -29,22 +42,46 @@ func NewRelay(serverHost, httpPort string) *Relay {
 	return &Relay{
 		serverHost: serverHost,
 		httpPort:   httpPort,
+		peers:      peerTable{peers: make(map[string]*PeerStatus)},
 	}
 }
 
-// SendMessage sends a message to a remote server
-func (r *Relay) SendMessage(from, to, subject, body, targetHost string) error {
+// SendMessage sends a message with any attachments to a remote server
+func (r *Relay) SendMessage(from, to, subject, body, targetHost string, attachments ...Attachment) error {
+	return r.Deliver(Message{
+		From:        from,
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		Attachments: attachments,
+	}, targetHost)
+}
+
+// Deliver sends a message to a remote server. The timestamp is set to the
+// current time if the message doesn't have one. If the target server is
+// known to be down it fails at once with ErrPeerUnreachable, or with
+// ErrPeerGone once it has been down for longer than the gone-after limit.
+func (r *Relay) Deliver(msg Message, targetHost string) error {
+	return r.DeliverContext(context.Background(), msg, targetHost)
+}
+
+// DeliverContext is like Deliver but carries ctx's request ID to the remote
+// server in the X-Request-ID header, so both sides log the same ID
+func (r *Relay) DeliverContext(ctx context.Context, msg Message, targetHost string) error {
 	// Don't federate to ourselves
 	if targetHost == r.serverHost {
 		return nil
 	}
 
-	msg := Message{
-		From:      from,
-		To:        to,
-		Subject:   subject,
-		Body:      body,
-		Timestamp: time.Now(),
+	if r.peers.gone(targetHost) {
+		return fmt.Errorf("%w: %s", ErrPeerGone, targetHost)
+	}
+	if r.peers.down(targetHost) {
+		return fmt.Errorf("%w: %s", ErrPeerUnreachable, targetHost)
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
 	}
 
 	// Try HTTP federation on port 8080
@@ -55,17 +92,30 @@ func (r *Relay) SendMessage(from, to, subject, body, targetHost string) error {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("Federation failed to %s: %v", targetHost, err)
+		slog.WarnContext(ctx, "federation failed", "host", targetHost, "err", err)
+		r.peers.record(targetHost, 0, err)
 		return err
 	}
 	defer resp.Body.Close()
+	// Any answer shows the server is up, even one refusing the message
+	r.peers.record(targetHost, time.Since(start), nil)
 
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("federation server responded with status %d", resp.StatusCode)
 	}
 
-	log.Printf("✅ Message federated successfully to %s", targetHost)
+	slog.InfoContext(ctx, "message federated", "host", targetHost, "to", msg.To)
 	return nil
 } 
\ No newline at end of file
@@ -0,0 +1,168 @@
+// Package htmlmail makes HTML message bodies safe to display. Sanitize
+// strips scripts and anything else that could run in the reader's mail
+// client. Render points inline images referenced with cid: URLs at their
+// attachments, and holds back content loaded from other servers, which
+// senders use to track when a message is read, unless the reader allows it.
+package htmlmail
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Options control how Render rewrites a body
+type Options struct {
+	// Policy, if set, sanitizes the body first, for bodies stored before
+	// sanitizing was added or under a looser policy
+	Policy *Policy
+	// InlineImages maps the content IDs of a message's attachments to the
+	// URLs they are served at
+	InlineImages map[string]string
+	// AllowRemote keeps references to content on other servers
+	AllowRemote bool
+}
+
+// resourceAttrs are the attributes that make a browser load a URL while
+// showing a page. <link href> is handled separately, since href on other
+// elements is only followed when clicked.
+var resourceAttrs = map[string]bool{
+	"src":        true,
+	"srcset":     true,
+	"background": true,
+	"poster":     true,
+}
+
+// remoteCSS matches url() references and @import rules in CSS that load
+// something from another server
+var remoteCSS = regexp.MustCompile(`(?i)url\(\s*['"]?\s*(?:[a-z][a-z0-9+.\-]*:)?//[^)]*\)|@import\s+['"]\s*(?:[a-z][a-z0-9+.\-]*:)?//[^'"]*['"]\s*;?`)
+
+// Render returns body with cid: references resolved to the URLs in
+// opts.InlineImages and, unless opts.AllowRemote is set, references to
+// remote content removed. It reports whether anything remote was removed,
+// so a client can offer to show it. Markup that is not rewritten is copied
+// unchanged.
+func Render(body string, opts Options) (string, bool) {
+	if opts.Policy != nil {
+		body = opts.Policy.Sanitize(body)
+	}
+
+	var b strings.Builder
+	blocked := false
+	inStyle := false
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // The whole body has been read
+		}
+
+		switch tt {
+		case html.TextToken:
+			if inStyle && !opts.AllowRemote {
+				css := string(z.Raw())
+				if cleaned := remoteCSS.ReplaceAllString(css, ""); cleaned != css {
+					b.WriteString(cleaned)
+					blocked = true
+					continue
+				}
+			}
+			b.Write(z.Raw())
+			continue
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "style" {
+				inStyle = false
+			}
+			b.Write(z.Raw())
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+		default:
+			b.Write(z.Raw())
+			continue
+		}
+
+		raw := string(z.Raw())
+		tok := z.Token()
+		if tok.Data == "style" && tt == html.StartTagToken {
+			inStyle = true
+		}
+
+		changed := false
+		attrs := tok.Attr[:0]
+		for _, a := range tok.Attr {
+			switch {
+			case resourceAttrs[a.Key] || (tok.Data == "link" && a.Key == "href"):
+				if id, ok := cidReference(a.Val); ok {
+					if target, found := opts.InlineImages[id]; found {
+						a.Val = target
+						changed = true
+					}
+				} else if !opts.AllowRemote && isRemote(a.Key, a.Val) {
+					blocked, changed = true, true
+					continue
+				}
+			case a.Key == "style" && !opts.AllowRemote:
+				if cleaned := remoteCSS.ReplaceAllString(a.Val, ""); cleaned != a.Val {
+					a.Val = cleaned
+					blocked, changed = true, true
+				}
+			}
+			attrs = append(attrs, a)
+		}
+
+		if changed {
+			tok.Attr = attrs
+			b.WriteString(tok.String())
+		} else {
+			b.WriteString(raw)
+		}
+	}
+	return b.String(), blocked
+}
+
+// cidReference returns the content ID a cid: URL refers to
+func cidReference(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 || !strings.EqualFold(value[:4], "cid:") {
+		return "", false
+	}
+	id, err := url.PathUnescape(value[4:])
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// isRemote reports whether an attribute value loads something from another
+// server. A srcset holds several comma-separated candidates.
+func isRemote(key, value string) bool {
+	if key != "srcset" {
+		return isRemoteURL(value)
+	}
+	for _, candidate := range strings.Split(value, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 && isRemoteURL(fields[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRemoteURL reports whether a URL names a host or a scheme other than the
+// self-contained cid: and data:. Unparseable URLs count as remote, since a
+// browser may read them more leniently.
+func isRemoteURL(value string) bool {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return true
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "cid", "data":
+		return false
+	case "":
+		return u.Host != ""
+	}
+	return true
+}
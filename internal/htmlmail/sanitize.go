@@ -0,0 +1,204 @@
+package htmlmail
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Policy decides which HTML survives Sanitize. Elements not allowed are
+// removed but their text is kept, except for those whose content is never
+// shown or can run code, which go entirely.
+type Policy struct {
+	elements map[string]bool
+	attrs    map[string]bool
+	styles   bool // Keep style attributes and <style> elements
+}
+
+// Names of the built-in policies, as set with HTML_SANITIZE_POLICY
+const (
+	PolicyRelaxed = "relaxed"
+	PolicyStrict  = "strict"
+)
+
+// Relaxed keeps what mail clients commonly send: formatting, links,
+// images, tables and inline styles
+var Relaxed = &Policy{
+	elements: set("a abbr address b bdi bdo big blockquote br caption center cite code col colgroup dd del details dfn div dl dt em " +
+		"figcaption figure font h1 h2 h3 h4 h5 h6 hr i img ins kbd li mark ol p pre q rp rt ruby s samp small span strike strong style " +
+		"sub summary sup table tbody td tfoot th thead time tr tt u ul var wbr"),
+	attrs: set("align alt background bgcolor border cellpadding cellspacing cite color colspan datetime dir face headers height href " +
+		"lang nowrap open reversed rowspan scope size span src start style title type valign width"),
+	styles: true,
+}
+
+// Strict keeps text formatting, lists and links only
+var Strict = &Policy{
+	elements: set("a b blockquote br code div em h1 h2 h3 h4 h5 h6 hr i li ol p pre s span strong sub sup u ul"),
+	attrs:    set("cite dir href lang start title"),
+}
+
+// Lookup returns the policy with the given name, or Relaxed if there is no
+// such policy
+func Lookup(name string) *Policy {
+	if name == PolicyStrict {
+		return Strict
+	}
+	return Relaxed
+}
+
+// dropContent are elements removed together with everything inside them
+var dropContent = set("script style iframe frame frameset noframes object embed applet noembed noscript template svg math title textarea select")
+
+// dangerousCSS matches CSS that can run script in some browser, import
+// other stylesheets, or hide either behind escapes
+var dangerousCSS = regexp.MustCompile(`(?i)expression\s*\(|javascript:|vbscript:|behavior\s*:|-moz-binding|@import|\\`)
+
+// Sanitize returns body with scripts, event handlers, and any element or
+// attribute the policy doesn't allow removed. Links may only use http(s)
+// and mailto URLs, images also cid: and data:image URLs, and links get
+// rel="noopener noreferrer".
+func (p *Policy) Sanitize(body string) string {
+	var b strings.Builder
+	skip, skipDepth := "", 0
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // The whole body has been read
+		}
+		tok := z.Token()
+
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && tok.Data == skip:
+				skipDepth++
+			case tt == html.EndTagToken && tok.Data == skip:
+				if skipDepth--; skipDepth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if tok.Data == "style" && p.styles && tt == html.StartTagToken {
+				p.writeStyleElement(&b, z)
+				continue
+			}
+			if dropContent[tok.Data] {
+				if tt == html.StartTagToken {
+					skip, skipDepth = tok.Data, 1
+				}
+				continue
+			}
+			if !p.elements[tok.Data] {
+				continue
+			}
+			tok.Attr = p.attributes(tok.Data, tok.Attr)
+			b.WriteString(tok.String())
+
+		case html.EndTagToken:
+			if p.elements[tok.Data] && !dropContent[tok.Data] {
+				b.WriteString(tok.String())
+			}
+		}
+		// Comments, which old browsers could run as conditional markup, and
+		// doctypes are dropped
+	}
+	return b.String()
+}
+
+// writeStyleElement copies a <style> element whose start tag was just read,
+// leaving out its content if it holds dangerous CSS
+func (p *Policy) writeStyleElement(b *strings.Builder, z *html.Tokenizer) {
+	var css string
+	for {
+		tt := z.Next()
+		if tt == html.TextToken {
+			css += string(z.Text())
+			continue
+		}
+		break // The end tag, or the end of the body
+	}
+	if dangerousCSS.MatchString(css) {
+		css = ""
+	}
+	b.WriteString("<style>" + css + "</style>")
+}
+
+// attributes returns the attributes of an allowed element that the policy
+// keeps
+func (p *Policy) attributes(element string, attrs []html.Attribute) []html.Attribute {
+	kept := attrs[:0]
+	for _, a := range attrs {
+		if !p.attrs[a.Key] || a.Namespace != "" {
+			continue
+		}
+		switch a.Key {
+		case "href", "src", "background", "cite":
+			if !safeURL(a.Key, a.Val) {
+				continue
+			}
+		case "style":
+			if !p.styles || dangerousCSS.MatchString(a.Val) {
+				continue
+			}
+		}
+		kept = append(kept, a)
+	}
+	if element == "a" {
+		kept = append(kept, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	return kept
+}
+
+// safeURL reports whether a URL attribute can only link to or load content,
+// not run script
+func safeURL(key, value string) bool {
+	// Browsers skip whitespace and control characters inside a scheme, as in
+	// "java\tscript:"
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+
+	u, err := url.Parse(cleaned)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+		return true
+	case "mailto":
+		return key == "href"
+	case "cid":
+		return key == "src"
+	case "data":
+		lower := strings.ToLower(u.Opaque)
+		for _, t := range []string{"image/png", "image/gif", "image/jpeg", "image/webp"} {
+			if strings.HasPrefix(lower, t+";") || strings.HasPrefix(lower, t+",") {
+				return key == "src"
+			}
+		}
+	}
+	return false
+}
+
+// set returns the space-separated words of list as a set
+func set(list string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(list) {
+		words[w] = true
+	}
+	return words
+}
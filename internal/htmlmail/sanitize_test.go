@@ -0,0 +1,106 @@
+package htmlmail
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// unsafeMarkers are fragments that must not survive sanitizing, in
+// lowercase. Escaped text such as "&lt;script" is harmless.
+var unsafeMarkers = []string{"<script", "javascript:", "vbscript:", "expression(", "<svg", "<math", "<iframe", "<object", "<embed", "<meta", "<base", "<form", "-moz-binding"}
+
+// eventHandler matches an event handler attribute left in a tag
+var eventHandler = regexp.MustCompile(`(?i)<[^>]*\son[a-z]+\s*=`)
+
+func TestSanitizeNeutralizesXSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		keep    string // Safe markup that must survive, if the policy allows it
+	}{
+		// Scripts
+		{"script element", `<p>Hi</p><script>alert(1)</script>`, "<p>Hi</p>"},
+		{"script with src", `<script src="https://evil.example/x.js"></script>ok`, "ok"},
+		{"uppercase script", `<SCRIPT>alert(1)</SCRIPT>`, ""},
+		{"nested script", `<div><script><script>alert(1)</script></script></div>`, "<div></div>"},
+		{"script split by text", `<scr<script>ipt>alert(1)</script>`, ""},
+		{"noscript trick", `<noscript><p title="</noscript><img src=x onerror=alert(1)>"></noscript>`, ""},
+
+		// Event handlers
+		{"onclick", `<b onclick="alert(1)">bold</b>`, "<b>bold</b>"},
+		{"onmouseover unquoted", `<a href="https://example.com" onmouseover=alert(1)>link</a>`, `href="https://example.com"`},
+		{"body onload", `<body onload="alert(1)">text</body>`, "text"},
+		{"uppercase handler", `<p ONCLICK="alert(1)">x</p>`, "<p>x</p>"},
+
+		// javascript: URLs
+		{"javascript href", `<a href="javascript:alert(1)">click</a>`, "click"},
+		{"mixed case javascript", `<a href="JaVaScRiPt:alert(1)">click</a>`, "click"},
+		{"javascript with tab", "<a href=\"java\tscript:alert(1)\">click</a>", "click"},
+		{"javascript with entity", `<a href="javascript&#58;alert(1)">click</a>`, "click"},
+		{"javascript with leading space", `<a href="  javascript:alert(1)">click</a>`, "click"},
+		{"vbscript href", `<a href="vbscript:msgbox(1)">click</a>`, "click"},
+		{"data html href", `<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`, "click"},
+		{"javascript img src", `<img src="javascript:alert(1)" alt="x">`, `alt="x"`},
+		{"javascript background", `<table background="javascript:alert(1)"><tr><td>x</td></tr></table>`, "<td>x</td>"},
+		{"form action", `<form action="javascript:alert(1)"><button>go</button></form>`, ""},
+
+		// SVG and images
+		{"img onerror", `<img src=x onerror=alert(1)>`, `<img src="x">`},
+		{"img onerror quoted", `<img src="x" onerror="alert(1)">`, `<img src="x">`},
+		{"svg onload", `<svg onload=alert(1)>`, ""},
+		{"svg script", `<svg><script>alert(1)</script></svg>after`, "after"},
+		{"svg animate href", `<svg><a><animate attributeName="href" values="javascript:alert(1)"/><text>x</text></a></svg>`, ""},
+		{"math", `<math><mtext><a href="javascript:alert(1)">x</a></mtext></math>`, ""},
+		{"iframe srcdoc", `<iframe srcdoc="<script>alert(1)</script>"></iframe>`, ""},
+		{"object data", `<object data="javascript:alert(1)"></object>`, ""},
+		{"embed", `<embed src="javascript:alert(1)">`, ""},
+
+		// Styles
+		{"style expression", `<div style="width: expression(alert(1))">x</div>`, "<div>x</div>"},
+		{"style javascript url", `<div style="background:url(javascript:alert(1))">x</div>`, "<div>x</div>"},
+		{"style escapes", `<div style="background:url(\6a avascript:alert(1))">x</div>`, "<div>x</div>"},
+		{"style moz-binding", `<div style="-moz-binding: url(https://evil.example/xss.xml#x)">x</div>`, "<div>x</div>"},
+		{"style element expression", `<style>p { width: expression(alert(1)) }</style><p>x</p>`, "<p>x</p>"},
+		{"style element import", `<style>@import "https://evil.example/x.css";</style>`, "<style></style>"},
+		{"safe style kept", `<p style="color: red">x</p>`, `<p style="color: red">x</p>`},
+
+		// Other tricks
+		{"meta refresh", `<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`, ""},
+		{"base href", `<base href="javascript:alert(1)//">`, ""},
+		{"conditional comment", `<!--[if IE]><script>alert(1)</script><![endif]-->ok`, "ok"},
+		{"attribute breakout", `<p title='"><script>alert(1)</script>'>x</p>`, "x"},
+		{"text is escaped", `&lt;script&gt;alert(1)&lt;/script&gt;`, "&lt;script&gt;"},
+	}
+
+	for _, policy := range []string{PolicyRelaxed, PolicyStrict} {
+		for _, tt := range tests {
+			t.Run(policy+"/"+tt.name, func(t *testing.T) {
+				got := Lookup(policy).Sanitize(tt.payload)
+				lower := strings.ToLower(got)
+				for _, marker := range unsafeMarkers {
+					if strings.Contains(lower, marker) {
+						t.Errorf("Sanitize(%q) = %q, still contains %q", tt.payload, got, marker)
+					}
+				}
+				if eventHandler.MatchString(got) {
+					t.Errorf("Sanitize(%q) = %q, still has an event handler", tt.payload, got)
+				}
+				// Strict drops images, tables and styles, so keep is only
+				// checked where the policy allows its markup at all
+				allowed := Lookup(policy).Sanitize(tt.keep) == tt.keep
+				if tt.keep != "" && (policy == PolicyRelaxed || allowed) && !strings.Contains(got, tt.keep) {
+					t.Errorf("Sanitize(%q) = %q, want it to keep %q", tt.payload, got, tt.keep)
+				}
+			})
+		}
+	}
+}
+
+func TestSanitizeMarksLinks(t *testing.T) {
+	got := Relaxed.Sanitize(`<a href="https://example.com" target="_blank">x</a>`)
+	want := `<a href="https://example.com" rel="noopener noreferrer">x</a>`
+	if got != want {
+		t.Errorf("Sanitize() = %q, want %q", got, want)
+	}
+}
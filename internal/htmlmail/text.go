@@ -0,0 +1,58 @@
+package htmlmail
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// hiddenContent are elements whose text is never shown as part of the page
+var hiddenContent = set("script style head title template noscript")
+
+// inlineElements are elements that sit within a line of text, so their tags
+// don't separate words
+var inlineElements = set("a abbr b bdi bdo big cite code del dfn em font i ins kbd mark q s samp small span strike strong sub sup time tt u var")
+
+// Text returns the text a reader sees in an HTML body, with the markup and
+// the content of elements that aren't displayed removed. Other tags become
+// spaces, so the words of neighbouring paragraphs or cells don't run
+// together.
+func Text(body string) string {
+	var b strings.Builder
+	skip, skipDepth := "", 0
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // The whole body has been read
+		}
+		name, _ := z.TagName()
+
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && string(name) == skip:
+				skipDepth++
+			case tt == html.EndTagToken && string(name) == skip:
+				if skipDepth--; skipDepth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.UnescapeString(string(z.Raw())))
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			if tt == html.StartTagToken && hiddenContent[string(name)] {
+				skip, skipDepth = string(name), 1
+				continue
+			}
+			if !inlineElements[string(name)] {
+				b.WriteByte(' ')
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,252 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// UserPage is a page of the admin user listing with pagination metadata
+type UserPage struct {
+	Users   []*database.User `json:"users"`
+	Total   int              `json:"total"`
+	Limit   int              `json:"limit"`
+	Offset  int              `json:"offset"`
+	HasMore bool             `json:"has_more"`
+}
+
+// VacuumResponse is returned by the admin vacuum endpoint
+type VacuumResponse struct {
+	Status     string `json:"status"`
+	SizeBefore int64  `json:"size_before"` // Bytes
+	SizeAfter  int64  `json:"size_after"`
+}
+
+// handleAdminListUsers returns a page of all users. Password hashes are never
+// serialized.
+func (s *Server) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset := parsePagination(r)
+
+	users, err := s.userRepo.List(limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list users", "err", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	total, err := s.userRepo.Count()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to count users", "err", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if users == nil {
+		users = []*database.User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserPage{
+		Users:   users,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+		HasMore: offset+len(users) < total,
+	})
+}
+
+// handleAdminDeleteUser permanently deletes a user. Their messages are kept
+// with the user reference cleared.
+func (s *Server) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.getAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.userRepo.Delete(target.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete user", "err", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin deleted user", "username", target.Username, "user_id", target.ID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleAdminDisableUser suspends a user's account. The user can no longer
+// log in and their existing tokens are rejected.
+func (s *Server) handleAdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.getAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.userRepo.DisableUser(target.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to disable user", "err", err)
+		http.Error(w, "Failed to disable user", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin disabled user", "username", target.Username, "user_id", target.ID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleAdminEnableUser lifts a user's suspension
+func (s *Server) handleAdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.getAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.userRepo.EnableUser(target.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to enable user", "err", err)
+		http.Error(w, "Failed to enable user", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin enabled user", "username", target.Username, "user_id", target.ID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// getAdminTargetUser loads the user named by the {id} route variable, writing
+// an error response if it does not exist. Admins cannot target their own
+// account, so they cannot lock themselves out.
+func (s *Server) getAdminTargetUser(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	admin, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if userID == admin.ID {
+		http.Error(w, "Cannot modify your own account", http.StatusBadRequest)
+		return nil, false
+	}
+
+	target, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get user", "err", err)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if target == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return target, true
+}
+
+// handleAdminBackup streams a consistent snapshot of the SQLite database as a
+// download. The snapshot is written to a temporary file first, since the
+// backup cannot be streamed while it is being taken.
+func (s *Server) handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	dir, err := os.MkdirTemp("", "yourmail-backup-")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create backup directory", "err", err)
+		http.Error(w, "Failed to back up database", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.db")
+	if err := s.db.Backup(r.Context(), path); err != nil {
+		if errors.Is(err, database.ErrBackupUnsupported) {
+			http.Error(w, "Backups are only supported for SQLite; use pg_dump for PostgreSQL", http.StatusNotImplemented)
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to back up database", "err", err)
+		http.Error(w, "Failed to back up database", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to open backup", "err", err)
+		http.Error(w, "Failed to back up database", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to stat backup", "err", err)
+		http.Error(w, "Failed to back up database", http.StatusInternalServerError)
+		return
+	}
+
+	name := "yourmail-" + time.Now().UTC().Format("20060102-150405") + ".db"
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	}))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+
+	if _, err := io.Copy(w, file); err != nil {
+		slog.WarnContext(r.Context(), "failed to send backup", "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "admin downloaded database backup", "bytes", info.Size())
+}
+
+// handleAdminVacuum compacts the database, returning the space left behind
+// by deleted messages and attachments to the filesystem
+func (s *Server) handleAdminVacuum(w http.ResponseWriter, r *http.Request) {
+	before, err := s.db.Size(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get database size", "err", err)
+		http.Error(w, "Failed to vacuum database", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.db.Vacuum(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "failed to vacuum database", "err", err)
+		http.Error(w, "Failed to vacuum database", http.StatusInternalServerError)
+		return
+	}
+
+	after, err := s.db.Size(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get database size", "err", err)
+		http.Error(w, "Failed to vacuum database", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin vacuumed database", "size_before", before, "size_after", after)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VacuumResponse{
+		Status:     "success",
+		SizeBefore: before,
+		SizeAfter:  after,
+	})
+}
+
+// handleAdminFederationPeers returns the reachability of every server this
+// one has relayed mail to or received mail from since it started
+func (s *Server) handleAdminFederationPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.relay.Peers())
+}
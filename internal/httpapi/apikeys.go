@@ -0,0 +1,222 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAPIKeysPerUser limits how many API keys a user can create
+const maxAPIKeysPerUser = 20
+
+// maxAPIKeyNameLength bounds the label given to a key
+const maxAPIKeyNameLength = 100
+
+// APIKeyRequest represents a request to create an API key. Scopes default
+// to read-only access.
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreatedAPIKey is the response to creating an API key; it is the only time
+// the key is returned
+type CreatedAPIKey struct {
+	*database.APIKey
+	Key string `json:"key"`
+}
+
+// resolveAPIKey returns the user an API key acts for, or nil if the key is
+// unknown or the user's account is disabled. Keys never carry admin rights.
+func (s *Server) resolveAPIKey(key string) (*auth.AuthUser, error) {
+	stored, err := s.apiKeyRepo.Authenticate(key)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil || user == nil || user.Disabled {
+		return nil, err
+	}
+
+	return &auth.AuthUser{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		APIKeyID: stored.ID,
+		Scopes:   stored.Scopes,
+	}, nil
+}
+
+// handleListAPIKeys returns the current user's API keys, without the keys
+// themselves
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := s.apiKeyRepo.List(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list API keys", "err", err)
+		http.Error(w, "Failed to list API keys", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if keys == nil {
+		keys = []*database.APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleCreateAPIKey creates an API key for the current user and returns it
+// once
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeAPIKeyRequest(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := s.apiKeyRepo.Count(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to count API keys", "err", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxAPIKeysPerUser {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "too_many_api_keys",
+			"message": fmt.Sprintf("At most %d API keys can be created", maxAPIKeysPerUser),
+		})
+		return
+	}
+
+	key, err := auth.NewAPIKey()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to generate API key", "err", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	created, err := s.apiKeyRepo.Create(user.ID, req.Name, key, req.Scopes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create API key", "err", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "API key created", "api_key_id", created.ID, "user_id", user.ID, "scopes", created.Scopes)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: created, Key: key})
+}
+
+// handleDeleteAPIKey revokes one of the current user's API keys
+func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.apiKeyRepo.GetByID(keyID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get API key", "err", err)
+		http.Error(w, "Failed to get API key", http.StatusInternalServerError)
+		return
+	}
+	if key == nil || key.UserID != user.ID {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.apiKeyRepo.Delete(key.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete API key", "err", err)
+		http.Error(w, "Failed to delete API key", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "API key revoked", "api_key_id", key.ID, "user_id", user.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// decodeAPIKeyRequest parses and validates an API key body, writing an error
+// response and returning false if it is unusable
+func decodeAPIKeyRequest(w http.ResponseWriter, r *http.Request) (*APIKeyRequest, bool) {
+	fail := func(code, message string) (*APIKeyRequest, bool) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   code,
+			"message": message,
+		})
+		return nil, false
+	}
+
+	var req APIKeyRequest
+	if !decodeJSON(w, r, &req) {
+		return nil, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		return fail("invalid_name", fmt.Sprintf("API key name is required and must be at most %d characters", maxAPIKeyNameLength))
+	}
+
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		return fail("invalid_scope", err.Error())
+	}
+	req.Scopes = scopes
+
+	return &req, true
+}
+
+// normalizeScopes checks that every requested scope exists and drops
+// repeats. No scopes means read-only access.
+func normalizeScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return []string{auth.ScopeRead}, nil
+	}
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range requested {
+		if !auth.ValidScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %q; supported scopes: %s", scope, strings.Join(auth.Scopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
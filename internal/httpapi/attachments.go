@@ -0,0 +1,184 @@
+package httpapi
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// handleGetMessageAttachments lists the attachment metadata of a message
+func (s *Server) handleGetMessageAttachments(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	message, ok := s.getAccessibleMessage(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.attachmentRepo.GetByMessageID(message.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get attachments", "err", err)
+		http.Error(w, "Failed to get attachments", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if attachments == nil {
+		attachments = []*database.Attachment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// handleGetAttachmentsZip streams all of a message's attachments as a zip
+// archive. Entries are written one at a time, so only a single attachment is
+// held in memory.
+func (s *Server) handleGetAttachmentsZip(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	message, ok := s.getAccessibleMessage(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.attachmentRepo.GetByMessageID(message.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get attachments", "err", err)
+		http.Error(w, "Failed to get attachments", http.StatusInternalServerError)
+		return
+	}
+
+	if len(attachments) == 0 {
+		http.Error(w, "Message has no attachments", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": zipArchiveName(message),
+	}))
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool)
+	for _, attachment := range attachments {
+		fileData, err := s.attachmentRepo.GetFileData(attachment.ID)
+		if err != nil {
+			// The response has already started, so all we can do is stop
+			slog.ErrorContext(r.Context(), "failed to get file data", "attachment_id", attachment.ID, "err", err)
+			return
+		}
+
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     uniqueZipEntryName(attachment.OriginalName, used),
+			Method:   zip.Deflate,
+			Modified: attachment.CreatedAt,
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to add attachment to zip", "attachment_id", attachment.ID, "err", err)
+			return
+		}
+		if _, err := entry.Write(fileData); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write attachment to zip", "attachment_id", attachment.ID, "err", err)
+			return
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "failed to finish zip", "message_id", message.ID, "err", err)
+	}
+}
+
+// zipArchiveName derives a download name for a message's attachments from
+// its subject, falling back to the message ID
+func zipArchiveName(message *database.Message) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(message.Subject) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('_')
+		}
+		if b.Len() >= 64 {
+			break
+		}
+	}
+
+	name := strings.Trim(b.String(), "._")
+	if name == "" {
+		name = fmt.Sprintf("message-%d", message.ID)
+	}
+	return name + "-attachments.zip"
+}
+
+// uniqueZipEntryName returns a safe entry name for an attachment, appending a
+// counter when the name is already in use. Names are compared
+// case-insensitively since many filesystems are.
+func uniqueZipEntryName(originalName string, used map[string]bool) string {
+	// Keep only the base name so entries can't escape the extraction directory
+	name := path.Base(strings.ReplaceAll(originalName, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "attachment"
+	}
+
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// getAccessibleMessage loads the message named by the {id} route variable and
+// verifies userID sent or received it, writing an error response if not
+func (s *Server) getAccessibleMessage(w http.ResponseWriter, r *http.Request, userID int) (*database.Message, bool) {
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	// Verify user has access to this message
+	if (message.ToUserID == nil || *message.ToUserID != userID) &&
+		(message.FromUserID == nil || *message.FromUserID != userID) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return nil, false
+	}
+
+	return message, true
+}
@@ -0,0 +1,144 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// BlockRequest represents a request to block a sender
+type BlockRequest struct {
+	Address string `json:"address" validate:"required,email"`
+}
+
+// handleListBlocks returns the senders the current user has blocked
+func (s *Server) handleListBlocks(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	blocks, err := s.blockRepo.List(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list blocked senders", "err", err)
+		http.Error(w, "Failed to list blocked senders", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if blocks == nil {
+		blocks = []*database.BlockedSender{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// handleCreateBlock blocks mail from an address to the current user
+func (s *Server) handleCreateBlock(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BlockRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	// The email tag has already checked the address, so this cannot fail
+	address, _ := compose.NormalizeAddress(req.Address)
+
+	existing, err := s.blockRepo.GetByAddress(user.ID, address)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up blocked sender", "err", err)
+		http.Error(w, "Failed to block sender", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "already_blocked",
+			"message": "That sender is already blocked",
+		})
+		return
+	}
+
+	block, err := s.blockRepo.Create(user.ID, address)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to block sender", "err", err)
+		http.Error(w, "Failed to block sender", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(block)
+}
+
+// handleDeleteBlock unblocks one of the current user's blocked senders
+func (s *Server) handleDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	blockID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid block ID", http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.blockRepo.GetByID(blockID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get blocked sender", "err", err)
+		http.Error(w, "Failed to get blocked sender", http.StatusInternalServerError)
+		return
+	}
+	if block == nil || block.UserID != user.ID {
+		http.Error(w, "Blocked sender not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.blockRepo.Delete(block.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to unblock sender", "err", err)
+		http.Error(w, "Failed to unblock sender", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// senderBlocked reports whether a local recipient has blocked mail from an
+// address. Mail from a blocked sender is dropped while the sender is told it
+// was delivered, so blocks are not revealed. If the blocklist cannot be read
+// the mail is let through.
+func (s *Server) senderBlocked(ctx context.Context, toUserID *int, from string) bool {
+	if toUserID == nil {
+		return false
+	}
+
+	blocked, err := s.blockRepo.IsBlocked(*toUserID, from)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to check blocklist", "user_id", *toUserID, "err", err)
+		return false
+	}
+	if blocked {
+		slog.InfoContext(ctx, "dropping mail from blocked sender", "user_id", *toUserID, "from", from)
+	}
+	return blocked
+}
@@ -0,0 +1,121 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+)
+
+// maxBulkMessages limits how many messages a single bulk request may touch
+const maxBulkMessages = 500
+
+// BulkMessageRequest represents a request to apply one action to many messages
+type BulkMessageRequest struct {
+	IDs    []int  `json:"ids"`
+	Action string `json:"action"` // "read", "unread" or "delete"
+}
+
+// BulkMessageResult is the outcome of a bulk action for a single message
+type BulkMessageResult struct {
+	ID      int    `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleBulkMessages applies an action to many messages at once. Every ID is
+// checked against the current user before anything is changed, and the
+// response reports per ID whether the action was applied. Read and unread
+// only apply to messages the user received; delete also removes messages
+// from Sent.
+func (s *Server) handleBulkMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BulkMessageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if len(req.IDs) == 0 || len(req.IDs) > maxBulkMessages {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_ids",
+			"message": fmt.Sprintf("Between 1 and %d message IDs are required", maxBulkMessages),
+		})
+		return
+	}
+
+	// Drop duplicates so each message is reported once
+	seen := make(map[int]bool, len(req.IDs))
+	ids := make([]int, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var outcomes map[int]string
+	var err error
+	switch req.Action {
+	case "read":
+		outcomes, err = s.messageRepo.MarkManyAsRead(user.ID, ids)
+	case "unread":
+		outcomes, err = s.messageRepo.MarkManyAsUnread(user.ID, ids)
+	case "delete":
+		if !user.HasScope(auth.ScopeDelete) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "insufficient_scope",
+				"message": fmt.Sprintf("Token lacks the %s scope", auth.ScopeDelete),
+			})
+			return
+		}
+		outcomes, err = s.messageRepo.DeleteMany(user.ID, ids)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_action",
+			"message": `Action must be "read", "unread" or "delete"`,
+		})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to apply bulk action", "action", req.Action, "err", err)
+		http.Error(w, "Failed to update messages", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]BulkMessageResult, len(ids))
+	applied := 0
+	for i, id := range ids {
+		results[i] = BulkMessageResult{ID: id, Success: outcomes[id] == database.BulkApplied}
+		if results[i].Success {
+			applied++
+		} else {
+			results[i].Error = outcomes[id]
+		}
+	}
+
+	if applied > 0 {
+		s.notifyUnreadCount(user.ID)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"action":  req.Action,
+		"applied": applied,
+		"results": results,
+	})
+}
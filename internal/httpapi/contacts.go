@@ -0,0 +1,287 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// maxContactNameLength limits contact display names
+const maxContactNameLength = 100
+
+// defaultSuggestLimit and maxSuggestLimit bound the number of suggestions
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+)
+
+// ContactRequest represents a request to create or update a contact
+type ContactRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// handleListContacts returns the current user's address book
+func (s *Server) handleListContacts(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	contacts, err := s.contactRepo.List(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list contacts", "err", err)
+		http.Error(w, "Failed to list contacts", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if contacts == nil {
+		contacts = []*database.Contact{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contacts)
+}
+
+// handleCreateContact adds a contact to the current user's address book
+func (s *Server) handleCreateContact(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeContactRequest(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := s.contactRepo.GetByAddress(user.ID, req.Address)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up contact", "err", err)
+		http.Error(w, "Failed to create contact", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		writeContactExists(w)
+		return
+	}
+
+	contact, err := s.contactRepo.Create(user.ID, req.Name, req.Address)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create contact", "err", err)
+		http.Error(w, "Failed to create contact", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(contact)
+}
+
+// handleUpdateContact changes the name and address of one of the current
+// user's contacts
+func (s *Server) handleUpdateContact(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	contact, ok := s.getOwnedContact(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeContactRequest(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := s.contactRepo.GetByAddress(user.ID, req.Address)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up contact", "err", err)
+		http.Error(w, "Failed to update contact", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil && existing.ID != contact.ID {
+		writeContactExists(w)
+		return
+	}
+
+	if err := s.contactRepo.Update(contact.ID, req.Name, req.Address); err != nil {
+		slog.ErrorContext(r.Context(), "failed to update contact", "err", err)
+		http.Error(w, "Failed to update contact", http.StatusInternalServerError)
+		return
+	}
+
+	contact.Name = req.Name
+	contact.Address = req.Address
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(contact)
+}
+
+// handleDeleteContact removes one of the current user's contacts
+func (s *Server) handleDeleteContact(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	contact, ok := s.getOwnedContact(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.contactRepo.Delete(contact.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete contact", "err", err)
+		http.Error(w, "Failed to delete contact", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleSuggestContacts returns contacts whose name or address starts with
+// the q parameter. Unless history=false, addresses the user has exchanged
+// mail with are appended after the saved contacts.
+func (s *Server) handleSuggestContacts(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := strings.TrimSpace(query.Get("q"))
+
+	limit := defaultSuggestLimit
+	if l := query.Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	if limit > maxSuggestLimit {
+		limit = maxSuggestLimit
+	}
+
+	suggestions, err := s.contactRepo.Suggest(user.ID, prefix, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to suggest contacts", "err", err)
+		http.Error(w, "Failed to suggest contacts", http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("history") != "false" && len(suggestions) < limit {
+		// Ask for one extra in case the user's own address is among them
+		correspondents, err := s.contactRepo.SuggestCorrespondents(user.ID, prefix, limit-len(suggestions)+1)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to suggest correspondents", "err", err)
+			http.Error(w, "Failed to suggest contacts", http.StatusInternalServerError)
+			return
+		}
+
+		ownAddress := fmt.Sprintf("%s@%s", user.Username, s.config.ServerHost)
+		for _, c := range correspondents {
+			if len(suggestions) >= limit {
+				break
+			}
+			if strings.EqualFold(c.Address, ownAddress) {
+				continue
+			}
+			suggestions = append(suggestions, c)
+		}
+	}
+
+	// Ensure we always return an array, never null
+	if suggestions == nil {
+		suggestions = []*database.Contact{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// decodeContactRequest parses and validates a contact body, writing an error
+// response and returning false if it is unusable
+func decodeContactRequest(w http.ResponseWriter, r *http.Request) (*ContactRequest, bool) {
+	var req ContactRequest
+	if !decodeJSON(w, r, &req) {
+		return nil, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Address = strings.TrimSpace(req.Address)
+
+	if !isValidEmail(req.Address) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_address",
+			"message": "Contact address must be a valid email address",
+		})
+		return nil, false
+	}
+
+	if len(req.Name) > maxContactNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_name",
+			"message": fmt.Sprintf("Contact name must be at most %d characters", maxContactNameLength),
+		})
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// writeContactExists reports that the address is already in the address book
+func writeContactExists(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   "contact_exists",
+		"message": "A contact with that address already exists",
+	})
+}
+
+// getOwnedContact loads the contact named by the {id} route variable and
+// checks that it belongs to userID, writing an error response if not
+func (s *Server) getOwnedContact(w http.ResponseWriter, r *http.Request, userID int) (*database.Contact, bool) {
+	contactID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid contact ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	contact, err := s.contactRepo.GetByID(contactID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get contact", "err", err)
+		http.Error(w, "Failed to get contact", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if contact == nil || contact.UserID != userID {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return contact, true
+}
@@ -0,0 +1,85 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS middleware
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Federation routes are called by other servers, not browsers
+		if strings.HasPrefix(r.URL.Path, "/federation/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The allowed origin is echoed back rather than "*", which browsers
+		// refuse along with credentials. Responses differ by origin, so
+		// caches must key on it.
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if s.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+RequestIDHeader+", "+IdempotencyKeyHeader+", Last-Event-ID, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader+", "+idempotentReplayHeader+", ETag")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed reports whether browsers may call the API from origin: it
+// matches one of the configured origins, or any origin is allowed
+func (s *Server) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if s.config.AllowAnyOrigin {
+		return true
+	}
+	for _, pattern := range s.config.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin reports whether origin matches pattern. A pattern is an exact
+// origin, or one whose host starts with "*." to allow any subdomain of the
+// rest (at any depth, but not the bare domain itself). Scheme and port must
+// match exactly.
+func matchOrigin(pattern, origin string) bool {
+	if strings.EqualFold(pattern, origin) {
+		return true
+	}
+
+	scheme, host, ok := strings.Cut(pattern, "://")
+	if !ok || !strings.HasPrefix(host, "*.") {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, scheme) {
+		return false
+	}
+
+	// With the port part of the suffix, a different port cannot match
+	suffix := strings.ToLower(host[1:])
+	originHost := strings.ToLower(u.Host)
+	return len(originHost) > len(suffix) && strings.HasSuffix(originHost, suffix) &&
+		!strings.Contains(originHost[:len(originHost)-len(suffix)], ":")
+}
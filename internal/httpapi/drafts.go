@@ -0,0 +1,279 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// SaveDraftRequest represents a request to save a draft. When ID is set the
+// existing draft is updated, otherwise a new draft is created.
+type SaveDraftRequest struct {
+	ID       int    `json:"id"`
+	To       string `json:"to"`
+	ReplyTo  string `json:"reply_to"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	IsHTML   bool   `json:"is_html"`
+	ThreadID string `json:"thread_id"`
+	ParentID int    `json:"parent_id"`
+}
+
+// handleSaveDraft creates or updates a draft without delivering it
+func (s *Server) handleSaveDraft(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req SaveDraftRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.ReplyTo != "" && !isValidEmail(req.ReplyTo) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_reply_to",
+			"message": fmt.Sprintf("Invalid reply-to address: %s", req.ReplyTo),
+		})
+		return
+	}
+
+	if req.ID > 0 {
+		draft, ok := s.getOwnedDraft(w, req.ID, user.ID)
+		if !ok {
+			return
+		}
+
+		if err := s.messageRepo.UpdateDraft(draft.ID, req.To, req.ReplyTo, req.Subject, req.Body, req.IsHTML); err != nil {
+			slog.ErrorContext(r.Context(), "failed to update draft", "err", err)
+			http.Error(w, "Failed to save draft", http.StatusInternalServerError)
+			return
+		}
+
+		updated, err := s.messageRepo.GetByIDWithAttachments(draft.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get draft", "err", err)
+			http.Error(w, "Failed to get draft", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(updated)
+		return
+	}
+
+	// Prepare threading parameters
+	var threadIDPtr *string
+	var parentIDPtr *int
+	if req.ThreadID != "" {
+		threadIDPtr = &req.ThreadID
+	}
+	if req.ParentID > 0 {
+		parentIDPtr = &req.ParentID
+	}
+
+	fromAddress := fmt.Sprintf("%s@%s", user.Username, s.config.ServerHost)
+	draft, err := s.messageRepo.CreateDraft(user.ID, fromAddress, req.To, req.ReplyTo, req.Subject, req.Body, req.IsHTML, threadIDPtr, parentIDPtr)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create draft", "err", err)
+		http.Error(w, "Failed to save draft", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(draft)
+}
+
+// handleGetDrafts returns the current user's drafts
+func (s *Server) handleGetDrafts(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	drafts, err := s.messageRepo.GetDraftsForUser(user.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get drafts", "err", err)
+		http.Error(w, "Failed to get drafts", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if drafts == nil {
+		drafts = []*database.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drafts)
+}
+
+// handleSendDraft delivers a draft through the normal send path
+func (s *Server) handleSendDraft(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	draftID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid draft ID", http.StatusBadRequest)
+		return
+	}
+
+	draft, ok := s.getOwnedDraft(w, draftID, user.ID)
+	if !ok {
+		return
+	}
+
+	if !s.requireVerifiedEmail(w, r, user.ID) {
+		return
+	}
+
+	// A draft may be saved incomplete, but must be valid before sending
+	if draft.ToAddress == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "missing_recipient",
+			"message": "Recipient email address is required",
+		})
+		return
+	}
+	if draft.Subject == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "missing_subject",
+			"message": "Email subject is required",
+		})
+		return
+	}
+	if !isValidEmail(draft.ToAddress) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_email",
+			"message": fmt.Sprintf("Invalid email format: %s", draft.ToAddress),
+		})
+		return
+	}
+
+	toUserID, err := s.lookupLocalRecipient(r.Context(), draft.ToAddress)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to lookup local user", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "user_lookup_failed",
+			"message": fmt.Sprintf("Failed to lookup recipient user: %v", err),
+		})
+		return
+	}
+
+	if !s.checkRecipientQuota(r.Context(), w, toUserID, draft.ToAddress, int64(len(draft.Body))) {
+		return
+	}
+
+	blocked := s.senderBlocked(r.Context(), toUserID, draft.FromAddress)
+	if blocked {
+		toUserID = nil
+	}
+
+	// Sign the message, placing the signature above any quoted text in replies
+	body := s.applyUserSignature(user.ID, draft.Body, draft.IsHTML, draft.ParentID != nil)
+	replyTo := s.replyAddressFor(user.ID, draft.ReplyTo)
+
+	message, federationError, err := s.sendDraft(r.Context(), draft, toUserID, blocked, replyTo, body)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to send draft", "err", err)
+		http.Error(w, "Failed to send draft", http.StatusInternalServerError)
+		return
+	}
+	if message == nil {
+		// Another request sent it first
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "draft_already_sent",
+			"message": "Draft has already been sent",
+		})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"message": "Message sent successfully",
+		"id":      message.ID,
+	}
+	if federationError != "" {
+		response["warnings"] = []string{federationError}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// sendDraft turns a draft into a message to toUserID (nil for external
+// recipients) with the given reply-to and body, and delivers it. Mail to a
+// recipient who blocked the sender is reported like any local delivery. It
+// returns a nil message if the draft was sent meanwhile, and the delivery
+// warning, if any.
+func (s *Server) sendDraft(ctx context.Context, draft *database.Message, toUserID *int, blocked bool, replyTo, body string) (*database.Message, string, error) {
+	sent, err := s.messageRepo.MarkDraftSent(draft.ID, toUserID, draft.ToAddress, replyTo, body, draft.IsHTML)
+	if err != nil || !sent {
+		return nil, "", err
+	}
+
+	message, err := s.messageRepo.GetByID(draft.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to reload sent draft: %w", err)
+	}
+	if message == nil {
+		return nil, "", fmt.Errorf("sent draft %d disappeared", draft.ID)
+	}
+
+	// Notify local recipients, or relay to external ones
+	if blocked {
+		s.recordDelivery(ctx, message, database.DeliveryLocal, "")
+		return message, "", nil
+	}
+	return message, s.deliverMessage(ctx, message), nil
+}
+
+// getOwnedDraft loads a draft and verifies it belongs to userID, writing an
+// error response if not
+func (s *Server) getOwnedDraft(w http.ResponseWriter, draftID, userID int) (*database.Message, bool) {
+	draft, err := s.messageRepo.GetByID(draftID)
+	if err != nil {
+		slog.Error("failed to get draft", "err", err)
+		http.Error(w, "Failed to get draft", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Scheduled sends are managed through /api/messages/scheduled
+	if draft == nil || !draft.IsDraft || draft.ScheduledFor != nil || draft.FromUserID == nil || *draft.FromUserID != userID {
+		http.Error(w, "Draft not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return draft, true
+}
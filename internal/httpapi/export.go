@@ -0,0 +1,292 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+	"yourmail/internal/mbox"
+)
+
+// exportBatchSize is how many messages an export reads from the database at
+// a time, so only one batch is held in memory
+const exportBatchSize = 100
+
+// ExportedMessage is a message in a JSON export
+type ExportedMessage struct {
+	*database.Message
+	Attachments []ExportedAttachment `json:"attachments,omitempty"`
+}
+
+// ExportedAttachment is an attachment in a JSON export. Data is only set
+// when the export was asked to include attachment contents.
+type ExportedAttachment struct {
+	*database.Attachment
+	Data []byte `json:"data,omitempty"` // Base64 encoded
+}
+
+// handleExport streams every message the user sent or received as an mbox
+// file (?format=mbox, the default) or a JSON array (?format=json). Drafts
+// are left out. Attachment metadata is always included; their contents only
+// with ?attachments=true.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "mbox"
+	}
+	if format != "mbox" && format != "json" {
+		http.Error(w, "Invalid format: must be mbox or json", http.StatusBadRequest)
+		return
+	}
+	withData, _ := strconv.ParseBool(r.URL.Query().Get("attachments"))
+
+	name := fmt.Sprintf("yourmail-%s-%s.%s", user.Username, time.Now().UTC().Format("20060102"), format)
+	if format == "mbox" {
+		w.Header().Set("Content-Type", "application/mbox")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	}))
+
+	var write func(*database.Message) error
+	var finish func() error
+	if format == "mbox" {
+		mw := mbox.NewWriter(w)
+		write = func(message *database.Message) error {
+			return s.writeMboxMessage(mw, message, withData)
+		}
+		finish = func() error { return nil }
+	} else {
+		write, finish = s.jsonExportWriter(w, withData)
+	}
+
+	// The response has started once anything is written, so errors from
+	// here on can only be logged and the download cut short
+	count, afterID := 0, 0
+	for {
+		messages, err := s.messageRepo.GetMailboxAfter(r.Context(), user.ID, afterID, exportBatchSize)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to export messages", "err", err)
+			if count == 0 {
+				http.Error(w, "Failed to export messages", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		for _, message := range messages {
+			if err := write(message); err != nil {
+				slog.WarnContext(r.Context(), "export interrupted", "message_id", message.ID, "err", err)
+				return
+			}
+			count++
+			afterID = message.ID
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if len(messages) < exportBatchSize {
+			break
+		}
+	}
+
+	if err := finish(); err != nil {
+		slog.WarnContext(r.Context(), "export interrupted", "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "exported mailbox", "format", format, "messages", count, "attachments", withData)
+}
+
+// jsonExportWriter returns functions that write messages as the elements of
+// a JSON array and then close it
+func (s *Server) jsonExportWriter(w http.ResponseWriter, withData bool) (write func(*database.Message) error, finish func() error) {
+	enc := json.NewEncoder(w)
+	first := true
+
+	write = func(message *database.Message) error {
+		sep := ","
+		if first {
+			sep, first = "[", false
+		}
+		if _, err := w.Write([]byte(sep)); err != nil {
+			return err
+		}
+
+		exported := ExportedMessage{Message: message}
+		for _, attachment := range message.Attachments {
+			entry := ExportedAttachment{Attachment: attachment}
+			if withData {
+				data, err := s.attachmentRepo.GetFileData(attachment.ID)
+				if err != nil {
+					return err
+				}
+				entry.Data = data
+			}
+			exported.Attachments = append(exported.Attachments, entry)
+		}
+		return enc.Encode(exported)
+	}
+
+	finish = func() error {
+		end := "]\n"
+		if first {
+			end = "[]\n"
+		}
+		_, err := w.Write([]byte(end))
+		return err
+	}
+	return write, finish
+}
+
+// writeMboxMessage formats a message as RFC 5322 text and appends it to the
+// mbox. Attachments are listed in X-Attachment headers, or attached as MIME
+// parts when withData is set.
+func (s *Server) writeMboxMessage(mw *mbox.Writer, message *database.Message, withData bool) error {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+
+	header("From", message.FromAddress)
+	header("To", message.ToAddress)
+	if message.ReplyTo != "" {
+		header("Reply-To", message.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header("Date", message.CreatedAt.Format(time.RFC1123Z))
+	if message.MessageID != "" {
+		header("Message-ID", message.MessageID)
+	} else {
+		// Stored before Message-IDs were recorded
+		header("Message-ID", fmt.Sprintf("<%d@%s>", message.ID, s.config.ServerHost))
+	}
+	if message.InReplyTo != "" {
+		header("In-Reply-To", message.InReplyTo)
+	}
+	if message.References != "" {
+		header("References", message.References)
+	}
+	if message.ThreadID != nil {
+		header("X-YourMail-Thread", *message.ThreadID)
+	}
+	if message.ReadStatus {
+		header("Status", "RO")
+	}
+	if message.Flagged {
+		header("X-Status", "F")
+	}
+	header("MIME-Version", "1.0")
+
+	contentType := "text/plain; charset=utf-8"
+	if message.IsHTML {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	if !withData || len(message.Attachments) == 0 {
+		for _, attachment := range message.Attachments {
+			header("X-Attachment", mime.FormatMediaType("attachment", map[string]string{
+				"filename": attachment.OriginalName,
+				"type":     attachment.ContentType,
+				"size":     strconv.FormatInt(attachment.FileSize, 10),
+			}))
+		}
+		header("Content-Type", contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, message.Body); err != nil {
+			return err
+		}
+		return mw.WriteMessage(message.FromAddress, message.CreatedAt, buf.Bytes())
+	}
+
+	var parts bytes.Buffer
+	mpw := multipart.NewWriter(&parts)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mpw.Boundary()}))
+	buf.WriteString("\r\n")
+
+	body, err := mpw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeQuotedPrintable(body, message.Body); err != nil {
+		return err
+	}
+
+	for _, attachment := range message.Attachments {
+		data, err := s.attachmentRepo.GetFileData(attachment.ID)
+		if err != nil {
+			return err
+		}
+		partHeader := textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.OriginalName})},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if attachment.ContentID != "" {
+			partHeader.Set("Content-ID", "<"+attachment.ContentID+">")
+			partHeader.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": attachment.OriginalName}))
+		}
+		part, err := mpw.CreatePart(partHeader)
+		if err != nil {
+			return err
+		}
+		if err := writeBase64Lines(part, data); err != nil {
+			return err
+		}
+	}
+	if err := mpw.Close(); err != nil {
+		return err
+	}
+
+	buf.Write(parts.Bytes())
+	return mw.WriteMessage(message.FromAddress, message.CreatedAt, buf.Bytes())
+}
+
+// writeQuotedPrintable writes text to w in quoted-printable encoding
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64Lines writes data to w base64 encoded in 76 character lines, as
+// MIME requires
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
@@ -0,0 +1,173 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+	"yourmail/internal/federation"
+
+	"github.com/gorilla/mux"
+)
+
+// federationAttachmentURLTTL is how long a download link for an attachment
+// relayed by reference works. The receiving server fetches it while
+// handling the relay, and a retried relay gets a fresh link.
+const federationAttachmentURLTTL = time.Hour
+
+// FederationInfo describes what this server accepts over federation. It is
+// the contract peers can check before relaying mail here.
+type FederationInfo struct {
+	Domain          string   `json:"domain"`
+	Version         string   `json:"version"`
+	ContentTypes    []string `json:"content_types"`     // Message body types accepted
+	MaxMessageBytes int64    `json:"max_message_bytes"` // Largest relay request accepted
+	// Largest attachment accepted, inline or by reference
+	MaxAttachmentBytes int64 `json:"max_attachment_bytes"`
+	// Schemes relayed messages may be signed with. Relays are not signed
+	// yet, so it is empty and there is no public key to publish.
+	SignatureSchemes []string `json:"signature_schemes"`
+}
+
+// handleFederationInfo tells peer servers about this server's federation
+// support
+func (s *Server) handleFederationInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FederationInfo{
+		Domain:             s.config.ServerHost,
+		Version:            apiVersion,
+		ContentTypes:       []string{"text/plain", "text/html"},
+		MaxMessageBytes:    s.config.FederationMaxMessageBytes,
+		MaxAttachmentBytes: s.config.MaxAttachmentBytes,
+		SignatureSchemes:   []string{},
+	})
+}
+
+// federationAttachments returns a message's attachments for relaying. Files
+// up to FEDERATION_INLINE_ATTACHMENT_BYTES are sent inline; larger ones as
+// signed links to handleFederationAttachment.
+func (s *Server) federationAttachments(message *database.Message) ([]federation.Attachment, error) {
+	attachments, err := s.attachmentRepo.GetByMessageID(message.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(federationAttachmentURLTTL)
+	var relayed []federation.Attachment
+	for _, a := range attachments {
+		fa := federation.Attachment{
+			Filename:    a.OriginalName,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Size:        a.FileSize,
+		}
+		if a.FileSize <= s.config.FederationInlineAttachmentBytes {
+			if fa.Data, err = s.attachmentRepo.GetFileData(a.ID); err != nil {
+				return nil, err
+			}
+		} else {
+			fa.URL = fmt.Sprintf("http://%s:%s/federation/attachments/%d?expires=%d&sig=%s",
+				s.config.ServerHost, s.config.HTTPPort, a.ID, expires.Unix(),
+				federation.SignAttachment(s.config.JWTSecret, a.ID, expires))
+		}
+		relayed = append(relayed, fa)
+	}
+	return relayed, nil
+}
+
+// receiveFederatedAttachments checks the attachments of a relayed message
+// against the same limits as uploads, downloading those sent by reference
+// from fromHost. If one can't be accepted it writes an error response, which
+// makes the sending server bounce the message, and returns false.
+func (s *Server) receiveFederatedAttachments(ctx context.Context, w http.ResponseWriter, msg *federation.Message, fromHost string) ([]pendingAttachment, bool) {
+	fail := func(status int, code, message string) ([]pendingAttachment, bool) {
+		slog.WarnContext(ctx, "federated attachment rejected", "from", msg.From, "reason", message)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   code,
+			"message": message,
+		})
+		return nil, false
+	}
+
+	var attachments []pendingAttachment
+	for _, a := range msg.Attachments {
+		if a.Filename == "" {
+			a.Filename = "attachment"
+		}
+		tooLarge := fmt.Sprintf("Attachment %s is too large (max %d bytes)", a.Filename, s.config.MaxAttachmentBytes)
+		if a.Size > s.config.MaxAttachmentBytes || int64(len(a.Data)) > s.config.MaxAttachmentBytes {
+			return fail(http.StatusRequestEntityTooLarge, "attachment_too_large", tooLarge)
+		}
+
+		data := a.Data
+		if a.URL != "" {
+			var err error
+			data, err = s.relay.FetchAttachment(ctx, a, fromHost, s.config.MaxAttachmentBytes)
+			if errors.Is(err, federation.ErrAttachmentTooLarge) {
+				return fail(http.StatusRequestEntityTooLarge, "attachment_too_large", tooLarge)
+			}
+			if err != nil {
+				return fail(http.StatusBadGateway, "attachment_fetch_failed", fmt.Sprintf("Failed to fetch attachment %s: %v", a.Filename, err))
+			}
+		}
+
+		if err := s.checkAttachmentType(a.ContentType, data); err != nil {
+			return fail(http.StatusUnsupportedMediaType, "attachment_rejected", fmt.Sprintf("Attachment %s rejected: %v", a.Filename, err))
+		}
+		attachments = append(attachments, pendingAttachment{
+			Filename:         fmt.Sprintf("%d_%s", time.Now().Unix(), a.Filename),
+			OriginalFilename: a.Filename,
+			ContentType:      compose.AttachmentContentType(a.ContentType, data),
+			ContentID:        compose.ContentID(a.ContentID),
+			Data:             data,
+		})
+	}
+	return attachments, true
+}
+
+// handleFederationAttachment serves an attachment relayed by reference to
+// the peer server holding a signed link to it
+func (s *Server) handleFederationAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if !federation.VerifyAttachment(s.config.JWTSecret, attachmentID, query.Get("expires"), query.Get("sig")) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := s.attachmentRepo.GetByID(attachmentID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get attachment", "err", err)
+		http.Error(w, "Failed to get file", http.StatusInternalServerError)
+		return
+	}
+	if attachment == nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	fileData, err := s.attachmentRepo.GetFileData(attachmentID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get file data", "err", err)
+		http.Error(w, "Failed to get file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(fileData)))
+	w.Write(fileData)
+}
@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// FlagMessageRequest represents a request to flag or unflag a message. A
+// missing flagged field flags the message.
+type FlagMessageRequest struct {
+	Flagged *bool `json:"flagged"`
+}
+
+// handleFlagMessage sets or clears the flag on a message
+func (s *Server) handleFlagMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var req FlagMessageRequest
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	flagged := req.Flagged == nil || *req.Flagged
+
+	// Get message to verify ownership
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	// Verify user owns this message (is the recipient)
+	if message.ToUserID == nil || *message.ToUserID != user.ID {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if err := s.messageRepo.SetFlag(messageID, flagged); err != nil {
+		slog.ErrorContext(r.Context(), "failed to flag message", "err", err)
+		http.Error(w, "Failed to flag message", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "flagged": flagged})
+}
+
+// handleGetFlaggedMessages returns the messages the user has flagged
+func (s *Server) handleGetFlaggedMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	messages, err := s.messageRepo.GetFlaggedForUser(user.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get flagged messages", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	s.renderBodies(r, messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// hideRecipientState clears per-recipient state (such as the flag) on the
+// messages, and their replies, that userID did not receive. The sender of a
+// message shares its row with the recipient and must not see their flags.
+func hideRecipientState(messages []*database.Message, userID int) {
+	for _, msg := range messages {
+		if msg.ToUserID == nil || *msg.ToUserID != userID {
+			msg.Flagged = false
+		}
+		if len(msg.Replies) > 0 {
+			hideRecipientState(msg.Replies, userID)
+		}
+	}
+}
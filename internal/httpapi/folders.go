@@ -0,0 +1,268 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// maxFolderNameLength limits folder names to something a sidebar can show
+const maxFolderNameLength = 64
+
+// CreateFolderRequest represents a request to create a folder
+type CreateFolderRequest struct {
+	Name string `json:"name"`
+}
+
+// MoveMessageRequest represents a request to file a message. A null or
+// missing folder_id moves the message back to the inbox.
+type MoveMessageRequest struct {
+	FolderID *int `json:"folder_id"`
+}
+
+// handleListFolders returns the current user's folders
+func (s *Server) handleListFolders(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	folders, err := s.folderRepo.ListFolders(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list folders", "err", err)
+		http.Error(w, "Failed to list folders", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if folders == nil {
+		folders = []*database.Folder{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folders)
+}
+
+// handleCreateFolder creates a folder for the current user
+func (s *Server) handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req CreateFolderRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxFolderNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_folder_name",
+			"message": fmt.Sprintf("Folder name must be between 1 and %d characters", maxFolderNameLength),
+		})
+		return
+	}
+
+	// The inbox is not a real folder, but shares the namespace in the
+	// per-folder unread counts
+	if strings.EqualFold(name, database.InboxName) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "folder_exists",
+			"message": "A folder with that name already exists",
+		})
+		return
+	}
+
+	existing, err := s.folderRepo.GetByName(user.ID, name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up folder", "err", err)
+		http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "folder_exists",
+			"message": "A folder with that name already exists",
+		})
+		return
+	}
+
+	folder, err := s.folderRepo.CreateFolder(user.ID, name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create folder", "err", err)
+		http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+// handleDeleteFolder deletes one of the current user's folders. Messages in
+// the folder go back to the inbox.
+func (s *Server) handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	folder, ok := s.getOwnedFolder(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.folderRepo.DeleteFolder(folder.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete folder", "err", err)
+		http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+		return
+	}
+	// Its messages, and their unread counts, are back in the inbox
+	s.notifyUnreadCount(user.ID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleGetFolderMessages returns the messages filed in a folder
+func (s *Server) handleGetFolderMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	folder, ok := s.getOwnedFolder(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	messages, err := s.folderRepo.GetMessagesInFolder(folder.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get folder messages", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleMoveMessage files a message into a folder or back into the inbox
+func (s *Server) handleMoveMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var req MoveMessageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	// Get message to verify access
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	// Verify user has access to this message
+	if (message.ToUserID == nil || *message.ToUserID != user.ID) &&
+		(message.FromUserID == nil || *message.FromUserID != user.ID) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	// Verify the target folder belongs to the user
+	if req.FolderID != nil {
+		folder, err := s.folderRepo.GetByID(*req.FolderID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get folder", "err", err)
+			http.Error(w, "Failed to get folder", http.StatusInternalServerError)
+			return
+		}
+		if folder == nil || folder.UserID != user.ID {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if err := s.folderRepo.MoveMessageToFolder(messageID, user.ID, req.FolderID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to move message", "err", err)
+		http.Error(w, "Failed to move message", http.StatusInternalServerError)
+		return
+	}
+	if message.ToUserID != nil && *message.ToUserID == user.ID && !message.ReadStatus {
+		s.notifyUnreadCount(user.ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// getOwnedFolder loads the folder named by the {id} route variable and
+// verifies it belongs to userID, writing an error response if not
+func (s *Server) getOwnedFolder(w http.ResponseWriter, r *http.Request, userID int) (*database.Folder, bool) {
+	folderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	folder, err := s.folderRepo.GetByID(folderID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get folder", "err", err)
+		http.Error(w, "Failed to get folder", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if folder == nil || folder.UserID != userID {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return folder, true
+}
@@ -0,0 +1,163 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMiddleware compresses JSON responses of at least GZIP_MIN_BYTES for
+// clients that accept gzip. Other responses, such as attachment downloads,
+// whose media is usually compressed already, and exports, are sent as
+// written. The SSE stream is left alone, since every event must reach the
+// client as soon as it is written.
+func (s *Server) gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.GzipMinBytes == 0 || strings.HasPrefix(r.URL.Path, "/api/sse/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: s.config.GzipMinBytes}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// gzip;q=0 refuses it
+		params = strings.ReplaceAll(params, " ", "")
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of a response until it knows
+// whether to compress it: the response must be JSON and reach minBytes.
+// Smaller responses are sent uncompressed when the handler returns.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	gz       *gzip.Writer
+	decided  bool // Whether the response is compressed has been settled
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.status == 0 {
+		gw.status = code
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	if gw.decided {
+		return gw.ResponseWriter.Write(b)
+	}
+
+	if !gw.compressible() {
+		if err := gw.passThrough(); err != nil {
+			return 0, err
+		}
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= gw.minBytes {
+		if err := gw.compress(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been written so far, settling on no compression if
+// that isn't decided yet
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	} else if !gw.decided {
+		gw.passThrough()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// compressible reports whether the response so far may be compressed
+func (gw *gzipResponseWriter) compressible() bool {
+	h := gw.Header()
+	if h.Get("Content-Encoding") != "" || gw.status == http.StatusNoContent || gw.status == http.StatusNotModified {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// compress sends the header of a compressed response and what is buffered
+func (gw *gzipResponseWriter) compress() error {
+	gw.decided = true
+	h := gw.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	_, err := gw.gz.Write(gw.buf)
+	gw.buf = nil
+	return err
+}
+
+// passThrough sends the header and anything buffered as they are
+func (gw *gzipResponseWriter) passThrough() error {
+	gw.decided = true
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+	if len(gw.buf) == 0 {
+		return nil
+	}
+	_, err := gw.ResponseWriter.Write(gw.buf)
+	gw.buf = nil
+	return err
+}
+
+// finish completes the response once the handler has returned
+func (gw *gzipResponseWriter) finish() {
+	if gw.gz != nil {
+		gw.gz.Close()
+	} else if !gw.decided {
+		gw.passThrough()
+	}
+}
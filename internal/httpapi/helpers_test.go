@@ -0,0 +1,94 @@
+package httpapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"yourmail/config"
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+	"yourmail/internal/database/dbtest"
+	"yourmail/internal/federation"
+)
+
+// newTestServer returns a server backed by a fresh SQLite database in a
+// temporary directory, with the default configuration
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := newCountingTestServer(t)
+	return s
+}
+
+// newCountingTestServer is like newTestServer, and also returns the counter
+// of the queries run against the server's database
+func newCountingTestServer(t *testing.T) (*Server, *dbtest.Counter) {
+	t.Helper()
+
+	cfg := config.Load()
+	cfg.ServerHost = "localhost"
+
+	db, counter := dbtest.Open(t)
+	db.SetMessageIDHost(cfg.ServerHost)
+
+	s := NewServer(cfg, db, federation.NewRelay(cfg.ServerHost, cfg.HTTPPort))
+	t.Cleanup(s.ShutdownSSE)
+	return s, counter
+}
+
+// createTestUser adds a user with the password "password123"
+func createTestUser(t *testing.T, s *Server, username string) *database.User {
+	t.Helper()
+	user, err := s.userRepo.Create(username, username+"@example.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+	return user
+}
+
+// authRequest returns a request made by user, as the auth middleware would
+// pass it on
+func authRequest(user *database.User, method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r.WithContext(auth.SetUserInContext(r.Context(), &auth.AuthUser{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+	}))
+}
+
+// addSSEClient registers an SSE client for userID whose events stay in its
+// queue, where the test can read them
+func addSSEClient(s *Server, userID int) *SSEClient {
+	w := httptest.NewRecorder()
+	client := &SSEClient{
+		userID:   userID,
+		writer:   w,
+		flusher:  w,
+		done:     make(chan bool),
+		events:   make(chan sseEvent, s.config.SSEClientBuffer),
+		lastPing: time.Now(),
+	}
+	s.sseMutex.Lock()
+	s.sseClients[userID] = append(s.sseClients[userID], client)
+	s.sseMutex.Unlock()
+	return client
+}
+
+// queuedEvents drains the events waiting in an SSE client's queue
+func queuedEvents(client *SSEClient) []sseEvent {
+	var events []sseEvent
+	for {
+		select {
+		case event := <-client.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
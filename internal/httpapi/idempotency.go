@@ -0,0 +1,113 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"yourmail/internal/auth"
+)
+
+// IdempotencyKeyHeader lets clients retry a request without repeating it
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayHeader marks a response replayed from an earlier request
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder captures the status and body written to a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes a handler safe to retry. When a request carries an
+// Idempotency-Key header, a successful response is stored under that key
+// for the current user, and later requests with the same key get the stored
+// response instead of running the handler again. Unsuccessful responses are
+// not stored, so a request that failed can be retried with the same key.
+// Requests without the header are handled as usual.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		user, ok := auth.GetUserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "User not found in context", http.StatusInternalServerError)
+			return
+		}
+
+		fail := func(status int, code, message string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   code,
+				"message": message,
+			})
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			fail(http.StatusBadRequest, "invalid_idempotency_key", "Idempotency key must be at most 255 characters")
+			return
+		}
+
+		record, err := s.idempotencyRepo.Reserve(user.ID, key, r.URL.Path, s.config.IdempotencyTTL)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to reserve idempotency key", "err", err)
+			http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+
+		if record != nil {
+			switch {
+			case record.Path != r.URL.Path:
+				fail(http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency key was already used for a different request")
+			case record.StatusCode == 0:
+				fail(http.StatusConflict, "idempotency_key_in_use", "A request with this idempotency key is still in progress")
+			default:
+				slog.InfoContext(r.Context(), "replaying idempotent response", "user_id", user.ID, "key", key)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(idempotentReplayHeader, "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Response)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status >= 200 && rec.status < 300 {
+			err = s.idempotencyRepo.Complete(user.ID, key, rec.status, rec.body.Bytes())
+		} else {
+			err = s.idempotencyRepo.Release(user.ID, key)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to update idempotency key", "key", key, "err", err)
+		}
+	}
+}
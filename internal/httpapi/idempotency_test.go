@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"yourmail/internal/database"
+)
+
+func TestIdempotentSendStoresOneMessage(t *testing.T) {
+	s := newTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	carol := createTestUser(t, s, "carol")
+	createTestUser(t, s, "bob")
+	send := s.idempotent(s.handleSendMessage)
+
+	post := func(user *database.User, key string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := authRequest(user, "POST", "/api/send", strings.NewReader(`{"to": "bob@localhost", "subject": "Once", "body": "Only once"}`))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		send(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("send returned %d: %s", w.Code, w.Body)
+		}
+		return w
+	}
+	sent := func(user *database.User) int {
+		t.Helper()
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE from_user_id = ?`, user.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	first := post(alice, "retry-1")
+	second := post(alice, "retry-1")
+	if n := sent(alice); n != 1 {
+		t.Errorf("alice has %d messages after a retried send, want 1", n)
+	}
+	if first.Header().Get(idempotentReplayHeader) != "" {
+		t.Errorf("first response marked as replayed")
+	}
+	if second.Header().Get(idempotentReplayHeader) != "true" {
+		t.Errorf("retried response not marked as replayed")
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Errorf("replayed response differs:\n%s\nwant\n%s", second.Body, first.Body)
+	}
+
+	// Keys are per user, and a new key sends again
+	post(carol, "retry-1")
+	if n := sent(carol); n != 1 {
+		t.Errorf("carol has %d messages after sending with alice's key, want 1", n)
+	}
+	post(alice, "retry-2")
+	if n := sent(alice); n != 2 {
+		t.Errorf("alice has %d messages after a second key, want 2", n)
+	}
+}
@@ -0,0 +1,215 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+	"yourmail/internal/mailparse"
+	"yourmail/internal/mbox"
+)
+
+// maxImportProblems caps the problems listed in an import summary
+const maxImportProblems = 100
+
+// ImportResponse summarizes an mbox import
+type ImportResponse struct {
+	Imported int             `json:"imported"`
+	Skipped  int             `json:"skipped"`
+	Errors   []ImportProblem `json:"errors,omitempty"`   // Messages that were skipped
+	Warnings []ImportProblem `json:"warnings,omitempty"` // Attachments left out of imported messages
+}
+
+// ImportProblem explains what went wrong with one message of an import
+type ImportProblem struct {
+	Message int    `json:"message"` // Position in the mbox, starting at 1
+	Error   string `json:"error"`
+}
+
+// importedMessage is a message parsed from an mbox
+type importedMessage struct {
+	from, to, replyTo string
+	subject, body     string
+	isHTML            bool
+	date              time.Time
+	read, flagged     bool
+	headers           database.MessageHeaders
+	attachments       []*pendingAttachment
+	warnings          []string
+}
+
+// handleImport stores the messages of an uploaded mbox file (the "file" field
+// of a multipart form) as mail received by the user. The file is read as it
+// is uploaded, one message at a time. Messages that cannot be parsed are
+// skipped and reported rather than failing the import.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxImportBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart upload with an mbox file", http.StatusBadRequest)
+		return
+	}
+
+	var file *multipart.Part
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, "Missing file field", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			file = part
+			break
+		}
+	}
+
+	// Read the mailbox size once and keep count, rather than summing the
+	// whole mailbox again for every message
+	var used int64
+	if s.config.MailboxQuota > 0 {
+		if used, err = s.messageRepo.GetUserStorageUsage(user.ID); err != nil {
+			slog.ErrorContext(r.Context(), "failed to get storage usage", "user_id", user.ID, "err", err)
+			http.Error(w, "Failed to check mailbox quota", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var response ImportResponse
+	problem := func(list *[]ImportProblem, n int, msg string) {
+		if len(*list) < maxImportProblems {
+			*list = append(*list, ImportProblem{Message: n, Error: msg})
+		}
+	}
+
+	reader := mbox.NewReader(file)
+	for n := 1; ; n++ {
+		raw, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				http.Error(w, fmt.Sprintf("Import is larger than %d bytes", s.config.MaxImportBytes), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, mbox.ErrNotMbox) && n == 1:
+				http.Error(w, "File is not an mbox", http.StatusBadRequest)
+			default:
+				slog.WarnContext(r.Context(), "import interrupted", "message", n, "err", err)
+				http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			}
+			return
+		}
+
+		msg, err := s.parseImportedMessage(raw, user.Email)
+		if err != nil {
+			response.Skipped++
+			problem(&response.Errors, n, err.Error())
+			continue
+		}
+
+		size := int64(len(msg.body))
+		for _, a := range msg.attachments {
+			size += int64(len(a.Data))
+		}
+		if s.config.MailboxQuota > 0 && used+size > s.config.MailboxQuota {
+			response.Skipped++
+			problem(&response.Errors, n, "mailbox is full")
+			continue
+		}
+
+		message, err := s.messageRepo.Import(user.ID, msg.from, msg.to, msg.replyTo, msg.subject, msg.body, msg.isHTML, msg.date, msg.read, msg.flagged, msg.headers)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to import message", "message", n, "err", err)
+			http.Error(w, "Failed to store imported message", http.StatusInternalServerError)
+			return
+		}
+		response.Imported++
+		used += size
+
+		for _, warning := range msg.warnings {
+			problem(&response.Warnings, n, warning)
+		}
+		for _, a := range msg.attachments {
+			if _, err := s.attachmentRepo.Create(message.ID, a.Filename, a.OriginalFilename, a.ContentType, a.ContentID, int64(len(a.Data)), nil, a.Data); err != nil {
+				slog.WarnContext(r.Context(), "failed to store imported attachment", "message_id", message.ID, "file", a.OriginalFilename, "err", err)
+				problem(&response.Warnings, n, fmt.Sprintf("Failed to store attachment %s", a.OriginalFilename))
+			}
+		}
+	}
+
+	slog.InfoContext(r.Context(), "imported mailbox", "imported", response.Imported, "skipped", response.Skipped)
+	if response.Imported > 0 {
+		s.enforceInboxLimit(r.Context(), user.ID)
+		s.notifyUnreadCount(user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseImportedMessage parses one message of an mbox. Attachments that are
+// too large or of a type that is not allowed are left out with a warning.
+func (s *Server) parseImportedMessage(raw []byte, ownAddress string) (*importedMessage, error) {
+	parsed, err := mailparse.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &importedMessage{
+		from:    parsed.From,
+		to:      ownAddress,
+		replyTo: parsed.ReplyTo,
+		subject: parsed.Subject,
+		body:    parsed.Body,
+		isHTML:  parsed.IsHTML,
+		date:    parsed.Date,
+		read:    strings.Contains(parsed.Header.Get("Status"), "R"),
+		flagged: strings.Contains(parsed.Header.Get("X-Status"), "F"),
+		headers: database.MessageHeaders{
+			MessageID:  parsed.MessageID,
+			InReplyTo:  parsed.InReplyTo,
+			References: strings.Join(parsed.References, " "),
+		},
+	}
+	if len(parsed.To) > 0 {
+		msg.to = strings.Join(parsed.To, ", ")
+	}
+	if msg.date.IsZero() {
+		msg.date = time.Now()
+	}
+
+	for _, a := range parsed.Attachments {
+		if int64(len(a.Data)) > s.config.MaxAttachmentBytes {
+			msg.warnings = append(msg.warnings, fmt.Sprintf("Attachment %s is too large (%d bytes, max %d bytes)", a.Filename, len(a.Data), s.config.MaxAttachmentBytes))
+			continue
+		}
+		if err := s.checkAttachmentType(a.ContentType, a.Data); err != nil {
+			msg.warnings = append(msg.warnings, fmt.Sprintf("Attachment %s rejected: %v", a.Filename, err))
+			continue
+		}
+		msg.attachments = append(msg.attachments, &pendingAttachment{
+			Filename:         fmt.Sprintf("%d_%s", time.Now().Unix(), a.Filename),
+			OriginalFilename: a.Filename,
+			ContentType:      compose.AttachmentContentType(a.ContentType, a.Data),
+			ContentID:        a.ContentID,
+			Data:             a.Data,
+		})
+	}
+	return msg, nil
+}
@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+func TestInboxSort(t *testing.T) {
+	s := newTestServer(t)
+	bob := createTestUser(t, s, "bob")
+
+	// Three threads, oldest first; only cherry is unread
+	threads := []struct {
+		from, subject string
+		read          bool
+	}{
+		{"carol", "Banana", true},
+		{"alice", "cherry", false},
+		{"dave", "apple", true},
+	}
+	start := time.Now().Add(-time.Hour)
+	for i, th := range threads {
+		sender := createTestUser(t, s, th.from)
+		message, err := s.messageRepo.CreateWithThreading(&sender.ID, &bob.ID, th.from+"@localhost", "bob@localhost", "", th.subject, "body", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec(`UPDATE messages SET created_at = ? WHERE id = ?`, start.Add(time.Duration(i)*time.Minute), message.ID); err != nil {
+			t.Fatal(err)
+		}
+		if th.read {
+			if err := s.messageRepo.MarkAsRead(message.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	list := func(query string) (int, []string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.handleGetMessages(w, authRequest(bob, "GET", "/api/messages?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var page MessagePage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		var subjects []string
+		for _, m := range page.Messages {
+			subjects = append(subjects, m.Subject)
+		}
+		return w.Code, subjects
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"apple", "cherry", "Banana"}},
+		{"sort=date", []string{"apple", "cherry", "Banana"}},
+		{"sort=date&order=desc", []string{"apple", "cherry", "Banana"}},
+		{"sort=date&order=asc", []string{"Banana", "cherry", "apple"}},
+		{"order=asc", []string{"Banana", "cherry", "apple"}},
+		{"sort=subject", []string{"apple", "Banana", "cherry"}},
+		{"sort=subject&order=asc", []string{"apple", "Banana", "cherry"}},
+		{"sort=subject&order=desc", []string{"cherry", "Banana", "apple"}},
+		{"sort=sender", []string{"cherry", "Banana", "apple"}},
+		{"sort=sender&order=desc", []string{"apple", "Banana", "cherry"}},
+		{"sort=unread", []string{"cherry", "apple", "Banana"}},
+		{"sort=unread&order=desc", []string{"cherry", "apple", "Banana"}},
+		{"sort=unread&order=asc", []string{"apple", "Banana", "cherry"}},
+	}
+	for _, tt := range tests {
+		code, got := list(tt.query)
+		if code != http.StatusOK {
+			t.Errorf("?%s returned %d", tt.query, code)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("?%s listed %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{
+		"sort=size",
+		"sort=DATE",
+		"sort=m.id",
+		"sort=subject%3B%20DROP%20TABLE%20messages",
+		"order=up",
+		"sort=subject&order=ASC",
+	} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("?%s returned %d, want 400", query, code)
+		}
+	}
+	if !database.ValidInboxSort(database.InboxSortUnread) || database.ValidInboxSort("") {
+		t.Errorf("ValidInboxSort disagrees with the sort keys")
+	}
+}
@@ -0,0 +1,96 @@
+package httpapi
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// handleGetMessage returns a single message the user sent or received, with
+// its sender, recipient and attachments. Recipients can pass mark_read=true
+// to mark it read in the same request.
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	message, err := s.messageRepo.GetByIDWithAttachments(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	isRecipient := message.ToUserID != nil && *message.ToUserID == user.ID
+	isSender := message.FromUserID != nil && *message.FromUserID == user.ID
+	if !isRecipient && !isSender {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if isRecipient && !message.ReadStatus && r.URL.Query().Get("mark_read") == "true" {
+		if err := s.messageRepo.MarkAsRead(message.ID); err != nil {
+			slog.ErrorContext(r.Context(), "failed to mark message as read", "err", err)
+			http.Error(w, "Failed to mark message as read", http.StatusInternalServerError)
+			return
+		}
+		message.ReadStatus = true
+		s.sendReadReceipt(r.Context(), message)
+	}
+
+	message.FromUser = s.userSummary(message.FromUserID)
+	message.ToUser = s.userSummary(message.ToUserID)
+
+	if isSender {
+		recipients, err := s.messageRepo.GetSendRecipients(message.ID, user.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get message recipients", "err", err)
+			http.Error(w, "Failed to get message", http.StatusInternalServerError)
+			return
+		}
+		message.Recipients = recipients
+	}
+
+	messages := []*database.Message{message}
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	writeJSONWithETag(w, r, message)
+}
+
+// userSummary returns the public identity of a local user, as listings
+// attach it to messages, or nil if there is none
+func (s *Server) userSummary(userID *int) *database.User {
+	if userID == nil {
+		return nil
+	}
+
+	user, err := s.userRepo.GetByID(*userID)
+	if err != nil {
+		slog.Error("failed to get user", "user_id", *userID, "err", err)
+		return nil
+	}
+	if user == nil {
+		return nil
+	}
+
+	return &database.User{ID: user.ID, Username: user.Username, Email: user.Email}
+}
@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGetMessageListsRecipientsForSender(t *testing.T) {
+	s := newTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+	createTestUser(t, s, "carol")
+
+	w := httptest.NewRecorder()
+	s.handleSendMessage(w, authRequest(alice, "POST", "/api/send",
+		strings.NewReader(`{"to": ["bob@localhost", "carol@localhost"], "subject": "Hi", "body": "Hello"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("send returned %d: %s", w.Code, w.Body)
+	}
+	var sent struct {
+		ID         int               `json:"id"`
+		Recipients []RecipientResult `json:"recipients"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Recipients) != 2 {
+		t.Fatalf("got %d recipients in send response, want 2", len(sent.Recipients))
+	}
+	bobCopy := sent.Recipients[0].ID
+	if err := s.messageRepo.SetDeliveryStatus(sent.Recipients[1].ID, database.DeliveryFailed, "mailbox gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(user *database.User, id int) *database.Message {
+		t.Helper()
+		r := authRequest(user, "GET", "/api/messages/"+strconv.Itoa(id), nil)
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+		w := httptest.NewRecorder()
+		s.handleGetMessage(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get returned %d: %s", w.Code, w.Body)
+		}
+		var message database.Message
+		if err := json.NewDecoder(w.Body).Decode(&message); err != nil {
+			t.Fatal(err)
+		}
+		return &message
+	}
+
+	// The sender sees every recipient from either copy
+	for _, id := range []int{sent.Recipients[0].ID, sent.Recipients[1].ID} {
+		message := get(alice, id)
+		if len(message.Recipients) != 2 {
+			t.Fatalf("message %d lists %d recipients, want 2", id, len(message.Recipients))
+		}
+		bobState, carolState := message.Recipients[0], message.Recipients[1]
+		if bobState.To != "bob@localhost" || bobState.DeliveryStatus != database.DeliveryLocal {
+			t.Errorf("first recipient = %+v, want bob@localhost delivered locally", bobState)
+		}
+		if carolState.To != "carol@localhost" || carolState.DeliveryStatus != database.DeliveryFailed || carolState.DeliveryError != "mailbox gone" {
+			t.Errorf("second recipient = %+v, want carol@localhost failed", carolState)
+		}
+	}
+
+	// A recipient does not learn who else it went to
+	if message := get(bob, bobCopy); len(message.Recipients) != 0 {
+		t.Errorf("recipient sees %d recipients, want none", len(message.Recipients))
+	}
+}
+
+func TestSendWithFilesRejectsOversizedUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.config.MaxAttachmentBytes = 1024
+	alice := createTestUser(t, s, "alice")
+	createTestUser(t, s, "bob")
+
+	send := func(size int) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("to", "bob@localhost")
+		form.WriteField("subject", "Files")
+		form.WriteField("body", "See attached")
+		file, err := form.CreateFormFile("attachments", "data.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(bytes.Repeat([]byte("x"), size))
+		form.Close()
+
+		r := authRequest(alice, "POST", "/api/send", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.handleSendMessage(w, r)
+		return w
+	}
+
+	if w := send(multipartOverhead + 2048); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload returned %d, want 413: %s", w.Code, w.Body)
+	} else if !strings.Contains(w.Body.String(), "request_too_large") {
+		t.Errorf("oversized upload body = %s, want request_too_large", w.Body)
+	}
+	if w := send(512); w.Code != http.StatusOK {
+		t.Errorf("small upload returned %d: %s", w.Code, w.Body)
+	}
+}
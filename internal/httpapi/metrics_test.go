@@ -0,0 +1,50 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsRequireTokenOrAdmin(t *testing.T) {
+	s := newTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	admin := createTestUser(t, s, "admin")
+	token := func(id int, username string, isAdmin bool) string {
+		t.Helper()
+		jwt, err := s.jwtService.GenerateToken(id, username, username+"@example.com", isAdmin, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + jwt
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name          string
+		metricsToken  string
+		authorization string
+		want          int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"user token", "", token(alice.ID, "alice", false), http.StatusForbidden},
+		{"admin token", "", token(admin.ID, "admin", true), http.StatusOK},
+		{"metrics token", "scrape-secret", "Bearer scrape-secret", http.StatusOK},
+		{"wrong metrics token", "scrape-secret", "Bearer guess", http.StatusUnauthorized},
+		{"admin instead of metrics token", "scrape-secret", token(admin.ID, "admin", true), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.config.MetricsToken = tt.metricsToken
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.metricsAuth(ok)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
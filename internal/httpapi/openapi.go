@@ -0,0 +1,412 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+	"yourmail/internal/federation"
+	"yourmail/internal/openapi"
+
+	"github.com/gorilla/mux"
+)
+
+// apiVersion is the version of the HTTP API
+const apiVersion = "2.0.0"
+
+// bearerAuth names the security scheme in the OpenAPI document, which takes
+// either a JWT or an API key
+const bearerAuth = "bearerAuth"
+
+// apiDoc documents one route for the OpenAPI document. Routes are matched to
+// their docs by method and path template when the document is built.
+type apiDoc struct {
+	Summary  string
+	Tag      string
+	Public   bool        // No token required
+	Request  interface{} // JSON request body
+	Response interface{} // JSON response body; nil for a plain success response
+	Params   []apiParam
+	// Content type of a non-JSON response, such as a file download
+	ResponseType string
+}
+
+// apiParam documents a query or header parameter
+type apiParam struct {
+	In          string
+	Name        string
+	Description string
+}
+
+// The following types describe JSON responses that handlers build as maps
+
+// StatusResponse is returned by actions that have nothing else to report
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// ErrorResponse is returned when a JSON request fails validation
+type ErrorResponse struct {
+	Success bool         `json:"success"`
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"` // Set for validation_failed
+}
+
+// SendMessageResponse is returned by the send endpoints
+type SendMessageResponse struct {
+	Success     bool              `json:"success"`
+	Message     string            `json:"message"`
+	ID          int               `json:"id"`
+	Recipients  []RecipientResult `json:"recipients"`
+	Warnings    []string          `json:"warnings,omitempty"`
+	Attachments *struct {
+		Processed int `json:"processed"`
+		Total     int `json:"total"`
+	} `json:"attachments,omitempty"` // Multipart sends and forwards only
+}
+
+// BulkMessageResponse is returned by the bulk message endpoint
+type BulkMessageResponse struct {
+	Action  string              `json:"action"`
+	Applied int                 `json:"applied"`
+	Results []BulkMessageResult `json:"results"`
+}
+
+// UnreadCountResponse is returned by the unread count endpoint
+type UnreadCountResponse struct {
+	UnreadCount int `json:"unread_count"`
+}
+
+// FlagResponse is returned when a message is flagged or unflagged
+type FlagResponse struct {
+	Status  string `json:"status"`
+	Flagged bool   `json:"flagged"`
+}
+
+// HealthResponse is returned by the health check. Status is "healthy",
+// "degraded" when only federation peers are unreachable, or "unhealthy".
+type HealthResponse struct {
+	Status    string            `json:"status"`
+	Timestamp string            `json:"timestamp"`
+	Version   string            `json:"version"`
+	Checks    map[string]string `json:"checks"`           // "ok" or what failed, by subsystem
+	Failed    []string          `json:"failed,omitempty"` // Subsystems whose check failed
+}
+
+// ProbeResponse is returned by the liveness and readiness probes
+type ProbeResponse struct {
+	Status string `json:"status"`           // "alive", "ready" or "not ready"
+	Reason string `json:"reason,omitempty"` // Why the server is not ready
+}
+
+// ProfileResponse is the current user's profile with their storage usage
+type ProfileResponse struct {
+	*database.User
+	Storage StorageUsage `json:"storage"`
+}
+
+var (
+	paginationParams = []apiParam{
+		{In: "query", Name: "limit", Description: "Maximum number of results"},
+		{In: "query", Name: "offset", Description: "Number of results to skip"},
+	}
+	listingParams = append([]apiParam{
+		{In: "query", Name: "format", Description: `"array" returns a bare array instead of a page`},
+		{In: "query", Name: "linkify", Description: `"true" adds rendered_body with linked URLs and addresses`},
+		{In: "query", Name: "remote_images", Description: `"true" keeps remote content in the rendered_body of HTML messages`},
+	}, paginationParams...)
+	idempotencyParams = []apiParam{
+		{In: "header", Name: IdempotencyKeyHeader, Description: "Makes the request safe to retry; see the README"},
+	}
+)
+
+// apiDocs documents the routes registered in Start
+var apiDocs = map[string]apiDoc{
+	// Authentication and service
+	"POST /api/register":         {Summary: "Register a new account", Tag: "auth", Public: true, Request: database.CreateUserRequest{}, Response: database.LoginResponse{}},
+	"POST /api/login":            {Summary: "Log in and get a token", Tag: "auth", Public: true, Request: database.LoginRequest{}, Response: database.LoginResponse{}},
+	"GET /api/livez":             {Summary: "Liveness probe; always 200 while the process runs", Tag: "service", Public: true, Response: ProbeResponse{}},
+	"GET /api/readyz":            {Summary: "Readiness probe; 503 during startup, shutdown or a database outage", Tag: "service", Public: true, Response: ProbeResponse{}},
+	"GET /api/health":            {Summary: "Health check; 503 when the database is unreachable", Tag: "service", Public: true, Response: HealthResponse{}, Params: []apiParam{{In: "query", Name: "deep", Description: `"true" also checks that federation peers answer`}}},
+	"GET /api/openapi.json":      {Summary: "This OpenAPI document", Tag: "service", Public: true, ResponseType: "application/json"},
+	"GET /api/docs":              {Summary: "Interactive API documentation", Tag: "service", Public: true, ResponseType: "text/html"},
+	"GET /api/sse/inbox":         {Summary: "Stream inbox events", Tag: "events", Public: true, ResponseType: "text/event-stream", Params: []apiParam{{In: "query", Name: "token", Description: "JWT, since EventSource cannot send headers"}, {In: "header", Name: "Last-Event-ID", Description: "Replay messages received after this event ID"}}},
+	"GET /api/profile":           {Summary: "Get your profile and storage usage", Tag: "profile", Response: ProfileResponse{}},
+	"PUT /api/profile":           {Summary: "Change your username or email address", Tag: "profile", Request: UpdateProfileRequest{}, Response: database.LoginResponse{}},
+	"POST /api/profile/password": {Summary: "Change your password", Tag: "profile", Request: ChangePasswordRequest{}},
+	"GET /api/profile/security":  {Summary: "List your recent logins", Tag: "profile", Response: SecurityOverview{}},
+	"GET /api/verify":            {Summary: "Verify your email address", Tag: "auth", Public: true, Params: []apiParam{{In: "query", Name: "token", Description: "Token from the verification link"}}},
+	"POST /api/verify/resend":    {Summary: "Issue a new email verification token", Tag: "auth", Response: VerificationResponse{}},
+	"GET /api/whoami":            {Summary: "Check your token and get who it belongs to", Tag: "auth", Response: auth.AuthUser{}},
+	"PUT /api/profile/settings":  {Summary: "Update your mail settings", Tag: "profile", Request: UpdateSettingsRequest{}, Response: database.User{}},
+
+	// Messages
+	"GET /api/messages":                      {Summary: "List your inbox", Tag: "messages", Response: MessagePage{}, Params: append([]apiParam{{In: "query", Name: "folder", Description: "List this folder instead of the inbox"}, {In: "query", Name: "sort", Description: `"date" (default), "subject", "sender" or "unread"`}, {In: "query", Name: "order", Description: `"asc" or "desc"; defaults to newest and unread first, A to Z otherwise`}, {In: "query", Name: "body", Description: `"true" to include full bodies; listings otherwise carry only each message's preview`}, {In: "query", Name: "cursor", Description: "Page by cursor instead of offset: empty for the first page, then the next_cursor of the last page, which replaces total and offset in the response"}}, listingParams...)},
+	"GET /api/messages/sent":                 {Summary: "List sent messages", Tag: "messages", Response: MessagePage{}, Params: listingParams},
+	"GET /api/messages/unread-count":         {Summary: "Count unread messages", Tag: "messages", Response: UnreadCountResponse{}, Params: []apiParam{{In: "query", Name: "by", Description: `"folder" returns an object of counts keyed by folder name, with the inbox as "Inbox"`}}},
+	"POST /api/messages/bulk":                {Summary: "Apply an action to many messages", Tag: "messages", Request: BulkMessageRequest{}, Response: BulkMessageResponse{}},
+	"GET /api/messages/flagged":              {Summary: "List flagged messages", Tag: "messages", Response: []*database.Message{}, Params: paginationParams},
+	"GET /api/messages/spam":                 {Summary: "List messages taken for spam", Tag: "messages", Response: []*database.Message{}, Params: paginationParams},
+	"GET /api/messages/scheduled":            {Summary: "List messages scheduled to be sent, due soonest first", Tag: "messages", Response: []*database.Message{}, Params: paginationParams},
+	"PUT /api/messages/scheduled/{id}":       {Summary: "Move a scheduled send to another time", Tag: "messages", Request: RescheduleRequest{}, Response: database.Message{}},
+	"DELETE /api/messages/scheduled/{id}":    {Summary: "Cancel a scheduled send", Tag: "messages"},
+	"GET /api/messages/snoozed":              {Summary: "List snoozed messages, due soonest first", Tag: "messages", Response: []*database.Message{}, Params: paginationParams},
+	"GET /api/messages/{id}":                 {Summary: "Get a message", Tag: "messages", Response: database.Message{}, Params: []apiParam{{In: "query", Name: "mark_read", Description: `"true" also marks the message read`}, {In: "query", Name: "remote_images", Description: `"true" keeps remote content in an HTML rendered_body`}}},
+	"POST /api/messages/{id}/read":           {Summary: "Mark a message read", Tag: "messages"},
+	"POST /api/messages/{id}/unread":         {Summary: "Mark a message unread", Tag: "messages"},
+	"POST /api/messages/{id}/move":           {Summary: "Move a message to a folder", Tag: "messages", Request: MoveMessageRequest{}},
+	"POST /api/messages/{id}/not-spam":       {Summary: "Move a message out of Spam and trust its sender more", Tag: "messages"},
+	"POST /api/messages/{id}/flag":           {Summary: "Flag or unflag a message", Tag: "messages", Request: FlagMessageRequest{}, Response: FlagResponse{}},
+	"POST /api/messages/{id}/snooze":         {Summary: "Hide a message from the inbox until a later time", Tag: "messages", Request: SnoozeRequest{}},
+	"POST /api/messages/{id}/unsnooze":       {Summary: "Return a snoozed message to the inbox now", Tag: "messages"},
+	"GET /api/messages/{id}/reply":           {Summary: "Get a reply draft for a message", Tag: "messages", Response: ComposePrefill{}},
+	"GET /api/messages/{id}/forward":         {Summary: "Get a forward draft for a message", Tag: "messages", Response: ComposePrefill{}},
+	"POST /api/messages/{id}/forward":        {Summary: "Forward a message with its attachments", Tag: "messages", Request: ForwardRequest{}, Response: SendMessageResponse{}, Params: idempotencyParams},
+	"GET /api/messages/{id}/attachments":     {Summary: "List a message's attachments", Tag: "attachments", Response: []*database.Attachment{}},
+	"GET /api/messages/{id}/attachments.zip": {Summary: "Download all attachments as a zip", Tag: "attachments", ResponseType: "application/zip"},
+	"GET /api/attachments/{id}":              {Summary: "Download an attachment", Tag: "attachments", ResponseType: "application/octet-stream"},
+	"POST /api/send":                         {Summary: "Send or schedule a message", Tag: "messages", Request: SendMessageRequest{}, Response: SendMessageResponse{}, Params: idempotencyParams},
+	"GET /api/search":                        {Summary: "Search your messages", Tag: "messages", Response: []*database.Message{}, Params: append([]apiParam{{In: "query", Name: "q", Description: "Search terms"}, {In: "query", Name: "ranked", Description: `"true" ranks results by relevance`}}, paginationParams...)},
+	"GET /api/export":                        {Summary: "Export your mail as mbox or JSON", Tag: "messages", ResponseType: "application/mbox", Params: []apiParam{{In: "query", Name: "format", Description: `"mbox" (default) or "json"`}, {In: "query", Name: "attachments", Description: `"true" includes attachment contents`}}},
+	"POST /api/import":                       {Summary: "Import messages from an uploaded mbox file", Tag: "messages", Response: ImportResponse{}},
+
+	// Threads
+	"GET /api/threads":                         {Summary: "List your threads, most recently active first", Tag: "threads", Response: ThreadPage{}, Params: paginationParams},
+	"GET /api/threads/{threadId}":              {Summary: "Get the messages in a thread", Tag: "threads", Response: []*database.Message{}},
+	"GET /api/threads/{threadId}/participants": {Summary: "List a thread's participants", Tag: "threads", Response: []*ThreadParticipant{}},
+	"POST /api/threads/{threadId}/typing":      {Summary: "Tell participants you are typing", Tag: "threads", Request: TypingRequest{}},
+	"POST /api/threads/{threadId}/mute":        {Summary: "Mute a thread", Tag: "threads"},
+	"POST /api/threads/{threadId}/unmute":      {Summary: "Unmute a thread", Tag: "threads"},
+
+	// Drafts
+	"GET /api/drafts":            {Summary: "List drafts", Tag: "drafts", Response: []*database.Message{}, Params: paginationParams},
+	"POST /api/drafts":           {Summary: "Save a draft", Tag: "drafts", Request: SaveDraftRequest{}, Response: database.Message{}},
+	"POST /api/drafts/{id}/send": {Summary: "Send a draft", Tag: "drafts", Response: SendMessageResponse{}, Params: idempotencyParams},
+
+	// Folders
+	"GET /api/folders":               {Summary: "List folders", Tag: "folders", Response: []*database.Folder{}},
+	"POST /api/folders":              {Summary: "Create a folder", Tag: "folders", Request: CreateFolderRequest{}, Response: database.Folder{}},
+	"DELETE /api/folders/{id}":       {Summary: "Delete a folder", Tag: "folders"},
+	"GET /api/folders/{id}/messages": {Summary: "List the messages in a folder", Tag: "folders", Response: []*database.Message{}, Params: paginationParams},
+
+	// Contacts
+	"GET /api/contacts":         {Summary: "List contacts", Tag: "contacts", Response: []*database.Contact{}},
+	"POST /api/contacts":        {Summary: "Create a contact", Tag: "contacts", Request: ContactRequest{}, Response: database.Contact{}},
+	"GET /api/contacts/suggest": {Summary: "Suggest recipients", Tag: "contacts", Response: []*database.Contact{}, Params: []apiParam{{In: "query", Name: "q", Description: "Prefix to match"}, {In: "query", Name: "limit", Description: "Maximum number of suggestions"}, {In: "query", Name: "history", Description: `"false" leaves out past correspondents`}}},
+	"PUT /api/contacts/{id}":    {Summary: "Update a contact", Tag: "contacts", Request: ContactRequest{}, Response: database.Contact{}},
+	"DELETE /api/contacts/{id}": {Summary: "Delete a contact", Tag: "contacts"},
+
+	// Blocked senders
+	"GET /api/blocks":         {Summary: "List blocked senders", Tag: "blocks", Response: []*database.BlockedSender{}},
+	"POST /api/blocks":        {Summary: "Block a sender", Tag: "blocks", Request: BlockRequest{}, Response: database.BlockedSender{}},
+	"DELETE /api/blocks/{id}": {Summary: "Unblock a sender", Tag: "blocks"},
+
+	// Webhooks
+	"GET /api/webhooks":              {Summary: "List webhooks", Tag: "webhooks", Response: []*database.Webhook{}},
+	"POST /api/webhooks":             {Summary: "Register a webhook", Tag: "webhooks", Request: WebhookRequest{}, Response: CreatedWebhook{}},
+	"DELETE /api/webhooks/{id}":      {Summary: "Delete a webhook", Tag: "webhooks"},
+	"POST /api/webhooks/{id}/enable": {Summary: "Re-enable a disabled webhook", Tag: "webhooks"},
+
+	// Credentials
+	"POST /api/tokens":      {Summary: "Issue a token limited to some scopes", Tag: "keys", Request: TokenRequest{}, Response: TokenResponse{}},
+	"GET /api/keys":         {Summary: "List API keys", Tag: "keys", Response: []*database.APIKey{}},
+	"POST /api/keys":        {Summary: "Create an API key; the key is only returned here", Tag: "keys", Request: APIKeyRequest{}, Response: CreatedAPIKey{}},
+	"DELETE /api/keys/{id}": {Summary: "Revoke an API key", Tag: "keys"},
+
+	// Templates
+	"GET /api/templates":         {Summary: "List templates", Tag: "templates", Response: []*database.Template{}},
+	"POST /api/templates":        {Summary: "Create a template", Tag: "templates", Request: TemplateRequest{}, Response: database.Template{}},
+	"PUT /api/templates/{id}":    {Summary: "Update a template", Tag: "templates", Request: TemplateRequest{}, Response: database.Template{}},
+	"DELETE /api/templates/{id}": {Summary: "Delete a template", Tag: "templates"},
+
+	// Admin
+	"GET /api/admin/users":               {Summary: "List users", Tag: "admin", Response: UserPage{}, Params: paginationParams},
+	"DELETE /api/admin/users/{id}":       {Summary: "Delete a user", Tag: "admin"},
+	"POST /api/admin/users/{id}/disable": {Summary: "Suspend a user", Tag: "admin"},
+	"POST /api/admin/users/{id}/enable":  {Summary: "Lift a user's suspension", Tag: "admin"},
+	"GET /api/admin/backup":              {Summary: "Download a snapshot of the SQLite database", Tag: "admin", ResponseType: "application/vnd.sqlite3"},
+	"POST /api/admin/vacuum":             {Summary: "Compact the database", Tag: "admin", Response: VacuumResponse{}},
+	"GET /api/admin/federation/peers":    {Summary: "List federation peers and their reachability", Tag: "admin", Response: []federation.PeerStatus{}},
+}
+
+// pathVariable matches a mux path variable, with or without a pattern
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// buildOpenAPISpec describes the /api routes registered on the router,
+// using apiDocs for their summaries and schemas. Routes without docs are still
+// listed, and both they and docs without a route are logged so the two stay
+// in sync.
+func buildOpenAPISpec(router *mux.Router) ([]byte, error) {
+	b := openapi.NewBuilder("YourMail API", apiVersion)
+	b.AddSecurityScheme(bearerAuth, openapi.SecurityScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT or API key"})
+
+	documented := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := pathVariable.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+
+			key := method + " " + path
+			doc, ok := apiDocs[key]
+			if !ok {
+				slog.Warn("route missing from API docs", "route", key)
+			}
+			documented[key] = true
+			b.Add(method, path, doc.operation(b, path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for key := range apiDocs {
+		if !documented[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	for _, key := range stale {
+		slog.Warn("API docs for unknown route", "route", key)
+	}
+
+	return json.MarshalIndent(b.Document(), "", "  ")
+}
+
+// operation builds the OpenAPI operation for a route on path
+func (doc apiDoc) operation(b *openapi.Builder, path string) *openapi.Operation {
+	op := &openapi.Operation{
+		Summary:   doc.Summary,
+		Responses: make(map[string]openapi.Response),
+	}
+	if doc.Tag != "" {
+		op.Tags = []string{doc.Tag}
+	}
+	if !doc.Public {
+		op.Security = []map[string][]string{{bearerAuth: {}}}
+		op.Responses["401"] = openapi.Response{Description: "Missing or invalid token"}
+	}
+
+	for _, match := range pathVariable.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, openapi.Parameter{
+			Name: match[1], In: "path", Required: true, Schema: &openapi.Schema{Type: "string"},
+		})
+	}
+	for _, p := range doc.Params {
+		op.Parameters = append(op.Parameters, openapi.Parameter{
+			Name: p.Name, In: p.In, Description: p.Description, Schema: &openapi.Schema{Type: "string"},
+		})
+	}
+
+	if doc.Request != nil {
+		op.RequestBody = &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"application/json": {Schema: b.SchemaOf(doc.Request)}},
+		}
+		op.Responses["400"] = openapi.Response{
+			Description: "Invalid request",
+			Content:     map[string]openapi.MediaType{"application/json": {Schema: b.SchemaOf(ErrorResponse{})}},
+		}
+		if path == "/api/send" {
+			op.RequestBody.Content["multipart/form-data"] = openapi.MediaType{Schema: sendFormSchema()}
+		}
+	}
+
+	switch {
+	case doc.ResponseType != "":
+		op.Responses["200"] = openapi.Response{
+			Description: "Success",
+			Content:     map[string]openapi.MediaType{doc.ResponseType: {Schema: &openapi.Schema{Type: "string"}}},
+		}
+	case doc.Response != nil:
+		op.Responses["200"] = openapi.Response{
+			Description: "Success",
+			Content:     map[string]openapi.MediaType{"application/json": {Schema: b.SchemaOf(doc.Response)}},
+		}
+	default:
+		op.Responses["200"] = openapi.Response{
+			Description: "Success",
+			Content:     map[string]openapi.MediaType{"application/json": {Schema: b.SchemaOf(StatusResponse{})}},
+		}
+	}
+
+	return op
+}
+
+// sendFormSchema describes the multipart form accepted by /api/send
+func sendFormSchema() *openapi.Schema {
+	text := func(description string) *openapi.Schema {
+		return &openapi.Schema{Type: "string", Description: description}
+	}
+	return &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"to":              text("Recipient addresses; repeat the field or separate with commas"),
+			"reply_to":        text("Reply-To address"),
+			"subject":         text("Subject"),
+			"body":            text("Body"),
+			"is_html":         text(`"true" if the body is HTML`),
+			"thread_id":       text("Thread to add the message to"),
+			"parent_id":       text("Message being replied to"),
+			"template_id":     text("Template to compose from"),
+			"request_receipt": text(`"true" to ask for a read receipt`),
+			"attachments": {
+				Type:  "array",
+				Items: &openapi.Schema{Type: "string", Format: "binary"},
+			},
+			"content_ids": {
+				Type:        "array",
+				Description: "Content IDs of the attachments at the same positions, for cid: references in an HTML body",
+				Items:       &openapi.Schema{Type: "string"},
+			},
+		},
+	}
+}
+
+// handleOpenAPISpec serves the OpenAPI document
+func (s *Server) handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openapiSpec)
+}
+
+// swaggerUIPage renders the OpenAPI document with Swagger UI
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>YourMail API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// handleAPIDocs serves Swagger UI for the OpenAPI document
+func (s *Server) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+// pendingExpiryBatch is how many expired pending messages are bounced per
+// query
+const pendingExpiryBatch = 100
+
+// StartPendingExpirer bounces, each interval, mail that has waited longer
+// than FEDERATION_PENDING_MAX_AGE for its recipient's server to come back,
+// and mail for servers the relay has given up on. It returns a function
+// that stops it.
+func (s *Server) StartPendingExpirer(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.expirePending(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// expirePending fails and bounces every pending message older than
+// FEDERATION_PENDING_MAX_AGE, a batch at a time, and every one for a server
+// that has been down longer than FEDERATION_PEER_GONE_AFTER
+func (s *Server) expirePending(ctx context.Context) {
+	for _, peer := range s.relay.Peers() {
+		if !peer.Gone {
+			continue
+		}
+		messages, err := s.messageRepo.GetPendingForHost(peer.Host)
+		if err != nil {
+			slog.Error("failed to get pending messages", "host", peer.Host, "err", err)
+			continue
+		}
+		for _, message := range messages {
+			s.failPending(ctx, message, fmt.Sprintf("The recipient's server %s has been unreachable too long", peer.Host))
+		}
+	}
+
+	reason := fmt.Sprintf("The recipient's server could not be reached for %s", s.config.FederationPendingMaxAge)
+	for ctx.Err() == nil {
+		cutoff := time.Now().Add(-s.config.FederationPendingMaxAge)
+		messages, err := s.messageRepo.GetPendingSince(cutoff, pendingExpiryBatch)
+		if err != nil {
+			slog.Error("failed to get expired pending messages", "err", err)
+			return
+		}
+
+		for _, message := range messages {
+			s.failPending(ctx, message, reason)
+		}
+		if len(messages) < pendingExpiryBatch {
+			return
+		}
+	}
+}
+
+// pendingExpired reports whether a message has waited too long for its
+// recipient's server to be sent anymore
+func (s *Server) pendingExpired(message *database.Message) bool {
+	return time.Since(message.CreatedAt) > s.config.FederationPendingMaxAge
+}
+
+// failPending gives up on a message waiting for its recipient's server and
+// bounces it to the sender with reason. A message a retry delivered
+// meanwhile is left alone.
+func (s *Server) failPending(ctx context.Context, message *database.Message, reason string) {
+	failed, err := s.messageRepo.FailPending(message.ID, reason)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to expire pending message", "message_id", message.ID, "err", err)
+		return
+	}
+	if !failed {
+		return
+	}
+
+	slog.WarnContext(ctx, "pending message expired", "id", message.ID, "to", message.ToAddress, "created_at", message.CreatedAt)
+	message.DeliveryStatus = database.DeliveryFailed
+	message.DeliveryError = reason
+	s.sendBounce(ctx, message, reason)
+}
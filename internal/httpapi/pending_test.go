@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+func TestExpirePendingBouncesOldMessages(t *testing.T) {
+	s := newTestServer(t)
+	s.config.FederationPendingMaxAge = time.Hour
+	alice := createTestUser(t, s, "alice")
+
+	store := func(subject string, age time.Duration) *database.Message {
+		t.Helper()
+		message, err := s.messageRepo.CreateWithThreading(&alice.ID, nil, "alice@localhost", "bob@down.example", "", subject, "body", false, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		if err := s.messageRepo.SetDeliveryStatus(message.ID, database.DeliveryPending, "peer server is unreachable"); err != nil {
+			t.Fatalf("failed to mark message pending: %v", err)
+		}
+		if _, err := s.db.Exec(`UPDATE messages SET created_at = ? WHERE id = ?`, time.Now().Add(-age), message.ID); err != nil {
+			t.Fatalf("failed to age message: %v", err)
+		}
+		return message
+	}
+	expired := store("old", 2*time.Hour)
+	recent := store("new", time.Minute)
+
+	s.expirePending(context.Background())
+
+	got, err := s.messageRepo.GetByID(expired.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeliveryStatus != database.DeliveryFailed {
+		t.Errorf("expired message status = %q, want %q", got.DeliveryStatus, database.DeliveryFailed)
+	}
+	got, err = s.messageRepo.GetByID(recent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeliveryStatus != database.DeliveryPending {
+		t.Errorf("recent message status = %q, want %q", got.DeliveryStatus, database.DeliveryPending)
+	}
+
+	var bounces int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE to_user_id = ? AND from_address = ?`, alice.ID, "mailer-daemon@localhost").Scan(&bounces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounces != 1 {
+		t.Errorf("got %d bounces, want 1", bounces)
+	}
+
+	// A second pass finds nothing left to bounce
+	s.expirePending(context.Background())
+	s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE to_user_id = ? AND from_address = ?`, alice.ID, "mailer-daemon@localhost").Scan(&bounces)
+	if bounces != 1 {
+		t.Errorf("got %d bounces after a second pass, want 1", bounces)
+	}
+}
@@ -0,0 +1,374 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+)
+
+// UpdateProfileRequest changes the user's username or email address. Fields
+// left out of the JSON body are not changed.
+type UpdateProfileRequest struct {
+	Username *string `json:"username" validate:"omitempty,min=3,max=20"`
+	Email    *string `json:"email" validate:"omitempty,email"`
+}
+
+// ChangePasswordRequest changes the user's password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=6"`
+}
+
+// UpdateSettingsRequest represents a partial update of the user's mail
+// settings. Fields left out of the JSON body are not changed.
+type UpdateSettingsRequest struct {
+	Signature     *string `json:"signature"`
+	SignatureHTML *string `json:"signature_html"`
+	ReplyTo       *string `json:"reply_to"`
+	// SendReadReceipts lets senders who ask for a receipt know when the
+	// user has read their message
+	SendReadReceipts *bool `json:"send_read_receipts"`
+}
+
+// handleUpdateSettings updates the current user's mail settings
+func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req UpdateSettingsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.ReplyTo != nil && *req.ReplyTo != "" && !isValidEmail(*req.ReplyTo) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_reply_to",
+			"message": fmt.Sprintf("Invalid reply-to address: %s", *req.ReplyTo),
+		})
+		return
+	}
+
+	current, err := s.userRepo.GetByID(user.ID)
+	if err != nil || current == nil {
+		slog.ErrorContext(r.Context(), "failed to get user settings", "err", err)
+		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Signature != nil || req.SignatureHTML != nil {
+		signature, signatureHTML := current.Signature, current.SignatureHTML
+		if req.Signature != nil {
+			signature = *req.Signature
+		}
+		if req.SignatureHTML != nil {
+			signatureHTML = *req.SignatureHTML
+		}
+		if err := s.userRepo.UpdateSignature(user.ID, signature, signatureHTML); err != nil {
+			slog.ErrorContext(r.Context(), "failed to update signature", "err", err)
+			http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.ReplyTo != nil {
+		if err := s.userRepo.UpdateReplyTo(user.ID, *req.ReplyTo); err != nil {
+			slog.ErrorContext(r.Context(), "failed to update reply-to address", "err", err)
+			http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.SendReadReceipts != nil {
+		if err := s.userRepo.UpdateSendReadReceipts(user.ID, *req.SendReadReceipts); err != nil {
+			slog.ErrorContext(r.Context(), "failed to update read receipt setting", "err", err)
+			http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	updated, err := s.userRepo.GetByID(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get user profile", "err", err)
+		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// handleUpdateProfile changes the current user's username or email address.
+// Both must be unused, as on registration. A new email address has to be
+// verified again. Since tokens carry the username and email, a new token is
+// returned and the old ones stop working after a rename.
+func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req UpdateProfileRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	current, err := s.userRepo.GetByID(user.ID)
+	if err != nil || current == nil {
+		slog.ErrorContext(r.Context(), "failed to get user profile", "err", err)
+		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+		return
+	}
+
+	username, email := current.Username, current.Email
+	if req.Username != nil {
+		username = *req.Username
+	}
+	if req.Email != nil {
+		// The email tag has already checked the address, so this cannot fail
+		email, _ = compose.NormalizeAddress(*req.Email)
+	}
+
+	if username != current.Username {
+		if s.isReservedUsername(username) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "username_reserved",
+				"message": "Username is reserved",
+			})
+			return
+		}
+
+		existing, _ := s.userRepo.GetByUsername(username)
+		if existing != nil && existing.ID != current.ID {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "username_exists",
+				"message": "Username already exists",
+			})
+			return
+		}
+	}
+
+	emailChanged := email != current.Email
+	if emailChanged {
+		existing, _ := s.userRepo.GetByEmail(email)
+		if existing != nil && existing.ID != current.ID {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "email_exists",
+				"message": "Email already exists",
+			})
+			return
+		}
+	}
+
+	updated, err := s.userRepo.Update(current.ID, username, email)
+	if err != nil {
+		// Most likely a concurrent registration took the name or address
+		slog.ErrorContext(r.Context(), "failed to update profile", "err", err)
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	if updated.Username != current.Username {
+		slog.InfoContext(r.Context(), "user renamed", "user_id", current.ID, "old", current.Username, "new", updated.Username)
+
+		// Unsent drafts would otherwise go out from the old address
+		fromAddress := fmt.Sprintf("%s@%s", updated.Username, s.config.ServerHost)
+		if err := s.messageRepo.UpdateDraftSender(current.ID, fromAddress); err != nil {
+			slog.ErrorContext(r.Context(), "failed to update draft sender", "user_id", current.ID, "err", err)
+		}
+	}
+
+	var verificationToken string
+	if emailChanged {
+		verificationToken, err = s.startEmailVerification(r.Context(), updated)
+		if err != nil {
+			// The user can ask for a new token
+			slog.ErrorContext(r.Context(), "failed to start email verification", "username", updated.Username, "err", err)
+		}
+	}
+
+	token, err := s.jwtService.GenerateToken(updated.ID, updated.Username, updated.Email, updated.IsAdmin, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to generate token", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "token_generation_failed",
+			"message": fmt.Sprintf("Failed to generate token: %v", err),
+		})
+		return
+	}
+
+	response := database.LoginResponse{
+		Success: true,
+		Message: "Profile updated successfully",
+		Token:   token,
+		User:    updated,
+	}
+	if s.config.Environment == "development" {
+		response.VerificationToken = verificationToken
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleChangePassword replaces the current user's password after checking
+// the current one
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	authenticated, err := s.userRepo.Authenticate(user.Username, req.CurrentPassword)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authentication error", "username", user.Username, "err", err)
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return
+	}
+	if authenticated == nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_password",
+			"message": "Current password is incorrect",
+		})
+		return
+	}
+
+	if err := s.userRepo.UpdatePassword(user.ID, req.NewPassword); err != nil {
+		slog.ErrorContext(r.Context(), "failed to update password", "err", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "password changed", "username", user.Username)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// applyUserSignature adds the user's configured signature to an outgoing body
+func (s *Server) applyUserSignature(userID int, body string, isHTML, isReply bool) string {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		slog.Error("failed to load signature", "user_id", userID, "err", err)
+		return body
+	}
+
+	sig := compose.Signature{Text: user.Signature, HTML: user.SignatureHTML}
+	return compose.ApplySignature(body, isHTML, isReply, sig)
+}
+
+// replyAddressFor returns the Reply-To address for an outgoing message: the
+// requested address, or the user's default when none was given
+func (s *Server) replyAddressFor(userID int, requested string) string {
+	if requested != "" {
+		return requested
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		slog.Error("failed to load reply-to default", "user_id", userID, "err", err)
+		return ""
+	}
+	return user.ReplyTo
+}
+
+// recentLoginsShown is how many login attempts the security overview lists
+const recentLoginsShown = 20
+
+// maxUserAgentLength bounds the User-Agent kept with a login
+const maxUserAgentLength = 256
+
+// SecurityOverview lists the user's recent login attempts
+type SecurityOverview struct {
+	LastLoginAt  *time.Time             `json:"last_login_at"`
+	RecentLogins []*database.LoginEvent `json:"recent_logins"`
+}
+
+// recordLogin adds a login attempt to the audit log. user is nil if the
+// attempt failed. The write runs in the background so it doesn't slow down
+// logging in.
+func (s *Server) recordLogin(r *http.Request, username string, user *database.User) {
+	event := database.LoginEvent{
+		IP:        r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Protocol:  database.LoginHTTP,
+		Success:   user != nil,
+	}
+	if len(event.UserAgent) > maxUserAgentLength {
+		event.UserAgent = event.UserAgent[:maxUserAgentLength]
+	}
+	if user != nil {
+		event.UserID = user.ID
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		if err := s.loginRepo.Record(username, event); err != nil {
+			slog.ErrorContext(ctx, "failed to record login", "username", username, "err", err)
+		}
+	}()
+}
+
+// handleGetSecurity returns the current user's last login and recent login
+// attempts, successful or not, so they can spot access that wasn't theirs
+func (s *Server) handleGetSecurity(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.userRepo.GetByID(authUser.ID)
+	if err != nil || user == nil {
+		slog.ErrorContext(r.Context(), "failed to get user", "user_id", authUser.ID, "err", err)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	logins, err := s.loginRepo.ListRecent(user.ID, recentLoginsShown)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list logins", "err", err)
+		http.Error(w, "Failed to list logins", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if logins == nil {
+		logins = []*database.LoginEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SecurityOverview{LastLoginAt: user.LastLoginAt, RecentLogins: logins})
+}
@@ -0,0 +1,63 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// StorageUsage reports how much space a user's mailbox takes up
+type StorageUsage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"` // 0 means unlimited
+}
+
+// checkRecipientQuota verifies that a local recipient's mailbox has room for
+// size more bytes, writing a 507 response if it does not. External
+// recipients always pass, as does everyone when no quota is configured.
+func (s *Server) checkRecipientQuota(ctx context.Context, w http.ResponseWriter, toUserID *int, to string, size int64) bool {
+	over, err := s.recipientOverQuota(ctx, toUserID, to, size)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "quota_check_failed",
+			"message": "Failed to check recipient mailbox quota",
+		})
+		return false
+	}
+
+	if over {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "quota_exceeded",
+			"message": fmt.Sprintf("Mailbox of %s is full", to),
+		})
+		return false
+	}
+
+	return true
+}
+
+// recipientOverQuota reports whether size more bytes would take a local
+// recipient's mailbox over the configured quota
+func (s *Server) recipientOverQuota(ctx context.Context, toUserID *int, to string, size int64) (bool, error) {
+	if toUserID == nil || s.config.MailboxQuota <= 0 {
+		return false, nil
+	}
+
+	used, err := s.messageRepo.GetUserStorageUsage(*toUserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get storage usage", "user_id", *toUserID, "err", err)
+		return false, err
+	}
+
+	if used+size > s.config.MailboxQuota {
+		slog.InfoContext(ctx, "mailbox over quota", "to", to, "size", size, "used", used, "quota", s.config.MailboxQuota)
+		return true, nil
+	}
+	return false, nil
+}
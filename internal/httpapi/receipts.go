@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+// ReadReceipt tells a sender that a recipient has read their message
+type ReadReceipt struct {
+	MessageID int       `json:"message_id"`
+	ThreadID  *string   `json:"thread_id"`
+	To        string    `json:"to"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// sendReadReceipt is called when the recipient marks an unread message read.
+// If the sender asked for a receipt and the recipient allows them, it records
+// the read time and notifies the sender with a read-receipt event. Only the
+// first read is reported.
+func (s *Server) sendReadReceipt(ctx context.Context, message *database.Message) {
+	if !message.RequestReceipt || message.ReadAt != nil {
+		return
+	}
+
+	recorded, err := s.messageRepo.RecordReadReceipt(message.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record read receipt", "message_id", message.ID, "err", err)
+		return
+	}
+	if !recorded {
+		return // The recipient does not send receipts
+	}
+
+	// Reload for the stored read time
+	updated, err := s.messageRepo.GetByID(message.ID)
+	if err != nil || updated == nil || updated.ReadAt == nil {
+		slog.ErrorContext(ctx, "failed to reload message for read receipt", "message_id", message.ID, "err", err)
+		return
+	}
+	message.ReadAt = updated.ReadAt
+
+	if message.FromUserID == nil {
+		return
+	}
+
+	slog.InfoContext(ctx, "read receipt recorded", "message_id", message.ID, "from_user_id", *message.FromUserID)
+
+	receipt := ReadReceipt{
+		MessageID: message.ID,
+		ThreadID:  message.ThreadID,
+		To:        message.ToAddress,
+		ReadAt:    *message.ReadAt,
+	}
+
+	s.sendSSEEventToUser(*message.FromUserID, "read-receipt", receipt)
+}
@@ -0,0 +1,269 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+)
+
+// maxRecipients limits how many recipients a single send may address
+const maxRecipients = 50
+
+// recipientRejected is the status reported for a recipient the message was
+// not stored for
+const recipientRejected = "rejected"
+
+// Recipients is a list of recipient addresses. In JSON it is an array of
+// addresses or, as in earlier versions, a single string, which may hold
+// several comma-separated addresses.
+type Recipients []string
+
+// UnmarshalJSON accepts either a string or an array of strings
+func (rs *Recipients) UnmarshalJSON(data []byte) error {
+	var list string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*rs = compose.SplitRecipients(list)
+		return nil
+	}
+
+	var addresses []string
+	if err := json.Unmarshal(data, &addresses); err != nil {
+		return fmt.Errorf("to must be a string or an array of strings")
+	}
+	*rs = compose.UniqueRecipients(addresses)
+	return nil
+}
+
+// RecipientResult reports the outcome of a send for one recipient
+type RecipientResult struct {
+	To     string `json:"to"`
+	ID     int    `json:"id,omitempty"` // The recipient's copy of the message
+	Status string `json:"status"`       // Its delivery status, or "rejected"
+	Error  string `json:"error,omitempty"`
+}
+
+// outgoingMessage is a validated message ready to be sent to its recipients
+type outgoingMessage struct {
+	From        string
+	ReplyTo     string
+	Subject     string
+	Body        string
+	IsHTML      bool
+	ThreadID    *string
+	ParentID    *int
+	Attachments []pendingAttachment
+
+	// RequestReceipt asks local recipients for a read receipt
+	RequestReceipt bool
+}
+
+// pendingAttachment is an uploaded file that passed validation
+type pendingAttachment struct {
+	Filename         string
+	OriginalFilename string
+	ContentType      string
+	ContentID        string // Set for images shown inline by an HTML body
+	Data             []byte
+}
+
+// sendResult summarizes a send to several recipients
+type sendResult struct {
+	FirstID     int // ID of the first recipient's copy
+	Recipients  []RecipientResult
+	Warnings    []string
+	Attachments int // Attachments stored with every copy
+}
+
+// validateRecipients checks the recipient list of a send, writing a 400
+// response if it is empty, too long or holds an invalid address. Valid
+// addresses are normalized in place.
+func validateRecipients(ctx context.Context, w http.ResponseWriter, to []string) bool {
+	fail := func(code, message string) bool {
+		slog.DebugContext(ctx, "send rejected", "reason", code)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   code,
+			"message": message,
+		})
+		return false
+	}
+
+	if len(to) == 0 {
+		return fail("missing_recipient", "Recipient email address is required")
+	}
+	if len(to) > maxRecipients {
+		return fail("too_many_recipients", fmt.Sprintf("At most %d recipients are allowed", maxRecipients))
+	}
+	for i, addr := range to {
+		normalized, err := compose.NormalizeAddress(addr)
+		if err != nil {
+			return fail("invalid_email", fmt.Sprintf("Invalid email format: %s", addr))
+		}
+		to[i] = normalized
+	}
+	return true
+}
+
+// sendToRecipients stores a copy of msg for each recipient, all in one
+// thread, and delivers it: local recipients are notified and external ones
+// relayed. Each recipient is resolved independently, so a full mailbox or an
+// unreachable server only affects that recipient. If no copy could be stored
+// an error response is written and false is returned.
+func (s *Server) sendToRecipients(ctx context.Context, w http.ResponseWriter, user *auth.AuthUser, msg *outgoingMessage, to []string) (*sendResult, bool) {
+	size := int64(len(msg.Body))
+	for _, a := range msg.Attachments {
+		size += int64(len(a.Data))
+	}
+
+	// Results are reported in the order the recipients were given
+	type recipient struct {
+		index   int
+		address string
+		userID  *int
+		blocked bool // The recipient blocked the sender; only the sent copy is kept
+	}
+	var accepted []recipient
+	result := &sendResult{Recipients: make([]RecipientResult, len(to))}
+	var overQuota []string
+
+	for i, addr := range to {
+		toUserID, err := s.lookupLocalRecipient(ctx, addr)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to look up local user", "to", addr, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "user_lookup_failed",
+				"message": fmt.Sprintf("Failed to lookup recipient user: %v", err),
+			})
+			return nil, false
+		}
+
+		over, err := s.recipientOverQuota(ctx, toUserID, addr, size)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "quota_check_failed",
+				"message": "Failed to check recipient mailbox quota",
+			})
+			return nil, false
+		}
+		if over {
+			overQuota = append(overQuota, addr)
+			result.Recipients[i] = RecipientResult{To: addr, Status: recipientRejected, Error: "quota_exceeded"}
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Mailbox of %s is full", addr))
+			continue
+		}
+
+		if s.senderBlocked(ctx, toUserID, msg.From) {
+			accepted = append(accepted, recipient{index: i, address: addr, blocked: true})
+			continue
+		}
+		accepted = append(accepted, recipient{index: i, address: addr, userID: toUserID})
+	}
+
+	if len(accepted) == 0 {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "quota_exceeded",
+			"message": fmt.Sprintf("Mailbox of %s is full", overQuota[0]),
+		})
+		return nil, false
+	}
+
+	failedAttachments := make(map[int]bool)
+	threadID := msg.ThreadID
+	stored := make(map[int]*database.Message)
+	for _, rcpt := range accepted {
+		message, err := s.messageRepo.CreateWithThreading(&user.ID, rcpt.userID, msg.From, rcpt.address, msg.ReplyTo, msg.Subject, msg.Body, msg.IsHTML, threadID, msg.ParentID)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to store message", "to", rcpt.address, "err", err)
+			if len(stored) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "message_creation_failed",
+					"message": fmt.Sprintf("Failed to create message in database: %v", err),
+				})
+				return nil, false
+			}
+			result.Recipients[rcpt.index] = RecipientResult{To: rcpt.address, Status: recipientRejected, Error: "message_creation_failed"}
+			continue
+		}
+
+		// Later copies join the thread of the first
+		if threadID == nil {
+			threadID = message.ThreadID
+		}
+		if len(stored) == 0 {
+			result.FirstID = message.ID
+		}
+		stored[rcpt.index] = message
+
+		// Only local recipients can send a receipt back
+		if msg.RequestReceipt && rcpt.userID != nil {
+			if err := s.messageRepo.SetRequestReceipt(message.ID); err != nil {
+				slog.ErrorContext(ctx, "failed to request read receipt", "message_id", message.ID, "err", err)
+			} else {
+				message.RequestReceipt = true
+			}
+		}
+
+		for i, a := range msg.Attachments {
+			attachment, err := s.attachmentRepo.Create(message.ID, a.Filename, a.OriginalFilename, a.ContentType, a.ContentID, int64(len(a.Data)), nil, a.Data)
+			if err != nil {
+				errorMsg := fmt.Sprintf("Failed to store attachment %s: %v", a.OriginalFilename, err)
+				slog.WarnContext(ctx, "attachment rejected", "message_id", message.ID, "file", a.OriginalFilename, "reason", errorMsg)
+				result.Warnings = append(result.Warnings, errorMsg)
+				failedAttachments[i] = true
+				continue
+			}
+			slog.DebugContext(ctx, "attachment stored", "message_id", message.ID, "attachment_id", attachment.ID,
+				"content_type", a.ContentType, "size", len(a.Data))
+		}
+	}
+	result.Attachments = len(msg.Attachments) - len(failedAttachments)
+
+	// The sender's view of any copy lists the outcome for every recipient
+	var storedIDs []int
+	for _, rcpt := range accepted {
+		if message := stored[rcpt.index]; message != nil {
+			storedIDs = append(storedIDs, message.ID)
+		}
+	}
+	if err := s.messageRepo.GroupSend(storedIDs); err != nil {
+		slog.ErrorContext(ctx, "failed to group sent copies", "message_id", result.FirstID, "err", err)
+	}
+
+	for _, rcpt := range accepted {
+		message := stored[rcpt.index]
+		if message == nil {
+			continue
+		}
+		if rcpt.blocked {
+			// Reported like any local delivery
+			s.recordDelivery(ctx, message, database.DeliveryLocal, "")
+		} else if warning := s.deliverMessage(ctx, message); warning != "" {
+			result.Warnings = append(result.Warnings, warning)
+		}
+		result.Recipients[rcpt.index] = RecipientResult{
+			To:     message.ToAddress,
+			ID:     message.ID,
+			Status: message.DeliveryStatus,
+			Error:  message.DeliveryError,
+		}
+		slog.InfoContext(ctx, "message sent", "id", message.ID, "from", msg.From, "to", message.ToAddress,
+			"attachments", result.Attachments)
+	}
+
+	return result, true
+}
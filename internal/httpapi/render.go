@@ -0,0 +1,167 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/database"
+	"yourmail/internal/htmlmail"
+)
+
+// linkPattern matches http(s) URLs, bare www. hosts and email addresses in
+// plaintext. Dotless domains are accepted for email so localhost-style
+// addresses (alice@localhost) are linked too.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+|[a-z0-9._%+\-]+@[a-z0-9\-]+(?:\.[a-z0-9\-]+)*`)
+
+// linkify converts a plaintext body into HTML with URLs and email addresses
+// turned into anchors. All other text is HTML-escaped, so user content can
+// never inject markup.
+func linkify(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range linkPattern.FindAllStringIndex(text, -1) {
+		start, end := loc[0], loc[1]
+
+		// Don't swallow trailing punctuation such as "see http://x.com."
+		for end > start && strings.ContainsRune(".,;:!?)]}", rune(text[end-1])) {
+			end--
+		}
+		if end <= last || end == start {
+			continue
+		}
+
+		match := text[start:end]
+		var href string
+		switch lower := strings.ToLower(match); {
+		case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+			href = match
+		case strings.HasPrefix(lower, "www."):
+			href = "http://" + match
+		case strings.Contains(match, "@"):
+			href = "mailto:" + match
+		default:
+			continue
+		}
+
+		b.WriteString(escapeText(text[last:start]))
+		b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="noopener noreferrer nofollow" target="_blank">`)
+		b.WriteString(html.EscapeString(match))
+		b.WriteString("</a>")
+		last = end
+	}
+	b.WriteString(escapeText(text[last:]))
+	return b.String()
+}
+
+// escapeText HTML-escapes plaintext and preserves its line breaks
+func escapeText(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>\n")
+}
+
+// shouldLinkify reports whether plaintext bodies should be rendered for this
+// request. The ?linkify= query parameter overrides the configured default.
+func (s *Server) shouldLinkify(r *http.Request) bool {
+	if v := r.URL.Query().Get("linkify"); v != "" {
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			return enabled
+		}
+	}
+	return s.config.LinkifyPlaintext
+}
+
+// allowRemoteContent reports whether the reader asked, with
+// ?remote_images=true, to see content HTML bodies load from other servers
+func allowRemoteContent(r *http.Request) bool {
+	allow, _ := strconv.ParseBool(r.URL.Query().Get("remote_images"))
+	return allow
+}
+
+// includeBodies reports whether the client asked, with ?body=true, for a
+// listing to carry full message bodies rather than just their previews
+func includeBodies(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("body"))
+	return include
+}
+
+// omitBodies clears the bodies of messages and their replies, leaving their
+// previews to be listed
+func omitBodies(messages []*database.Message) {
+	for _, msg := range messages {
+		msg.Body = ""
+		omitBodies(msg.Replies)
+	}
+}
+
+// renderBodies fills RenderedBody for messages and their replies. HTML
+// bodies always get one, with inline images pointed at their attachments
+// and remote content left out unless the request allows it. Plaintext
+// bodies get one when linkification is enabled for the request.
+func (s *Server) renderBodies(r *http.Request, messages []*database.Message) {
+	linkPlain := s.shouldLinkify(r)
+	allowRemote := allowRemoteContent(r)
+	inline := s.inlineImages(r.Context(), messages)
+
+	var render func(messages []*database.Message)
+	render = func(messages []*database.Message) {
+		for _, msg := range messages {
+			switch {
+			case msg.IsHTML:
+				msg.RenderedBody, msg.RemoteContentBlocked = htmlmail.Render(msg.Body, htmlmail.Options{
+					Policy:       htmlmail.Lookup(s.config.HTMLPolicy),
+					InlineImages: inline[msg.ID],
+					AllowRemote:  allowRemote,
+				})
+			case linkPlain:
+				msg.RenderedBody = linkify(msg.Body)
+			}
+			render(msg.Replies)
+		}
+	}
+	render(messages)
+}
+
+// inlineImages returns, for each HTML message (or reply) that refers to
+// inline images, the URLs of its attachments keyed by content ID
+func (s *Server) inlineImages(ctx context.Context, messages []*database.Message) map[int]map[string]string {
+	var ids []int
+	var collect func(messages []*database.Message)
+	collect = func(messages []*database.Message) {
+		for _, msg := range messages {
+			if msg.IsHTML && strings.Contains(strings.ToLower(msg.Body), "cid:") {
+				ids = append(ids, msg.ID)
+			}
+			collect(msg.Replies)
+		}
+	}
+	collect(messages)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	attachments, err := s.attachmentRepo.GetByMessageIDsContext(ctx, ids)
+	if err != nil {
+		// The images show as broken, the rest of the message is fine
+		slog.ErrorContext(ctx, "failed to load inline images", "err", err)
+		return nil
+	}
+
+	inline := make(map[int]map[string]string)
+	for messageID, list := range attachments {
+		for _, a := range list {
+			if a.ContentID == "" {
+				continue
+			}
+			if inline[messageID] == nil {
+				inline[messageID] = make(map[string]string)
+			}
+			inline[messageID][a.ContentID] = fmt.Sprintf("%s/api/attachments/%d", s.config.PublicURL, a.ID)
+		}
+	}
+	return inline
+}
@@ -0,0 +1,231 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+)
+
+// ComposePrefill is a pre-filled draft for replying to or forwarding a
+// message. Its fields match SaveDraftRequest so it can be saved as is.
+type ComposePrefill struct {
+	To          string                 `json:"to"`
+	Subject     string                 `json:"subject"`
+	Body        string                 `json:"body"`
+	IsHTML      bool                   `json:"is_html"`
+	ThreadID    string                 `json:"thread_id,omitempty"`
+	ParentID    int                    `json:"parent_id,omitempty"`
+	Attachments []*database.Attachment `json:"attachments,omitempty"`
+}
+
+// handleGetReplyPrefill returns a draft replying to a message
+func (s *Server) handleGetReplyPrefill(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	message, ok := s.getQuotableMessage(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	// Replying to our own sent message continues the conversation with
+	// its recipient rather than addressing ourselves
+	to := message.ReplyAddress()
+	if message.FromUserID != nil && *message.FromUserID == user.ID {
+		to = message.ToAddress
+	}
+
+	prefill := ComposePrefill{
+		To:       to,
+		Subject:  compose.ReplySubject(message.Subject),
+		IsHTML:   message.IsHTML,
+		ParentID: message.ID,
+	}
+	if message.ThreadID != nil {
+		prefill.ThreadID = *message.ThreadID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefill)
+}
+
+// handleGetForwardPrefill returns a draft forwarding a message, quoting its
+// body and listing its attachments
+func (s *Server) handleGetForwardPrefill(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	message, ok := s.getQuotableMessage(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.attachmentRepo.GetByMessageID(message.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get attachments", "err", err)
+		http.Error(w, "Failed to get attachments", http.StatusInternalServerError)
+		return
+	}
+
+	prefill := ComposePrefill{
+		Subject: compose.ForwardSubject(message.Subject),
+		Body: compose.ForwardBody(compose.Original{
+			From:    message.FromAddress,
+			To:      message.ToAddress,
+			Subject: message.Subject,
+			Body:    message.Body,
+			IsHTML:  message.IsHTML,
+			Date:    message.CreatedAt,
+		}),
+		IsHTML:      message.IsHTML,
+		Attachments: attachments,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefill)
+}
+
+// ForwardRequest is the body of a forward request
+type ForwardRequest struct {
+	To   Recipients `json:"to"`   // One or more addresses
+	Body string     `json:"body"` // Optional note above the forwarded message
+}
+
+// handleForwardMessage sends a message the user sent or received on to new
+// recipients. The body quotes the original under a forwarded-message header,
+// after the user's note, and the original's attachments are copied to the
+// forward. It starts a new thread.
+func (s *Server) handleForwardMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.requireVerifiedEmail(w, r, user.ID) {
+		return
+	}
+
+	message, ok := s.getQuotableMessage(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ForwardRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !validateRecipients(r.Context(), w, req.To) {
+		return
+	}
+
+	stored, err := s.attachmentRepo.GetByMessageID(message.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get attachments", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "attachment_read_failed",
+			"message": "Failed to read the message's attachments",
+		})
+		return
+	}
+	attachments := make([]pendingAttachment, 0, len(stored))
+	for _, a := range stored {
+		data, err := s.attachmentRepo.GetFileData(a.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to read attachment", "attachment_id", a.ID, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "attachment_read_failed",
+				"message": fmt.Sprintf("Failed to read attachment %s", a.OriginalName),
+			})
+			return
+		}
+		attachments = append(attachments, pendingAttachment{
+			Filename:         fmt.Sprintf("%d_%s", time.Now().Unix(), a.OriginalName),
+			OriginalFilename: a.OriginalName,
+			ContentType:      a.ContentType,
+			ContentID:        a.ContentID,
+			Data:             data,
+		})
+	}
+
+	note := req.Body
+	if message.IsHTML && strings.TrimSpace(note) != "" {
+		note = "<p>" + strings.ReplaceAll(html.EscapeString(note), "\n", "<br>") + "</p>"
+	}
+	body := note + compose.ForwardBody(compose.Original{
+		From:    message.FromAddress,
+		To:      message.ToAddress,
+		Subject: message.Subject,
+		Body:    message.Body,
+		IsHTML:  message.IsHTML,
+		Date:    message.CreatedAt,
+	})
+
+	// The signature goes above the forwarded message, as in replies
+	msg := &outgoingMessage{
+		From:        fmt.Sprintf("%s@%s", user.Username, s.config.ServerHost),
+		ReplyTo:     s.replyAddressFor(user.ID, ""),
+		Subject:     compose.ForwardSubject(message.Subject),
+		Body:        s.applyUserSignature(user.ID, body, message.IsHTML, true),
+		IsHTML:      message.IsHTML,
+		Attachments: attachments,
+	}
+	result, ok := s.sendToRecipients(r.Context(), w, user, msg, req.To)
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Message forwarded successfully",
+		"id":         result.FirstID,
+		"recipients": result.Recipients,
+		"attachments": map[string]interface{}{
+			"processed": result.Attachments,
+			"total":     len(attachments),
+		},
+	}
+	if len(result.Warnings) > 0 {
+		response["warnings"] = result.Warnings
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// getQuotableMessage loads a delivered message the user can access, writing
+// an error response if there is none. Drafts cannot be replied to or
+// forwarded.
+func (s *Server) getQuotableMessage(w http.ResponseWriter, r *http.Request, userID int) (*database.Message, bool) {
+	message, ok := s.getAccessibleMessage(w, r, userID)
+	if !ok {
+		return nil, false
+	}
+
+	if message.IsDraft {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return message, true
+}
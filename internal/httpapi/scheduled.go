@@ -0,0 +1,360 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// scheduledSendBatch is how many due messages the scheduled sender loads per
+// query
+const scheduledSendBatch = 100
+
+// recipientScheduled is the status reported for a recipient of a scheduled
+// send
+const recipientScheduled = "scheduled"
+
+// RescheduleRequest represents a request to move a scheduled send
+type RescheduleRequest struct {
+	ScheduledFor time.Time `json:"scheduled_for"` // RFC 3339; must be in the future
+}
+
+// scheduleToRecipients stores a copy of msg for each recipient, all in one
+// thread, to be sent at the given time. Until then the copies are drafts, so
+// recipients do not see them. Recipients are resolved, and quotas and blocks
+// checked, when the copies are sent. warnings are included in the response.
+func (s *Server) scheduleToRecipients(ctx context.Context, w http.ResponseWriter, user *auth.AuthUser, msg *outgoingMessage, to []string, at time.Time, warnings []string) {
+	if !at.After(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_scheduled_for",
+			"message": "scheduled_for must be a time in the future",
+		})
+		return
+	}
+
+	result := &sendResult{Recipients: make([]RecipientResult, len(to)), Warnings: warnings}
+	threadID := msg.ThreadID
+	for i, addr := range to {
+		message, err := s.scheduleCopy(msg, user.ID, addr, threadID, at)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to store scheduled message", "to", addr, "err", err)
+			if result.FirstID == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "message_creation_failed",
+					"message": fmt.Sprintf("Failed to create message in database: %v", err),
+				})
+				return
+			}
+			result.Recipients[i] = RecipientResult{To: addr, Status: recipientRejected, Error: "message_creation_failed"}
+			continue
+		}
+
+		// Later copies join the thread of the first
+		if threadID == nil {
+			threadID = message.ThreadID
+		}
+		if result.FirstID == 0 {
+			result.FirstID = message.ID
+		}
+
+		// Only local recipients can send a receipt back
+		if msg.RequestReceipt {
+			if toUserID, err := s.lookupLocalRecipient(ctx, addr); err == nil && toUserID != nil {
+				if err := s.messageRepo.SetRequestReceipt(message.ID); err != nil {
+					slog.ErrorContext(ctx, "failed to request read receipt", "message_id", message.ID, "err", err)
+				}
+			}
+		}
+
+		for _, a := range msg.Attachments {
+			if _, err := s.attachmentRepo.Create(message.ID, a.Filename, a.OriginalFilename, a.ContentType, a.ContentID, int64(len(a.Data)), nil, a.Data); err != nil {
+				errorMsg := fmt.Sprintf("Failed to store attachment %s: %v", a.OriginalFilename, err)
+				slog.WarnContext(ctx, "attachment rejected", "message_id", message.ID, "file", a.OriginalFilename, "reason", errorMsg)
+				result.Warnings = append(result.Warnings, errorMsg)
+			}
+		}
+
+		result.Recipients[i] = RecipientResult{To: addr, ID: message.ID, Status: recipientScheduled}
+		slog.InfoContext(ctx, "message scheduled", "id", message.ID, "from", msg.From, "to", addr, "scheduled_for", at)
+	}
+
+	response := map[string]interface{}{
+		"success":       true,
+		"message":       "Message scheduled",
+		"id":            result.FirstID,
+		"scheduled_for": at,
+		"recipients":    result.Recipients,
+	}
+	if len(result.Warnings) > 0 {
+		response["warnings"] = result.Warnings
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// scheduleCopy stores the copy of msg for one recipient as a draft due at
+// the given time
+func (s *Server) scheduleCopy(msg *outgoingMessage, userID int, to string, threadID *string, at time.Time) (*database.Message, error) {
+	message, err := s.messageRepo.CreateDraft(userID, msg.From, to, msg.ReplyTo, msg.Subject, msg.Body, msg.IsHTML, threadID, msg.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.messageRepo.Schedule(message.ID, at); err != nil {
+		// Don't leave it behind as a plain draft
+		if err := s.messageRepo.Delete(message.ID); err != nil {
+			slog.Error("failed to remove unscheduled draft", "message_id", message.ID, "err", err)
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// handleGetScheduled returns the current user's scheduled sends, due soonest
+// first
+func (s *Server) handleGetScheduled(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	messages, err := s.messageRepo.GetScheduledForUser(user.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get scheduled messages", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleRescheduleMessage moves a scheduled send to another time
+func (s *Server) handleRescheduleMessage(w http.ResponseWriter, r *http.Request) {
+	message, ok := s.getOwnedScheduled(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req RescheduleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !req.ScheduledFor.After(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_scheduled_for",
+			"message": "scheduled_for must be a time in the future",
+		})
+		return
+	}
+
+	scheduled, err := s.messageRepo.Schedule(message.ID, req.ScheduledFor)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to reschedule message", "err", err)
+		http.Error(w, "Failed to reschedule message", http.StatusInternalServerError)
+		return
+	}
+	if !scheduled {
+		writeAlreadySent(w)
+		return
+	}
+
+	updated, err := s.messageRepo.GetByIDWithAttachments(message.ID)
+	if err != nil || updated == nil {
+		slog.ErrorContext(r.Context(), "failed to get scheduled message", "message_id", message.ID, "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// handleCancelScheduled deletes a scheduled send, with its attachments,
+// before it is sent
+func (s *Server) handleCancelScheduled(w http.ResponseWriter, r *http.Request) {
+	message, ok := s.getOwnedScheduled(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.messageRepo.DeleteScheduled(message.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to cancel scheduled message", "err", err)
+		http.Error(w, "Failed to cancel message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !deleted {
+		writeAlreadySent(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// writeAlreadySent writes the response for a scheduled send that went out
+// while the request was being handled
+func writeAlreadySent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   "already_sent",
+		"message": "Message has already been sent",
+	})
+}
+
+// getOwnedScheduled loads the scheduled send named by the {id} route
+// variable, writing an error response unless the current user scheduled it
+func (s *Server) getOwnedScheduled(w http.ResponseWriter, r *http.Request) (*database.Message, bool) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get scheduled message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return nil, false
+	}
+	if message == nil || !message.IsDraft || message.ScheduledFor == nil || message.FromUserID == nil || *message.FromUserID != user.ID {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return nil, false
+	}
+	return message, true
+}
+
+// StartScheduledSender sends scheduled messages that are due each interval.
+// It returns a function that stops the sender.
+func (s *Server) StartScheduledSender(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.sendDueScheduled(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// sendDueScheduled sends every scheduled message that is due, a batch at a
+// time. Messages that could not be handled are left for the next run.
+func (s *Server) sendDueScheduled(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := s.messageRepo.GetDueScheduled(time.Now(), scheduledSendBatch)
+		if err != nil {
+			slog.Error("failed to get due scheduled messages", "err", err)
+			return
+		}
+
+		handled := 0
+		for _, message := range messages {
+			if s.sendScheduled(ctx, message) {
+				handled++
+			}
+		}
+		if len(messages) < scheduledSendBatch || handled < len(messages) {
+			return
+		}
+	}
+}
+
+// sendScheduled sends a scheduled message that is due through the same
+// checks and delivery as an immediate send. A recipient whose mailbox is
+// full gets nothing and the sender a bounce. It reports false if the message
+// should be tried again.
+func (s *Server) sendScheduled(ctx context.Context, draft *database.Message) bool {
+	if draft.FromUserID == nil {
+		// The sender's account was deleted
+		if _, err := s.messageRepo.DeleteScheduled(draft.ID); err != nil {
+			slog.ErrorContext(ctx, "failed to remove orphaned scheduled message", "message_id", draft.ID, "err", err)
+			return false
+		}
+		return true
+	}
+
+	toUserID, err := s.lookupLocalRecipient(ctx, draft.ToAddress)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to look up local user", "to", draft.ToAddress, "err", err)
+		return false
+	}
+
+	size := int64(len(draft.Body))
+	for _, a := range draft.Attachments {
+		size += a.FileSize
+	}
+	over, err := s.recipientOverQuota(ctx, toUserID, draft.ToAddress, size)
+	if err != nil {
+		return false
+	}
+	if over {
+		sent, err := s.messageRepo.MarkDraftSent(draft.ID, nil, draft.ToAddress, draft.ReplyTo, draft.Body, draft.IsHTML)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to send scheduled message", "message_id", draft.ID, "err", err)
+			return false
+		}
+		if sent {
+			reason := fmt.Sprintf("Mailbox of %s is full", draft.ToAddress)
+			s.recordDelivery(ctx, draft, database.DeliveryFailed, reason)
+			s.sendBounce(ctx, draft, reason)
+		}
+		return true
+	}
+
+	blocked := s.senderBlocked(ctx, toUserID, draft.FromAddress)
+	if blocked {
+		toUserID = nil
+	}
+
+	message, warning, err := s.sendDraft(ctx, draft, toUserID, blocked, draft.ReplyTo, draft.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to send scheduled message", "message_id", draft.ID, "err", err)
+		return false
+	}
+	if message != nil {
+		slog.InfoContext(ctx, "scheduled message sent", "id", message.ID, "from", message.FromAddress, "to", message.ToAddress,
+			"status", message.DeliveryStatus, "warning", warning)
+	}
+	return true
+}
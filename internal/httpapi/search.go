@@ -0,0 +1,62 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+)
+
+// handleSearch searches the messages the user sent or received. By default
+// results are substring matches, newest first; with ranked=true the
+// full-text index is used and results are ordered by relevance.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	ranked, _ := strconv.ParseBool(r.URL.Query().Get("ranked"))
+
+	var messages []*database.Message
+	var err error
+	if ranked {
+		messages, err = s.messageRepo.FullTextSearchContext(r.Context(), user.ID, query, limit, offset)
+		if errors.Is(err, database.ErrFullTextSearchUnavailable) {
+			// Fall back to unranked results rather than failing the search
+			ranked = false
+		}
+	}
+	if !ranked {
+		messages, err = s.messageRepo.SearchMessagesContext(r.Context(), user.ID, query, limit, offset)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to search messages", "err", err)
+		http.Error(w, "Failed to search messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,57 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"yourmail/internal/database"
+)
+
+func TestConcurrentSendsDoNotHitLockedDatabase(t *testing.T) {
+	s := newTestServer(t)
+	senders := []*database.User{createTestUser(t, s, "alice"), createTestUser(t, s, "carol"), createTestUser(t, s, "dave")}
+	bob := createTestUser(t, s, "bob")
+	createTestUser(t, s, "erin")
+
+	const perSender = 15
+	var wg sync.WaitGroup
+	errs := make(chan string, len(senders)*perSender)
+	for _, sender := range senders {
+		for i := 0; i < perSender; i++ {
+			wg.Add(1)
+			go func(sender *database.User, i int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"to": ["bob@localhost", "erin@localhost"], "subject": "Burst %d", "body": "Message %d from %s"}`, i, i, sender.Username)
+				w := httptest.NewRecorder()
+				s.handleSendMessage(w, authRequest(sender, "POST", "/api/send", strings.NewReader(body)))
+				if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "locked") {
+					errs <- fmt.Sprintf("%s send %d: %d %s", sender.Username, i, w.Code, w.Body)
+				}
+			}(sender, i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var received int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE to_user_id = ?`, bob.ID).Scan(&received); err != nil {
+		t.Fatal(err)
+	}
+	if want := len(senders) * perSender; received != want {
+		t.Errorf("bob received %d messages, want %d", received, want)
+	}
+	count, err := s.messageRepo.GetUnreadCount(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != received {
+		t.Errorf("bob's unread count = %d, want %d", count, received)
+	}
+}
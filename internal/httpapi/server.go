@@ -1,31 +1,70 @@
 package httpapi
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"yourmail/config"
+	"yourmail/internal/antivirus"
 	"yourmail/internal/auth"
+	"yourmail/internal/compose"
 	"yourmail/internal/database"
 	"yourmail/internal/federation"
+	"yourmail/internal/metrics"
+	"yourmail/internal/spam"
+	"yourmail/internal/sysmail"
+	"yourmail/internal/webhook"
 
 	"github.com/gorilla/mux"
 )
 
+// SSE drop policies applied when a client's event buffer is full
+const (
+	sseDropOldest = "drop-oldest" // Discard the oldest queued event to make room
+	sseDisconnect = "disconnect"  // Disconnect the slow client
+)
+
+// sseDroppedEvents counts events discarded because a client's buffer was full
+var sseDroppedEvents = metrics.NewCounter("yourmail_sse_dropped_events_total",
+	"Number of SSE events dropped because a client was too slow to read them")
+
 // SSEClient represents a Server-Sent Events client
 type SSEClient struct {
-	userID   int
-	writer   http.ResponseWriter
-	flusher  http.Flusher
-	done     chan bool
-	lastPing time.Time
+	userID    int
+	writer    http.ResponseWriter
+	flusher   http.Flusher
+	done      chan bool
+	closeOnce sync.Once
+	events    chan sseEvent // Bounded queue drained by the client's handler goroutine
+	lastPing  time.Time
+
+	// queueMu orders events in the queue by ID. lastMessageID is the newest
+	// received message the client has been sent, and is the ID of its events.
+	queueMu       sync.Mutex
+	lastMessageID int
+	replayed      map[int]bool // Messages already sent by replaySSEMessages
+}
+
+// sseEvent is a serialized event waiting to be written to a client. An event
+// without a type is a ping.
+type sseEvent struct {
+	id        int
+	eventType string
+	data      []byte
+	messageID int // The message a new-message or new-reply event is about
 }
 
 // Server represents the HTTP API server
@@ -35,101 +74,265 @@ type Server struct {
 	userRepo       *database.UserRepository
 	messageRepo    *database.MessageRepository
 	attachmentRepo *database.AttachmentRepository
+	folderRepo     *database.FolderRepository
+	contactRepo    *database.ContactRepository
+	blockRepo      *database.BlockRepository
+	spamRepo       *database.SpamRepository
+	templateRepo   *database.TemplateRepository
+	webhookRepo    *database.WebhookRepository
+	idempotencyRepo *database.IdempotencyRepository
+	apiKeyRepo     *database.APIKeyRepository
+	loginRepo      *database.LoginEventRepository
+	webhooks       *webhook.Dispatcher
+	sysmail        *sysmail.Renderer
 	jwtService     *auth.JWTService
+	spamScorer     spam.Scorer
+	attachmentScanner antivirus.Scanner
 	relay          *federation.Relay
+	httpServer     *http.Server
+	openapiSpec    []byte      // Built by Start from the registered routes
+	ready          atomic.Bool // Set by SetReady; answers /api/readyz
 	
 	// SSE client management
 	sseClients    map[int][]*SSEClient // userID -> clients
 	sseMutex      sync.RWMutex
 	sseCloseChan  chan *SSEClient
+	sseClosed     bool               // Set by ShutdownSSE; guarded by sseMutex
+	sseCtx        context.Context    // Cancelled by ShutdownSSE
+	sseCancel     context.CancelFunc
+
+	// Typing indicators that have not expired yet
+	typingTimers map[typingKey]*time.Timer
+	typingMu     sync.Mutex
 }
 
 // NewServer creates a new HTTP API server
 func NewServer(cfg *config.Config, db *database.DB, relay *federation.Relay) *Server {
 	attachmentRepo := database.NewAttachmentRepository(db)
+	webhookRepo := database.NewWebhookRepository(db)
+	renderer, err := sysmail.NewRenderer(cfg.SystemMailTemplateDir)
+	if err != nil {
+		slog.Warn("some system mail templates could not be loaded, using built-in defaults", "err", err)
+	}
+	sseCtx, sseCancel := context.WithCancel(context.Background())
 	server := &Server{
 		config:         cfg,
 		db:             db,
 		userRepo:       database.NewUserRepository(db),
 		messageRepo:    database.NewMessageRepository(db, attachmentRepo),
 		attachmentRepo: attachmentRepo,
-		jwtService:     auth.NewJWTService(cfg.JWTSecret, "yourmail"),
+		folderRepo:     database.NewFolderRepository(db),
+		contactRepo:    database.NewContactRepository(db),
+		blockRepo:      database.NewBlockRepository(db),
+		spamRepo:       database.NewSpamRepository(db),
+		spamScorer:     spam.Heuristic{},
+		attachmentScanner: antivirus.Noop{},
+		templateRepo:   database.NewTemplateRepository(db),
+		webhookRepo:    webhookRepo,
+		idempotencyRepo: database.NewIdempotencyRepository(db),
+		apiKeyRepo:     database.NewAPIKeyRepository(db),
+		loginRepo:      database.NewLoginEventRepository(db),
+		webhooks: webhook.NewDispatcher(webhookRepo, webhook.Options{
+			MaxAttempts:           cfg.WebhookMaxAttempts,
+			Timeout:               cfg.WebhookTimeout,
+			FailureLimit:          cfg.WebhookFailureLimit,
+			AllowPrivateAddresses: cfg.WebhookAllowPrivate,
+		}),
+		sysmail:        renderer,
+		jwtService:     auth.NewJWTService(cfg.JWTSecret, "yourmail", cfg.JWTExpiration),
 		relay:          relay,
+		httpServer:     &http.Server{Addr: ":" + cfg.HTTPPort},
 		sseClients:     make(map[int][]*SSEClient),
 		sseCloseChan:   make(chan *SSEClient, 100),
+		sseCtx:         sseCtx,
+		sseCancel:      sseCancel,
+		typingTimers:   make(map[typingKey]*time.Timer),
 	}
 	
+	if cfg.AttachmentScanAddress != "" {
+		server.attachmentScanner = antivirus.ClamAV{Address: cfg.AttachmentScanAddress, Timeout: cfg.AttachmentScanTimeout}
+	}
+
+	// Tokens of suspended or renamed accounts stop working immediately
+	server.jwtService.SetAccountChecker(server.userRepo.IsActive)
+	server.jwtService.SetAPIKeyResolver(server.resolveAPIKey)
+
+	// Send mail held for a peer server once it is back
+	relay.OnPeerRecovered(func(host string) { go server.retryPending(host) })
+
 	// Start SSE client cleanup goroutine
-	go server.cleanupSSEClients()
+	go server.cleanupSSEClients(sseCtx)
 	
 	return server
 }
 
-// Start starts the HTTP server
+// Start listens on the configured port and serves the API
 func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves the API on listener. It returns nil once Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
 	router := mux.NewRouter()
 
+	// Tag every request with an ID for its log lines
+	router.Use(s.requestIDMiddleware)
+
 	// CORS middleware
 	router.Use(s.corsMiddleware)
 
+	// Compress large JSON responses
+	router.Use(s.gzipMiddleware)
+
 	// Public routes (no auth required)
 	router.HandleFunc("/api/register", s.handleRegister).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/login", s.handleLogin).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/verify", s.handleVerifyEmail).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/health", s.handleHealth).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/livez", s.handleLivez).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/readyz", s.handleReadyz).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/openapi.json", s.handleOpenAPISpec).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/docs", s.handleAPIDocs).Methods("GET")
+
+	// Metrics take the metrics token or an admin
+	router.HandleFunc("/metrics", s.metricsAuth(metrics.Handler().ServeHTTP)).Methods("GET")
 
 	// Protected routes (JWT auth required)
 	router.HandleFunc("/api/messages", s.jwtService.AuthMiddleware(s.handleGetMessages)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/messages/sent", s.jwtService.AuthMiddleware(s.handleGetSentMessages)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/messages/unread-count", s.jwtService.AuthMiddleware(s.handleGetUnreadCount)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/bulk", s.jwtService.AuthMiddleware(s.handleBulkMessages)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/flagged", s.jwtService.AuthMiddleware(s.handleGetFlaggedMessages)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/spam", s.jwtService.AuthMiddleware(s.handleGetSpam)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/snoozed", s.jwtService.AuthMiddleware(s.handleGetSnoozed)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/scheduled", s.jwtService.AuthMiddleware(s.handleGetScheduled)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/scheduled/{id}", s.jwtService.AuthMiddleware(auth.RequireScope(auth.ScopeSend, s.handleRescheduleMessage))).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/messages/scheduled/{id}", s.jwtService.AuthMiddleware(auth.RequireScope(auth.ScopeSend, s.handleCancelScheduled))).Methods("DELETE")
+	router.HandleFunc("/api/messages/{id:[0-9]+}", s.jwtService.AuthMiddleware(s.handleGetMessage)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/messages/{id}/read", s.jwtService.AuthMiddleware(s.handleMarkAsRead)).Methods("POST", "OPTIONS")
-	router.HandleFunc("/api/send", s.jwtService.AuthMiddleware(s.handleSendMessage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/unread", s.jwtService.AuthMiddleware(s.handleMarkAsUnread)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/send", s.jwtService.AuthMiddleware(auth.RequireScope(auth.ScopeSend, s.idempotent(s.handleSendMessage)))).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/profile", s.jwtService.AuthMiddleware(s.handleGetProfile)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/profile", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleUpdateProfile))).Methods("PUT")
+	router.HandleFunc("/api/profile/password", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleChangePassword))).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/profile/security", s.jwtService.AuthMiddleware(s.handleGetSecurity)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/whoami", s.jwtService.AuthMiddleware(s.handleWhoami)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/verify/resend", s.jwtService.AuthMiddleware(s.handleResendVerification)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/profile/settings", s.jwtService.AuthMiddleware(s.handleUpdateSettings)).Methods("PUT", "OPTIONS")
+	
+	router.HandleFunc("/api/messages/{id}/move", s.jwtService.AuthMiddleware(s.handleMoveMessage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/not-spam", s.jwtService.AuthMiddleware(s.handleNotSpam)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/flag", s.jwtService.AuthMiddleware(s.handleFlagMessage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/snooze", s.jwtService.AuthMiddleware(s.handleSnoozeMessage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/unsnooze", s.jwtService.AuthMiddleware(s.handleUnsnoozeMessage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/reply", s.jwtService.AuthMiddleware(s.handleGetReplyPrefill)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/forward", s.jwtService.AuthMiddleware(s.handleGetForwardPrefill)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/forward", s.jwtService.AuthMiddleware(auth.RequireScope(auth.ScopeSend, s.idempotent(s.handleForwardMessage)))).Methods("POST", "OPTIONS")
+
+	// Folder routes
+	router.HandleFunc("/api/folders", s.jwtService.AuthMiddleware(s.handleListFolders)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/folders", s.jwtService.AuthMiddleware(s.handleCreateFolder)).Methods("POST")
+	router.HandleFunc("/api/folders/{id}", s.jwtService.AuthMiddleware(s.handleDeleteFolder)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/folders/{id}/messages", s.jwtService.AuthMiddleware(s.handleGetFolderMessages)).Methods("GET", "OPTIONS")
 	
+	// Contact routes
+	router.HandleFunc("/api/contacts", s.jwtService.AuthMiddleware(s.handleListContacts)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/contacts", s.jwtService.AuthMiddleware(s.handleCreateContact)).Methods("POST")
+	router.HandleFunc("/api/contacts/suggest", s.jwtService.AuthMiddleware(s.handleSuggestContacts)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/contacts/{id}", s.jwtService.AuthMiddleware(s.handleUpdateContact)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/contacts/{id}", s.jwtService.AuthMiddleware(s.handleDeleteContact)).Methods("DELETE")
+	router.HandleFunc("/api/blocks", s.jwtService.AuthMiddleware(s.handleListBlocks)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/blocks", s.jwtService.AuthMiddleware(s.handleCreateBlock)).Methods("POST")
+	router.HandleFunc("/api/blocks/{id}", s.jwtService.AuthMiddleware(s.handleDeleteBlock)).Methods("DELETE", "OPTIONS")
+
+	// Webhook routes
+	router.HandleFunc("/api/webhooks", s.jwtService.AuthMiddleware(s.handleListWebhooks)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/webhooks", s.jwtService.AuthMiddleware(s.handleCreateWebhook)).Methods("POST")
+	router.HandleFunc("/api/webhooks/{id}", s.jwtService.AuthMiddleware(s.handleDeleteWebhook)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/webhooks/{id}/enable", s.jwtService.AuthMiddleware(s.handleEnableWebhook)).Methods("POST", "OPTIONS")
+
+	// Credential routes; keys and scoped tokens can't mint or manage others
+	router.HandleFunc("/api/tokens", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleCreateToken))).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/keys", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleListAPIKeys))).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/keys", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleCreateAPIKey))).Methods("POST")
+	router.HandleFunc("/api/keys/{id}", s.jwtService.AuthMiddleware(auth.LoginOnly(s.handleDeleteAPIKey))).Methods("DELETE", "OPTIONS")
+
+	// Template routes
+	router.HandleFunc("/api/templates", s.jwtService.AuthMiddleware(s.handleListTemplates)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/templates", s.jwtService.AuthMiddleware(s.handleCreateTemplate)).Methods("POST")
+	router.HandleFunc("/api/templates/{id}", s.jwtService.AuthMiddleware(s.handleUpdateTemplate)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/templates/{id}", s.jwtService.AuthMiddleware(s.handleDeleteTemplate)).Methods("DELETE")
+
+	// Search routes
+	router.HandleFunc("/api/search", s.jwtService.AuthMiddleware(s.handleSearch)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/export", s.jwtService.AuthMiddleware(s.handleExport)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/import", s.jwtService.AuthMiddleware(s.handleImport)).Methods("POST", "OPTIONS")
+
+	// Draft routes
+	router.HandleFunc("/api/drafts", s.jwtService.AuthMiddleware(s.handleGetDrafts)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/drafts", s.jwtService.AuthMiddleware(s.handleSaveDraft)).Methods("POST")
+	router.HandleFunc("/api/drafts/{id}/send", s.jwtService.AuthMiddleware(auth.RequireScope(auth.ScopeSend, s.idempotent(s.handleSendDraft)))).Methods("POST", "OPTIONS")
+
 	// Threading routes
+	router.HandleFunc("/api/threads", s.jwtService.AuthMiddleware(s.handleListThreads)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/threads/{threadId}", s.jwtService.AuthMiddleware(s.handleGetThread)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/threads/{threadId}/participants", s.jwtService.AuthMiddleware(s.handleGetThreadParticipants)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/threads/{threadId}/typing", s.jwtService.AuthMiddleware(s.handleTyping)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/threads/{threadId}/mute", s.jwtService.AuthMiddleware(s.handleMuteThread)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/threads/{threadId}/unmute", s.jwtService.AuthMiddleware(s.handleUnmuteThread)).Methods("POST", "OPTIONS")
 	
 	// Attachment routes
 	router.HandleFunc("/api/attachments/{id}", s.jwtService.AuthMiddleware(s.handleGetAttachment)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/attachments", s.jwtService.AuthMiddleware(s.handleGetMessageAttachments)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/messages/{id}/attachments.zip", s.jwtService.AuthMiddleware(s.handleGetAttachmentsZip)).Methods("GET", "OPTIONS")
+
+	// Admin routes
+	router.HandleFunc("/api/admin/users", s.jwtService.AdminMiddleware(s.handleAdminListUsers)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}", s.jwtService.AdminMiddleware(s.handleAdminDeleteUser)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/disable", s.jwtService.AdminMiddleware(s.handleAdminDisableUser)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/enable", s.jwtService.AdminMiddleware(s.handleAdminEnableUser)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/backup", s.jwtService.AdminMiddleware(s.handleAdminBackup)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/vacuum", s.jwtService.AdminMiddleware(s.handleAdminVacuum)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/federation/peers", s.jwtService.AdminMiddleware(s.handleAdminFederationPeers)).Methods("GET", "OPTIONS")
 
 	// Server-Sent Events for real-time updates
-	router.HandleFunc("/api/sse/inbox", s.handleSSEInbox).Methods("GET")
+	router.HandleFunc("/api/sse/inbox", s.handleSSEInbox).Methods("GET", "OPTIONS")
 
 	// Federation routes (for server-to-server communication)
 	router.HandleFunc("/federation/relay", s.handleFederationRelay).Methods("POST")
+	router.HandleFunc("/federation/info", s.handleFederationInfo).Methods("GET")
+	router.HandleFunc("/federation/attachments/{id:[0-9]+}", s.handleFederationAttachment).Methods("GET")
 
-	log.Printf("🚀 HTTP API server starting on :%s", s.config.HTTPPort)
-	return http.ListenAndServe(":"+s.config.HTTPPort, router)
-}
-
-// CORS middleware
-func (s *Server) corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		
-		// Check if origin is allowed
-		allowed := false
-		for _, allowedOrigin := range s.config.AllowedOrigins {
-			if origin == allowedOrigin {
-				allowed = true
-				break
-			}
-		}
-		
-		if allowed {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	// Describe the routes registered above
+	spec, err := buildOpenAPISpec(router)
+	if err != nil {
+		return fmt.Errorf("failed to build OpenAPI document: %w", err)
+	}
+	s.openapiSpec = spec
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	slog.Info("HTTP API server starting", "addr", listener.Addr().String())
+	s.httpServer.Handler = router
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
 
-		next.ServeHTTP(w, r)
-	})
+// Shutdown stops the server gracefully. SSE clients are disconnected first,
+// since their streams would otherwise never finish, then in-flight requests
+// are allowed to complete until ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ShutdownSSE()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("HTTP server shutdown: %w", err)
+	}
+	s.webhooks.Close()
+	slog.InfoContext(ctx, "HTTP server stopped")
+	return nil
 }
 
 // handleRegister handles user registration
@@ -137,41 +340,19 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	var req database.CreateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "invalid_json",
-			"message": fmt.Sprintf("Failed to parse JSON request: %v", err),
-		})
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	// Basic validation
-	if len(req.Username) < 3 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "username_too_short",
-			"message": "Username must be at least 3 characters",
-		})
-		return
-	}
-	if len(req.Password) < 6 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "password_too_short",
-			"message": "Password must be at least 6 characters",
-		})
-		return
-	}
-	if !strings.Contains(req.Email, "@") {
-		w.WriteHeader(http.StatusBadRequest)
+	// The email tag has already checked the address, so this cannot fail
+	req.Email, _ = compose.NormalizeAddress(req.Email)
+
+	if s.isReservedUsername(req.Username) {
+		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "invalid_email",
-			"message": "Invalid email format",
+			"error":   "username_reserved",
+			"message": "Username is reserved",
 		})
 		return
 	}
@@ -202,7 +383,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Create user
 	user, err := s.userRepo.Create(req.Username, req.Email, req.Password)
 	if err != nil {
-		log.Printf("Failed to create user: %v", err)
+		slog.ErrorContext(r.Context(), "failed to create user", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -212,10 +393,22 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	verificationToken, err := s.startEmailVerification(r.Context(), user)
+	if err != nil {
+		// The account works without it; the user can ask for a new token
+		slog.ErrorContext(r.Context(), "failed to start email verification", "username", user.Username, "err", err)
+	}
+
+	if s.config.WelcomeMail {
+		if err := s.sendSystemMail(r.Context(), sysmail.Welcome, user.ID, s.systemMailData(user.Username)); err != nil {
+			slog.ErrorContext(r.Context(), "failed to send welcome mail", "username", user.Username, "err", err)
+		}
+	}
+
 	// Generate JWT token
-	token, err := s.jwtService.GenerateToken(user.ID, user.Username, user.Email)
+	token, err := s.jwtService.GenerateToken(user.ID, user.Username, user.Email, user.IsAdmin, nil)
 	if err != nil {
-		log.Printf("Failed to generate token: %v", err)
+		slog.ErrorContext(r.Context(), "failed to generate token", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -231,6 +424,9 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		Token:   token,
 		User:    user,
 	}
+	if s.config.Environment == "development" {
+		response.VerificationToken = verificationToken
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -241,20 +437,26 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	var req database.LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "invalid_json",
-			"message": fmt.Sprintf("Failed to parse JSON request: %v", err),
-		})
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Authenticate user
 	user, err := s.userRepo.Authenticate(req.Username, req.Password)
+	if err == nil || errors.Is(err, database.ErrAccountDisabled) {
+		s.recordLogin(r, req.Username, user)
+	}
+	if errors.Is(err, database.ErrAccountDisabled) {
+		response := database.LoginResponse{
+			Success: false,
+			Message: "Account suspended",
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	if err != nil {
-		log.Printf("Authentication error: %v", err)
+		slog.ErrorContext(r.Context(), "authentication error", "username", req.Username, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -275,9 +477,9 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate JWT token
-	token, err := s.jwtService.GenerateToken(user.ID, user.Username, user.Email)
+	token, err := s.jwtService.GenerateToken(user.ID, user.Username, user.Email, user.IsAdmin, nil)
 	if err != nil {
-		log.Printf("Failed to generate token: %v", err)
+		slog.ErrorContext(r.Context(), "failed to generate token", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -298,6 +500,20 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleWhoami returns the user the token belongs to, as carried in its
+// claims. It is a cheap way for clients to check that a token is still valid;
+// handleGetProfile returns the full record.
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
 // handleGetProfile returns the current user's profile
 func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	user, ok := auth.GetUserFromContext(r.Context())
@@ -309,13 +525,75 @@ func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	// Get full user details from database
 	fullUser, err := s.userRepo.GetByID(user.ID)
 	if err != nil {
-		log.Printf("Failed to get user profile: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get user profile", "err", err)
 		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
 		return
 	}
 
+	used, err := s.messageRepo.GetUserStorageUsage(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get storage usage", "err", err)
+		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONWithETag(w, r, struct {
+		*database.User
+		Storage StorageUsage `json:"storage"`
+	}{fullUser, StorageUsage{Used: used, Quota: s.config.MailboxQuota}})
+}
+
+// parsePagination reads the limit (default 50, max 100) and offset query
+// parameters, ignoring invalid values
+func parsePagination(r *http.Request) (limit, offset int) {
+	limit = 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+	return limit, offset
+}
+
+// MessagePage is a page of a message listing with pagination metadata
+type MessagePage struct {
+	Messages []*database.Message `json:"messages"`
+	Total    int                 `json:"total"`
+	Limit    int                 `json:"limit"`
+	Offset   int                 `json:"offset"`
+	HasMore  bool                `json:"has_more"`
+}
+
+// CursorPage is a page of the inbox listed with ?cursor. NextCursor is sent
+// back as the cursor of the following page, and is empty on the last page.
+type CursorPage struct {
+	Messages   []*database.Message `json:"messages"`
+	Limit      int                 `json:"limit"`
+	HasMore    bool                `json:"has_more"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// writeMessagePage writes a listing as a MessagePage, or as a bare array for
+// older clients that pass ?format=array
+func writeMessagePage(w http.ResponseWriter, r *http.Request, messages []*database.Message, total, limit, offset int) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(fullUser)
+	if r.URL.Query().Get("format") == "array" {
+		json.NewEncoder(w).Encode(messages)
+		return
+	}
+
+	json.NewEncoder(w).Encode(MessagePage{
+		Messages: messages,
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+		HasMore:  offset+len(messages) < total,
+	})
 }
 
 // handleGetMessages returns messages for the authenticated user
@@ -327,22 +605,54 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse pagination parameters
-	limit := 50 // default
-	offset := 0
-	if l := r.URL.Query().Get("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
-			limit = parsed
+	limit, offset := parsePagination(r)
+	opts := database.InboxOptions{Limit: limit, Offset: offset}
+
+	// Sort keys are checked against an allowlist before they reach SQL
+	query := r.URL.Query()
+	if sort := query.Get("sort"); sort != "" {
+		if !database.ValidInboxSort(sort) {
+			http.Error(w, "Invalid sort: use date, subject, sender or unread", http.StatusBadRequest)
+			return
 		}
+		opts.Sort = sort
 	}
-	if o := r.URL.Query().Get("offset"); o != "" {
-		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
-			offset = parsed
+	if order := query.Get("order"); order != "" {
+		if order != "asc" && order != "desc" {
+			http.Error(w, "Invalid order: use asc or desc", http.StatusBadRequest)
+			return
+		}
+		opts.Order = order
+	}
+
+	// Optionally list a folder instead of the inbox
+	if f := r.URL.Query().Get("folder"); f != "" {
+		folderID, err := strconv.Atoi(f)
+		if err != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+		folder, err := s.folderRepo.GetByID(folderID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get folder", "err", err)
+			http.Error(w, "Failed to get folder", http.StatusInternalServerError)
+			return
+		}
+		if folder == nil || folder.UserID != user.ID {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
 		}
+		opts.FolderID = &folderID
+	}
+
+	if query.Has("cursor") {
+		s.getInboxByCursor(w, r, user.ID, opts)
+		return
 	}
 
-	messages, err := s.messageRepo.GetInboxForUser(user.ID, limit, offset)
+	messages, total, err := s.messageRepo.GetInboxPageForUserContext(r.Context(), user.ID, opts)
 	if err != nil {
-		log.Printf("Failed to get messages: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get messages", "err", err)
 		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
 		return
 	}
@@ -352,8 +662,56 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 		messages = []*database.Message{}
 	}
 
+	hideRecipientState(messages, user.ID)
+	if includeBodies(r) {
+		s.renderBodies(r, messages)
+	} else {
+		omitBodies(messages)
+	}
+
+	writeMessagePage(w, r, messages, total, limit, offset)
+}
+
+// getInboxByCursor writes the page of the inbox after the ?cursor given, or
+// the first page for an empty cursor. Pages follow the default newest-first
+// order, so mail arriving while a client scrolls doesn't shift later pages.
+func (s *Server) getInboxByCursor(w http.ResponseWriter, r *http.Request, userID int, opts database.InboxOptions) {
+	if (opts.Sort != "" && opts.Sort != database.InboxSortDate) || opts.Order == "asc" {
+		http.Error(w, "Cursor paging only supports the default sort", http.StatusBadRequest)
+		return
+	}
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := database.ParseInboxCursor(token)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		opts.Before = cursor
+	}
+
+	messages, next, err := s.messageRepo.GetInboxCursorPageForUserContext(r.Context(), userID, opts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get messages", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	hideRecipientState(messages, userID)
+	if includeBodies(r) {
+		s.renderBodies(r, messages)
+	} else {
+		omitBodies(messages)
+	}
+
+	page := CursorPage{Messages: messages, Limit: opts.Limit}
+	if next != nil {
+		page.HasMore, page.NextCursor = true, next.Encode()
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(page)
 }
 
 // handleGetSentMessages returns sent messages for the authenticated user
@@ -365,22 +723,11 @@ func (s *Server) handleGetSentMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse pagination parameters
-	limit := 50
-	offset := 0
-	if l := r.URL.Query().Get("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
-			limit = parsed
-		}
-	}
-	if o := r.URL.Query().Get("offset"); o != "" {
-		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
-			offset = parsed
-		}
-	}
+	limit, offset := parsePagination(r)
 
-	messages, err := s.messageRepo.GetSentForUser(user.ID, limit, offset)
+	messages, total, err := s.messageRepo.GetSentPageForUserContext(r.Context(), user.ID, limit, offset)
 	if err != nil {
-		log.Printf("Failed to get sent messages: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get sent messages", "err", err)
 		http.Error(w, "Failed to get sent messages", http.StatusInternalServerError)
 		return
 	}
@@ -390,11 +737,14 @@ func (s *Server) handleGetSentMessages(w http.ResponseWriter, r *http.Request) {
 		messages = []*database.Message{}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	writeMessagePage(w, r, messages, total, limit, offset)
 }
 
-// handleGetUnreadCount returns the count of unread messages
+// handleGetUnreadCount returns the count of unread messages, or with
+// ?by=folder the count in each folder
 func (s *Server) handleGetUnreadCount(w http.ResponseWriter, r *http.Request) {
 	user, ok := auth.GetUserFromContext(r.Context())
 	if !ok {
@@ -402,9 +752,21 @@ func (s *Server) handleGetUnreadCount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("by") == "folder" {
+		counts, err := s.messageRepo.GetUnreadCountsByFolder(user.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get unread counts", "err", err)
+			http.Error(w, "Failed to get unread count", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+		return
+	}
+
 	count, err := s.messageRepo.GetUnreadCount(user.ID)
 	if err != nil {
-		log.Printf("Failed to get unread count: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get unread count", "err", err)
 		http.Error(w, "Failed to get unread count", http.StatusInternalServerError)
 		return
 	}
@@ -416,6 +778,18 @@ func (s *Server) handleGetUnreadCount(w http.ResponseWriter, r *http.Request) {
 
 // handleMarkAsRead marks a message as read
 func (s *Server) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
+	s.setReadStatus(w, r, true)
+}
+
+// handleMarkAsUnread marks a message as unread so the user can revisit it
+func (s *Server) handleMarkAsUnread(w http.ResponseWriter, r *http.Request) {
+	s.setReadStatus(w, r, false)
+}
+
+// setReadStatus sets the read status of the message named by the {id} route
+// variable. Only the recipient may change it; setting the status the message
+// already has is not an error.
+func (s *Server) setReadStatus(w http.ResponseWriter, r *http.Request, read bool) {
 	user, ok := auth.GetUserFromContext(r.Context())
 	if !ok {
 		http.Error(w, "User not found in context", http.StatusInternalServerError)
@@ -432,7 +806,7 @@ func (s *Server) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
 	// Get message to verify ownership
 	message, err := s.messageRepo.GetByID(messageID)
 	if err != nil {
-		log.Printf("Failed to get message: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
 		http.Error(w, "Failed to get message", http.StatusInternalServerError)
 		return
 	}
@@ -448,66 +822,64 @@ func (s *Server) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.messageRepo.MarkAsRead(messageID)
+	if read {
+		err = s.messageRepo.MarkAsRead(messageID)
+	} else {
+		err = s.messageRepo.MarkAsUnread(messageID)
+	}
 	if err != nil {
-		log.Printf("Failed to mark message as read: %v", err)
-		http.Error(w, "Failed to mark message as read", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "failed to update read status", "err", err)
+		http.Error(w, "Failed to update read status", http.StatusInternalServerError)
 		return
 	}
 
+	if message.ReadStatus != read {
+		s.notifyUnreadCount(user.ID)
+		if read {
+			s.sendReadReceipt(r.Context(), message)
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
 // SendMessageRequest represents a request to send a message
 type SendMessageRequest struct {
-	To       string `json:"to"`
-	Subject  string `json:"subject"`
-	Body     string `json:"body"`
-	IsHTML   bool   `json:"is_html"`
-	ThreadID string `json:"thread_id"`
-	ParentID int    `json:"parent_id"`
+	To       Recipients `json:"to"` // One or more addresses
+	ReplyTo  string     `json:"reply_to"`
+	Subject  string     `json:"subject"`
+	Body     string     `json:"body"`
+	IsHTML   bool       `json:"is_html"`
+	ThreadID string     `json:"thread_id"`
+	ParentID int        `json:"parent_id"`
+	// TemplateID optionally fills in an empty subject and body from one of
+	// the sender's templates
+	TemplateID int `json:"template_id"`
+	// RequestReceipt asks local recipients to report when they read it
+	RequestReceipt bool `json:"request_receipt"`
+	// Scheduled stores the message to be sent at ScheduledFor instead of
+	// now
+	Scheduled    bool      `json:"scheduled"`
+	ScheduledFor time.Time `json:"scheduled_for"`
 }
 
-// isValidEmail checks if an email address is valid, allowing localhost domains
+// isValidEmail checks if an email address is well formed. Dotless domains
+// such as localhost are allowed for development setups.
 func isValidEmail(email string) bool {
-	// Must contain exactly one @
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		return false
-	}
-	
-	localPart := parts[0]
-	domain := parts[1]
-	
-	// Local part must not be empty
-	if localPart == "" {
-		return false
-	}
-	
-	// Domain must not be empty
-	if domain == "" {
-		return false
-	}
-	
-	// Allow localhost and localhost-style domains (no dots required)
-	// Also allow regular domains with dots
-	return true // Basic validation passed
+	return compose.ValidAddress(email)
 }
 
 // handleSendMessage handles sending messages with threading and attachment support
 func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	log.Printf("=== SEND MESSAGE REQUEST START ===")
-	log.Printf("Method: %s", r.Method)
-	log.Printf("URL: %s", r.URL.String())
-	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
-	log.Printf("Content-Length: %s", r.Header.Get("Content-Length"))
-	log.Printf("User-Agent: %s", r.Header.Get("User-Agent"))
-	log.Printf("Authorization present: %t", r.Header.Get("Authorization") != "")
-	
+	slog.DebugContext(r.Context(), "send message request",
+		"content_type", r.Header.Get("Content-Type"),
+		"content_length", r.ContentLength,
+		"user_agent", r.UserAgent())
+
 	user, ok := auth.GetUserFromContext(r.Context())
 	if !ok {
-		log.Printf("ERROR: User not found in context")
+		slog.ErrorContext(r.Context(), "user not found in context")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -515,293 +887,355 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 			"error":   "authentication_error",
 			"message": "User not found in context",
 		})
-		log.Printf("=== SEND MESSAGE REQUEST END (AUTH ERROR) ===")
 		return
 	}
-	
-	log.Printf("Authenticated user: %s (ID: %d)", user.Username, user.ID)
 
+	if !s.requireVerifiedEmail(w, r, user.ID) {
+		return
+	}
+	
 	// Check if this is a multipart form (for file uploads) or JSON
 	contentType := r.Header.Get("Content-Type")
-	log.Printf("Detected content type: %s", contentType)
-	
 	if strings.Contains(contentType, "multipart/form-data") {
-		log.Printf("Routing to handleSendMessageWithFiles")
 		s.handleSendMessageWithFiles(w, r, user)
 		return
 	}
 
-	log.Printf("Processing as JSON request")
 	// Set JSON response header
 	w.Header().Set("Content-Type", "application/json")
 
 	// Handle JSON request (backward compatibility)
 	var req SendMessageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("ERROR: Failed to decode JSON: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "invalid_json",
-			"message": fmt.Sprintf("Failed to parse JSON request: %v", err),
-		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE REQUEST END (JSON ERROR) ===")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 	
-	log.Printf("Decoded JSON request: To=%s, Subject=%s, Body length=%d, IsHTML=%t", 
-		req.To, req.Subject, len(req.Body), req.IsHTML)
+	slog.DebugContext(r.Context(), "decoded send request", "user_id", user.ID, "to", req.To, "body_bytes", len(req.Body), "is_html", req.IsHTML)
 
 	// Validation with detailed error messages
-	if req.To == "" {
-		log.Printf("ERROR: Missing recipient")
-		w.WriteHeader(http.StatusBadRequest)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "missing_recipient",
-			"message": "Recipient email address is required",
-		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE REQUEST END (MISSING RECIPIENT) ===")
+	if !validateRecipients(r.Context(), w, req.To) {
 		return
 	}
 
+	if req.TemplateID > 0 {
+		slog.DebugContext(r.Context(), "applying template", "template_id", req.TemplateID)
+		if !s.applyTemplate(w, user, req.TemplateID, req.To, &req.Subject, &req.Body, &req.IsHTML) {
+			return
+		}
+	}
+
 	if req.Subject == "" {
-		log.Printf("ERROR: Missing subject")
+		slog.DebugContext(r.Context(), "send rejected", "reason", "missing_subject")
 		w.WriteHeader(http.StatusBadRequest)
 		response := map[string]interface{}{
 			"success": false,
 			"error":   "missing_subject",
 			"message": "Email subject is required",
 		}
-		log.Printf("Sending error response: %+v", response)
 		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE REQUEST END (MISSING SUBJECT) ===")
 		return
 	}
 
-	// Validate email format
-	if !isValidEmail(req.To) {
-		log.Printf("ERROR: Invalid email format: %s", req.To)
+	if req.ReplyTo != "" && !isValidEmail(req.ReplyTo) {
+		slog.DebugContext(r.Context(), "send rejected", "reason", "invalid_reply_to", "reply_to", req.ReplyTo)
 		w.WriteHeader(http.StatusBadRequest)
 		response := map[string]interface{}{
 			"success": false,
-			"error":   "invalid_email",
-			"message": fmt.Sprintf("Invalid email format: %s", req.To),
+			"error":   "invalid_reply_to",
+			"message": fmt.Sprintf("Invalid reply-to address: %s", req.ReplyTo),
 		}
-		log.Printf("Sending error response: %+v", response)
 		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE REQUEST END (INVALID EMAIL) ===")
 		return
 	}
 
 	// Create from address
 	fromAddress := fmt.Sprintf("%s@%s", user.Username, s.config.ServerHost)
-	log.Printf("From address: %s", fromAddress)
-
-	// Check if recipient is local or external
-	var toUserID *int
-	if strings.Contains(req.To, "@") {
-		parts := strings.Split(req.To, "@")
-		if len(parts) == 2 && parts[1] == s.config.ServerHost {
-			// Local user
-			localUser, err := s.userRepo.GetByUsername(parts[0])
-			if err != nil {
-				log.Printf("ERROR: Failed to lookup local user: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := map[string]interface{}{
-					"success": false,
-					"error":   "user_lookup_failed",
-					"message": fmt.Sprintf("Failed to lookup recipient user: %v", err),
-				}
-				log.Printf("Sending error response: %+v", response)
-				json.NewEncoder(w).Encode(response)
-				log.Printf("=== SEND MESSAGE REQUEST END (USER LOOKUP FAILED) ===")
-				return
-			} else if localUser != nil {
-				toUserID = &localUser.ID
-				log.Printf("Found local recipient: %s (ID: %d)", parts[0], localUser.ID)
-			} else {
-				log.Printf("Local user %s not found, treating as external", parts[0])
-			}
-		} else {
-			log.Printf("External recipient: %s", req.To)
-		}
-	}
+
+	// Sign the message, placing the signature above any quoted text in replies
+	req.Body = s.applyUserSignature(user.ID, req.Body, req.IsHTML, req.ParentID > 0)
+	req.ReplyTo = s.replyAddressFor(user.ID, req.ReplyTo)
 
 	// Prepare threading parameters
 	var threadIDPtr *string
 	var parentIDPtr *int
 	if req.ThreadID != "" {
 		threadIDPtr = &req.ThreadID
-		log.Printf("Thread ID: %s", req.ThreadID)
 	}
 	if req.ParentID > 0 {
 		parentIDPtr = &req.ParentID
-		log.Printf("Parent ID: %d", req.ParentID)
 	}
 
-	// Store message in database with threading support
-	log.Printf("Creating message in database...")
-	message, err := s.messageRepo.CreateWithThreading(&user.ID, toUserID, fromAddress, req.To, req.Subject, req.Body, req.IsHTML, threadIDPtr, parentIDPtr)
-	if err != nil {
-		log.Printf("ERROR: Failed to store message: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "message_creation_failed",
-			"message": fmt.Sprintf("Failed to create message in database: %v", err),
-		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE REQUEST END (DB ERROR) ===")
+	msg := &outgoingMessage{
+		From:           fromAddress,
+		ReplyTo:        req.ReplyTo,
+		Subject:        req.Subject,
+		Body:           req.Body,
+		IsHTML:         req.IsHTML,
+		ThreadID:       threadIDPtr,
+		ParentID:       parentIDPtr,
+		RequestReceipt: req.RequestReceipt,
+	}
+	if req.Scheduled {
+		s.scheduleToRecipients(r.Context(), w, user, msg, req.To, req.ScheduledFor, nil)
 		return
 	}
-	
-	log.Printf("Message created successfully with ID: %d", message.ID)
-
-	// Notify SSE clients if it's a local message
-	if toUserID != nil {
-		log.Printf("Notifying SSE clients for local message")
-		go s.notifyNewMessage(message)
-	}
-
-	// If external recipient, try federation
-	federationError := ""
-	if toUserID == nil && strings.Contains(req.To, "@") {
-		parts := strings.Split(req.To, "@")
-		if len(parts) == 2 {
-			log.Printf("Attempting federation to %s", parts[1])
-			err := s.relay.SendMessage(fromAddress, req.To, req.Subject, req.Body, parts[1])
-			if err != nil {
-				federationError = fmt.Sprintf("Federation to %s failed: %v", parts[1], err)
-				log.Printf("WARNING: %s", federationError)
-				// Don't fail the whole request - message is stored locally
-			} else {
-				log.Printf("Federation successful to %s", parts[1])
-			}
-		}
+
+	// Store a copy for each recipient and deliver it
+	result, ok := s.sendToRecipients(r.Context(), w, user, msg, req.To)
+	if !ok {
+		return
 	}
 
 	// Prepare response
 	response := map[string]interface{}{
-		"success": true,
-		"message": "Message sent successfully",
-		"id":      message.ID,
+		"success":    true,
+		"message":    "Message sent successfully",
+		"id":         result.FirstID,
+		"recipients": result.Recipients,
 	}
 
-	// Include federation warning if there was an issue
-	if federationError != "" {
-		response["warnings"] = []string{federationError}
+	// Include warnings for recipients that failed
+	if len(result.Warnings) > 0 {
+		response["warnings"] = result.Warnings
 	}
 
-	log.Printf("Sending success response: %+v", response)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
-	log.Printf("=== SEND MESSAGE REQUEST END (SUCCESS) ===")
 }
 
-// handleSendMessageWithFiles handles sending messages with file attachments
-func (s *Server) handleSendMessageWithFiles(w http.ResponseWriter, r *http.Request, user *auth.AuthUser) {
-	log.Printf("=== SEND MESSAGE WITH FILES REQUEST START ===")
-	log.Printf("Handling multipart form upload for user %s (ID: %d)", user.Username, user.ID)
-	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
-	log.Printf("Content-Length: %s", r.Header.Get("Content-Length"))
-	
-	// Ensure all responses are JSON
-	w.Header().Set("Content-Type", "application/json")
-	
-	// Parse multipart form for file uploads
-	log.Printf("Parsing multipart form (max 50MB)...")
-	err := r.ParseMultipartForm(50 << 20) // 50MB max memory
+// lookupLocalRecipient returns the user ID of a recipient hosted on this
+// server, or nil if the address is external or names an unknown local user
+func (s *Server) lookupLocalRecipient(ctx context.Context, to string) (*int, error) {
+	parts := strings.Split(to, "@")
+	if len(parts) != 2 || !strings.EqualFold(parts[1], s.config.ServerHost) {
+		slog.DebugContext(ctx, "external recipient", "to", to)
+		return nil, nil
+	}
+
+	localUser, err := s.userRepo.GetByUsername(parts[0])
 	if err != nil {
-		log.Printf("ERROR: Failed to parse multipart form: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "failed_to_parse_form",
-			"message": fmt.Sprintf("Failed to parse multipart form: %v", err),
-		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (FORM PARSE ERROR) ===")
-		return
+		return nil, err
+	}
+	if localUser == nil {
+		slog.DebugContext(ctx, "local user not found, treating as external", "to", to)
+		return nil, nil
 	}
-	
-	log.Printf("Multipart form parsed successfully")
 
-	// Extract form fields
-	to := r.FormValue("to")
-	subject := r.FormValue("subject")
-	body := r.FormValue("body")
-	isHTMLStr := r.FormValue("is_html")
-	isHTML := isHTMLStr == "true"
-	threadID := r.FormValue("thread_id")
-	parentIDStr := r.FormValue("parent_id")
+	slog.DebugContext(ctx, "local recipient", "to", to, "user_id", localUser.ID)
+	return &localUser.ID, nil
+}
 
-	log.Printf("Form values extracted:")
-	log.Printf("  to: '%s'", to)
-	log.Printf("  subject: '%s'", subject)
-	log.Printf("  body length: %d", len(body))
-	log.Printf("  body preview: '%.100s%s'", body, func() string { if len(body) > 100 { return "..." } else { return "" } }())
-	log.Printf("  is_html (raw): '%s'", isHTMLStr)
-	log.Printf("  is_html (parsed): %t", isHTML)
-	log.Printf("  thread_id: '%s'", threadID)
-	log.Printf("  parent_id: '%s'", parentIDStr)
-
-	// Count available files
-	fileCount := 0
-	if r.MultipartForm != nil && r.MultipartForm.File != nil {
-		if files, exists := r.MultipartForm.File["attachments"]; exists {
-			fileCount = len(files)
+// deliverMessage hands a stored message to its recipient: local recipients
+// are notified over SSE and external ones are relayed via federation. The
+// outcome is recorded as the message's delivery status. If federation
+// fails the sender gets a bounce and a warning is returned; the message
+// stays stored locally. Mail for a server known to be down is left pending
+// and retried by retryPending when the server is back, until it is older
+// than FEDERATION_PENDING_MAX_AGE and bounces. Mail for a server the relay
+// has given up on bounces straight away.
+func (s *Server) deliverMessage(ctx context.Context, message *database.Message) string {
+	if message.ToUserID != nil {
+		s.recordDelivery(ctx, message, database.DeliveryLocal, "")
+		s.enforceInboxLimit(ctx, *message.ToUserID)
+		if !s.quarantineIfSpam(ctx, message, false) {
+			go s.notifyNewMessage(message)
 		}
+		return ""
 	}
-	log.Printf("  attachments count: %d", fileCount)
 
-	// Validation with detailed error messages
-	if to == "" {
-		log.Printf("ERROR: Missing required field: to")
-		w.WriteHeader(http.StatusBadRequest)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "missing_recipient",
-			"message": "Recipient email address is required",
+	parts := strings.Split(message.ToAddress, "@")
+	if len(parts) != 2 {
+		return ""
+	}
+
+	slog.DebugContext(ctx, "relaying message", "id", message.ID, "host", parts[1])
+	attachments, err := s.federationAttachments(message)
+	if err == nil {
+		// The relay finishes even if the sending client hangs up meanwhile
+		err = s.relay.DeliverContext(context.WithoutCancel(ctx), federation.Message{
+			From:        message.FromAddress,
+			To:          message.ToAddress,
+			ReplyTo:     message.ReplyTo,
+			Subject:     message.Subject,
+			Body:        message.Body,
+			IsHTML:      message.IsHTML,
+			Timestamp:   message.CreatedAt, // Not the time of a retry
+			MessageID:   message.MessageID,
+			InReplyTo:   message.InReplyTo,
+			References:  strings.Fields(message.References),
+			Attachments: attachments,
+		}, parts[1])
+	}
+	if errors.Is(err, federation.ErrPeerUnreachable) {
+		if s.pendingExpired(message) {
+			// Record it as pending first so failPending can claim it
+			s.recordDelivery(ctx, message, database.DeliveryPending, err.Error())
+			s.failPending(ctx, message, fmt.Sprintf("The recipient's server could not be reached for %s", s.config.FederationPendingMaxAge))
+			return fmt.Sprintf("Delivery to %s failed: the server has been unreachable too long", parts[1])
+		}
+		slog.InfoContext(ctx, "federation deferred", "id", message.ID, "host", parts[1])
+		s.recordDelivery(ctx, message, database.DeliveryPending, err.Error())
+		return fmt.Sprintf("Delivery to %s is delayed: the server is unreachable, will retry", parts[1])
+	}
+	if err != nil {
+		federationError := fmt.Sprintf("Federation to %s failed: %v", parts[1], err)
+		slog.WarnContext(ctx, "federation failed", "id", message.ID, "host", parts[1], "err", err)
+		s.recordDelivery(ctx, message, database.DeliveryFailed, err.Error())
+		s.sendBounce(ctx, message, err.Error())
+		return federationError
+	}
+
+	slog.InfoContext(ctx, "message relayed", "id", message.ID, "host", parts[1])
+	s.recordDelivery(ctx, message, database.DeliveryDelivered, "")
+	return ""
+}
+
+// retryPending delivers the messages left pending for host's server
+func (s *Server) retryPending(host string) {
+	ctx := context.Background()
+	messages, err := s.messageRepo.GetPendingForHost(host)
+	if err != nil {
+		slog.Error("failed to get pending messages", "host", host, "err", err)
+		return
+	}
+	if len(messages) > 0 {
+		slog.Info("retrying pending messages", "host", host, "count", len(messages))
+	}
+	for _, message := range messages {
+		s.deliverMessage(ctx, message)
+	}
+}
+
+// recordDelivery stores a message's delivery status, logging rather than
+// failing if it cannot be saved since the message itself was handled
+func (s *Server) recordDelivery(ctx context.Context, message *database.Message, status, deliveryError string) {
+	if err := s.messageRepo.SetDeliveryStatus(message.ID, status, deliveryError); err != nil {
+		slog.ErrorContext(ctx, "failed to record delivery status", "message_id", message.ID, "err", err)
+		return
+	}
+	message.DeliveryStatus = status
+	message.DeliveryError = deliveryError
+}
+
+// enforceInboxLimit evicts the oldest unflagged messages from a local
+// recipient's mailbox when it exceeds the configured MAX_INBOX_MESSAGES
+func (s *Server) enforceInboxLimit(ctx context.Context, userID int) {
+	if s.config.MaxInboxMessages <= 0 {
+		return
+	}
+
+	evicted, err := s.messageRepo.EnforceInboxLimit(userID, s.config.MaxInboxMessages)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to enforce inbox limit", "user_id", userID, "err", err)
+		return
+	}
+	if evicted > 0 {
+		slog.InfoContext(ctx, "evicted old messages", "user_id", userID, "count", evicted)
+	}
+}
+
+// multipartOverhead is how much a multipart send may exceed
+// MaxAttachmentBytes, for its text fields and part headers
+const multipartOverhead = 1 << 20
+
+// handleSendMessageWithFiles handles sending messages with file attachments
+func (s *Server) handleSendMessageWithFiles(w http.ResponseWriter, r *http.Request, user *auth.AuthUser) {
+	// Ensure all responses are JSON
+	w.Header().Set("Content-Type", "application/json")
+	
+	// Parse multipart form for file uploads. The upload may hold one
+	// attachment of the largest size allowed, plus the other form fields.
+	limit := s.config.MaxAttachmentBytes + multipartOverhead
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	err := r.ParseMultipartForm(limit)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		slog.DebugContext(r.Context(), "send rejected", "reason", "request_too_large", "limit", limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "request_too_large",
+			"message": fmt.Sprintf("Upload is larger than %d bytes", limit),
+		})
+		return
+	}
+	if err != nil {
+		slog.DebugContext(r.Context(), "send rejected", "reason", "failed_to_parse_form", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]interface{}{
+			"success": false,
+			"error":   "failed_to_parse_form",
+			"message": fmt.Sprintf("Failed to parse multipart form: %v", err),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
+
+	// Extract form fields. Recipients may be repeated "to" fields, each
+	// holding one or more comma-separated addresses.
+	var to []string
+	for _, list := range r.MultipartForm.Value["to"] {
+		to = append(to, compose.SplitRecipients(list)...)
+	}
+	to = compose.UniqueRecipients(to)
+	replyTo := r.FormValue("reply_to")
+	subject := r.FormValue("subject")
+	body := r.FormValue("body")
+	isHTMLStr := r.FormValue("is_html")
+	isHTML := isHTMLStr == "true"
+	threadID := r.FormValue("thread_id")
+	parentIDStr := r.FormValue("parent_id")
+	requestReceipt := r.FormValue("request_receipt") == "true"
+
+	slog.DebugContext(r.Context(), "decoded send request", "user_id", user.ID, "to", to, "body_bytes", len(body), "is_html", isHTML,
+		"attachments", len(r.MultipartForm.File["attachments"]))
+
+	// Validation with detailed error messages
+	if !validateRecipients(r.Context(), w, to) {
+		return
+	}
+
+	templateID, err := parseTemplateID(r.FormValue("template_id"))
+	if err != nil {
+		slog.DebugContext(r.Context(), "send rejected", "reason", "invalid_template", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]interface{}{
+			"success": false,
+			"error":   "invalid_template",
+			"message": err.Error(),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if templateID > 0 {
+		slog.DebugContext(r.Context(), "applying template", "template_id", templateID)
+		if !s.applyTemplate(w, user, templateID, to, &subject, &body, &isHTML) {
+			return
 		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (MISSING TO) ===")
-		return
 	}
 
 	if subject == "" {
-		log.Printf("ERROR: Missing required field: subject")
+		slog.DebugContext(r.Context(), "send rejected", "reason", "missing_subject")
 		w.WriteHeader(http.StatusBadRequest)
 		response := map[string]interface{}{
 			"success": false,
 			"error":   "missing_subject",
 			"message": "Email subject is required",
 		}
-		log.Printf("Sending error response: %+v", response)
 		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (MISSING SUBJECT) ===")
 		return
 	}
 
-	// Validate email format
-	if !isValidEmail(to) {
-		log.Printf("ERROR: Invalid email format: %s", to)
+	if replyTo != "" && !isValidEmail(replyTo) {
+		slog.DebugContext(r.Context(), "send rejected", "reason", "invalid_reply_to", "reply_to", replyTo)
 		w.WriteHeader(http.StatusBadRequest)
 		response := map[string]interface{}{
 			"success": false,
-			"error":   "invalid_email",
-			"message": fmt.Sprintf("Invalid email format: %s", to),
+			"error":   "invalid_reply_to",
+			"message": fmt.Sprintf("Invalid reply-to address: %s", replyTo),
 		}
-		log.Printf("Sending error response: %+v", response)
 		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (INVALID EMAIL) ===")
 		return
 	}
 
@@ -810,18 +1244,15 @@ func (s *Server) handleSendMessageWithFiles(w http.ResponseWriter, r *http.Reque
 	if parentIDStr != "" {
 		if pid, err := strconv.Atoi(parentIDStr); err == nil {
 			parentID = &pid
-			log.Printf("Parsed parent ID: %d", pid)
 		} else {
-			log.Printf("ERROR: Invalid parent ID format: %s", parentIDStr)
+			slog.DebugContext(r.Context(), "send rejected", "reason", "invalid_parent_id", "parent_id", parentIDStr)
 			w.WriteHeader(http.StatusBadRequest)
 			response := map[string]interface{}{
 				"success": false,
 				"error":   "invalid_parent_id",
 				"message": fmt.Sprintf("Invalid parent ID format: %s", parentIDStr),
 			}
-			log.Printf("Sending error response: %+v", response)
 			json.NewEncoder(w).Encode(response)
-			log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (INVALID PARENT ID) ===")
 			return
 		}
 	}
@@ -830,214 +1261,162 @@ func (s *Server) handleSendMessageWithFiles(w http.ResponseWriter, r *http.Reque
 	var threadIDPtr *string
 	if threadID != "" {
 		threadIDPtr = &threadID
-		log.Printf("Thread ID: %s", threadID)
 	}
 
 	// Create from address
 	fromAddress := fmt.Sprintf("%s@%s", user.Username, s.config.ServerHost)
-	log.Printf("From address: %s -> To address: %s", fromAddress, to)
-
-	// Check if recipient is local or external
-	var toUserID *int
-	if strings.Contains(to, "@") {
-		parts := strings.Split(to, "@")
-		if len(parts) == 2 && parts[1] == s.config.ServerHost {
-			// Local user
-			log.Printf("Looking up local user: %s", parts[0])
-			localUser, err := s.userRepo.GetByUsername(parts[0])
-			if err != nil {
-				log.Printf("ERROR: Failed to lookup local user: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := map[string]interface{}{
-					"success": false,
-					"error":   "user_lookup_failed",
-					"message": fmt.Sprintf("Failed to lookup recipient user: %v", err),
-				}
-				log.Printf("Sending error response: %+v", response)
-				json.NewEncoder(w).Encode(response)
-				log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (USER LOOKUP FAILED) ===")
-				return
-			} else if localUser != nil {
-				toUserID = &localUser.ID
-				log.Printf("Found local user %s with ID %d", parts[0], localUser.ID)
-			} else {
-				log.Printf("Local user %s not found, treating as external", parts[0])
-			}
-		} else {
-			log.Printf("External recipient: %s (host: %s)", to, parts[1])
-		}
-	}
 
-	// Store message in database with threading support
-	log.Printf("Creating message with threading support...")
-	message, err := s.messageRepo.CreateWithThreading(&user.ID, toUserID, fromAddress, to, subject, body, isHTML, threadIDPtr, parentID)
-	if err != nil {
-		log.Printf("ERROR: Failed to store message: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		response := map[string]interface{}{
-			"success": false,
-			"error":   "message_creation_failed",
-			"message": fmt.Sprintf("Failed to create message in database: %v", err),
-		}
-		log.Printf("Sending error response: %+v", response)
-		json.NewEncoder(w).Encode(response)
-		log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (DB ERROR) ===")
-		return
-	}
-	log.Printf("Message created successfully with ID: %d", message.ID)
+	// Sign the message, placing the signature above any quoted text in replies
+	body = s.applyUserSignature(user.ID, body, isHTML, parentID != nil)
+	replyTo = s.replyAddressFor(user.ID, replyTo)
 
-	// Handle file attachments
-	attachmentCount := 0
+	// Read and check attachments up front, since every recipient's copy
+	// gets the same files
+	var attachments []pendingAttachment
 	attachmentErrors := []string{}
-	if files := r.MultipartForm.File["attachments"]; len(files) > 0 {
-		log.Printf("Processing %d file attachments", len(files))
-		for i, fileHeader := range files {
-			log.Printf("Processing attachment %d: %s (%d bytes)", i+1, fileHeader.Filename, fileHeader.Size)
-			
-			// Check file size limit (50MB)
-			if fileHeader.Size > 50*1024*1024 {
-				errorMsg := fmt.Sprintf("File %s is too large (%d bytes, max 50MB)", fileHeader.Filename, fileHeader.Size)
-				log.Printf("WARNING: %s", errorMsg)
-				attachmentErrors = append(attachmentErrors, errorMsg)
-				continue
-			}
-			
-			// Open uploaded file
-			file, err := fileHeader.Open()
-			if err != nil {
-				errorMsg := fmt.Sprintf("Failed to open file %s: %v", fileHeader.Filename, err)
-				log.Printf("WARNING: %s", errorMsg)
-				attachmentErrors = append(attachmentErrors, errorMsg)
-				continue
-			}
-			defer file.Close()
-
-			// Read file content
-			fileData, err := io.ReadAll(file)
-			if err != nil {
-				errorMsg := fmt.Sprintf("Failed to read file %s: %v", fileHeader.Filename, err)
-				log.Printf("WARNING: %s", errorMsg)
-				attachmentErrors = append(attachmentErrors, errorMsg)
-				continue
-			}
-
-			// Generate unique filename
-			filename := fmt.Sprintf("%d_%s", time.Now().Unix(), fileHeader.Filename)
-			contentType := fileHeader.Header.Get("Content-Type")
-			if contentType == "" {
-				contentType = "application/octet-stream"
-			}
-			
-			log.Printf("Storing attachment: %s (original: %s, type: %s, size: %d)", 
-				filename, fileHeader.Filename, contentType, len(fileData))
-			
-			// Store attachment in database
-			attachment, err := s.attachmentRepo.Create(
-				message.ID,
-				filename,
-				fileHeader.Filename,
-				contentType,
-				int64(len(fileData)),
-				nil, // file_path (we store in DB for now)
-				fileData,
-			)
-			if err != nil {
-				errorMsg := fmt.Sprintf("Failed to store attachment %s: %v", fileHeader.Filename, err)
-				log.Printf("WARNING: %s", errorMsg)
-				attachmentErrors = append(attachmentErrors, errorMsg)
-			} else {
-				log.Printf("Attachment stored successfully with ID: %d", attachment.ID)
-				attachmentCount++
-			}
+	// An HTML body shows a file inline by referring to its content ID,
+	// given in the file part's Content-ID header or in the content_ids
+	// field at the same position as the file
+	contentIDs := r.MultipartForm.Value["content_ids"]
+	for i, fileHeader := range r.MultipartForm.File["attachments"] {
+		attachment, errorMsg := s.readAttachment(fileHeader)
+		if errorMsg != "" {
+			slog.WarnContext(r.Context(), "attachment rejected", "file", fileHeader.Filename, "reason", errorMsg)
+			attachmentErrors = append(attachmentErrors, errorMsg)
+			continue
 		}
-	}
-	log.Printf("Successfully processed %d attachments (errors: %d)", attachmentCount, len(attachmentErrors))
-
-	// Notify SSE clients if it's a local message
-	if toUserID != nil {
-		log.Printf("Notifying SSE clients for local message")
-		go s.notifyNewMessage(message)
-	}
-
-	// If external recipient, try federation
-	federationError := ""
-	if toUserID == nil && strings.Contains(to, "@") {
-		parts := strings.Split(to, "@")
-		if len(parts) == 2 {
-			log.Printf("Attempting federation to %s", parts[1])
-			err := s.relay.SendMessage(fromAddress, to, subject, body, parts[1])
-			if err != nil {
-				federationError = fmt.Sprintf("Federation to %s failed: %v", parts[1], err)
-				log.Printf("WARNING: %s", federationError)
-				// Don't fail the whole request - message is stored locally
-			} else {
-				log.Printf("Federation successful to %s", parts[1])
-			}
+		attachment.ContentID = compose.ContentID(fileHeader.Header.Get("Content-ID"))
+		if i < len(contentIDs) && contentIDs[i] != "" {
+			attachment.ContentID = compose.ContentID(contentIDs[i])
 		}
+		attachments = append(attachments, *attachment)
+	}
+	attachments, scanErrors := s.scanAttachments(r.Context(), attachments)
+	attachmentErrors = append(attachmentErrors, scanErrors...)
+
+	msg := &outgoingMessage{
+		From:           fromAddress,
+		ReplyTo:        replyTo,
+		Subject:        subject,
+		Body:           body,
+		IsHTML:         isHTML,
+		ThreadID:       threadIDPtr,
+		ParentID:       parentID,
+		Attachments:    attachments,
+		RequestReceipt: requestReceipt,
+	}
+	if r.FormValue("scheduled") == "true" {
+		// An unparseable time is zero, which is rejected as not in the future
+		scheduledFor, _ := time.Parse(time.RFC3339, r.FormValue("scheduled_for"))
+		s.scheduleToRecipients(r.Context(), w, user, msg, to, scheduledFor, attachmentErrors)
+		return
+	}
+
+	// Store a copy for each recipient and deliver it
+	result, ok := s.sendToRecipients(r.Context(), w, user, msg, to)
+	if !ok {
+		return
 	}
 
-	log.Printf("Message sent successfully - ID: %d, attachments: %d", message.ID, attachmentCount)
-	
 	// Prepare response with detailed information
 	response := map[string]interface{}{
 		"success":    true,
 		"message":    "Message sent successfully",
-		"id":         message.ID,
+		"id":         result.FirstID,
+		"recipients": result.Recipients,
 		"attachments": map[string]interface{}{
-			"processed": attachmentCount,
+			"processed": result.Attachments,
 			"total":     len(r.MultipartForm.File["attachments"]),
 		},
 	}
 
-	// Include warnings if there were attachment errors
-	if len(attachmentErrors) > 0 {
-		response["warnings"] = attachmentErrors
-		log.Printf("Including %d attachment warnings", len(attachmentErrors))
-	}
-
-	// Include federation warning if there was an issue
-	if federationError != "" {
-		if response["warnings"] == nil {
-			response["warnings"] = []string{}
-		}
-		response["warnings"] = append(response["warnings"].([]string), federationError)
-		log.Printf("Including federation warning")
+	// Include warnings for rejected attachments and failed recipients
+	warnings := append(attachmentErrors, result.Warnings...)
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
 	}
 
-	log.Printf("Sending success response: %+v", response)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
-	log.Printf("=== SEND MESSAGE WITH FILES REQUEST END (SUCCESS) ===")
+}
+
+// readAttachment reads an uploaded file and checks it against the size and
+// type limits. If the file cannot be used it returns a message explaining
+// why instead.
+func (s *Server) readAttachment(fileHeader *multipart.FileHeader) (*pendingAttachment, string) {
+	// Check file size limit
+	if fileHeader.Size > s.config.MaxAttachmentBytes {
+		return nil, fmt.Sprintf("File %s is too large (%d bytes, max %d bytes)", fileHeader.Filename, fileHeader.Size, s.config.MaxAttachmentBytes)
+	}
+
+	// Open uploaded file
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fmt.Sprintf("Failed to open file %s: %v", fileHeader.Filename, err)
+	}
+	defer file.Close()
+
+	// Read file content
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Sprintf("Failed to read file %s: %v", fileHeader.Filename, err)
+	}
+
+	contentType := fileHeader.Header.Get("Content-Type")
+	if err := s.checkAttachmentType(contentType, fileData); err != nil {
+		return nil, fmt.Sprintf("File %s rejected: %v", fileHeader.Filename, err)
+	}
+
+	return &pendingAttachment{
+		// Generate unique filename
+		Filename:         fmt.Sprintf("%d_%s", time.Now().Unix(), fileHeader.Filename),
+		OriginalFilename: fileHeader.Filename,
+		ContentType:      compose.AttachmentContentType(contentType, fileData),
+		Data:             fileData,
+	}, ""
 }
 
 // handleFederationRelay handles incoming federation messages
 func (s *Server) handleFederationRelay(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.FederationMaxMessageBytes)
 	var msg federation.Message
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+	if !decodeJSON(w, r, &msg) {
+		return
+	}
+
+	// Find recipient user
+	to, err := compose.NormalizeAddress(msg.To)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "invalid_json",
-			"message": fmt.Sprintf("Failed to parse JSON request: %v", err),
+			"error":   "invalid_recipient_format",
+			"message": "Invalid recipient format",
 		})
 		return
 	}
+	msg.To = to
 
-	// Find recipient user
-	if !strings.Contains(msg.To, "@") {
+	from, err := compose.NormalizeAddress(msg.From)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "invalid_recipient_format",
-			"message": "Invalid recipient format",
+			"error":   "invalid_sender_format",
+			"message": "Invalid sender format",
 		})
 		return
 	}
+	msg.From = from
+
+	// The sending server is up; track it with the other peers
+	_, fromHost, _ := strings.Cut(msg.From, "@")
+	s.relay.NotePeer(fromHost)
 
 	parts := strings.Split(msg.To, "@")
-	if len(parts) != 2 || parts[1] != s.config.ServerHost {
+	if len(parts) != 2 || !strings.EqualFold(parts[1], s.config.ServerHost) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -1049,7 +1428,7 @@ func (s *Server) handleFederationRelay(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.userRepo.GetByUsername(parts[0])
 	if err != nil {
-		log.Printf("Failed to lookup user: %v", err)
+		slog.ErrorContext(r.Context(), "failed to lookup user", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -1069,10 +1448,72 @@ func (s *Server) handleFederationRelay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Store message
-	_, err = s.messageRepo.Create(nil, &user.ID, msg.From, msg.To, msg.Subject, msg.Body)
+	// Keep only well-formed threading headers; a missing Message-ID is
+	// generated when the message is stored
+	headers := database.MessageHeaders{
+		MessageID:  compose.ParseMessageID(msg.MessageID),
+		InReplyTo:  compose.ParseMessageID(msg.InReplyTo),
+		References: strings.Join(compose.ParseMessageIDs(strings.Join(msg.References, " ")), " "),
+	}
+
+	// A peer retrying a relay we already stored gets the same answer again
+	if headers.MessageID != "" {
+		duplicate, err := s.messageRepo.HasReceived(user.ID, headers.MessageID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to check for duplicate message", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "message_storage_failed",
+				"message": fmt.Sprintf("Failed to store message: %v", err),
+			})
+			return
+		}
+		if duplicate {
+			slog.InfoContext(r.Context(), "ignoring duplicate federated message", "message_id", headers.MessageID, "user_id", user.ID)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"status":  "already_delivered",
+			})
+			return
+		}
+	}
+
+	attachments, ok := s.receiveFederatedAttachments(r.Context(), w, &msg, fromHost)
+	if !ok {
+		return
+	}
+
+	size := int64(len(msg.Body))
+	for _, a := range attachments {
+		size += int64(len(a.Data))
+	}
+	if !s.checkRecipientQuota(r.Context(), w, &user.ID, msg.To, size) {
+		return
+	}
+
+	// Drop mail from blocked senders without telling the other server
+	if s.senderBlocked(r.Context(), &user.ID, msg.From) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"status":  "delivered",
+		})
+		return
+	}
+
+	// Drop a malformed Reply-To rather than rejecting the message
+	if msg.ReplyTo != "" && !isValidEmail(msg.ReplyTo) {
+		slog.WarnContext(r.Context(), "ignoring invalid federated reply-to address", "reply_to", msg.ReplyTo)
+		msg.ReplyTo = ""
+	}
+
+	// Store message, threaded with the one it replies to if we have it. An
+	// HTML body is sanitized as it is stored, like local mail.
+	stored, err := s.messageRepo.CreateReceived(user.ID, msg.From, msg.To, msg.ReplyTo, msg.Subject, msg.Body, msg.IsHTML, headers)
 	if err != nil {
-		log.Printf("Failed to store federated message: %v", err)
+		slog.ErrorContext(r.Context(), "failed to store federated message", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -1082,21 +1523,19 @@ func (s *Server) handleFederationRelay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Notify SSE clients about the new federated message
-	go func() {
-		// Create a message object for notification
-		newMsg := &database.Message{
-			FromUserID:  nil,
-			ToUserID:    &user.ID,
-			FromAddress: msg.From,
-			ToAddress:   msg.To,
-			Subject:     msg.Subject,
-			Body:        msg.Body,
-			ReadStatus:  false,
-			CreatedAt:   time.Now(),
+	for _, a := range attachments {
+		if _, err := s.attachmentRepo.Create(stored.ID, a.Filename, a.OriginalFilename, a.ContentType, a.ContentID, int64(len(a.Data)), nil, a.Data); err != nil {
+			slog.ErrorContext(r.Context(), "failed to store federated attachment", "message_id", stored.ID, "file", a.OriginalFilename, "err", err)
 		}
-		s.notifyNewMessage(newMsg)
-	}()
+	}
+
+	s.enforceInboxLimit(r.Context(), user.ID)
+
+	// Notify SSE clients about the new federated message, unless it was
+	// taken for spam
+	if !s.quarantineIfSpam(r.Context(), stored, true) {
+		go s.notifyNewMessage(stored)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1105,20 +1544,116 @@ func (s *Server) handleFederationRelay(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleHealth returns server health status
+// healthCheckTimeout bounds how long the health check waits for the
+// database, so a hung database fails the check instead of stalling it
+const healthCheckTimeout = 2 * time.Second
+
+// handleHealth reports whether the server can serve requests: the database
+// must answer, or the check fails with 503. With ?deep=true it also probes
+// every known federation peer.
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	health := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"version":   "2.0.0",
+	health := HealthResponse{
+		Status:    "healthy",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Version:   apiVersion,
+		Checks:    map[string]string{},
+	}
+	status := http.StatusOK
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := s.db.CheckHealth(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "health check failed", "subsystem", "database", "err", err)
+		health.Status = "unhealthy"
+		health.Checks["database"] = "unreachable"
+		health.Failed = append(health.Failed, "database")
+		status = http.StatusServiceUnavailable
+	} else {
+		health.Checks["database"] = "ok"
+	}
+
+	// Unreachable peers only delay mail to them, so they degrade the
+	// server without taking it out of rotation
+	if r.URL.Query().Get("deep") == "true" {
+		down := 0
+		peers := s.relay.ProbePeers(r.Context(), s.config.FederationProbeTimeout)
+		for _, p := range peers {
+			if !p.Reachable {
+				down++
+			}
+		}
+		if down == 0 {
+			health.Checks["federation"] = "ok"
+		} else {
+			health.Checks["federation"] = fmt.Sprintf("%d of %d peers unreachable", down, len(peers))
+			health.Failed = append(health.Failed, "federation")
+			if health.Status == "healthy" {
+				health.Status = "degraded"
+			}
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(health)
 }
 
+// SetReady marks whether the server should be sent traffic. It is set once
+// startup has finished and cleared when shutdown begins.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// handleLivez reports that the process is up. It checks nothing else, so a
+// busy server isn't restarted for being slow.
+func (s *Server) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProbeResponse{Status: "alive"})
+}
+
+// handleReadyz reports whether the server should be sent traffic: startup
+// must have finished and the database must answer. Otherwise it responds
+// with 503.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ProbeResponse{Status: "not ready", Reason: "starting up or shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := s.db.CheckHealth(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "readiness check failed", "subsystem", "database", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ProbeResponse{Status: "not ready", Reason: "database unreachable"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(ProbeResponse{Status: "ready"})
+}
+
+// metricsAuth lets requests through to next only if they carry the
+// configured metrics token or, without one, come from an admin
+func (s *Server) metricsAuth(next http.HandlerFunc) http.HandlerFunc {
+	if s.config.MetricsToken == "" {
+		return s.jwtService.AdminMiddleware(next)
+	}
+	want := []byte("Bearer " + s.config.MetricsToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "Metrics token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // cleanupSSEClients manages SSE client connections and removes dead ones
-func (s *Server) cleanupSSEClients() {
+// until ctx is cancelled
+func (s *Server) cleanupSSEClients(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -1128,45 +1663,74 @@ func (s *Server) cleanupSSEClients() {
 			s.pingSSEClients()
 		case client := <-s.sseCloseChan:
 			s.removeSSEClient(client)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// pingSSEClients sends ping messages to keep connections alive
-func (s *Server) pingSSEClients() {
+// closeSSEClient asks the cleanup goroutine to remove a client. It never
+// blocks; requests made after ShutdownSSE are dropped since every client has
+// already been closed.
+func (s *Server) closeSSEClient(client *SSEClient) {
+	select {
+	case s.sseCloseChan <- client:
+	case <-s.sseCtx.Done():
+	default:
+		go func() {
+			select {
+			case s.sseCloseChan <- client:
+			case <-s.sseCtx.Done():
+			}
+		}()
+	}
+}
+
+// ShutdownSSE stops accepting SSE connections, disconnects every client and
+// stops the cleanup goroutine. It is safe to call more than once.
+func (s *Server) ShutdownSSE() {
 	s.sseMutex.Lock()
-	defer s.sseMutex.Unlock()
+	if s.sseClosed {
+		s.sseMutex.Unlock()
+		return
+	}
+	s.sseClosed = true
 
+	count := 0
 	for userID, clients := range s.sseClients {
-		var activeClients []*SSEClient
 		for _, client := range clients {
-			// Send ping
-			if s.sendSSEPing(client) {
-				activeClients = append(activeClients, client)
-			}
-		}
-		s.sseClients[userID] = activeClients
-		if len(activeClients) == 0 {
-			delete(s.sseClients, userID)
+			client.closeOnce.Do(func() { close(client.done) })
+			count++
 		}
+		delete(s.sseClients, userID)
 	}
+	s.sseMutex.Unlock()
+
+	s.sseCancel()
+	slog.Info("SSE shut down", "clients", count)
 }
 
-// sendSSEPing sends a ping message to an SSE client
-func (s *Server) sendSSEPing(client *SSEClient) bool {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("SSE ping failed for user %d: %v", client.userID, r)
-		}
-	}()
+// pingSSEClients queues a ping to keep every SSE connection alive. Like any
+// other event the ping is written by the client's handler goroutine, so it
+// never interleaves with an event; clients whose connection has gone away
+// fail the write and are removed.
+func (s *Server) pingSSEClients() {
+	s.sseMutex.RLock()
+	var clients []*SSEClient
+	for _, userClients := range s.sseClients {
+		clients = append(clients, userClients...)
+	}
+	s.sseMutex.RUnlock()
 
-	_, err := fmt.Fprintf(client.writer, ": ping\n\n")
-	if err != nil {
-		return false
+	for _, client := range clients {
+		client.queueMu.Lock()
+		select {
+		case client.events <- sseEvent{}:
+		default:
+			// The client has events waiting, which keep it alive anyway
+		}
+		client.queueMu.Unlock()
 	}
-	client.flusher.Flush()
-	client.lastPing = time.Now()
-	return true
 }
 
 // removeSSEClient removes a client from the SSE client list
@@ -1187,12 +1751,22 @@ func (s *Server) removeSSEClient(client *SSEClient) {
 		delete(s.sseClients, client.userID)
 	}
 
-	// Close client's done channel
-	close(client.done)
+	// Close client's done channel (a client may be removed more than once,
+	// e.g. after a buffer overflow and again on disconnect)
+	client.closeOnce.Do(func() { close(client.done) })
 }
 
 // handleSSEInbox handles Server-Sent Events for inbox updates
 func (s *Server) handleSSEInbox(w http.ResponseWriter, r *http.Request) {
+	// The token in the URL lets any page open the stream, so browsers on
+	// other origins are turned away here rather than only by CORS. Requests
+	// without an Origin come from the same origin or from outside a browser.
+	if origin := r.Header.Get("Origin"); origin != "" && !s.originAllowed(origin) {
+		slog.DebugContext(r.Context(), "sse origin rejected", "origin", origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
 	// Get token from query parameter (since EventSource can't send custom headers)
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -1206,6 +1780,21 @@ func (s *Server) handleSSEInbox(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
+	if !(&auth.AuthUser{Scopes: claims.Scopes}).HasScope(auth.ScopeRead) {
+		http.Error(w, "Token lacks the messages:read scope", http.StatusForbidden)
+		return
+	}
+
+	active, err := s.userRepo.IsActive(claims.UserID, claims.Username)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to check account status", "err", err)
+		http.Error(w, "Failed to check account status", http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		http.Error(w, "Account disabled or renamed", http.StatusForbidden)
+		return
+	}
 
 	// Check if response writer supports flushing
 	flusher, ok := w.(http.Flusher)
@@ -1214,12 +1803,19 @@ func (s *Server) handleSSEInbox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set SSE headers with proper CORS
+	// Set SSE headers. CORS headers were set by corsMiddleware, from the
+	// same allowlist as every other route.
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// A reconnecting client resumes after the last event it saw, and its
+	// queue gets room for the messages it missed
+	lastEventID, resuming := parseLastEventID(r)
+	buffer := s.config.SSEClientBuffer
+	if resuming {
+		buffer += maxSSEReplay
+	}
 
 	// Create SSE client
 	client := &SSEClient{
@@ -1227,56 +1823,179 @@ func (s *Server) handleSSEInbox(w http.ResponseWriter, r *http.Request) {
 		writer:   w,
 		flusher:  flusher,
 		done:     make(chan bool),
+		events:   make(chan sseEvent, buffer),
 		lastPing: time.Now(),
 	}
 
-	// Add client to the list
+	// Hold back events until the client has caught up, so that none are
+	// missed between adding the client and looking up its last message
+	client.queueMu.Lock()
+
+	// Add client to the list, unless the server is shutting down
 	s.sseMutex.Lock()
+	if s.sseClosed {
+		s.sseMutex.Unlock()
+		client.queueMu.Unlock()
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	s.sseClients[client.userID] = append(s.sseClients[client.userID], client)
 	s.sseMutex.Unlock()
 
+	if resuming {
+		s.replaySSEMessages(r.Context(), client, lastEventID)
+	} else if latest, err := s.messageRepo.GetLatestReceivedID(client.userID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to get latest message ID", "user_id", client.userID, "err", err)
+	} else {
+		client.lastMessageID = latest
+	}
+	client.queueMu.Unlock()
+
 	// Send initial unread count
 	go func() {
-		count, err := s.messageRepo.GetUnreadCount(client.userID)
+		event, err := s.unreadCountEvent(client.userID)
 		if err == nil {
-			s.sendSSEEvent(client, "unread-count", map[string]int{"count": count})
+			s.sendSSEEvent(client, "unread-count", event)
 		}
 	}()
 
 	// Send welcome message
 	s.sendSSEEvent(client, "connected", map[string]string{"message": "Connected to inbox updates"})
 
-	// Wait for client disconnect or server shutdown
-	select {
-	case <-client.done:
-		log.Printf("SSE client disconnected for user %d", client.userID)
-	case <-r.Context().Done():
-		log.Printf("SSE client context cancelled for user %d", client.userID)
-		s.sseCloseChan <- client
+	// Write queued events until the client disconnects or the server shuts down
+	for {
+		select {
+		case event := <-client.events:
+			if err := s.writeSSEEvent(client, event); err != nil {
+				slog.WarnContext(r.Context(), "failed to write SSE event", "user_id", client.userID, "err", err)
+				s.closeSSEClient(client)
+				return
+			}
+		case <-client.done:
+			slog.DebugContext(r.Context(), "SSE client disconnected", "user_id", client.userID)
+			return
+		case <-r.Context().Done():
+			slog.DebugContext(r.Context(), "SSE client context cancelled", "user_id", client.userID)
+			s.closeSSEClient(client)
+			return
+		}
 	}
 }
 
-// sendSSEEvent sends an event to an SSE client
+// sendSSEEvent queues an event for an SSE client without blocking. If the
+// client's buffer is full the configured drop policy is applied.
 func (s *Server) sendSSEEvent(client *SSEClient, eventType string, data interface{}) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("SSE send failed for user %d: %v", client.userID, r)
-		}
-	}()
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to marshal SSE data", "err", err)
+		return
+	}
+	s.queueSSEEvent(client, eventType, jsonData, 0)
+}
+
+// sendSSEEventToUser queues an event for every SSE client of a user. The
+// event is serialized once and shared by the clients.
+func (s *Server) sendSSEEventToUser(userID int, eventType string, data interface{}) {
+	clients := s.userSSEClients(userID)
+	if len(clients) == 0 {
+		return
+	}
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("Failed to marshal SSE data: %v", err)
+		slog.Error("failed to marshal SSE data", "err", err)
 		return
 	}
+	for _, client := range clients {
+		s.queueSSEEvent(client, eventType, jsonData, 0)
+	}
+}
 
-	_, err = fmt.Fprintf(client.writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+// sendSSEMessage queues a new-message or new-reply event for a message the
+// user received on each of their SSE clients. The message ID becomes the ID
+// of the clients' events, so a reconnecting client can resume after it.
+func (s *Server) sendSSEMessage(clients []*SSEClient, message *database.Message) {
+	jsonData, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Failed to write SSE event: %v", err)
+		slog.Error("failed to marshal SSE data", "err", err)
+		return
+	}
+	for _, client := range clients {
+		s.queueSSEEvent(client, messageEventType(message), jsonData, message.ID)
+	}
+}
+
+// userSSEClients returns a copy of a user's SSE clients. Callers get a copy
+// since removeSSEClient modifies the slice in place once the lock is released.
+func (s *Server) userSSEClients(userID int) []*SSEClient {
+	s.sseMutex.RLock()
+	defer s.sseMutex.RUnlock()
+	return append([]*SSEClient(nil), s.sseClients[userID]...)
+}
+
+// queueSSEEvent queues a serialized event for an SSE client without
+// blocking, advancing the client's event ID when the event is about a newer
+// message. Events are only ever written by the client's handler goroutine, in
+// the order they were queued.
+func (s *Server) queueSSEEvent(client *SSEClient, eventType string, jsonData []byte, messageID int) {
+	client.queueMu.Lock()
+	defer client.queueMu.Unlock()
+
+	if messageID > 0 && client.replayed[messageID] {
+		return // Already sent when the client resumed
+	}
+	if messageID > client.lastMessageID {
+		client.lastMessageID = messageID
+	}
+	event := sseEvent{id: client.lastMessageID, eventType: eventType, data: jsonData, messageID: messageID}
+
+	select {
+	case client.events <- event:
 		return
+	default:
+	}
+
+	sseDroppedEvents.Inc()
+	if s.config.SSEDropPolicy == sseDisconnect {
+		slog.Warn("SSE buffer full, disconnecting slow client", "user_id", client.userID)
+		s.closeSSEClient(client)
+		return
+	}
+
+	// Drop the oldest queued event to make room for this one
+	select {
+	case <-client.events:
+	default:
+	}
+	select {
+	case client.events <- event:
+	default:
+		sseDroppedEvents.Inc()
+	}
+}
+
+// writeSSEEvent writes a queued event to the client's stream. It must only be
+// called from the client's handler goroutine.
+func (s *Server) writeSSEEvent(client *SSEClient, event sseEvent) error {
+	if event.eventType == "" {
+		if _, err := fmt.Fprintf(client.writer, ": ping\n\n"); err != nil {
+			return err
+		}
+		client.flusher.Flush()
+		client.lastPing = time.Now()
+		return nil
 	}
 
+	if event.id > 0 {
+		if _, err := fmt.Fprintf(client.writer, "id: %d\n", event.id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(client.writer, "event: %s\ndata: %s\n\n", event.eventType, event.data); err != nil {
+		return err
+	}
 	client.flusher.Flush()
+	return nil
 }
 
 // notifyNewMessage notifies all SSE clients about a new message
@@ -1285,30 +2004,15 @@ func (s *Server) notifyNewMessage(message *database.Message) {
 		return // External message, no local recipient to notify
 	}
 
-	// Determine if this is a reply or a new root message
-	isReply := message.ParentID != nil
+	s.webhooks.Dispatch(*message.ToUserID, webhook.EventMessageReceived, message)
 
-	// Send appropriate event to direct recipient
-	s.sseMutex.RLock()
-	clients := s.sseClients[*message.ToUserID]
-	s.sseMutex.RUnlock()
-
-	for _, client := range clients {
-		if isReply {
-			// Send as reply event - this won't add to inbox list
-			go s.sendSSEEvent(client, "new-reply", message)
-		} else {
-			// Send as new message event - this will add to inbox list
-			go s.sendSSEEvent(client, "new-message", message)
-		}
-		
-		// Always send updated unread count
-		go func(c *SSEClient) {
-			count, err := s.messageRepo.GetUnreadCount(c.userID)
-			if err == nil {
-				s.sendSSEEvent(c, "unread-count", map[string]int{"count": count})
-			}
-		}(client)
+	// Send appropriate event to direct recipient, followed by their updated
+	// unread count, unless they muted the thread. Queueing never blocks, so
+	// no goroutines are needed, and the count is looked up once however many
+	// clients the user has open.
+	if clients := s.userSSEClients(*message.ToUserID); len(clients) > 0 && !s.threadMuted(*message.ToUserID, message) {
+		s.sendSSEMessage(clients, message)
+		s.notifyUnreadCount(*message.ToUserID)
 	}
 
 	// If this is a reply (has thread_id), notify all thread participants
@@ -1317,55 +2021,81 @@ func (s *Server) notifyNewMessage(message *database.Message) {
 	}
 }
 
+// notifyUnreadCount pushes a user's current unread count to all of their
+// SSE clients
+func (s *Server) notifyUnreadCount(userID int) {
+	event, err := s.unreadCountEvent(userID)
+	if err != nil {
+		slog.Error("failed to get unread count", "user_id", userID, "err", err)
+		return
+	}
+
+	s.sendSSEEventToUser(userID, "unread-count", event)
+}
+
+// UnreadCountEvent is the data of the unread-count SSE event
+type UnreadCountEvent struct {
+	Count   int            `json:"count"`
+	Folders map[string]int `json:"folders"` // As returned by ?by=folder
+}
+
+// unreadCountEvent looks up a user's unread counts for an unread-count event
+func (s *Server) unreadCountEvent(userID int) (*UnreadCountEvent, error) {
+	count, err := s.messageRepo.GetUnreadCount(userID)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := s.messageRepo.GetUnreadCountsByFolder(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &UnreadCountEvent{Count: count, Folders: folders}, nil
+}
+
 // notifyThreadUpdate notifies all participants in a thread about updates
 func (s *Server) notifyThreadUpdate(threadID string) {
-	log.Printf("DEBUG: Notifying thread update for thread %s", threadID)
 	
 	// Get all messages in the thread
 	threadMessages, err := s.messageRepo.GetThreadByID(threadID)
 	if err != nil {
-		log.Printf("ERROR: Failed to get thread %s for notification: %v", threadID, err)
+		slog.Error("failed to get thread for notification", "thread_id", threadID, "err", err)
 		return
 	}
 
 	if len(threadMessages) == 0 {
-		log.Printf("DEBUG: No messages found in thread %s", threadID)
+		slog.Debug("no messages found in thread", "thread_id", threadID)
 		return
 	}
 
 	// Find all unique participants in the thread (both senders and receivers)
-	participantIDs := make(map[int]bool)
-	for _, msg := range threadMessages {
-		if msg.FromUserID != nil {
-			participantIDs[*msg.FromUserID] = true
-		}
-		if msg.ToUserID != nil {
-			participantIDs[*msg.ToUserID] = true
-		}
-	}
-
-	log.Printf("DEBUG: Found %d participants in thread %s", len(participantIDs), threadID)
+	participantIDs := threadParticipantIDs(threadMessages)
 
-	// Get the root message (first message in chronological order) with updated replies
-	rootMessage := threadMessages[0]
-	if len(threadMessages) > 1 {
-		rootMessage.Replies = threadMessages[1:] // All messages except the first one are replies
-	}
-
-	// Send thread update to all participants
-	s.sseMutex.RLock()
-	defer s.sseMutex.RUnlock()
+	slog.Debug("notifying thread update", "thread_id", threadID, "participants", len(participantIDs))
 
+	// Send each participant the part of the thread they sent or received,
+	// with its first message as the root and the rest as replies. Those who
+	// muted the thread are left alone.
 	for participantID := range participantIDs {
-		clients := s.sseClients[participantID]
-		log.Printf("DEBUG: Sending thread update to user %d (%d clients)", participantID, len(clients))
-		
-		for _, client := range clients {
-			go s.sendSSEEvent(client, "thread-updated", map[string]interface{}{
-				"thread_id": threadID,
-				"message":   rootMessage,
-			})
+		muted, err := s.messageRepo.IsThreadMuted(participantID, threadID)
+		if err != nil {
+			slog.Error("failed to check thread mute", "user_id", participantID, "err", err)
+		}
+		if muted {
+			continue
 		}
+
+		visible := filterThreadAccess(threadMessages, participantID)
+		if len(visible) == 0 {
+			continue
+		}
+		rootMessage := *visible[0]
+		rootMessage.Replies = visible[1:]
+
+		slog.Debug("sending thread update", "thread_id", threadID, "user_id", participantID)
+		s.sendSSEEventToUser(participantID, "thread-updated", map[string]interface{}{
+			"thread_id": threadID,
+			"message":   rootMessage,
+		})
 	}
 }
 
@@ -1385,25 +2115,18 @@ func (s *Server) handleGetThread(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all messages in the thread
-	messages, err := s.messageRepo.GetThreadByID(threadID)
+	// Only the messages the user sent or received are read
+	messages, err := s.messageRepo.GetThreadForUserContext(r.Context(), threadID, user.ID)
 	if err != nil {
-		log.Printf("Failed to get thread: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get thread", "err", err)
 		http.Error(w, "Failed to get thread", http.StatusInternalServerError)
 		return
 	}
 
-	// Filter messages to only show those the user can access
-	var filteredMessages []*database.Message
-	for _, msg := range messages {
-		if (msg.ToUserID != nil && *msg.ToUserID == user.ID) || 
-		   (msg.FromUserID != nil && *msg.FromUserID == user.ID) {
-			filteredMessages = append(filteredMessages, msg)
-		}
-	}
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(filteredMessages)
+	writeJSONWithETag(w, r, messages)
 }
 
 // handleGetAttachment serves attachment files
@@ -1426,7 +2149,7 @@ func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
 	// Get attachment info
 	attachment, err := s.attachmentRepo.GetByID(attachmentID)
 	if err != nil {
-		log.Printf("Failed to get attachment: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get attachment", "err", err)
 		http.Error(w, "Attachment not found", http.StatusNotFound)
 		return
 	}
@@ -1453,7 +2176,7 @@ func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
 	// Get file data
 	fileData, err := s.attachmentRepo.GetFileData(attachmentID)
 	if err != nil {
-		log.Printf("Failed to get file data: %v", err)
+		slog.ErrorContext(r.Context(), "failed to get file data", "err", err)
 		http.Error(w, "Failed to get file", http.StatusInternalServerError)
 		return
 	}
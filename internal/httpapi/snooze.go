@@ -0,0 +1,207 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// snoozeSweepBatch is how many due messages the sweeper wakes per query
+const snoozeSweepBatch = 500
+
+// SnoozeRequest represents a request to snooze a message
+type SnoozeRequest struct {
+	Until time.Time `json:"until"` // RFC 3339; must be in the future
+}
+
+// handleGetSnoozed returns the current user's snoozed messages, due soonest
+// first
+func (s *Server) handleGetSnoozed(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	messages, err := s.messageRepo.GetSnoozedForUser(user.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get snoozed messages", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if messages == nil {
+		messages = []*database.Message{}
+	}
+
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleSnoozeMessage hides a message the current user received from their
+// inbox and unread count until the requested time
+func (s *Server) handleSnoozeMessage(w http.ResponseWriter, r *http.Request) {
+	user, message, ok := s.receivedMessage(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req SnoozeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !req.Until.After(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_until",
+			"message": "until must be a time in the future",
+		})
+		return
+	}
+
+	if err := s.messageRepo.Snooze(message.ID, user.ID, req.Until); err != nil {
+		slog.ErrorContext(r.Context(), "failed to snooze message", "err", err)
+		http.Error(w, "Failed to snooze message", http.StatusInternalServerError)
+		return
+	}
+	if !message.ReadStatus {
+		s.notifyUnreadCount(user.ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleUnsnoozeMessage returns a snoozed message to the current user's
+// inbox without waiting for its time
+func (s *Server) handleUnsnoozeMessage(w http.ResponseWriter, r *http.Request) {
+	user, message, ok := s.receivedMessage(w, r)
+	if !ok {
+		return
+	}
+
+	woken, err := s.messageRepo.Unsnooze(message.ID, user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to unsnooze message", "err", err)
+		http.Error(w, "Failed to unsnooze message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !woken {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "not_snoozed",
+			"message": "Message is not snoozed",
+		})
+		return
+	}
+	if !message.ReadStatus {
+		s.notifyUnreadCount(user.ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// receivedMessage looks up the message named by the {id} route variable,
+// writing an error response unless the current user received it
+func (s *Server) receivedMessage(w http.ResponseWriter, r *http.Request) (*auth.AuthUser, *database.Message, bool) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if message == nil || message.IsDraft || message.ToUserID == nil || *message.ToUserID != user.ID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return user, message, true
+}
+
+// StartSnoozeSweeper returns messages whose snooze has ended to their
+// recipients' inboxes each interval, telling connected clients about them
+// as if they had just arrived. It returns a function that stops the sweeper.
+func (s *Server) StartSnoozeSweeper(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.sweepSnoozed(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// sweepSnoozed wakes every message that is due, a batch at a time, so one
+// pass covers all users without loading them all at once
+func (s *Server) sweepSnoozed(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := s.messageRepo.WakeSnoozed(time.Now(), snoozeSweepBatch)
+		if err != nil {
+			slog.Error("failed to wake snoozed messages", "err", err)
+			return
+		}
+
+		notified := make(map[int]bool)
+		for _, message := range messages {
+			if message.ToUserID == nil {
+				continue // Deleted by its recipient while snoozed
+			}
+			userID := *message.ToUserID
+			clients := s.userSSEClients(userID)
+			if len(clients) == 0 || s.threadMuted(userID, message) {
+				continue
+			}
+			s.sendSSEMessage(clients, message)
+			notified[userID] = true
+		}
+		for userID := range notified {
+			s.notifyUnreadCount(userID)
+		}
+
+		if len(messages) > 0 {
+			slog.Debug("woke snoozed messages", "count", len(messages))
+		}
+		if len(messages) < snoozeSweepBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+	"yourmail/internal/spam"
+
+	"github.com/gorilla/mux"
+)
+
+// spamFolderName is the folder quarantined mail is filed in. It is created
+// the first time a user gets spam.
+const spamFolderName = "Spam"
+
+// SetSpamScorer replaces the scorer used to decide whether incoming mail is
+// spam. The default is spam.Heuristic.
+func (s *Server) SetSpamScorer(scorer spam.Scorer) {
+	s.spamScorer = scorer
+}
+
+// quarantineIfSpam scores a message just stored for a local recipient and,
+// if it scores above SPAM_THRESHOLD, files it in the recipient's Spam folder
+// marked as read. It reports whether it did, in which case the recipient
+// should not be notified. Errors are logged and leave the message in the
+// inbox.
+func (s *Server) quarantineIfSpam(ctx context.Context, message *database.Message, external bool) bool {
+	if s.config.SpamThreshold == 0 || message.ToUserID == nil {
+		return false
+	}
+	userID := *message.ToUserID
+
+	known, err := s.spamRepo.KnownSender(userID, message.FromAddress)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to score message", "message_id", message.ID, "err", err)
+		return false
+	}
+	marks, err := s.spamRepo.NotSpamMarks(userID, message.FromAddress)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to score message", "message_id", message.ID, "err", err)
+		return false
+	}
+
+	score := s.spamScorer.Score(spam.Message{
+		From:         message.FromAddress,
+		Subject:      message.Subject,
+		Body:         message.Body,
+		IsHTML:       message.IsHTML,
+		External:     external,
+		KnownSender:  known,
+		NotSpamMarks: marks,
+	})
+	if score <= s.config.SpamThreshold {
+		return false
+	}
+
+	folder, err := s.spamFolder(userID, true)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get spam folder", "user_id", userID, "err", err)
+		return false
+	}
+	if err := s.folderRepo.MoveMessageToFolder(message.ID, userID, &folder.ID); err != nil {
+		slog.ErrorContext(ctx, "failed to quarantine message", "message_id", message.ID, "err", err)
+		return false
+	}
+	if err := s.messageRepo.MarkAsRead(message.ID); err != nil {
+		slog.ErrorContext(ctx, "failed to mark spam read", "message_id", message.ID, "err", err)
+	}
+
+	slog.InfoContext(ctx, "message quarantined as spam", "message_id", message.ID, "user_id", userID, "from", message.FromAddress, "score", score)
+	return true
+}
+
+// spamFolder returns the user's Spam folder, creating it if create is set.
+// It returns nil if there is none and create is not set.
+func (s *Server) spamFolder(userID int, create bool) (*database.Folder, error) {
+	folder, err := s.folderRepo.GetByName(userID, spamFolderName)
+	if err != nil || folder != nil || !create {
+		return folder, err
+	}
+	folder, err = s.folderRepo.CreateFolder(userID, spamFolderName)
+	if err != nil {
+		// Another delivery may have just created it
+		if existing, _ := s.folderRepo.GetByName(userID, spamFolderName); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return folder, nil
+}
+
+// handleGetSpam returns the messages in the current user's Spam folder
+func (s *Server) handleGetSpam(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	folder, err := s.spamFolder(user.ID, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get spam folder", "err", err)
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	messages := []*database.Message{}
+	if folder != nil {
+		limit, offset := parsePagination(r)
+		messages, err = s.folderRepo.GetMessagesInFolder(folder.ID, limit, offset)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to get spam messages", "err", err)
+			http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+			return
+		}
+		// Ensure we always return an array, never null
+		if messages == nil {
+			messages = []*database.Message{}
+		}
+	}
+
+	hideRecipientState(messages, user.ID)
+	s.renderBodies(r, messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleNotSpam moves a message out of the Spam folder back to the inbox
+// and makes later mail from its sender less likely to be taken for spam
+func (s *Server) handleNotSpam(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	message, err := s.messageRepo.GetByID(messageID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get message", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+	if message == nil || message.ToUserID == nil || *message.ToUserID != user.ID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	folder, err := s.spamFolder(user.ID, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get spam folder", "err", err)
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+	inSpam := false
+	if folder != nil {
+		if inSpam, err = s.folderRepo.Contains(folder.ID, message.ID); err != nil {
+			slog.ErrorContext(r.Context(), "failed to check spam folder", "err", err)
+			http.Error(w, "Failed to get message", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !inSpam {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "not_in_spam",
+			"message": "Message is not in the Spam folder",
+		})
+		return
+	}
+
+	if err := s.folderRepo.MoveMessageToFolder(message.ID, user.ID, nil); err != nil {
+		slog.ErrorContext(r.Context(), "failed to move message", "err", err)
+		http.Error(w, "Failed to move message", http.StatusInternalServerError)
+		return
+	}
+	if err := s.spamRepo.RecordNotSpam(user.ID, message.FromAddress); err != nil {
+		// The message is back in the inbox, which is what the user sees
+		slog.ErrorContext(r.Context(), "failed to record spam feedback", "err", err)
+	}
+	if !message.ReadStatus {
+		s.notifyUnreadCount(user.ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
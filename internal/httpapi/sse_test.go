@@ -0,0 +1,172 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyNewMessageSharesUnreadCountAcrossClients(t *testing.T) {
+	s, queries := newCountingTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+
+	clients := []*SSEClient{addSSEClient(s, bob.ID), addSSEClient(s, bob.ID), addSSEClient(s, bob.ID)}
+
+	const messages = 5
+	var ids []int
+	for i := 0; i < messages; i++ {
+		message, err := s.messageRepo.CreateWithThreading(&alice.ID, &bob.ID, "alice@localhost", "bob@localhost", "", fmt.Sprintf("Message %d", i), "Hello", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+
+		queries.Reset()
+		s.notifyNewMessage(message)
+		if n := queries.Count("FROM folders f"); n != 1 {
+			t.Errorf("message %d: unread counts looked up %d times for %d clients, want once", i, n, len(clients))
+		}
+	}
+
+	for c, client := range clients {
+		// Thread updates are sent from another goroutine, so only the
+		// events queued by notifyNewMessage itself have a fixed order
+		var got []sseEvent
+		for _, event := range queuedEvents(client) {
+			if event.eventType != "thread-updated" {
+				got = append(got, event)
+			}
+		}
+		if len(got) != 2*messages {
+			t.Fatalf("client %d got %d events, want %d", c, len(got), 2*messages)
+		}
+		for i, id := range ids {
+			message, count := got[2*i], got[2*i+1]
+			if message.eventType != "new-message" || message.messageID != id {
+				t.Errorf("client %d event %d = %s about message %d, want new-message about %d", c, 2*i, message.eventType, message.messageID, id)
+			}
+			if count.eventType != "unread-count" {
+				t.Errorf("client %d event %d = %s, want unread-count", c, 2*i+1, count.eventType)
+				continue
+			}
+			var unread UnreadCountEvent
+			if err := json.Unmarshal(count.data, &unread); err != nil {
+				t.Fatal(err)
+			}
+			if unread.Count != i+1 {
+				t.Errorf("client %d unread count after message %d = %d, want %d", c, i, unread.Count, i+1)
+			}
+		}
+	}
+}
+
+// TestSSEStreamNotGarbledByConcurrentWriters pushes events and pings at one
+// client from several goroutines at once, and checks that every event
+// arrives whole and in the order each goroutine sent them. Run with -race.
+func TestSSEStreamNotGarbledByConcurrentWriters(t *testing.T) {
+	s := newTestServer(t)
+	s.config.SSEClientBuffer = 4096
+	bob := createTestUser(t, s, "bob")
+	token, err := s.jwtService.GenerateToken(bob.ID, bob.Username, bob.Email, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.handleSSEInbox))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/events?token=" + url.QueryEscape(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+
+	// readEvent returns the lines of the next event, without the blank line
+	// that ends it
+	readEvent := func() []string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				t.Fatalf("stream ended: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	// The client is registered once it has been greeted
+	for {
+		if lines := readEvent(); len(lines) > 0 && lines[0] == "event: connected" {
+			break
+		}
+	}
+
+	const pushers, perPusher = 4, 200
+	padding := strings.Repeat("x", 512)
+	var wg sync.WaitGroup
+	for p := 0; p < pushers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perPusher; i++ {
+				s.sendSSEEventToUser(bob.ID, "test", map[string]interface{}{"pusher": p, "seq": i, "padding": padding})
+			}
+		}(p)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < perPusher; i++ {
+			s.pingSSEClients()
+		}
+	}()
+
+	next := make([]int, pushers)
+	deadline := time.AfterFunc(10*time.Second, func() { resp.Body.Close() })
+	defer deadline.Stop()
+	for received := 0; received < pushers*perPusher; {
+		lines := readEvent()
+		if len(lines) == 1 && lines[0] == ": ping" {
+			continue
+		}
+		if len(lines) > 0 && strings.HasPrefix(lines[0], "id: ") {
+			lines = lines[1:]
+		}
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "event: ") || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("garbled event: %q", lines)
+		}
+		if lines[0] != "event: test" {
+			continue // An unread count or other event the server sent itself
+		}
+		var data struct {
+			Pusher  int    `json:"pusher"`
+			Seq     int    `json:"seq"`
+			Padding string `json:"padding"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &data); err != nil {
+			t.Fatalf("garbled event data %q: %v", lines[1], err)
+		}
+		if data.Padding != padding {
+			t.Fatalf("event data from pusher %d was cut short", data.Pusher)
+		}
+		if data.Seq != next[data.Pusher] {
+			t.Fatalf("pusher %d: got event %d, want %d", data.Pusher, data.Seq, next[data.Pusher])
+		}
+		next[data.Pusher]++
+		received++
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"yourmail/internal/database"
+)
+
+// maxSSEReplay limits how many missed messages are replayed to a reconnecting
+// SSE client. Clients that missed more should reload their inbox.
+const maxSSEReplay = 100
+
+// messageEventType returns the SSE event announcing a received message:
+// new-reply for replies, which don't add to the inbox list, and new-message
+// for new root messages
+func messageEventType(message *database.Message) string {
+	if message.ParentID != nil {
+		return "new-reply"
+	}
+	return "new-message"
+}
+
+// parseLastEventID returns the ID of the last event a reconnecting SSE client
+// received, which browsers send in the Last-Event-ID header
+func parseLastEventID(r *http.Request) (int, bool) {
+	header := r.Header.Get("Last-Event-ID")
+	if header == "" {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(header)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// replaySSEMessages queues events for the messages the client's user received
+// after lastEventID, oldest first. The caller must hold client.queueMu, and
+// the client's queue must have room for maxSSEReplay more events.
+func (s *Server) replaySSEMessages(ctx context.Context, client *SSEClient, lastEventID int) {
+	client.lastMessageID = lastEventID
+
+	messages, err := s.messageRepo.GetReceivedAfter(client.userID, lastEventID, maxSSEReplay)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get missed messages", "user_id", client.userID, "err", err)
+		return
+	}
+
+	client.replayed = make(map[int]bool, len(messages))
+	for _, message := range messages {
+		if message.SnoozedUntil != nil || s.threadMuted(client.userID, message) {
+			client.lastMessageID = message.ID
+			continue
+		}
+
+		data, err := json.Marshal(message)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to marshal SSE data", "err", err)
+			continue
+		}
+
+		client.lastMessageID = message.ID
+		client.replayed[message.ID] = true
+		client.events <- sseEvent{id: message.ID, eventType: messageEventType(message), data: data, messageID: message.ID}
+	}
+
+	if len(messages) > 0 {
+		slog.DebugContext(ctx, "replayed missed messages", "user_id", client.userID, "count", len(messages), "last_event_id", lastEventID)
+	}
+}
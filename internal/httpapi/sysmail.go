@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"yourmail/internal/database"
+	"yourmail/internal/sysmail"
+)
+
+// systemMailData returns the template data common to all system mail sent
+// to a local user
+func (s *Server) systemMailData(username string) sysmail.Data {
+	return sysmail.Data{
+		ServerName: s.config.ServerName,
+		ServerHost: s.config.ServerHost,
+		Username:   username,
+		Address:    fmt.Sprintf("%s@%s", username, s.config.ServerHost),
+	}
+}
+
+// mailerDaemon is the reserved local part bounces are sent from
+const mailerDaemon = "mailer-daemon"
+
+// isReservedUsername reports whether name is used by the server itself for
+// system mail and so cannot be registered
+func (s *Server) isReservedUsername(name string) bool {
+	return strings.EqualFold(name, mailerDaemon) || strings.EqualFold(name, s.config.SystemMailSender)
+}
+
+// sendSystemMail renders a system message and delivers it to a local user
+// from the configured system sender address
+func (s *Server) sendSystemMail(ctx context.Context, kind sysmail.Kind, userID int, data sysmail.Data) error {
+	return s.sendSystemMailFrom(ctx, s.config.SystemMailSender, kind, userID, data)
+}
+
+// sendSystemMailFrom renders a system message and delivers it to a local
+// user from sender@<host>
+func (s *Server) sendSystemMailFrom(ctx context.Context, sender string, kind sysmail.Kind, userID int, data sysmail.Data) error {
+	msg, err := s.sysmail.Render(kind, data)
+	if err != nil {
+		return err
+	}
+
+	fromAddress := fmt.Sprintf("%s@%s", sender, s.config.ServerHost)
+	message, err := s.messageRepo.CreateWithThreading(nil, &userID, fromAddress, data.Address, "", msg.Subject, msg.Body, false, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to store %s mail: %w", kind, err)
+	}
+
+	slog.InfoContext(ctx, "sent system mail", "kind", kind, "to", data.Address)
+	s.deliverMessage(ctx, message)
+	return nil
+}
+
+// sendBounce tells the local sender of a message that it could not be
+// delivered, with a notice from mailer-daemon in their inbox. Messages
+// without a local sender, including bounces themselves, never bounce, and
+// the notice is always delivered locally so it cannot be federated.
+func (s *Server) sendBounce(ctx context.Context, message *database.Message, reason string) {
+	if message.FromUserID == nil {
+		return
+	}
+	if strings.EqualFold(message.FromAddress, fmt.Sprintf("%s@%s", mailerDaemon, s.config.ServerHost)) {
+		return
+	}
+
+	sender, err := s.userRepo.GetByID(*message.FromUserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get bounce recipient", "user_id", *message.FromUserID, "err", err)
+		return
+	}
+	if sender == nil {
+		return
+	}
+
+	data := s.systemMailData(sender.Username)
+	data.Recipient = message.ToAddress
+	data.Subject = message.Subject
+	data.Reason = reason
+	if err := s.sendSystemMailFrom(ctx, mailerDaemon, sysmail.Bounce, sender.ID, data); err != nil {
+		slog.ErrorContext(ctx, "failed to send bounce", "message_id", message.ID, "err", err)
+	}
+}
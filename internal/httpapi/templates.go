@@ -0,0 +1,296 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// maxTemplateNameLength limits template names to something a picker can show
+const maxTemplateNameLength = 64
+
+// TemplateRequest represents a request to create or update a template
+type TemplateRequest struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	IsHTML  bool   `json:"is_html"`
+}
+
+// handleListTemplates returns the current user's templates
+func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	templates, err := s.templateRepo.List(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list templates", "err", err)
+		http.Error(w, "Failed to list templates", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if templates == nil {
+		templates = []*database.Template{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// handleCreateTemplate saves a new template for the current user
+func (s *Server) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeTemplateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := s.templateRepo.GetByName(user.ID, req.Name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up template", "err", err)
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		writeTemplateExists(w)
+		return
+	}
+
+	template, err := s.templateRepo.Create(user.ID, req.Name, req.Subject, req.Body, req.IsHTML)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create template", "err", err)
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// handleUpdateTemplate replaces one of the current user's templates
+func (s *Server) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	template, ok := s.getOwnedTemplate(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeTemplateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := s.templateRepo.GetByName(user.ID, req.Name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up template", "err", err)
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil && existing.ID != template.ID {
+		writeTemplateExists(w)
+		return
+	}
+
+	updated, err := s.templateRepo.Update(template.ID, req.Name, req.Subject, req.Body, req.IsHTML)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update template", "err", err)
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// handleDeleteTemplate deletes one of the current user's templates
+func (s *Server) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	template, ok := s.getOwnedTemplate(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.templateRepo.Delete(template.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete template", "err", err)
+		http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// applyTemplate fills in the subject and body of an outgoing message from
+// one of the user's templates. Values the sender supplied take precedence,
+// and a body taken from the template also takes its HTML setting. It writes
+// an error response and returns false if the template cannot be used.
+func (s *Server) applyTemplate(w http.ResponseWriter, user *auth.AuthUser, templateID int, to []string, subject, body *string, isHTML *bool) bool {
+	template, err := s.templateRepo.GetByID(templateID)
+	if err != nil {
+		slog.Error("failed to get template", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "template_lookup_failed",
+			"message": fmt.Sprintf("Failed to get template: %v", err),
+		})
+		return false
+	}
+
+	if template == nil || template.UserID != user.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_template",
+			"message": fmt.Sprintf("Template %d not found", templateID),
+		})
+		return false
+	}
+
+	if *subject == "" {
+		*subject = expandTemplate(template.Subject, user, to, false)
+	}
+	if *body == "" {
+		*body = expandTemplate(template.Body, user, to, template.IsHTML)
+		*isHTML = template.IsHTML
+	}
+	return true
+}
+
+// expandTemplate substitutes the supported placeholders in template text:
+// {{username}} and {{address}} describe the recipients, as a comma-separated
+// list when there are several, {{sender}} is the sending user and {{date}}
+// is today's date. Values are escaped for HTML bodies.
+func expandTemplate(text string, user *auth.AuthUser, to []string, isHTML bool) string {
+	usernames := make([]string, len(to))
+	for i, addr := range to {
+		usernames[i] = addr
+		if at := strings.LastIndex(addr, "@"); at >= 0 {
+			usernames[i] = addr[:at]
+		}
+	}
+
+	escape := func(v string) string { return v }
+	if isHTML {
+		escape = html.EscapeString
+	}
+
+	return strings.NewReplacer(
+		"{{username}}", escape(strings.Join(usernames, ", ")),
+		"{{address}}", escape(strings.Join(to, ", ")),
+		"{{sender}}", escape(user.Username),
+		"{{date}}", time.Now().Format("2006-01-02"),
+	).Replace(text)
+}
+
+// parseTemplateID parses an optional template_id form value. Zero means no
+// template was requested.
+func parseTemplateID(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid template ID: %s", value)
+	}
+	return id, nil
+}
+
+// decodeTemplateRequest parses and validates a template body, writing an
+// error response and returning false if it is unusable
+func decodeTemplateRequest(w http.ResponseWriter, r *http.Request) (*TemplateRequest, bool) {
+	var req TemplateRequest
+	if !decodeJSON(w, r, &req) {
+		return nil, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTemplateNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_template_name",
+			"message": fmt.Sprintf("Template name must be between 1 and %d characters", maxTemplateNameLength),
+		})
+		return nil, false
+	}
+
+	if req.Subject == "" && req.Body == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "empty_template",
+			"message": "A template needs a subject or a body",
+		})
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// writeTemplateExists reports that the user already has a template by that name
+func writeTemplateExists(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   "template_exists",
+		"message": "A template with that name already exists",
+	})
+}
+
+// getOwnedTemplate loads the template named by the {id} route variable and
+// checks that it belongs to userID, writing an error response if not
+func (s *Server) getOwnedTemplate(w http.ResponseWriter, r *http.Request, userID int) (*database.Template, bool) {
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	template, err := s.templateRepo.GetByID(templateID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get template", "err", err)
+		http.Error(w, "Failed to get template", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if template == nil || template.UserID != userID {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return template, true
+}
@@ -0,0 +1,209 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// ThreadParticipant is an address that sent or received a message in a
+// thread. User is set when the address belongs to a local account.
+type ThreadParticipant struct {
+	Address string           `json:"address"`
+	User    *ParticipantUser `json:"user,omitempty"`
+}
+
+// ParticipantUser is the public profile of a local thread participant
+type ParticipantUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// ThreadPage is a page of the thread list with pagination metadata
+type ThreadPage struct {
+	Threads []*database.ThreadSummary `json:"threads"`
+	Total   int                       `json:"total"`
+	Limit   int                       `json:"limit"`
+	Offset  int                       `json:"offset"`
+	HasMore bool                      `json:"has_more"`
+}
+
+// handleListThreads returns summaries of the threads the current user has
+// mail in, most recently active first. Unlike the inbox it lists sent mail
+// too, and no messages.
+func (s *Server) handleListThreads(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	threads, total, err := s.messageRepo.ListThreadsForUserContext(r.Context(), user.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list threads", "err", err)
+		http.Error(w, "Failed to list threads", http.StatusInternalServerError)
+		return
+	}
+	if threads == nil {
+		threads = []*database.ThreadSummary{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ThreadPage{
+		Threads: threads,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+		HasMore: offset+len(threads) < total,
+	})
+}
+
+// handleGetThreadParticipants returns the distinct senders and recipients of
+// the thread messages visible to the current user
+func (s *Server) handleGetThreadParticipants(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	threadID := mux.Vars(r)["threadId"]
+	if threadID == "" {
+		http.Error(w, "Thread ID is required", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := s.messageRepo.GetThreadForUserContext(r.Context(), threadID, user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get thread", "err", err)
+		http.Error(w, "Failed to get thread", http.StatusInternalServerError)
+		return
+	}
+
+	participants := []*ThreadParticipant{}
+	seen := make(map[string]*ThreadParticipant)
+	users := make(map[int]*ParticipantUser)
+
+	add := func(address string, userID *int) {
+		p, exists := seen[address]
+		if !exists {
+			p = &ThreadParticipant{Address: address}
+			seen[address] = p
+			participants = append(participants, p)
+		}
+		if p.User == nil && userID != nil {
+			p.User = s.participantUser(*userID, users)
+		}
+	}
+
+	for _, msg := range messages {
+		add(msg.FromAddress, msg.FromUserID)
+		add(msg.ToAddress, msg.ToUserID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(participants)
+}
+
+// participantUser looks up a local user's public profile, caching lookups in
+// cache. It returns nil if the user no longer exists.
+func (s *Server) participantUser(userID int, cache map[int]*ParticipantUser) *ParticipantUser {
+	if u, ok := cache[userID]; ok {
+		return u
+	}
+
+	var pu *ParticipantUser
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		slog.Error("failed to get thread participant", "user_id", userID, "err", err)
+	} else if u != nil {
+		pu = &ParticipantUser{ID: u.ID, Username: u.Username, Email: u.Email}
+	}
+
+	cache[userID] = pu
+	return pu
+}
+
+// filterThreadAccess returns the messages that userID sent or received
+func filterThreadAccess(messages []*database.Message, userID int) []*database.Message {
+	var filtered []*database.Message
+	for _, msg := range messages {
+		if (msg.ToUserID != nil && *msg.ToUserID == userID) ||
+			(msg.FromUserID != nil && *msg.FromUserID == userID) {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+// handleMuteThread mutes a thread for the current user. Its mail stays
+// readable but no longer counts as unread or raises new-message events.
+func (s *Server) handleMuteThread(w http.ResponseWriter, r *http.Request) {
+	s.setThreadMuted(w, r, true)
+}
+
+// handleUnmuteThread unmutes a thread for the current user
+func (s *Server) handleUnmuteThread(w http.ResponseWriter, r *http.Request) {
+	s.setThreadMuted(w, r, false)
+}
+
+// setThreadMuted mutes or unmutes the thread named by the {threadId} route
+// variable. Only users with messages in the thread may do so.
+func (s *Server) setThreadMuted(w http.ResponseWriter, r *http.Request, muted bool) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	threadID := mux.Vars(r)["threadId"]
+	messages, err := s.messageRepo.GetThreadForUserContext(r.Context(), threadID, user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get thread", "err", err)
+		http.Error(w, "Failed to get thread", http.StatusInternalServerError)
+		return
+	}
+	if len(messages) == 0 {
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
+
+	if muted {
+		err = s.messageRepo.MuteThread(user.ID, threadID)
+	} else {
+		err = s.messageRepo.UnmuteThread(user.ID, threadID)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to update thread mute", "err", err)
+		http.Error(w, "Failed to update thread", http.StatusInternalServerError)
+		return
+	}
+
+	// Unread mail in the thread left or rejoined the count
+	s.notifyUnreadCount(user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// threadMuted reports whether userID muted the thread of a message. If the
+// mute cannot be checked the thread is taken as not muted.
+func (s *Server) threadMuted(userID int, message *database.Message) bool {
+	if message.ThreadID == nil {
+		return false
+	}
+	muted, err := s.messageRepo.IsThreadMuted(userID, *message.ThreadID)
+	if err != nil {
+		slog.Error("failed to check thread mute", "user_id", userID, "err", err)
+		return false
+	}
+	return muted
+}
@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNotifyThreadUpdateSkipsMutedParticipants(t *testing.T) {
+	s := newTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+
+	first, err := s.messageRepo.CreateWithThreading(&alice.ID, &bob.ID, "alice@localhost", "bob@localhost", "", "Hi", "Hello", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := *first.ThreadID
+	if _, err := s.messageRepo.CreateWithThreading(&bob.ID, &alice.ID, "bob@localhost", "alice@localhost", "", "Re: Hi", "Hello back", false, &threadID, &first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.messageRepo.MuteThread(bob.ID, threadID); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceClient := addSSEClient(s, alice.ID)
+	bobClient := addSSEClient(s, bob.ID)
+	s.notifyThreadUpdate(threadID)
+
+	if events := queuedEvents(aliceClient); len(events) != 1 || events[0].eventType != "thread-updated" {
+		t.Errorf("alice got %v, want one thread-updated event", events)
+	}
+	if events := queuedEvents(bobClient); len(events) != 0 {
+		t.Errorf("bob muted the thread but got %d events", len(events))
+	}
+}
+
+// TestThreadShowsEachParticipantOnlyTheirMessages builds a thread between
+// three users where each pair exchanges one message, and checks each user
+// reads only the two messages they sent or received, while its participants
+// still list all three addresses once each.
+func TestThreadShowsEachParticipantOnlyTheirMessages(t *testing.T) {
+	s := newTestServer(t)
+	alice := createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+	carol := createTestUser(t, s, "carol")
+
+	send := func(from, to *database.User, threadID *string, parentID *int) *database.Message {
+		t.Helper()
+		message, err := s.messageRepo.CreateWithThreading(&from.ID, &to.ID, from.Username+"@localhost", to.Username+"@localhost", "", "Plans", "Hello", false, threadID, parentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	toBob := send(alice, bob, nil, nil)
+	threadID := *toBob.ThreadID
+	toCarol := send(bob, carol, &threadID, &toBob.ID)
+	toAlice := send(carol, alice, &threadID, &toCarol.ID)
+
+	get := func(user *database.User, target string, handler http.HandlerFunc, v interface{}) {
+		t.Helper()
+		r := mux.SetURLVars(authRequest(user, "GET", target, nil), map[string]string{"threadId": threadID})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s as %s returned %d: %s", target, user.Username, w.Code, w.Body)
+		}
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user *database.User
+		want []int
+	}{
+		{alice, []int{toBob.ID, toAlice.ID}},
+		{bob, []int{toBob.ID, toCarol.ID}},
+		{carol, []int{toCarol.ID, toAlice.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user.Username, func(t *testing.T) {
+			var messages []*database.Message
+			get(tt.user, "/api/threads/"+threadID, s.handleGetThread, &messages)
+			var ids []int
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("thread messages = %v, want %v", ids, tt.want)
+			}
+
+			var participants []*ThreadParticipant
+			get(tt.user, "/api/threads/"+threadID+"/participants", s.handleGetThreadParticipants, &participants)
+			var addresses []string
+			for _, p := range participants {
+				addresses = append(addresses, p.Address)
+			}
+			slices.Sort(addresses)
+			if want := []string{"alice@localhost", "bob@localhost", "carol@localhost"}; !slices.Equal(addresses, want) {
+				t.Errorf("participants = %v, want %v", addresses, want)
+			}
+		})
+	}
+}
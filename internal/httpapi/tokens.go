@@ -0,0 +1,67 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"yourmail/internal/auth"
+)
+
+// TokenRequest represents a request for a scoped token. Scopes default to
+// read-only access.
+type TokenRequest struct {
+	Scopes []string `json:"scopes"`
+}
+
+// TokenResponse carries a scoped token and when it expires
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleCreateToken issues the current user a JWT limited to the requested
+// scopes, to hand to an integration that should not have full access. It
+// expires like a login token and never carries admin rights.
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TokenRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_scope",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	token, err := s.jwtService.GenerateToken(user.ID, user.Username, user.Email, false, scopes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to generate token", "err", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "scoped token issued", "user_id", user.ID, "scopes", scopes)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:     token,
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(s.config.JWTExpiration),
+	})
+}
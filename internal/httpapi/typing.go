@@ -0,0 +1,136 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+
+	"github.com/gorilla/mux"
+)
+
+// typingTimeout is how long a typing indicator lasts unless it is renewed
+const typingTimeout = 5 * time.Second
+
+// TypingRequest represents a change of the current user's typing state in a
+// thread. An empty body means the user is typing.
+type TypingRequest struct {
+	Typing *bool `json:"typing"`
+}
+
+// TypingEvent tells thread participants that someone started or stopped
+// composing a reply
+type TypingEvent struct {
+	ThreadID  string `json:"thread_id"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Typing    bool   `json:"typing"`
+	ExpiresIn int    `json:"expires_in,omitempty"` // Seconds until the indicator clears unless renewed
+}
+
+// typingKey identifies one user's typing indicator in one thread
+type typingKey struct {
+	threadID string
+	userID   int
+}
+
+// handleTyping broadcasts a typing event to the other local participants of
+// a thread. Clients repeat the request while the user keeps typing; if they
+// stop, participants get a typing=false event once typingTimeout passes.
+func (s *Server) handleTyping(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	threadID := mux.Vars(r)["threadId"]
+	if threadID == "" {
+		http.Error(w, "Thread ID is required", http.StatusBadRequest)
+		return
+	}
+
+	typing := true
+	if r.ContentLength != 0 {
+		var req TypingRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Typing != nil {
+			typing = *req.Typing
+		}
+	}
+
+	messages, err := s.messageRepo.GetThreadByIDContext(r.Context(), threadID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get thread", "err", err)
+		http.Error(w, "Failed to get thread", http.StatusInternalServerError)
+		return
+	}
+
+	if len(filterThreadAccess(messages, user.ID)) == 0 {
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
+
+	participants := threadParticipantIDs(messages)
+	event := TypingEvent{ThreadID: threadID, UserID: user.ID, Username: user.Username, Typing: typing}
+	key := typingKey{threadID: threadID, userID: user.ID}
+
+	s.typingMu.Lock()
+	if timer, exists := s.typingTimers[key]; exists {
+		timer.Stop()
+		delete(s.typingTimers, key)
+	}
+	if typing {
+		event.ExpiresIn = int(typingTimeout / time.Second)
+		var timer *time.Timer
+		timer = time.AfterFunc(typingTimeout, func() {
+			s.typingMu.Lock()
+			if s.typingTimers[key] != timer {
+				// Renewed or stopped in the meantime
+				s.typingMu.Unlock()
+				return
+			}
+			delete(s.typingTimers, key)
+			s.typingMu.Unlock()
+
+			s.broadcastTyping(participants, TypingEvent{ThreadID: threadID, UserID: user.ID, Username: user.Username})
+		})
+		s.typingTimers[key] = timer
+	}
+	s.typingMu.Unlock()
+
+	s.broadcastTyping(participants, event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// broadcastTyping sends a typing event to the SSE clients of the thread
+// participants, except the user who is typing
+func (s *Server) broadcastTyping(participants map[int]bool, event TypingEvent) {
+	for participantID := range participants {
+		if participantID != event.UserID {
+			s.sendSSEEventToUser(participantID, "typing", event)
+		}
+	}
+}
+
+// threadParticipantIDs returns the local users who sent or received any of
+// the messages
+func threadParticipantIDs(messages []*database.Message) map[int]bool {
+	participantIDs := make(map[int]bool)
+	for _, msg := range messages {
+		if msg.FromUserID != nil {
+			participantIDs[*msg.FromUserID] = true
+		}
+		if msg.ToUserID != nil {
+			participantIDs[*msg.ToUserID] = true
+		}
+	}
+	return participantIDs
+}
@@ -0,0 +1,73 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"yourmail/internal/compose"
+)
+
+// maxConcurrentScans limits how many attachments of one upload are scanned
+// for viruses at once
+const maxConcurrentScans = 4
+
+// checkAttachmentType verifies an uploaded file against the configured
+// attachment type lists
+func (s *Server) checkAttachmentType(declared string, data []byte) error {
+	policy := compose.AttachmentPolicy{
+		Allowed: s.config.AllowedAttachmentTypes,
+		Blocked: s.config.BlockedAttachmentTypes,
+	}
+	return policy.Check(declared, data)
+}
+
+// scanAttachments checks attachments for viruses, several at a time, and
+// returns the ones that may be stored along with a warning for each one left
+// out. Infected files are always left out; files that could not be scanned
+// are kept only with ATTACHMENT_SCAN_FAIL_OPEN.
+func (s *Server) scanAttachments(ctx context.Context, attachments []pendingAttachment) ([]pendingAttachment, []string) {
+	warnings := make([]string, len(attachments))
+	sem := make(chan struct{}, maxConcurrentScans)
+	var wg sync.WaitGroup
+	for i := range attachments {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			warnings[i] = s.scanAttachment(ctx, &attachments[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var kept []pendingAttachment
+	var rejected []string
+	for i, a := range attachments {
+		if warnings[i] != "" {
+			rejected = append(rejected, warnings[i])
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept, rejected
+}
+
+// scanAttachment scans one attachment, returning why it must be left out or
+// "" if it may be stored
+func (s *Server) scanAttachment(ctx context.Context, a *pendingAttachment) string {
+	threat, err := s.attachmentScanner.Scan(ctx, a.Data)
+	if err != nil {
+		if s.config.AttachmentScanFailOpen {
+			slog.WarnContext(ctx, "attachment not scanned, keeping it", "file", a.OriginalFilename, "err", err)
+			return ""
+		}
+		slog.ErrorContext(ctx, "attachment not scanned, rejecting it", "file", a.OriginalFilename, "err", err)
+		return fmt.Sprintf("File %s rejected: it could not be scanned for viruses", a.OriginalFilename)
+	}
+	if threat != "" {
+		slog.WarnContext(ctx, "attachment rejected", "file", a.OriginalFilename, "reason", "virus", "threat", threat)
+		return fmt.Sprintf("File %s rejected: virus found (%s)", a.OriginalFilename, threat)
+	}
+	return ""
+}
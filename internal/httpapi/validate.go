@@ -0,0 +1,99 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"yourmail/internal/compose"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError reports one field of a request that broke one of the rules in
+// its validate tag
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"` // The rule that failed, e.g. "max"
+	Param string `json:"param,omitempty"`
+}
+
+// requestValidator checks the validate tags on request structs. Fields are
+// reported by their JSON names and "email" uses the same rules as sends.
+var requestValidator = newRequestValidator()
+
+func newRequestValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	v.RegisterValidation("email", func(fl validator.FieldLevel) bool {
+		return compose.ValidAddress(fl.Field().String())
+	})
+	return v
+}
+
+// decodeJSON decodes the request body into v and checks its validate tags,
+// writing a 400 response and returning false if either fails
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	fail := func(response map[string]interface{}) bool {
+		slog.DebugContext(r.Context(), "request rejected", "reason", response["error"])
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fail(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_json",
+			"message": fmt.Sprintf("Failed to parse JSON request: %v", err),
+		})
+	}
+
+	fields := validateRequest(v)
+	if len(fields) > 0 {
+		return fail(map[string]interface{}{
+			"success": false,
+			"error":   "validation_failed",
+			"message": fmt.Sprintf("Invalid %s: failed %s", fields[0].Field, fields[0].Error),
+			"fields":  fields,
+		})
+	}
+	return true
+}
+
+// validateRequest checks the validate tags on v, returning the fields that
+// broke them
+func validateRequest(v interface{}) []FieldError {
+	err := requestValidator.Struct(v)
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		// Anything else means v is not a struct, so it has no tags to check
+		return nil
+	}
+
+	fields := make([]FieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		// The namespace starts with the struct's type name; drop it so
+		// nested fields read like "attachments[0].filename"
+		field := fe.Namespace()
+		if _, rest, ok := strings.Cut(field, "."); ok {
+			field = rest
+		}
+		fields = append(fields, FieldError{Field: field, Error: fe.Tag(), Param: fe.Param()})
+	}
+	return fields
+}
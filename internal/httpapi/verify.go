@@ -0,0 +1,192 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+)
+
+// VerificationHookPayload is posted to VERIFICATION_HOOK_URL for every
+// verification token issued, for the receiver to email to the user
+type VerificationHookPayload struct {
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Token     string    `json:"token"`
+	Link      string    `json:"link"` // Opening it verifies the address
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// VerificationResponse is returned when a verification token is issued.
+// The token itself is only included in development.
+type VerificationResponse struct {
+	Status            string `json:"status"`
+	VerificationToken string `json:"verification_token,omitempty"`
+}
+
+// startEmailVerification issues a new verification token for the user and
+// hands it to the verification hook, if one is configured. It returns the
+// token so that development setups, which have no way to email it, can show
+// it to the user.
+func (s *Server) startEmailVerification(ctx context.Context, user *database.User) (string, error) {
+	token, err := s.userRepo.StartEmailVerification(user.ID, s.config.EmailVerificationTTL)
+	if err != nil {
+		return "", err
+	}
+	user.EmailVerified = false
+
+	if s.config.VerificationHookURL == "" {
+		if s.config.Environment != "development" {
+			slog.WarnContext(ctx, "no VERIFICATION_HOOK_URL set, verification token not sent", "username", user.Username)
+		}
+		return token, nil
+	}
+
+	payload := VerificationHookPayload{
+		Username:  user.Username,
+		Email:     user.Email,
+		Token:     token,
+		Link:      s.config.PublicURL + "/api/verify?token=" + url.QueryEscape(token),
+		ExpiresAt: time.Now().Add(s.config.EmailVerificationTTL),
+	}
+	// The hook finishes even if the client hangs up meanwhile
+	go s.postVerificationHook(context.WithoutCancel(ctx), payload)
+	return token, nil
+}
+
+// postVerificationHook delivers a verification token to the hook. Failures
+// are only logged; the user can ask for a new token.
+func (s *Server) postVerificationHook(ctx context.Context, payload VerificationHookPayload) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.WebhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode verification hook payload", "err", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.VerificationHookURL, bytes.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "invalid VERIFICATION_HOOK_URL", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.WarnContext(ctx, "verification hook failed", "username", payload.Username, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.WarnContext(ctx, "verification hook failed", "username", payload.Username, "status", resp.StatusCode)
+		return
+	}
+	slog.InfoContext(ctx, "sent verification token", "username", payload.Username)
+}
+
+// handleVerifyEmail marks an email address verified using the token from a
+// verification link
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.userRepo.VerifyEmail(token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to verify email", "err", err)
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_token",
+			"message": "Verification link is invalid or has expired",
+		})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "email verified", "username", user.Username)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleResendVerification issues a new verification token for the user's
+// email address, invalidating the previous one
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := s.userRepo.GetByID(authUser.ID)
+	if err != nil || user == nil {
+		slog.ErrorContext(r.Context(), "failed to get user", "err", err)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerified {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "already_verified",
+			"message": "Email address is already verified",
+		})
+		return
+	}
+
+	token, err := s.startEmailVerification(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to start email verification", "err", err)
+		http.Error(w, "Failed to issue verification token", http.StatusInternalServerError)
+		return
+	}
+
+	response := VerificationResponse{Status: "success"}
+	if s.config.Environment == "development" {
+		response.VerificationToken = token
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// requireVerifiedEmail writes a 403 response and returns false when sending
+// is limited to verified users and the user's address is not verified
+func (s *Server) requireVerifiedEmail(w http.ResponseWriter, r *http.Request, userID int) bool {
+	if !s.config.RequireEmailVerification {
+		return true
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		slog.ErrorContext(r.Context(), "failed to get user", "user_id", userID, "err", err)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return false
+	}
+	if user.EmailVerified {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   "email_unverified",
+		"message": fmt.Sprintf("Verify %s before sending mail", user.Email),
+	})
+	return false
+}
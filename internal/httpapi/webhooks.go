@@ -0,0 +1,241 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"yourmail/internal/auth"
+	"yourmail/internal/database"
+	"yourmail/internal/webhook"
+
+	"github.com/gorilla/mux"
+)
+
+// maxWebhooksPerUser limits how many webhooks a user can register
+const maxWebhooksPerUser = 10
+
+// minWebhookSecretLength keeps caller-chosen secrets from being guessable
+const minWebhookSecretLength = 16
+
+// WebhookRequest represents a request to register a webhook. A secret is
+// generated when none is given, and events default to every event.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// CreatedWebhook is the response to registering a webhook; it is the only
+// time the secret is returned
+type CreatedWebhook struct {
+	*database.Webhook
+	Secret string `json:"secret"`
+}
+
+// handleListWebhooks returns the current user's webhooks, without secrets
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	webhooks, err := s.webhookRepo.List(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list webhooks", "err", err)
+		http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure we always return an array, never null
+	if webhooks == nil {
+		webhooks = []*database.Webhook{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// handleCreateWebhook registers a webhook for the current user
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.webhooks.CheckURL(r.Context(), req.URL); err != nil {
+		slog.InfoContext(r.Context(), "webhook URL refused", "user_id", user.ID, "url", req.URL, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "invalid_url",
+			"message": "Webhook URL must point at a public address: " + err.Error(),
+		})
+		return
+	}
+
+	count, err := s.webhookRepo.Count(user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to count webhooks", "err", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxWebhooksPerUser {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "too_many_webhooks",
+			"message": fmt.Sprintf("At most %d webhooks can be registered", maxWebhooksPerUser),
+		})
+		return
+	}
+
+	if req.Secret == "" {
+		if req.Secret, err = webhook.NewSecret(); err != nil {
+			slog.ErrorContext(r.Context(), "failed to generate webhook secret", "err", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	created, err := s.webhookRepo.Create(user.ID, req.URL, req.Secret, req.Events)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create webhook", "err", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "webhook registered", "webhook_id", created.ID, "user_id", user.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedWebhook{Webhook: created, Secret: created.Secret})
+}
+
+// handleDeleteWebhook removes one of the current user's webhooks
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	hook, ok := s.getOwnedWebhook(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.webhookRepo.Delete(hook.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete webhook", "err", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleEnableWebhook reactivates a webhook that was disabled after
+// repeated delivery failures
+func (s *Server) handleEnableWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	hook, ok := s.getOwnedWebhook(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.webhookRepo.Enable(hook.ID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to enable webhook", "err", err)
+		http.Error(w, "Failed to enable webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// decodeWebhookRequest parses and validates a webhook body, writing an error
+// response and returning false if it is unusable
+func decodeWebhookRequest(w http.ResponseWriter, r *http.Request) (*WebhookRequest, bool) {
+	fail := func(code, message string) (*WebhookRequest, bool) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   code,
+			"message": message,
+		})
+		return nil, false
+	}
+
+	var req WebhookRequest
+	if !decodeJSON(w, r, &req) {
+		return nil, false
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fail("invalid_url", "Webhook URL must be an absolute http or https URL")
+	}
+
+	if req.Secret != "" && len(req.Secret) < minWebhookSecretLength {
+		return fail("invalid_secret", fmt.Sprintf("Webhook secret must be at least %d characters", minWebhookSecretLength))
+	}
+
+	if len(req.Events) == 0 {
+		req.Events = webhook.Events
+	}
+	for _, event := range req.Events {
+		known := false
+		for _, e := range webhook.Events {
+			if event == e {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fail("invalid_event", fmt.Sprintf("Unknown event %q; supported events: %s", event, strings.Join(webhook.Events, ", ")))
+		}
+	}
+
+	return &req, true
+}
+
+// getOwnedWebhook loads the webhook named by the {id} route variable and
+// checks that it belongs to userID, writing an error response if not
+func (s *Server) getOwnedWebhook(w http.ResponseWriter, r *http.Request, userID int) (*database.Webhook, bool) {
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	hook, err := s.webhookRepo.GetByID(webhookID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get webhook", "err", err)
+		http.Error(w, "Failed to get webhook", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if hook == nil || hook.UserID != userID {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return hook, true
+}
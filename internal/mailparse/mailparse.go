@@ -0,0 +1,216 @@
+// Package mailparse turns RFC 5322 messages, as found in mbox files or
+// received over SMTP, into the parts YourMail stores: addresses, subject,
+// a single text or HTML body, and attachments.
+package mailparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"yourmail/internal/compose"
+)
+
+// maxDepth bounds how deeply nested multipart bodies are walked
+const maxDepth = 10
+
+// Message is a parsed message
+type Message struct {
+	Header  mail.Header // The top level header, for fields not parsed here
+	From    string      // Bare address
+	To      []string    // Bare addresses, empty if there is no To header
+	ReplyTo string
+	Subject string
+	Date    time.Time // Zero if missing or malformed
+
+	MessageID  string
+	InReplyTo  string
+	References []string
+
+	Body        string
+	IsHTML      bool
+	Attachments []*Attachment
+}
+
+// Attachment is a MIME part that is not the message body
+type Attachment struct {
+	Filename    string // Always set; generated for unnamed parts
+	ContentType string // As declared, with its parameters
+	ContentID   string // Without angle brackets; empty if there is none
+	Data        []byte
+}
+
+// Parse parses a message. The body is the first text/plain part, or the
+// first text/html part if there is none; parts marked as attachments, or
+// that are not text, become attachments. Messages without a usable From
+// header are rejected.
+func Parse(raw []byte) (*Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("malformed message: %v", err)
+	}
+
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid From header: %v", err)
+	}
+
+	msg := &Message{
+		Header:     m.Header,
+		From:       from.Address,
+		Subject:    decodeHeaderWords(m.Header.Get("Subject")),
+		MessageID:  compose.ParseMessageID(m.Header.Get("Message-ID")),
+		InReplyTo:  compose.ParseMessageID(m.Header.Get("In-Reply-To")),
+		References: compose.ParseMessageIDs(m.Header.Get("References")),
+	}
+	if to, err := m.Header.AddressList("To"); err == nil {
+		for _, addr := range to {
+			msg.To = append(msg.To, addr.Address)
+		}
+	}
+	if replyTo, err := m.Header.AddressList("Reply-To"); err == nil && len(replyTo) > 0 {
+		msg.ReplyTo = replyTo[0].Address
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	var plain, html *string
+	var walk func(header mail.Header, body io.Reader, depth int) error
+	walk = func(header mail.Header, body io.Reader, depth int) error {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "text/plain; charset=us-ascii"
+		}
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType, params = "application/octet-stream", nil
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") && depth < maxDepth {
+			parts := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := parts.NextRawPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("malformed MIME body: %v", err)
+				}
+				if err := walk(mail.Header(part.Header), part, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		data, err := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+		if err != nil {
+			return fmt.Errorf("malformed MIME body: %v", err)
+		}
+		if depth == 0 {
+			// The line break ending a single part body is not part of the
+			// text
+			data = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+		}
+
+		disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+		filename := dispParams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+
+		if disposition != "attachment" && filename == "" {
+			switch {
+			case mediaType == "text/plain" && plain == nil:
+				text := decodeCharset(params["charset"], data)
+				plain = &text
+				return nil
+			case mediaType == "text/html" && html == nil:
+				text := decodeCharset(params["charset"], data)
+				html = &text
+				return nil
+			}
+		}
+
+		if filename == "" {
+			filename = fmt.Sprintf("attachment-%d", len(msg.Attachments)+1)
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				filename += exts[0]
+			}
+		}
+		msg.Attachments = append(msg.Attachments, &Attachment{
+			Filename:    decodeHeaderWords(filename),
+			ContentType: contentType,
+			ContentID:   compose.ContentID(header.Get("Content-ID")),
+			Data:        data,
+		})
+		return nil
+	}
+	if err := walk(m.Header, m.Body, 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case plain != nil:
+		msg.Body = *plain
+	case html != nil:
+		msg.Body, msg.IsHTML = *html, true
+	}
+	return msg, nil
+}
+
+// decodeTransferEncoding reads a MIME part body, undoing its
+// Content-Transfer-Encoding
+func decodeTransferEncoding(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// Encoded lines are wrapped, which the decoder does not expect
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data)
+		return base64.StdEncoding.DecodeString(string(data))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(body))
+	default:
+		return io.ReadAll(body)
+	}
+}
+
+// decodeCharset converts text in the given charset to UTF-8. Latin-1 is
+// converted; other charsets are assumed to be UTF-8 compatible, with any
+// invalid bytes replaced.
+func decodeCharset(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return strings.ToValidUTF8(string(data), "\uFFFD")
+}
+
+// decodeHeaderWords decodes RFC 2047 encoded words in a header value,
+// returning the value unchanged if it cannot be decoded
+func decodeHeaderWords(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
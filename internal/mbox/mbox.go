@@ -0,0 +1,162 @@
+// Package mbox reads and writes mailboxes in the mboxrd format: messages
+// one after another, each starting with a "From " separator line, with any
+// body line that starts with optional '>' characters followed by "From "
+// quoted by one more '>'.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// separatorTime is the date layout of the "From " separator line, as
+// written by asctime
+const separatorTime = "Mon Jan _2 15:04:05 2006"
+
+// ErrNotMbox is returned by Reader.Next when the input does not start with
+// a "From " separator line
+var ErrNotMbox = errors.New("not an mbox file: missing From separator line")
+
+// Writer writes messages to an mbox
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer that writes an mbox to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteMessage appends a message to the mbox. from is the envelope sender
+// for the separator line and msg is the message in RFC 5322 format, with
+// either LF or CRLF line endings.
+func (mw *Writer) WriteMessage(from string, date time.Time, msg []byte) error {
+	if from == "" || strings.ContainsAny(from, " \t\r\n") {
+		from = "MAILER-DAEMON"
+	}
+	if _, err := mw.w.WriteString("From " + from + " " + date.UTC().Format(separatorTime) + "\n"); err != nil {
+		return err
+	}
+
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+
+		if isFromLine(line) {
+			if err := mw.w.WriteByte('>'); err != nil {
+				return err
+			}
+		}
+		if _, err := mw.w.Write(line); err != nil {
+			return err
+		}
+		if err := mw.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+
+	// A blank line separates messages
+	if err := mw.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+// isFromLine reports whether a line must be quoted: any number of '>'
+// followed by "From "
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// Reader reads messages from an mbox
+type Reader struct {
+	r       *bufio.Reader
+	started bool // Set once the first separator line has been read
+}
+
+// NewReader returns a Reader that reads an mbox from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message in the mbox with its quoted "From " lines
+// restored and LF line endings, or io.EOF when there are no more. Any line
+// starting with "From " begins a new message, as unquoted ones can only be
+// separators.
+func (mr *Reader) Next() ([]byte, error) {
+	if !mr.started {
+		if err := mr.skipToFirstMessage(); err != nil {
+			return nil, err
+		}
+		mr.started = true
+	}
+
+	var msg bytes.Buffer
+	for {
+		if peek, _ := mr.r.Peek(5); bytes.Equal(peek, []byte("From ")) {
+			if msg.Len() == 0 {
+				// Two separators in a row; skip the empty message
+				if _, err := mr.r.ReadBytes('\n'); err != nil && err != io.EOF {
+					return nil, err
+				}
+				continue
+			}
+			break
+		}
+
+		line, err := mr.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			if msg.Len() == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(line) > 0 && line[0] == '>' && isFromLine(line) {
+			line = line[1:]
+		}
+		msg.Write(line)
+		msg.WriteByte('\n')
+	}
+
+	// Drop the blank line that separates messages
+	data := msg.Bytes()
+	if bytes.HasSuffix(data, []byte("\n\n")) {
+		data = data[:len(data)-1]
+	}
+	return data, nil
+}
+
+// skipToFirstMessage consumes the first separator line, allowing for blank
+// lines before it
+func (mr *Reader) skipToFirstMessage() error {
+	for {
+		line, err := mr.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err == io.EOF {
+				return io.EOF
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("From ")) {
+			return ErrNotMbox
+		}
+		return nil
+	}
+}
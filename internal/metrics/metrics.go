@@ -0,0 +1,136 @@
+// Package metrics provides a minimal metrics registry that is exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can be written in the exposition format
+type metric interface {
+	name() string
+	help() string
+	kind() string
+	value() float64
+}
+
+// registry holds all registered metrics keyed by name
+var registry = struct {
+	sync.RWMutex
+	metrics map[string]metric
+}{metrics: make(map[string]metric)}
+
+// register adds a metric, replacing any existing metric with the same name
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics[m.name()] = m
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	metricName string
+	metricHelp string
+	count      atomic.Int64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, metricHelp: help}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.count.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	c.count.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.count.Load()
+}
+
+func (c *Counter) name() string   { return c.metricName }
+func (c *Counter) help() string   { return c.metricHelp }
+func (c *Counter) kind() string   { return "counter" }
+func (c *Counter) value() float64 { return float64(c.count.Load()) }
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	metricName string
+	metricHelp string
+	bits       atomic.Uint64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, metricHelp: help}
+	register(g)
+	return g
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) name() string   { return g.metricName }
+func (g *Gauge) help() string   { return g.metricHelp }
+func (g *Gauge) kind() string   { return "gauge" }
+func (g *Gauge) value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+// funcMetric is a metric whose value is read from a callback at scrape time
+type funcMetric struct {
+	metricName string
+	metricHelp string
+	metricKind string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn on each scrape
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&funcMetric{metricName: name, metricHelp: help, metricKind: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is computed by fn on each
+// scrape; fn must return a monotonically increasing value
+func NewCounterFunc(name, help string, fn func() float64) {
+	register(&funcMetric{metricName: name, metricHelp: help, metricKind: "counter", fn: fn})
+}
+
+func (f *funcMetric) name() string   { return f.metricName }
+func (f *funcMetric) help() string   { return f.metricHelp }
+func (f *funcMetric) kind() string   { return f.metricKind }
+func (f *funcMetric) value() float64 { return f.fn() }
+
+// Handler returns an HTTP handler serving all registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.RLock()
+		metrics := make([]metric, 0, len(registry.metrics))
+		for _, m := range registry.metrics {
+			metrics = append(metrics, m)
+		}
+		registry.RUnlock()
+
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name(), m.help())
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.name(), m.kind())
+			fmt.Fprintf(w, "%s %v\n", m.name(), m.value())
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"yourmail/config"
+	"yourmail/internal/database"
+	"yourmail/internal/database/dbtest"
+)
+
+// replyTimeout bounds how long a test waits on the session
+const replyTimeout = 5 * time.Second
+
+// newTestServer returns a TCP protocol server backed by a fresh SQLite
+// database, with the default configuration changed by configure if set
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) *Server {
+	t.Helper()
+	cfg := config.Load()
+	cfg.ServerHost = "localhost"
+	if configure != nil {
+		configure(cfg)
+	}
+	db, _ := dbtest.Open(t)
+	db.SetMessageIDHost(cfg.ServerHost)
+	return NewServer(cfg, db)
+}
+
+// createTestUser adds a user with the password "password123"
+func createTestUser(t *testing.T, s *Server, username string) *database.User {
+	t.Helper()
+	user, err := s.userRepo.Create(username, username+"@example.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+	return user
+}
+
+// testClient is the client end of a session run over net.Pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	done   chan struct{} // Closed once the session has ended
+}
+
+// dial runs a session of s over net.Pipe and returns its client, having
+// read the greeting
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	c := &testClient{t: t, conn: clientConn, reader: bufio.NewReader(clientConn), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		s.handle(serverConn)
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-c.done
+	})
+	c.expect("220 ")
+	return c
+}
+
+// send writes a command line
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("failed to send %.40q: %v", line, err)
+	}
+}
+
+// readLine returns the next reply line, without its CRLF
+func (c *testClient) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// expect reads the next reply line and fails the test unless it starts
+// with prefix
+func (c *testClient) expect(prefix string) string {
+	c.t.Helper()
+	line := c.readLine()
+	if !strings.HasPrefix(line, prefix) {
+		c.t.Fatalf("got reply %q, want one starting %q", line, prefix)
+	}
+	return line
+}
+
+// command sends a line and expects a reply starting with prefix
+func (c *testClient) command(line, prefix string) string {
+	c.t.Helper()
+	c.send(line)
+	return c.expect(prefix)
+}
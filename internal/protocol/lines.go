@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// lineSplitter is a bufio.SplitFunc source that behaves like bufio.ScanLines
+// but survives lines longer than maxLen. Instead of failing the scanner with
+// bufio.ErrTooLong, the rest of an oversized line is discarded and an empty
+// token is returned with tooLong set, so the session can reject the line and
+// keep reading.
+type lineSplitter struct {
+	maxLen     int
+	discarding bool // Skipping the remainder of an oversized line
+	tooLong    bool // The last token was an oversized line
+}
+
+// bufferSize is the scanner buffer size needed for lines of maxLen bytes
+// plus a CRLF terminator
+func (ls *lineSplitter) bufferSize() int {
+	return ls.maxLen + 2
+}
+
+// split implements bufio.SplitFunc
+func (ls *lineSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	ls.tooLong = false
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line := bytes.TrimSuffix(data[:i], []byte("\r"))
+		if ls.discarding || len(line) > ls.maxLen {
+			ls.discarding = false
+			ls.tooLong = true
+			return i + 1, []byte{}, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	}
+
+	// No newline yet. If the buffer is full the line is too long: drop what
+	// we have and keep discarding until the newline arrives.
+	if len(data) >= ls.bufferSize() {
+		ls.discarding = true
+		return len(data), nil, nil
+	}
+
+	if atEOF && len(data) > 0 {
+		if ls.discarding {
+			ls.discarding = false
+			ls.tooLong = true
+			return len(data), []byte{}, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	}
+
+	// Request more data
+	return 0, nil, nil
+}
@@ -1,57 +1,299 @@
 package protocol
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"yourmail/config"
 	"yourmail/internal/database"
+	"yourmail/internal/metrics"
 )
 
-// Server represents the TCP protocol server
+// refuseTimeout bounds how long sending the busy reply to a refused
+// connection may take
+const refuseTimeout = 5 * time.Second
+
+// Server accepts client connections on a port and runs a session for each.
+// It serves the YourMail TCP protocol or, from NewSMTPServer, SMTP.
 type Server struct {
 	config       *config.Config
 	db           *database.DB
 	userRepo     *database.UserRepository
 	messageRepo  *database.MessageRepository
+	attachRepo   *database.AttachmentRepository
+	blockRepo    *database.BlockRepository
+	loginRepo    *database.LoginEventRepository
 	listener     net.Listener
 	shutdownChan chan struct{}
+
+	name   string           // Protocol name for logs
+	port   string
+	handle func(net.Conn) // Runs a session, closing the connection when done
+	// Reply sent to connections refused because the server is full
+	busyReply string
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{} // Open client connections
+	sessions sync.WaitGroup
+	refused  *metrics.Counter
 }
 
 // NewServer creates a new TCP protocol server
 func NewServer(cfg *config.Config, db *database.DB) *Server {
+	s := newServer(cfg, db, "TCP", cfg.TCPPort)
+	s.busyReply = "421 Too many connections, try again later"
+	s.handle = func(conn net.Conn) {
+		session := NewSession(conn, s.userRepo, s.messageRepo, s.blockRepo, s.loginRepo, s.config)
+		session.server = s
+		session.Handle()
+	}
+	return s
+}
+
+// newServer creates a server for a protocol; the caller sets handle
+func newServer(cfg *config.Config, db *database.DB, name, port string) *Server {
 	attachmentRepo := database.NewAttachmentRepository(db)
-	return &Server{
+	s := &Server{
 		config:       cfg,
 		db:           db,
 		userRepo:     database.NewUserRepository(db),
 		messageRepo:  database.NewMessageRepository(db, attachmentRepo),
+		attachRepo:   attachmentRepo,
+		blockRepo:    database.NewBlockRepository(db),
+		loginRepo:    database.NewLoginEventRepository(db),
 		listener:     nil,
 		shutdownChan: make(chan struct{}),
+		name:         name,
+		port:         port,
+		conns:        make(map[net.Conn]struct{}),
 	}
+
+	prefix := "yourmail_" + strings.ToLower(name)
+	metrics.NewGaugeFunc(prefix+"_connections", "Number of open "+name+" client connections", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.conns))
+	})
+	s.refused = metrics.NewCounter(prefix+"_refused_connections_total",
+		"Total number of "+name+" connections refused because the connection limit was reached")
+	return s
 }
 
-// Start starts the TCP server
+// Start listens on the server's port and serves connections. It returns
+// nil once Shutdown is called.
 func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", ":"+s.config.TCPPort)
+	listener, err := net.Listen("tcp", ":"+s.port)
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve serves connections accepted on listener, which it closes when it
+// returns. It returns nil once Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.shutdownChan:
+		// Shut down before we started listening
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	default:
+	}
+	s.listener = listener
+	s.mu.Unlock()
 	defer listener.Close()
 
-	log.Printf("🔌 TCP server listening on :%s", s.config.TCPPort)
+	slog.Info(s.name+" server listening", "addr", listener.Addr().String())
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			select {
+			case <-s.shutdownChan:
+				return nil
+			default:
+			}
+			slog.Error("failed to accept connection", "err", err)
 			continue
 		}
 
+		s.mu.Lock()
+		select {
+		case <-s.shutdownChan:
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		if len(s.conns) >= s.config.TCPMaxConnections {
+			s.mu.Unlock()
+			s.refused.Inc()
+			slog.Warn(s.name+" connection refused, connection limit reached",
+				"client", conn.RemoteAddr().String(), "limit", s.config.TCPMaxConnections)
+			go s.refuse(conn)
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.sessions.Add(1)
+		s.mu.Unlock()
+
 		// Handle each client connection in a separate goroutine
 		go func() {
-			session := NewSession(conn, s.userRepo, s.messageRepo, s.config.ServerHost)
-			session.Handle()
+			defer s.sessions.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			s.handle(conn)
 		}()
 	}
-} 
\ No newline at end of file
+}
+
+// Shutdown stops accepting connections and ends every session once its
+// current command has been handled. If sessions are still running when ctx
+// expires their connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	select {
+	case <-s.shutdownChan:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	close(s.shutdownChan)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// Interrupt sessions waiting for their next command; a command that is
+	// being handled still gets to write its response
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info(s.name + " server stopped")
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// refuse tells a client the server is full and closes its connection
+func (s *Server) refuse(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	conn.Write([]byte(s.busyReply + "\r\n"))
+}
+
+// extendDeadline gives a session's client TCP_IDLE_TIMEOUT to send its next
+// command. Once the server is shutting down the deadline Shutdown set is
+// left alone, so the session still ends after its current command.
+func (s *Server) extendDeadline(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stoppingLocked() {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(s.config.TCPIdleTimeout))
+}
+
+// stopping reports whether Shutdown has been called
+func (s *Server) stopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stoppingLocked()
+}
+
+// stoppingLocked is stopping for callers holding s.mu
+func (s *Server) stoppingLocked() bool {
+	select {
+	case <-s.shutdownChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reasons a session ends, as logged when its connection closes
+const (
+	endDisconnected = "client disconnected"
+	endIdle         = "idle timeout"
+	endNotReading   = "client stopped reading replies"
+	endShutdown     = "server shutting down"
+	endReadError    = "read error"
+)
+
+// endReason tells why a session stopped reading: readErr is its scanner's
+// error, nil at end of input, and writeErr the error of a reply that could
+// not be sent. s may be nil for a session not run by a server.
+func (s *Server) endReason(readErr, writeErr error) string {
+	var netErr net.Error
+	switch {
+	case writeErr != nil:
+		return endNotReading
+	case readErr == nil || errors.Is(readErr, syscall.ECONNRESET):
+		return endDisconnected
+	case s != nil && s.stopping():
+		return endShutdown
+	case s != nil && errors.As(readErr, &netErr) && netErr.Timeout():
+		return endIdle
+	}
+	return endReadError
+}
+
+// writeReply sends a line to a session's client. A client that doesn't take
+// it within TCP_IDLE_TIMEOUT has stopped reading, and its connection is
+// closed to end the session. s may be nil for a session not run by a
+// server, whose writes have no deadline.
+func (s *Server) writeReply(conn net.Conn, line string) error {
+	if s != nil {
+		conn.SetWriteDeadline(time.Now().Add(s.config.TCPIdleTimeout))
+	}
+	if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// recordLogin adds a login attempt to the audit log. user is nil if the
+// attempt failed. The write runs in the background so it doesn't hold up
+// the session.
+func recordLogin(repo *database.LoginEventRepository, conn net.Conn, protocol, username string, user *database.User, logger *slog.Logger) {
+	event := database.LoginEvent{
+		IP:       conn.RemoteAddr().String(),
+		Protocol: protocol,
+		Success:  user != nil,
+	}
+	if user != nil {
+		event.UserID = user.ID
+	}
+
+	go func() {
+		if err := repo.Record(username, event); err != nil {
+			logger.Error("failed to record login", "username", username, "err", err)
+		}
+	}()
+}
@@ -2,38 +2,74 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
+	"yourmail/config"
+	"yourmail/internal/compose"
 	"yourmail/internal/database"
 )
 
+// maxRecipients limits how many recipients a single SEND may name
+const maxRecipients = 50
+
+// maxSearchResults limits how many message IDs a SEARCH returns
+const maxSearchResults = 100
+
 // Session represents a TCP client session
 type Session struct {
 	conn         net.Conn
 	scanner      *bufio.Scanner
+	lines        *lineSplitter
+	logger       *slog.Logger // Tags every line with the client address
+	banner       string
+	maxInbox     int
+	quota        int64
+	maxBody      int64 // Largest body accepted by BODY
 	userRepo     *database.UserRepository
 	msgRepo      *database.MessageRepository
+	blockRepo    *database.BlockRepository
+	loginRepo    *database.LoginEventRepository
+	server       *Server // The server running the session, if any
+	writeErr     error   // Why a reply could not be sent, ending the session
 	serverHost   string
+	requireVerified bool // Only users with a verified email may send
 	authenticated bool
 	currentUser   *database.User
 	currentMessage struct {
-		to      string
+		to      []string
 		subject string
 		body    string
 	}
 }
 
 // NewSession creates a new session
-func NewSession(conn net.Conn, userRepo *database.UserRepository, msgRepo *database.MessageRepository, serverHost string) *Session {
+func NewSession(conn net.Conn, userRepo *database.UserRepository, msgRepo *database.MessageRepository, blockRepo *database.BlockRepository, loginRepo *database.LoginEventRepository, cfg *config.Config) *Session {
+	lines := &lineSplitter{maxLen: cfg.TCPMaxLineLength}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), lines.bufferSize())
+	scanner.Split(lines.split)
+
 	return &Session{
 		conn:       conn,
-		scanner:    bufio.NewScanner(conn),
+		scanner:    scanner,
+		lines:      lines,
+		logger:     slog.With("client", conn.RemoteAddr().String()),
+		banner:     cfg.TCPBanner,
+		maxInbox:   cfg.MaxInboxMessages,
+		quota:      cfg.MailboxQuota,
+		maxBody:    cfg.TCPMaxMessageBytes,
 		userRepo:   userRepo,
 		msgRepo:    msgRepo,
-		serverHost: serverHost,
+		blockRepo:  blockRepo,
+		loginRepo:  loginRepo,
+		serverHost: cfg.ServerHost,
+		requireVerified: cfg.RequireEmailVerification,
 	}
 }
 
@@ -41,18 +77,23 @@ func NewSession(conn net.Conn, userRepo *database.UserRepository, msgRepo *datab
 func (s *Session) Handle() {
 	defer s.conn.Close()
 	
-	clientAddr := s.conn.RemoteAddr().String()
-	log.Printf("New TCP connection from %s", clientAddr)
+	s.logger.Info("TCP connection opened")
 	
-	s.sendResponse("220 YourMail Server ready")
+	s.sendGreeting()
 	
-	for s.scanner.Scan() {
+	for s.nextLine() {
+		if s.lines.tooLong {
+			s.logger.Warn("rejected line that is too long", "max_bytes", s.lines.maxLen)
+			s.sendResponse("500 Line too long")
+			continue
+		}
+		
 		line := strings.TrimSpace(s.scanner.Text())
 		if line == "" {
 			continue
 		}
 		
-		log.Printf("[%s] Command: %s", clientAddr, line)
+		s.logger.Debug("TCP command", "line", line)
 		
 		parts := strings.SplitN(line, " ", 2)
 		command := strings.ToUpper(parts[0])
@@ -73,22 +114,59 @@ func (s *Session) Handle() {
 		case "QUIT":
 			s.handleQuit()
 			return
+		case "CAPABILITIES", "EHLO":
+			s.handleCapabilities()
 		case "HELP":
 			s.handleHelp()
 		case "LIST":
 			s.handleList()
 		case "READ":
 			s.handleRead(args)
+		case "FETCH":
+			s.handleFetch(args)
+		case "SEARCH":
+			s.handleSearch(args)
+		case "STATUS":
+			s.handleStatus()
+		case "RESET", "ABORT":
+			s.handleReset()
 		default:
 			s.sendResponse("500 Unknown command: " + command)
 		}
 	}
 	
-	if err := s.scanner.Err(); err != nil {
-		log.Printf("Scanner error for %s: %v", clientAddr, err)
+	reason := s.server.endReason(s.scanner.Err(), s.writeErr)
+	switch reason {
+	case endIdle:
+		s.sendResponse("421 Timeout, closing connection")
+	case endReadError:
+		s.logger.Warn("TCP read failed", "err", s.scanner.Err())
 	}
 	
-	log.Printf("Connection from %s closed", clientAddr)
+	s.logger.Info("TCP connection closed", "reason", reason)
+}
+
+// nextLine reads the client's next line, giving it TCP_IDLE_TIMEOUT to
+// arrive when the session is run by a server
+func (s *Session) nextLine() bool {
+	if s.server != nil {
+		s.server.extendDeadline(s.conn)
+	}
+	return s.scanner.Scan()
+}
+
+// sendGreeting sends the configured banner. Multi-line banners use "220-"
+// continuation lines, with "220 " marking the last line.
+func (s *Session) sendGreeting() {
+	lines := strings.Split(strings.TrimRight(s.banner, "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if i < len(lines)-1 {
+			s.sendResponse("220-" + line)
+		} else {
+			s.sendResponse("220 " + line)
+		}
+	}
 }
 
 // handleConnect authenticates the user
@@ -103,8 +181,15 @@ func (s *Session) handleConnect(args string) {
 	
 	// Authenticate user
 	user, err := s.userRepo.Authenticate(username, password)
+	if err == nil || errors.Is(err, database.ErrAccountDisabled) {
+		recordLogin(s.loginRepo, s.conn, database.LoginTCP, username, user, s.logger)
+	}
+	if errors.Is(err, database.ErrAccountDisabled) {
+		s.sendResponse("535 Account suspended")
+		return
+	}
 	if err != nil {
-		log.Printf("Authentication error: %v", err)
+		s.logger.Error("authentication failed", "username", username, "err", err)
 		s.sendResponse("500 Authentication failed")
 		return
 	}
@@ -117,7 +202,7 @@ func (s *Session) handleConnect(args string) {
 	s.authenticated = true
 	s.currentUser = user
 	s.sendResponse(fmt.Sprintf("250 Hello %s, authenticated successfully", username))
-	log.Printf("User %s authenticated successfully", username)
+	s.logger.Info("user authenticated", "username", username)
 }
 
 // handleSend sets the recipient for the message
@@ -126,14 +211,35 @@ func (s *Session) handleSend(args string) {
 		s.sendResponse("530 Not authenticated")
 		return
 	}
+	if s.requireVerified && !s.currentUser.EmailVerified {
+		s.sendResponse("530 Verify your email address before sending mail")
+		return
+	}
 	
-	if args == "" {
-		s.sendResponse("501 Usage: SEND <recipient@host>")
+	to := compose.SplitRecipients(args)
+	if len(to) == 0 {
+		s.sendResponse("501 Usage: SEND <recipient@host> [<recipient@host> ...]")
+		return
+	}
+	if len(to) > maxRecipients {
+		s.sendResponse(fmt.Sprintf("501 At most %d recipients are allowed", maxRecipients))
 		return
 	}
+	for i, addr := range to {
+		normalized, err := compose.NormalizeAddress(addr)
+		if err != nil {
+			s.sendResponse("501 Invalid recipient: " + addr)
+			return
+		}
+		to[i] = normalized
+	}
 	
-	s.currentMessage.to = args
-	s.sendResponse("250 Recipient set to " + args)
+	s.currentMessage.to = to
+	if len(to) == 1 {
+		s.sendResponse("250 Recipient set to " + to[0])
+	} else {
+		s.sendResponse("250 Recipients set to " + strings.Join(to, ", "))
+	}
 }
 
 // handleSubject sets the subject for the message
@@ -143,7 +249,7 @@ func (s *Session) handleSubject(args string) {
 		return
 	}
 	
-	if s.currentMessage.to == "" {
+	if len(s.currentMessage.to) == 0 {
 		s.sendResponse("503 Use SEND command first")
 		return
 	}
@@ -152,55 +258,196 @@ func (s *Session) handleSubject(args string) {
 	s.sendResponse("250 Subject set")
 }
 
-// handleBody sets the body and sends the message
+// handleBody sets the body and sends the message. Without arguments the
+// body is read from the lines that follow, up to a line holding only ".".
 func (s *Session) handleBody(args string) {
 	if !s.authenticated {
 		s.sendResponse("530 Not authenticated")
 		return
 	}
 	
-	if s.currentMessage.to == "" || s.currentMessage.subject == "" {
+	if len(s.currentMessage.to) == 0 || s.currentMessage.subject == "" {
 		s.sendResponse("503 Use SEND and SUBJECT commands first")
 		return
 	}
 	
-	s.currentMessage.body = args
+	body := args
+	if body == "" {
+		s.sendResponse(`354 Enter message body, end with "." on a line by itself`)
+		var tooLarge, ok bool
+		body, tooLarge, ok = s.readBody()
+		if !ok {
+			return
+		}
+		if tooLarge {
+			s.logger.Warn("rejected message body that is too large", "max_bytes", s.maxBody)
+			s.sendResponse(fmt.Sprintf("552 Message body exceeds %d bytes", s.maxBody))
+			return
+		}
+	} else if int64(len(body)) > s.maxBody {
+		s.sendResponse(fmt.Sprintf("552 Message body exceeds %d bytes", s.maxBody))
+		return
+	}
+	
+	sig := compose.Signature{Text: s.currentUser.Signature, HTML: s.currentUser.SignatureHTML}
+	s.currentMessage.body = compose.ApplySignature(body, false, false, sig)
 	
 	// Create from address
 	fromAddress := fmt.Sprintf("%s@%s", s.currentUser.Username, s.serverHost)
 	
+	// Deliver to each recipient on its own, so one full mailbox doesn't stop
+	// the others
+	to := s.currentMessage.to
+	results := make([]string, len(to))
+	var threadID *string
+	sent := 0
+	for i, addr := range to {
+		message, reply := s.deliverTo(addr, fromAddress, threadID)
+		results[i] = reply
+		if message != nil {
+			threadID = message.ThreadID
+			sent++
+		}
+	}
+	
+	s.resetMessage()
+	
+	if len(to) == 1 {
+		s.sendResponse(results[0])
+		return
+	}
+	if sent == 0 {
+		s.sendResponse("554 Message could not be sent to any recipient:")
+	} else {
+		s.sendResponse(fmt.Sprintf("250 Message sent to %d of %d recipients:", sent, len(to)))
+	}
+	for i, addr := range to {
+		s.sendResponse(fmt.Sprintf("  %s: %s", addr, results[i]))
+	}
+}
+
+// readBody reads body lines up to the terminating ".", undoing dot stuffing
+// as FETCH applies it. Bodies over TCP_MAX_MESSAGE_BYTES, or with a line
+// over TCP_MAX_LINE_LENGTH, are read to the end but not kept. It returns
+// false if the connection ended first.
+func (s *Session) readBody() (body string, tooLarge, ok bool) {
+	var buf strings.Builder
+	for s.nextLine() {
+		if s.lines.tooLong {
+			tooLarge = true
+			continue
+		}
+		line := s.scanner.Text()
+		if line == "." {
+			return buf.String(), tooLarge, true
+		}
+		line = strings.TrimPrefix(line, ".")
+		
+		if buf.Len() > 0 {
+			line = "\n" + line
+		}
+		if int64(buf.Len()+len(line)) > s.maxBody {
+			tooLarge = true
+			continue
+		}
+		buf.WriteString(line)
+	}
+	return "", false, false
+}
+
+// deliverTo stores a copy of the message being composed for one recipient,
+// joining threadID if set. It returns the stored message, or nil if it was
+// refused, along with the reply line describing the outcome.
+func (s *Session) deliverTo(to, fromAddress string, threadID *string) (*database.Message, string) {
 	// Check if recipient is local
 	var toUserID *int
-	if strings.Contains(s.currentMessage.to, "@") {
-		parts := strings.Split(s.currentMessage.to, "@")
-		if len(parts) == 2 && parts[1] == s.serverHost {
+	if strings.Contains(to, "@") {
+		parts := strings.Split(to, "@")
+		if len(parts) == 2 && strings.EqualFold(parts[1], s.serverHost) {
 			// Local user
 			localUser, err := s.userRepo.GetByUsername(parts[0])
 			if err != nil {
-				log.Printf("Failed to lookup local user: %v", err)
+				s.logger.Error("failed to look up local user", "username", parts[0], "err", err)
 			} else if localUser != nil {
 				toUserID = &localUser.ID
 			}
 		}
 	}
 	
+	// Refuse mail for local recipients whose mailbox is over quota
+	if toUserID != nil && s.quota > 0 {
+		used, err := s.msgRepo.GetUserStorageUsage(*toUserID)
+		if err != nil {
+			s.logger.Error("failed to get storage usage", "user_id", *toUserID, "err", err)
+			return nil, "451 Failed to check recipient mailbox"
+		}
+		if used+int64(len(s.currentMessage.body)) > s.quota {
+			return nil, "552 Recipient mailbox full"
+		}
+	}
+	
+	// Mail to someone who blocked the sender is dropped, keeping only the
+	// sender's copy, but reported like any local delivery
+	blocked := senderBlocked(s.blockRepo, s.logger, toUserID, fromAddress)
+	if blocked {
+		toUserID = nil
+	}
+
 	// Store message in database
-	message, err := s.msgRepo.Create(&s.currentUser.ID, toUserID, fromAddress, s.currentMessage.to, s.currentMessage.subject, s.currentMessage.body)
+	message, err := s.msgRepo.CreateWithThreading(&s.currentUser.ID, toUserID, fromAddress, to, s.currentUser.ReplyTo, s.currentMessage.subject, s.currentMessage.body, false, threadID, nil)
 	if err != nil {
-		log.Printf("Failed to store message: %v", err)
-		s.sendResponse("550 Failed to send message")
-		return
+		s.logger.Error("failed to store message", "err", err)
+		return nil, "550 Failed to send message"
 	}
 	
-	// Clear current message
+	if toUserID != nil || blocked {
+		if err := s.msgRepo.SetDeliveryStatus(message.ID, database.DeliveryLocal, ""); err != nil {
+			s.logger.Error("failed to record delivery status", "message_id", message.ID, "err", err)
+		}
+	}
+	
+	// Keep the recipient's mailbox within the configured limit
+	if toUserID != nil && s.maxInbox > 0 {
+		if _, err := s.msgRepo.EnforceInboxLimit(*toUserID, s.maxInbox); err != nil {
+			s.logger.Error("failed to enforce inbox limit", "user_id", *toUserID, "err", err)
+		}
+	}
+	
+	s.logger.Info("message sent", "id", message.ID, "from", fromAddress, "to", to)
+	return message, fmt.Sprintf("250 Message sent successfully (ID: %d)", message.ID)
+}
+
+// senderBlocked reports whether a local recipient has blocked mail from an
+// address. If the blocklist cannot be read the mail is let through.
+func senderBlocked(repo *database.BlockRepository, logger *slog.Logger, toUserID *int, from string) bool {
+	if toUserID == nil {
+		return false
+	}
+
+	blocked, err := repo.IsBlocked(*toUserID, from)
+	if err != nil {
+		logger.Error("failed to check blocklist", "user_id", *toUserID, "err", err)
+		return false
+	}
+	if blocked {
+		logger.Info("dropping mail from blocked sender", "user_id", *toUserID, "from", from)
+	}
+	return blocked
+}
+
+// handleReset discards the message being composed
+func (s *Session) handleReset() {
+	s.resetMessage()
+	s.sendResponse("250 Reset")
+}
+
+// resetMessage clears the message being composed
+func (s *Session) resetMessage() {
 	s.currentMessage = struct {
-		to      string
+		to      []string
 		subject string
 		body    string
 	}{}
-	
-	s.sendResponse(fmt.Sprintf("250 Message sent successfully (ID: %d)", message.ID))
-	log.Printf("Message sent from %s to %s", fromAddress, s.currentMessage.to)
 }
 
 // handleList shows the user's inbox
@@ -210,9 +457,9 @@ func (s *Session) handleList() {
 		return
 	}
 	
-	messages, err := s.msgRepo.GetInboxForUser(s.currentUser.ID, 20, 0)
+	messages, err := s.msgRepo.GetInboxForUser(s.currentUser.ID, database.InboxOptions{Limit: 20})
 	if err != nil {
-		log.Printf("Failed to get messages: %v", err)
+		s.logger.Error("failed to get messages", "err", err)
 		s.sendResponse("550 Failed to retrieve messages")
 		return
 	}
@@ -228,8 +475,8 @@ func (s *Session) handleList() {
 		if msg.ReadStatus {
 			readStatus = "read"
 		}
-		s.sendResponse(fmt.Sprintf("  %d. From: %s | Subject: %s | %s | %s", 
-			i+1, msg.FromAddress, msg.Subject, readStatus, msg.CreatedAt.Format("2006-01-02 15:04")))
+		s.sendResponse(fmt.Sprintf("  %d. ID: %d | From: %s | Subject: %s | %s | %s", 
+			i+1, msg.ID, msg.FromAddress, msg.Subject, readStatus, msg.CreatedAt.Format("2006-01-02 15:04")))
 	}
 }
 
@@ -246,9 +493,9 @@ func (s *Session) handleRead(args string) {
 	}
 	
 	// For simplicity, let's get recent messages and use the number as index
-	messages, err := s.msgRepo.GetInboxForUser(s.currentUser.ID, 20, 0)
+	messages, err := s.msgRepo.GetInboxForUser(s.currentUser.ID, database.InboxOptions{Limit: 20})
 	if err != nil {
-		log.Printf("Failed to get messages: %v", err)
+		s.logger.Error("failed to get messages", "err", err)
 		s.sendResponse("550 Failed to retrieve messages")
 		return
 	}
@@ -262,12 +509,15 @@ func (s *Session) handleRead(args string) {
 	
 	msg := messages[msgNum-1]
 	
-	// Mark as read
-	s.msgRepo.MarkAsRead(msg.ID)
+	s.markRead(msg)
 	
 	s.sendResponse("250 Message content:")
+	s.sendResponse(fmt.Sprintf("ID: %d", msg.ID))
 	s.sendResponse(fmt.Sprintf("From: %s", msg.FromAddress))
 	s.sendResponse(fmt.Sprintf("To: %s", msg.ToAddress))
+	if msg.ReplyTo != "" {
+		s.sendResponse(fmt.Sprintf("Reply-To: %s", msg.ReplyTo))
+	}
 	s.sendResponse(fmt.Sprintf("Subject: %s", msg.Subject))
 	s.sendResponse(fmt.Sprintf("Date: %s", msg.CreatedAt.Format("2006-01-02 15:04:05")))
 	s.sendResponse("")
@@ -275,15 +525,251 @@ func (s *Session) handleRead(args string) {
 	s.sendResponse(".")
 }
 
+// markRead marks a message the user received as read, recording a read
+// receipt if the sender asked for one
+func (s *Session) markRead(msg *database.Message) {
+	if msg.ReadStatus {
+		return
+	}
+	if err := s.msgRepo.MarkAsRead(msg.ID); err != nil {
+		s.logger.Error("failed to mark message read", "message_id", msg.ID, "err", err)
+		return
+	}
+	if msg.RequestReceipt {
+		if _, err := s.msgRepo.RecordReadReceipt(msg.ID); err != nil {
+			s.logger.Error("failed to record read receipt", "message_id", msg.ID, "err", err)
+		}
+	}
+}
+
+// handleFetch shows a message the user sent or received by its ID, which
+// unlike READ numbers does not change as mail comes and goes. The body is
+// dot-stuffed, so a line holding only "." always ends the message.
+func (s *Session) handleFetch(args string) {
+	if !s.authenticated {
+		s.sendResponse("530 Not authenticated")
+		return
+	}
+	
+	id, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil || id < 1 {
+		s.sendResponse("501 Usage: FETCH <message_id>")
+		return
+	}
+	
+	msg, err := s.msgRepo.GetByIDWithAttachments(id)
+	if err != nil {
+		s.logger.Error("failed to get message", "message_id", id, "err", err)
+		s.sendResponse("550 Failed to retrieve message")
+		return
+	}
+	received := msg != nil && msg.ToUserID != nil && *msg.ToUserID == s.currentUser.ID
+	sent := msg != nil && msg.FromUserID != nil && *msg.FromUserID == s.currentUser.ID
+	if msg == nil || msg.IsDraft || (!received && !sent) {
+		s.sendResponse("550 No such message")
+		return
+	}
+	
+	if received {
+		s.markRead(msg)
+		msg.ReadStatus = true
+	}
+	
+	var flags []string
+	if msg.ReadStatus {
+		flags = append(flags, `\Seen`)
+	}
+	if msg.Flagged {
+		flags = append(flags, `\Flagged`)
+	}
+	
+	s.sendResponse(fmt.Sprintf("250 Message %d:", msg.ID))
+	s.sendResponse(fmt.Sprintf("ID: %d", msg.ID))
+	s.sendResponse(fmt.Sprintf("From: %s", msg.FromAddress))
+	s.sendResponse(fmt.Sprintf("To: %s", msg.ToAddress))
+	if msg.ReplyTo != "" {
+		s.sendResponse(fmt.Sprintf("Reply-To: %s", msg.ReplyTo))
+	}
+	s.sendResponse(fmt.Sprintf("Subject: %s", msg.Subject))
+	s.sendResponse(fmt.Sprintf("Date: %s", msg.CreatedAt.Format(time.RFC1123Z)))
+	if msg.MessageID != "" {
+		s.sendResponse(fmt.Sprintf("Message-ID: %s", msg.MessageID))
+	}
+	if msg.InReplyTo != "" {
+		s.sendResponse(fmt.Sprintf("In-Reply-To: %s", msg.InReplyTo))
+	}
+	if msg.ThreadID != nil {
+		s.sendResponse(fmt.Sprintf("Thread: %s", *msg.ThreadID))
+	}
+	s.sendResponse(fmt.Sprintf("Flags: %s", strings.Join(flags, " ")))
+	for _, a := range msg.Attachments {
+		s.sendResponse(fmt.Sprintf("Attachment: %s (%s, %d bytes)", a.OriginalName, a.ContentType, a.FileSize))
+	}
+	if msg.IsHTML {
+		s.sendResponse("Content-Type: text/html")
+	}
+	s.sendResponse("")
+	for _, line := range strings.Split(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		s.sendResponse(line)
+	}
+	s.sendResponse(".")
+}
+
+// handleSearch lists the IDs of received messages matching every given
+// criterion, newest first. Criteria follow IMAP SEARCH: ALL, SEEN, UNSEEN,
+// FLAGGED, UNFLAGGED, FROM <text>, SUBJECT <text> and TEXT <text>, with
+// double quotes around text that contains spaces.
+func (s *Session) handleSearch(args string) {
+	if !s.authenticated {
+		s.sendResponse("530 Not authenticated")
+		return
+	}
+	
+	var criteria database.SearchCriteria
+	yes, no := true, false
+	words := splitQuoted(args)
+	for i := 0; i < len(words); i++ {
+		key := strings.ToUpper(words[i])
+		switch key {
+		case "ALL":
+		case "SEEN":
+			criteria.Read = &yes
+		case "UNSEEN":
+			criteria.Read = &no
+		case "FLAGGED":
+			criteria.Flagged = &yes
+		case "UNFLAGGED":
+			criteria.Flagged = &no
+		case "FROM", "SUBJECT", "TEXT":
+			if i+1 >= len(words) || words[i+1] == "" {
+				s.sendResponse(fmt.Sprintf("501 %s needs a value", key))
+				return
+			}
+			i++
+			switch key {
+			case "FROM":
+				criteria.From = words[i]
+			case "SUBJECT":
+				criteria.Subject = words[i]
+			default:
+				criteria.Text = words[i]
+			}
+		default:
+			s.sendResponse("501 Unknown search criterion: " + words[i])
+			return
+		}
+	}
+	
+	ids, err := s.msgRepo.SearchReceivedIDs(s.currentUser.ID, criteria, maxSearchResults)
+	if err != nil {
+		s.logger.Error("failed to search messages", "err", err)
+		s.sendResponse("550 Failed to search messages")
+		return
+	}
+	
+	response := "250 SEARCH"
+	for _, id := range ids {
+		response += " " + strconv.Itoa(id)
+	}
+	s.sendResponse(response)
+}
+
+// handleStatus reports the counts of the user's received messages
+func (s *Session) handleStatus() {
+	if !s.authenticated {
+		s.sendResponse("530 Not authenticated")
+		return
+	}
+	
+	status, err := s.msgRepo.GetMailboxStatus(s.currentUser.ID)
+	if err != nil {
+		s.logger.Error("failed to get mailbox status", "err", err)
+		s.sendResponse("550 Failed to get mailbox status")
+		return
+	}
+	s.sendResponse(fmt.Sprintf("250 STATUS MESSAGES %d UNSEEN %d FLAGGED %d LATEST %d",
+		status.Messages, status.Unread, status.Flagged, status.LatestID))
+}
+
+// splitQuoted splits s into space separated words, keeping the spaces in
+// double quoted words and removing the quotes
+func splitQuoted(s string) []string {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case r == ' ' && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// capabilities lists what the session supports, one token per line. The
+// limits are the ones the session enforces, so the list always matches the
+// server's configuration.
+func (s *Session) capabilities() []string {
+	caps := []string{
+		"AUTH CONNECT",
+		"BODY-MULTILINE",
+		fmt.Sprintf("SIZE %d", s.maxBody),
+		fmt.Sprintf("LINE-LENGTH %d", s.lines.maxLen),
+		fmt.Sprintf("MAX-RECIPIENTS %d", maxRecipients),
+	}
+	if s.server != nil {
+		caps = append(caps, fmt.Sprintf("IDLE-TIMEOUT %d", int(s.server.config.TCPIdleTimeout.Seconds())))
+	}
+	if s.requireVerified {
+		caps = append(caps, "VERIFIED-SENDERS")
+	}
+	return caps
+}
+
+// handleCapabilities answers CAPABILITIES (or EHLO) with the server host
+// followed by one capability per "250-" line, with "250 " marking the last
+func (s *Session) handleCapabilities() {
+	s.sendResponse("250-" + s.serverHost)
+	caps := s.capabilities()
+	for i, capability := range caps {
+		if i < len(caps)-1 {
+			s.sendResponse("250-" + capability)
+		} else {
+			s.sendResponse("250 " + capability)
+		}
+	}
+}
+
 // handleHelp shows available commands
 func (s *Session) handleHelp() {
 	s.sendResponse("214 Available commands:")
 	s.sendResponse("  CONNECT <username> <password> - Authenticate")
-	s.sendResponse("  SEND <recipient@host> - Set recipient")
+	s.sendResponse("  SEND <recipient@host> [...] - Set one or more recipients")
 	s.sendResponse("  SUBJECT <subject> - Set message subject")
-	s.sendResponse("  BODY <body> - Set message body and send")
+	s.sendResponse("  BODY [<body>] - Set message body and send; without a body, read lines up to \".\"")
+	s.sendResponse("  RESET - Discard the message being composed (alias: ABORT)")
 	s.sendResponse("  LIST - Show inbox")
 	s.sendResponse("  READ <number> - Read specific message")
+	s.sendResponse("  FETCH <id> - Read a message by its ID")
+	s.sendResponse("  SEARCH [criteria] - List IDs of matching messages")
+	s.sendResponse("  STATUS - Show message counts")
+	s.sendResponse("  CAPABILITIES - List supported extensions and limits (alias: EHLO)")
 	s.sendResponse("  HELP - Show this help")
 	s.sendResponse("  QUIT - Close connection")
 }
@@ -296,6 +782,7 @@ func (s *Session) handleQuit() {
 
 // sendResponse sends a response to the client
 func (s *Session) sendResponse(message string) {
-	response := message + "\r\n"
-	s.conn.Write([]byte(response))
+	if err := s.server.writeReply(s.conn, message); err != nil && s.writeErr == nil {
+		s.writeErr = err
+	}
 } 
\ No newline at end of file
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"yourmail/config"
+	"yourmail/internal/database"
+)
+
+func TestSessionClosesIdleConnection(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := newTestServer(t, func(cfg *config.Config) { cfg.TCPIdleTimeout = timeout })
+	start := time.Now()
+	c := dial(t, s)
+
+	c.expect("421 Timeout")
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("connection timed out after %v, want at least %v", elapsed, timeout)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	if _, err := c.reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("read after timeout returned %v, want EOF", err)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(replyTimeout):
+		t.Fatal("session still running after the idle timeout")
+	}
+}
+
+// TestSessionRejectsLongLines sends lines over TCP_MAX_LINE_LENGTH midway
+// through composing a message, and checks each is refused on its own while
+// the login, recipient and subject already given still stand
+func TestSessionRejectsLongLines(t *testing.T) {
+	const maxLen = 64
+	s := newTestServer(t, func(cfg *config.Config) { cfg.TCPMaxLineLength = maxLen })
+	createTestUser(t, s, "alice")
+	bob := createTestUser(t, s, "bob")
+	c := dial(t, s)
+
+	c.command("CONNECT alice password123", "250 ")
+	c.command("SEND bob@localhost", "250 ")
+	c.command("SUBJECT Plans", "250 ")
+
+	// Just over the limit, and long enough to overflow the read buffer
+	for _, n := range []int{maxLen + 1, 10 * maxLen} {
+		c.command("SUBJECT "+strings.Repeat("x", n), "500 Line too long")
+	}
+	c.command("STATUS", "250 ")
+
+	c.send("BODY")
+	c.expect("354 ")
+	c.send("Lunch?")
+	c.send(".")
+	c.expect("250 ")
+
+	inbox, err := s.messageRepo.GetInboxForUser(bob.ID, database.InboxOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 1 {
+		t.Fatalf("bob has %d messages, want 1", len(inbox))
+	}
+	if got := inbox[0]; got.Subject != "Plans" || !strings.HasPrefix(got.Body, "Lunch?") {
+		t.Errorf("bob got %q: %q, want the message composed before the long lines", got.Subject, got.Body)
+	}
+}
+
+func TestCapabilitiesFollowConfig(t *testing.T) {
+	recipients := fmt.Sprintf("MAX-RECIPIENTS %d", maxRecipients)
+	tests := []struct {
+		name      string
+		configure func(cfg *config.Config)
+		want      []string
+	}{
+		{
+			name: "limits",
+			configure: func(cfg *config.Config) {
+				cfg.TCPMaxMessageBytes = 1000
+				cfg.TCPMaxLineLength = 200
+				cfg.TCPIdleTimeout = time.Minute
+			},
+			want: []string{"AUTH CONNECT", "BODY-MULTILINE", "SIZE 1000", "LINE-LENGTH 200", recipients, "IDLE-TIMEOUT 60"},
+		},
+		{
+			name: "other limits",
+			configure: func(cfg *config.Config) {
+				cfg.TCPMaxMessageBytes = 5 << 20
+				cfg.TCPMaxLineLength = 4096
+				cfg.TCPIdleTimeout = 90 * time.Second
+			},
+			want: []string{"AUTH CONNECT", "BODY-MULTILINE", "SIZE 5242880", "LINE-LENGTH 4096", recipients, "IDLE-TIMEOUT 90"},
+		},
+		{
+			name: "verified senders",
+			configure: func(cfg *config.Config) {
+				cfg.TCPMaxMessageBytes = 1000
+				cfg.TCPMaxLineLength = 200
+				cfg.TCPIdleTimeout = time.Minute
+				cfg.RequireEmailVerification = true
+			},
+			want: []string{"AUTH CONNECT", "BODY-MULTILINE", "SIZE 1000", "LINE-LENGTH 200", recipients, "IDLE-TIMEOUT 60", "VERIFIED-SENDERS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, newTestServer(t, tt.configure))
+
+			c.command("CAPABILITIES", "250-localhost")
+			var got []string
+			for {
+				line := c.expect("250")
+				got = append(got, line[4:])
+				if line[3] == ' ' {
+					break
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("capabilities = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,596 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"yourmail/config"
+	"yourmail/internal/compose"
+	"yourmail/internal/database"
+	"yourmail/internal/federation"
+	"yourmail/internal/mailparse"
+)
+
+// NewSMTPServer creates a server that accepts mail from mail clients over
+// SMTP. Mail for other servers is relayed via federation.
+func NewSMTPServer(cfg *config.Config, db *database.DB, relay *federation.Relay) *Server {
+	s := newServer(cfg, db, "SMTP", cfg.SMTPPort)
+	s.busyReply = "421 4.3.2 Too many connections, try again later"
+	s.handle = func(conn net.Conn) {
+		session := NewSMTPSession(conn, s.userRepo, s.messageRepo, s.attachRepo, s.blockRepo, s.loginRepo, relay, s.config)
+		session.server = s
+		session.Handle()
+	}
+	return s
+}
+
+// smtpRecipient is an accepted RCPT TO address
+type smtpRecipient struct {
+	address string
+	userID  *int // Set for local users
+}
+
+// SMTPSession is a client session of the SMTP listener. It takes mail
+// submitted by local users: clients must authenticate with AUTH before MAIL,
+// and may only send as the user they authenticated as.
+type SMTPSession struct {
+	conn       net.Conn
+	scanner    *bufio.Scanner
+	lines      *lineSplitter
+	logger     *slog.Logger
+	config     *config.Config
+	userRepo   *database.UserRepository
+	msgRepo    *database.MessageRepository
+	attachRepo *database.AttachmentRepository
+	blockRepo  *database.BlockRepository
+	loginRepo  *database.LoginEventRepository
+	relay      *federation.Relay
+	server     *Server // The server running the session, if any
+	writeErr   error   // Why a reply could not be sent, ending the session
+
+	greeted bool
+	user    *database.User // Set once AUTH succeeds
+
+	// The mail transaction in progress
+	from       string
+	recipients []smtpRecipient
+}
+
+// NewSMTPSession creates a new SMTP session
+func NewSMTPSession(conn net.Conn, userRepo *database.UserRepository, msgRepo *database.MessageRepository, attachRepo *database.AttachmentRepository, blockRepo *database.BlockRepository, loginRepo *database.LoginEventRepository, relay *federation.Relay, cfg *config.Config) *SMTPSession {
+	lines := &lineSplitter{maxLen: cfg.TCPMaxLineLength}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), lines.bufferSize())
+	scanner.Split(lines.split)
+
+	return &SMTPSession{
+		conn:       conn,
+		scanner:    scanner,
+		lines:      lines,
+		logger:     slog.With("client", conn.RemoteAddr().String(), "protocol", "smtp"),
+		config:     cfg,
+		userRepo:   userRepo,
+		msgRepo:    msgRepo,
+		attachRepo: attachRepo,
+		blockRepo:  blockRepo,
+		loginRepo:  loginRepo,
+		relay:      relay,
+	}
+}
+
+// Handle processes the client session
+func (s *SMTPSession) Handle() {
+	defer s.conn.Close()
+
+	s.logger.Info("SMTP connection opened")
+	s.reply("220 %s ESMTP %s ready", s.config.ServerHost, s.config.ServerName)
+
+	for s.nextLine() {
+		if s.lines.tooLong {
+			s.logger.Warn("rejected line that is too long", "max_bytes", s.lines.maxLen)
+			s.reply("500 5.5.2 Line too long")
+			continue
+		}
+
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			s.reply("500 5.5.2 Empty command")
+			continue
+		}
+
+		verb, args, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		if verb == "AUTH" {
+			// Keep credentials out of the logs
+			s.logger.Debug("SMTP command", "verb", verb)
+		} else {
+			s.logger.Debug("SMTP command", "line", line)
+		}
+
+		switch verb {
+		case "EHLO":
+			s.handleHello(args, true)
+		case "HELO":
+			s.handleHello(args, false)
+		case "AUTH":
+			s.handleAuth(args)
+		case "MAIL":
+			s.handleMail(args)
+		case "RCPT":
+			s.handleRcpt(args)
+		case "DATA":
+			s.handleData()
+		case "RSET":
+			s.resetTransaction()
+			s.reply("250 2.0.0 OK")
+		case "NOOP":
+			s.reply("250 2.0.0 OK")
+		case "VRFY":
+			s.reply("252 2.5.0 Cannot verify user, but will accept message")
+		case "HELP":
+			s.reply("214 2.0.0 Supported commands: EHLO HELO AUTH MAIL RCPT DATA RSET NOOP QUIT")
+		case "QUIT":
+			s.reply("221 2.0.0 Bye")
+			return
+		default:
+			s.reply("500 5.5.1 Command not recognized")
+		}
+	}
+
+	reason := s.server.endReason(s.scanner.Err(), s.writeErr)
+	switch reason {
+	case endIdle:
+		s.reply("421 4.4.2 %s Idle timeout, closing connection", s.config.ServerHost)
+	case endReadError:
+		s.logger.Warn("SMTP read failed", "err", s.scanner.Err())
+	}
+
+	s.logger.Info("SMTP connection closed", "reason", reason)
+}
+
+// nextLine reads the client's next line, giving it TCP_IDLE_TIMEOUT to
+// arrive when the session is run by a server
+func (s *SMTPSession) nextLine() bool {
+	if s.server != nil {
+		s.server.extendDeadline(s.conn)
+	}
+	return s.scanner.Scan()
+}
+
+// handleHello answers EHLO, listing the supported extensions, or HELO
+func (s *SMTPSession) handleHello(args string, extended bool) {
+	if strings.TrimSpace(args) == "" {
+		s.reply("501 5.5.4 Domain name required")
+		return
+	}
+
+	s.greeted = true
+	s.resetTransaction()
+	if !extended {
+		s.reply("250 %s", s.config.ServerHost)
+		return
+	}
+	s.reply("250-%s greets %s", s.config.ServerHost, args)
+	s.reply("250-SIZE %d", s.config.SMTPMaxMessageBytes)
+	s.reply("250-8BITMIME")
+	s.reply("250-ENHANCEDSTATUSCODES")
+	s.reply("250 AUTH PLAIN LOGIN")
+}
+
+// handleAuth authenticates the client with the PLAIN or LOGIN mechanism
+// against the user store. The username may be given with or without
+// "@<server host>".
+func (s *SMTPSession) handleAuth(args string) {
+	if !s.greeted {
+		s.reply("503 5.5.1 Send EHLO first")
+		return
+	}
+	if s.user != nil {
+		s.reply("503 5.5.1 Already authenticated")
+		return
+	}
+
+	mechanism, initial, _ := strings.Cut(args, " ")
+	var username, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		// The initial response may come with the command or after an
+		// empty challenge
+		var credentials string
+		var ok bool
+		if initial != "" {
+			credentials, ok = s.decodeAuth(initial)
+		} else {
+			credentials, ok = s.challenge("")
+		}
+		if !ok {
+			return
+		}
+		fields := strings.Split(credentials, "\x00")
+		if len(fields) != 3 {
+			s.reply("501 5.5.2 Malformed credentials")
+			return
+		}
+		username, password = fields[1], fields[2]
+	case "LOGIN":
+		var ok bool
+		if initial != "" {
+			username, ok = s.decodeAuth(initial)
+		} else {
+			username, ok = s.challenge("Username:")
+		}
+		if !ok {
+			return
+		}
+		if password, ok = s.challenge("Password:"); !ok {
+			return
+		}
+	default:
+		s.reply("504 5.5.4 Unrecognized authentication mechanism")
+		return
+	}
+
+	if local, domain, found := strings.Cut(username, "@"); found && strings.EqualFold(domain, s.config.ServerHost) {
+		username = local
+	}
+
+	user, err := s.userRepo.Authenticate(username, password)
+	if err == nil || errors.Is(err, database.ErrAccountDisabled) {
+		recordLogin(s.loginRepo, s.conn, database.LoginSMTP, username, user, s.logger)
+	}
+	if errors.Is(err, database.ErrAccountDisabled) {
+		s.reply("535 5.7.8 Account suspended")
+		return
+	}
+	if err != nil {
+		s.logger.Error("authentication failed", "username", username, "err", err)
+		s.reply("454 4.7.0 Temporary authentication failure")
+		return
+	}
+	if user == nil {
+		s.reply("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+
+	s.user = user
+	s.reply("235 2.7.0 Authentication successful")
+	s.logger.Info("user authenticated", "username", username)
+}
+
+// challenge sends an AUTH challenge and returns the client's decoded
+// response. It returns false, having replied, if the client cancelled or
+// the response is not valid base64.
+func (s *SMTPSession) challenge(prompt string) (string, bool) {
+	s.reply("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+	if !s.nextLine() {
+		return "", false
+	}
+	response := strings.TrimSpace(s.scanner.Text())
+	if response == "*" {
+		s.reply("501 5.0.0 Authentication cancelled")
+		return "", false
+	}
+	return s.decodeAuth(response)
+}
+
+// decodeAuth decodes a base64 AUTH response, replying with an error if it
+// is malformed
+func (s *SMTPSession) decodeAuth(encoded string) (string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		s.reply("501 5.5.2 Malformed response")
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// handleMail starts a mail transaction. The sender must be the
+// authenticated user's address.
+func (s *SMTPSession) handleMail(args string) {
+	if s.user == nil {
+		s.reply("530 5.7.0 Authentication required")
+		return
+	}
+	if s.from != "" {
+		s.reply("503 5.5.1 Sender already given")
+		return
+	}
+	if s.config.RequireEmailVerification && !s.user.EmailVerified {
+		s.reply("530 5.7.0 Verify your email address before sending mail")
+		return
+	}
+
+	from, params, ok := parseSMTPPath(args, "FROM:")
+	if !ok {
+		s.reply("501 5.5.4 Usage: MAIL FROM:<address>")
+		return
+	}
+	if !strings.EqualFold(from, s.user.Username+"@"+s.config.ServerHost) && !strings.EqualFold(from, s.user.Email) {
+		s.reply("553 5.7.1 Sender address does not belong to you")
+		return
+	}
+
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(name, "SIZE") {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > s.config.SMTPMaxMessageBytes {
+				s.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+				return
+			}
+		}
+	}
+
+	s.from = from
+	s.reply("250 2.1.0 OK")
+}
+
+// handleRcpt adds a recipient to the mail transaction. Addresses on this
+// server must name an existing user.
+func (s *SMTPSession) handleRcpt(args string) {
+	if s.from == "" {
+		s.reply("503 5.5.1 Need MAIL command first")
+		return
+	}
+
+	to, _, ok := parseSMTPPath(args, "TO:")
+	if !ok {
+		s.reply("501 5.5.4 Usage: RCPT TO:<address>")
+		return
+	}
+	to, err := compose.NormalizeAddress(to)
+	if err != nil {
+		s.reply("501 5.1.3 Bad recipient address syntax")
+		return
+	}
+	if len(s.recipients) >= maxRecipients {
+		s.reply("452 4.5.3 Too many recipients")
+		return
+	}
+
+	recipient := smtpRecipient{address: to}
+	if local, domain, _ := strings.Cut(to, "@"); strings.EqualFold(domain, s.config.ServerHost) {
+		user, err := s.userRepo.GetByUsername(local)
+		if err != nil {
+			s.logger.Error("failed to look up local user", "username", local, "err", err)
+			s.reply("451 4.3.0 Failed to look up recipient")
+			return
+		}
+		if user == nil {
+			s.reply("550 5.1.1 No such user here")
+			return
+		}
+		recipient.userID = &user.ID
+	}
+
+	s.recipients = append(s.recipients, recipient)
+	s.reply("250 2.1.5 OK")
+}
+
+// handleData reads the message, checks it against the size, attachment and
+// quota limits, and stores a copy for every recipient. The message is
+// accepted or refused as a whole.
+func (s *SMTPSession) handleData() {
+	if len(s.recipients) == 0 {
+		s.reply("503 5.5.1 Need RCPT command first")
+		return
+	}
+	defer s.resetTransaction()
+
+	s.reply("354 Start mail input; end with <CRLF>.<CRLF>")
+	raw, tooLarge, ok := s.readData()
+	if !ok {
+		return
+	}
+	if tooLarge {
+		s.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+		return
+	}
+
+	parsed, err := mailparse.Parse(raw)
+	if err != nil {
+		s.reply("554 5.6.0 %v", err)
+		return
+	}
+
+	policy := compose.AttachmentPolicy{
+		Allowed: s.config.AllowedAttachmentTypes,
+		Blocked: s.config.BlockedAttachmentTypes,
+	}
+	size := int64(len(parsed.Body))
+	for _, a := range parsed.Attachments {
+		if int64(len(a.Data)) > s.config.MaxAttachmentBytes {
+			s.reply("552 5.3.4 Attachment %s is too large (max %d bytes)", a.Filename, s.config.MaxAttachmentBytes)
+			return
+		}
+		if err := policy.Check(a.ContentType, a.Data); err != nil {
+			s.reply("554 5.7.1 Attachment %s rejected: %v", a.Filename, err)
+			return
+		}
+		size += int64(len(a.Data))
+	}
+
+	// Refuse the message if any local mailbox would go over quota
+	if s.config.MailboxQuota > 0 {
+		for _, rcpt := range s.recipients {
+			if rcpt.userID == nil {
+				continue
+			}
+			used, err := s.msgRepo.GetUserStorageUsage(*rcpt.userID)
+			if err != nil {
+				s.logger.Error("failed to get storage usage", "user_id", *rcpt.userID, "err", err)
+				s.reply("451 4.3.0 Failed to check recipient mailbox")
+				return
+			}
+			if used+size > s.config.MailboxQuota {
+				s.reply("552 5.2.2 Mailbox full: %s", rcpt.address)
+				return
+			}
+		}
+	}
+
+	fromAddress := s.user.Username + "@" + s.config.ServerHost
+	replyTo := parsed.ReplyTo
+	if replyTo == "" {
+		replyTo = s.user.ReplyTo
+	}
+	headers := database.MessageHeaders{
+		MessageID:  parsed.MessageID,
+		InReplyTo:  parsed.InReplyTo,
+		References: strings.Join(parsed.References, " "),
+	}
+
+	var threadID *string
+	var firstID int
+	for _, rcpt := range s.recipients {
+		// Only the sender's copy is kept of mail to someone who blocked them
+		toUserID := rcpt.userID
+		blocked := senderBlocked(s.blockRepo, s.logger, toUserID, fromAddress)
+		if blocked {
+			toUserID = nil
+		}
+
+		message, err := s.msgRepo.CreateSent(s.user.ID, toUserID, fromAddress, rcpt.address, replyTo, parsed.Subject, parsed.Body, parsed.IsHTML, threadID, headers)
+		if err != nil {
+			s.logger.Error("failed to store message", "to", rcpt.address, "err", err)
+			continue
+		}
+		if firstID == 0 {
+			// Every copy is the same message, so they share its Message-ID
+			firstID, threadID = message.ID, message.ThreadID
+			headers.MessageID = message.MessageID
+		}
+
+		for _, a := range parsed.Attachments {
+			filename := fmt.Sprintf("%d_%s", time.Now().Unix(), a.Filename)
+			contentType := compose.AttachmentContentType(a.ContentType, a.Data)
+			if _, err := s.attachRepo.Create(message.ID, filename, a.Filename, contentType, a.ContentID, int64(len(a.Data)), nil, a.Data); err != nil {
+				s.logger.Error("failed to store attachment", "message_id", message.ID, "file", a.Filename, "err", err)
+			}
+		}
+
+		if blocked {
+			// Reported like any local delivery
+			if err := s.msgRepo.SetDeliveryStatus(message.ID, database.DeliveryLocal, ""); err != nil {
+				s.logger.Error("failed to record delivery status", "message_id", message.ID, "err", err)
+			}
+			continue
+		}
+		s.deliver(message)
+	}
+
+	if firstID == 0 {
+		s.reply("451 4.3.0 Failed to store message")
+		return
+	}
+	s.reply("250 2.0.0 Message accepted (ID: %d)", firstID)
+}
+
+// readData reads message lines up to the terminating ".", undoing dot
+// stuffing and storing lines with LF endings like the other ways mail comes
+// in. Messages over the size limit are read to the end but not kept.
+// It returns false if the connection ended first.
+func (s *SMTPSession) readData() (data []byte, tooLarge, ok bool) {
+	var buf bytes.Buffer
+	for s.nextLine() {
+		if s.lines.tooLong {
+			tooLarge = true
+			continue
+		}
+		line := s.scanner.Text()
+		if line == "." {
+			return buf.Bytes(), tooLarge, true
+		}
+		line = strings.TrimPrefix(line, ".")
+
+		if int64(buf.Len()+len(line)+2) > s.config.SMTPMaxMessageBytes {
+			tooLarge = true
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return nil, false, false
+}
+
+// deliver records the delivery of a stored copy: local recipients have it
+// already, and copies for other servers are relayed via federation
+func (s *SMTPSession) deliver(message *database.Message) {
+	if message.ToUserID != nil {
+		if err := s.msgRepo.SetDeliveryStatus(message.ID, database.DeliveryLocal, ""); err != nil {
+			s.logger.Error("failed to record delivery status", "message_id", message.ID, "err", err)
+		}
+		if s.config.MaxInboxMessages > 0 {
+			if _, err := s.msgRepo.EnforceInboxLimit(*message.ToUserID, s.config.MaxInboxMessages); err != nil {
+				s.logger.Error("failed to enforce inbox limit", "user_id", *message.ToUserID, "err", err)
+			}
+		}
+		s.logger.Info("message sent", "id", message.ID, "from", message.FromAddress, "to", message.ToAddress)
+		return
+	}
+
+	_, host, _ := strings.Cut(message.ToAddress, "@")
+	status, deliveryError := database.DeliveryDelivered, ""
+	err := s.relay.Deliver(federation.Message{
+		From:       message.FromAddress,
+		To:         message.ToAddress,
+		ReplyTo:    message.ReplyTo,
+		Subject:    message.Subject,
+		Body:       message.Body,
+		MessageID:  message.MessageID,
+		InReplyTo:  message.InReplyTo,
+		References: strings.Fields(message.References),
+	}, host)
+	if errors.Is(err, federation.ErrPeerUnreachable) {
+		// Sent by the HTTP server once the peer is back
+		s.logger.Info("federation deferred", "id", message.ID, "host", host)
+		status, deliveryError = database.DeliveryPending, err.Error()
+	} else if err != nil {
+		s.logger.Warn("federation failed", "id", message.ID, "host", host, "err", err)
+		status, deliveryError = database.DeliveryFailed, err.Error()
+	} else {
+		s.logger.Info("message relayed", "id", message.ID, "host", host)
+	}
+	if err := s.msgRepo.SetDeliveryStatus(message.ID, status, deliveryError); err != nil {
+		s.logger.Error("failed to record delivery status", "message_id", message.ID, "err", err)
+	}
+}
+
+// resetTransaction abandons the mail transaction in progress
+func (s *SMTPSession) resetTransaction() {
+	s.from = ""
+	s.recipients = nil
+}
+
+// reply sends a formatted response line to the client
+func (s *SMTPSession) reply(format string, args ...interface{}) {
+	if err := s.server.writeReply(s.conn, fmt.Sprintf(format, args...)); err != nil && s.writeErr == nil {
+		s.writeErr = err
+	}
+}
+
+// parseSMTPPath parses the argument of MAIL or RCPT, such as
+// "FROM:<alice@example.com> SIZE=1024", into the address and any
+// parameters after it. The keyword is matched case-insensitively.
+func parseSMTPPath(args, keyword string) (address string, params []string, ok bool) {
+	if len(args) < len(keyword) || !strings.EqualFold(args[:len(keyword)], keyword) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(args[len(keyword):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 2 {
+		// Missing or empty path
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
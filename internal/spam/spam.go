@@ -0,0 +1,87 @@
+// Package spam scores incoming mail so likely spam can be kept out of the
+// inbox. Scoring is pluggable through the Scorer interface; Heuristic is a
+// simple rule-based scorer that needs no training data.
+package spam
+
+import (
+	"regexp"
+	"unicode"
+)
+
+// Message is what a Scorer sees of a message and its recipient's history
+// with the sender
+type Message struct {
+	From     string
+	Subject  string
+	Body     string
+	IsHTML   bool
+	External bool // Arrived from another server
+
+	// KnownSender is set when the recipient has written to the sender or
+	// saved them as a contact
+	KnownSender bool
+	// NotSpamMarks counts the sender's messages the recipient has marked as
+	// not spam
+	NotSpamMarks int
+}
+
+// Scorer scores messages. Higher scores are more likely spam; messages
+// scoring above the configured threshold are quarantined.
+type Scorer interface {
+	Score(msg Message) int
+}
+
+// Points added by Heuristic for each sign of spam
+const (
+	ShoutingPoints = 2 // Subject in capitals
+	LinksPoints    = 2 // More than MaxLinks links
+	ExternalPoints = 1 // Sent from another server
+	UnknownPoints  = 2 // Sender the recipient never wrote to
+
+	// Each time the recipient rescued the sender's mail from the Spam
+	// folder, the sender's mail scores this much lower
+	NotSpamPoints = 3
+
+	// MaxLinks is the number of links a message may have without scoring
+	MaxLinks = 3
+)
+
+// linkPattern matches the start of a URL in a text or HTML body
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)`)
+
+// Heuristic scores messages by a few simple signs of spam: a subject in
+// capitals, many links, and an unfamiliar or external sender.
+type Heuristic struct{}
+
+// Score implements Scorer
+func (Heuristic) Score(msg Message) int {
+	score := 0
+	if shouting(msg.Subject) {
+		score += ShoutingPoints
+	}
+	if len(linkPattern.FindAllStringIndex(msg.Body, -1)) > MaxLinks {
+		score += LinksPoints
+	}
+	if msg.External {
+		score += ExternalPoints
+	}
+	if !msg.KnownSender {
+		score += UnknownPoints
+	}
+	return score - msg.NotSpamMarks*NotSpamPoints
+}
+
+// shouting reports whether a subject has a few letters and all of them are
+// capitals
+func shouting(subject string) bool {
+	letters := 0
+	for _, r := range subject {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsUpper(r) {
+			letters++
+		}
+	}
+	return letters >= 4
+}
@@ -0,0 +1,193 @@
+// Package sysmail renders the messages the server sends on its own behalf,
+// such as welcome mail and bounces. Each kind of message has a built-in
+// template that operators can override with a file, so the wording can be
+// changed without recompiling.
+//
+// Templates use text/template but only ever see a Data value, so an
+// operator-supplied template can reference the fields listed there and
+// nothing else.
+package sysmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Kind identifies a kind of system message
+type Kind string
+
+const (
+	Welcome       Kind = "welcome"
+	Bounce        Kind = "bounce"
+	Vacation      Kind = "vacation"
+	PasswordReset Kind = "reset"
+)
+
+// Kinds lists every kind of system message
+var Kinds = []Kind{Welcome, Bounce, Vacation, PasswordReset}
+
+// Data is the complete set of values available to system mail templates.
+// Not every field is set for every kind.
+type Data struct {
+	ServerName string // Display name of this server
+	ServerHost string // Mail domain of this server
+	Username   string // The user the message is addressed to
+	Address    string // The user's mail address
+	Recipient  string // The address a bounced message was sent to
+	Subject    string // Subject of the message being bounced or answered
+	Reason     string // Why a message bounced
+	Link       string // Action link, e.g. for a password reset
+}
+
+// Message is a rendered system message
+type Message struct {
+	Subject string
+	Body    string
+}
+
+// defaults holds the built-in template for each kind. The first line is the
+// subject; the body follows after a blank line.
+var defaults = map[Kind]string{
+	Welcome: `Subject: Welcome to {{.ServerName}}, {{.Username}}!
+
+Hi {{.Username}},
+
+Your new mailbox {{.Address}} is ready to use.
+
+-- The {{.ServerName}} team
+`,
+	Bounce: `Subject: Undeliverable: {{.Subject}}
+
+Your message to {{.Recipient}} could not be delivered.
+
+Reason: {{.Reason}}
+
+-- The {{.ServerName}} mail system
+`,
+	Vacation: `Subject: Auto-reply: {{.Subject}}
+
+{{.Username}} is away and will read your message on their return.
+`,
+	PasswordReset: `Subject: Reset your {{.ServerName}} password
+
+Hi {{.Username}},
+
+Follow this link to choose a new password:
+
+{{.Link}}
+
+If you did not ask for a password reset you can ignore this message.
+`,
+}
+
+// mailTemplate is a parsed subject and body template
+type mailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Renderer renders system messages from their templates
+type Renderer struct {
+	templates map[Kind]*mailTemplate
+}
+
+// NewRenderer creates a renderer using the built-in templates, overridden by
+// any "<kind>.tmpl" files found in dir. An empty dir uses only the built-in
+// templates. Override files that cannot be read or parsed are reported in
+// the returned error; the renderer is still usable and falls back to the
+// built-in template for those kinds.
+func NewRenderer(dir string) (*Renderer, error) {
+	r := &Renderer{templates: make(map[Kind]*mailTemplate)}
+	var errs []error
+
+	for _, kind := range Kinds {
+		tmpl, err := parse(kind, defaults[kind])
+		if err != nil {
+			// The built-in templates are fixed, so this is a programming error
+			panic(fmt.Sprintf("sysmail: invalid built-in %s template: %v", kind, err))
+		}
+		r.templates[kind] = tmpl
+
+		if dir == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, string(kind)+".tmpl")
+		text, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("failed to read %s: %w", path, err))
+			}
+			continue
+		}
+
+		override, err := parse(kind, string(text))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid template %s: %w", path, err))
+			continue
+		}
+		r.templates[kind] = override
+	}
+
+	return r, errors.Join(errs...)
+}
+
+// Render renders a system message of the given kind
+func (r *Renderer) Render(kind Kind, data Data) (*Message, error) {
+	tmpl, ok := r.templates[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown system mail kind: %s", kind)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s subject: %w", kind, err)
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s body: %w", kind, err)
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+	}, nil
+}
+
+// parse splits template text into its subject line and body and parses both.
+// The template is executed once against empty Data so references to fields
+// that do not exist are rejected up front rather than when mail is sent.
+func parse(kind Kind, text string) (*mailTemplate, error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	header, body, found := strings.Cut(text, "\n")
+	subject, ok := strings.CutPrefix(header, "Subject:")
+	if !ok {
+		return nil, errors.New(`first line must be "Subject: ..."`)
+	}
+	if found {
+		body = strings.TrimPrefix(body, "\n")
+	}
+
+	tmpl := &mailTemplate{}
+	var err error
+	if tmpl.subject, err = template.New(string(kind) + " subject").Parse(subject); err != nil {
+		return nil, err
+	}
+	if tmpl.body, err = template.New(string(kind) + " body").Parse(body); err != nil {
+		return nil, err
+	}
+
+	var discard bytes.Buffer
+	if err := tmpl.subject.Execute(&discard, Data{}); err != nil {
+		return nil, err
+	}
+	if err := tmpl.body.Execute(&discard, Data{}); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
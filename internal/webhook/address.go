@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned for a webhook URL whose host is, or
+// resolves to, an address on this server or its private network
+var ErrBlockedAddress = errors.New("webhook URLs may not point at local or private addresses")
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice
+// though net.IP.IsPrivate doesn't include it
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// blockedIP reports whether ip is one webhooks may not reach: loopback,
+// private, link-local (which includes cloud metadata services), unspecified
+// or multicast
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// CheckURL resolves the host of a webhook URL and returns ErrBlockedAddress
+// if any of its addresses may not be reached. Deliveries check again when
+// they connect, since the host's DNS records may change meanwhile.
+func (d *Dispatcher) CheckURL(ctx context.Context, rawURL string) error {
+	if d.opts.AllowPrivateAddresses {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", u.Hostname(), err)
+	}
+	for _, ip := range ips {
+		if blockedIP(ip.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrBlockedAddress, u.Hostname(), ip.IP)
+		}
+	}
+	return nil
+}
+
+// refuseBlocked is a net.Dialer Control function that refuses connections
+// to blocked addresses. It runs after DNS resolution, on the address
+// actually dialled, so a host that resolves differently at delivery time
+// than it did at registration can't get around CheckURL.
+func refuseBlocked(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || blockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+// newClient returns the HTTP client deliveries are made with. Unless
+// private addresses are allowed it connects only to public addresses,
+// including when following redirects, and ignores proxy settings, which
+// would hide the address being reached.
+func newClient(opts Options) *http.Client {
+	if opts.AllowPrivateAddresses {
+		return &http.Client{Timeout: opts.Timeout}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   refuseBlocked,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: opts.Timeout, Transport: transport}
+}
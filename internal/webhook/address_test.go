@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"224.0.0.1", true},
+		{"93.184.216.34", false},
+		{"8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := blockedIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("blockedIP(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	d := NewDispatcher(nil, Options{Timeout: time.Second})
+	defer d.Close()
+
+	for _, u := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest/meta-data", "https://10.0.0.5/hook", "http://[::1]/hook", "http://localhost/hook"} {
+		if err := d.CheckURL(context.Background(), u); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("CheckURL(%s) = %v, want ErrBlockedAddress", u, err)
+		}
+	}
+	if err := d.CheckURL(context.Background(), "https://93.184.216.34/hook"); err != nil {
+		t.Errorf("CheckURL of a public address = %v, want nil", err)
+	}
+
+	allowed := NewDispatcher(nil, Options{Timeout: time.Second, AllowPrivateAddresses: true})
+	defer allowed.Close()
+	if err := allowed.CheckURL(context.Background(), "http://127.0.0.1/hook"); err != nil {
+		t.Errorf("CheckURL with private addresses allowed = %v, want nil", err)
+	}
+}
+
+// TestClientRefusesBlockedAddresses checks the dial-time guard, which
+// catches a host that passed CheckURL but resolves to a private address
+// when the delivery is made
+func TestClientRefusesBlockedAddresses(t *testing.T) {
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	_, err := newClient(Options{Timeout: time.Second}).Post(srv.URL, "application/json", nil)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("delivery to %s = %v, want ErrBlockedAddress", srv.URL, err)
+	}
+	if reached {
+		t.Fatal("the blocked server was reached")
+	}
+
+	resp, err := newClient(Options{Timeout: time.Second, AllowPrivateAddresses: true}).Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("delivery with private addresses allowed = %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,208 @@
+// Package webhook delivers mailbox events to URLs registered by users.
+//
+// Each delivery is a JSON POST signed with the webhook's secret: the
+// X-YourMail-Signature header holds "sha256=" followed by the hex HMAC-SHA256
+// of the request body, so receivers can check that it came from this server.
+// Failed deliveries are retried with exponential backoff, and a webhook is
+// disabled after too many deliveries in a row have failed.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"yourmail/internal/database"
+)
+
+// Events a webhook can subscribe to
+const (
+	EventMessageReceived = "message.received"
+)
+
+// Events lists every event a webhook can subscribe to
+var Events = []string{EventMessageReceived}
+
+// Headers set on every delivery
+const (
+	SignatureHeader = "X-YourMail-Signature"
+	EventHeader     = "X-YourMail-Event"
+	DeliveryHeader  = "X-YourMail-Delivery"
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Options configures a Dispatcher
+type Options struct {
+	MaxAttempts  int           // Attempts per delivery, including the first
+	Timeout      time.Duration // Timeout of each attempt
+	FailureLimit int           // Failed deliveries in a row before a webhook is disabled
+
+	// AllowPrivateAddresses lets webhooks reach loopback and private
+	// addresses, for development against a local receiver
+	AllowPrivateAddresses bool
+}
+
+// Dispatcher sends events to the webhooks subscribed to them
+type Dispatcher struct {
+	repo    *database.WebhookRepository
+	client  *http.Client
+	opts    Options
+	backoff time.Duration // Wait before the first retry; doubles each retry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher storing delivery outcomes in repo
+func NewDispatcher(repo *database.WebhookRepository, opts Options) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		repo:    repo,
+		client:  newClient(opts),
+		opts:    opts,
+		backoff: time.Second,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Dispatch sends an event to each of the user's active webhooks subscribed
+// to it. Deliveries run in the background; Dispatch does not wait for them.
+func (d *Dispatcher) Dispatch(userID int, event string, data interface{}) {
+	webhooks, err := d.repo.ListActiveForEvent(userID, event)
+	if err != nil {
+		slog.Error("failed to list webhooks", "user_id", userID, "err", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(Payload{Event: event, Timestamp: time.Now().UTC(), Data: data})
+	if err != nil {
+		slog.Error("failed to marshal webhook payload", "event", event, "err", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		d.wg.Add(1)
+		go func(webhook *database.Webhook) {
+			defer d.wg.Done()
+			d.deliver(webhook, event, body)
+		}(webhook)
+	}
+}
+
+// Close abandons pending retries and waits for running attempts to finish
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// deliver posts body to a webhook, retrying with backoff, and records the
+// outcome
+func (d *Dispatcher) deliver(webhook *database.Webhook, event string, body []byte) {
+	deliveryID := newDeliveryID()
+	signature := Sign(webhook.Secret, body)
+	logger := slog.With("webhook_id", webhook.ID, "event", event, "delivery", deliveryID)
+
+	var err error
+	wait := d.backoff
+	for attempt := 1; attempt <= d.opts.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(wait):
+				wait *= 2
+			case <-d.ctx.Done():
+				logger.Info("webhook delivery abandoned on shutdown")
+				return
+			}
+		}
+
+		if err = d.post(webhook.URL, event, deliveryID, signature, body); err == nil {
+			logger.Debug("webhook delivered", "attempt", attempt)
+			if webhook.FailureCount > 0 {
+				if err := d.repo.RecordSuccess(webhook.ID); err != nil {
+					logger.Error("failed to record webhook success", "err", err)
+				}
+			}
+			return
+		}
+		logger.Warn("webhook delivery failed", "attempt", attempt, "err", err)
+	}
+
+	disabled, recordErr := d.repo.RecordFailure(webhook.ID, err.Error(), d.opts.FailureLimit)
+	if recordErr != nil {
+		logger.Error("failed to record webhook failure", "err", recordErr)
+		return
+	}
+	if disabled {
+		logger.Warn("webhook disabled after repeated failures", "url", webhook.URL)
+	}
+}
+
+// post makes a single delivery attempt. Any 2xx response counts as success.
+func (d *Dispatcher) post(url, event, deliveryID, signature string, body []byte) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "YourMail-Webhook")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of body keyed with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random secret for signing deliveries
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newDeliveryID returns a random ID identifying one delivery across retries
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -75,7 +75,7 @@ setup_backend() {
     print_success "Go dependencies installed"
     
     # Build the server
-    go build -o yourmail cmd/server/main.go
+    go build -tags sqlite_fts5 -o yourmail cmd/server/main.go
     print_success "Server binary built successfully"
 }
 